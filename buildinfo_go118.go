@@ -0,0 +1,24 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import "runtime/debug"
+
+// vcsInfo returns the version control information stamped into the
+// binary by the go command (Go 1.18 and later): the revision it was
+// built from, the revision's time, and whether the working tree had
+// uncommitted changes.
+func vcsInfo(bi *debug.BuildInfo) (revision, time string, modified bool) {
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.time":
+			time = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	return revision, time, modified
+}
@@ -0,0 +1,12 @@
+//go:build !go1.18
+// +build !go1.18
+
+package main
+
+import "runtime/debug"
+
+// vcsInfo returns nothing: before Go 1.18, the go command didn't stamp
+// version control information into binaries.
+func vcsInfo(bi *debug.BuildInfo) (revision, time string, modified bool) {
+	return "", "", false
+}
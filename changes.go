@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+var (
+	changedVCS = flag.String("changed", "", "only fix returns on lines changed in the working tree, according to `vcs` (git or hg)")
+	diffFile   = flag.String("diff-file", "", "only fix returns on lines added or changed by the unified diff in `file`")
+	diffBase   = flag.String("diff-base", "", "only fix returns in files changed since git `ref` (since the current branch forked from it), on the lines changed, in the working tree")
+)
+
+// A changeSource reports which lines of which files have changed, so
+// that fixes can be limited to them.
+type changeSource interface {
+	// Changes returns the changed line ranges in the new version of
+	// each changed file, keyed by absolute file path.
+	Changes() (map[string][]returns.LineRange, error)
+}
+
+// newChangeSource returns the change source selected by the -changed,
+// -diff-file, and -diff-base flags, or nil if none is set.
+func newChangeSource() (changeSource, error) {
+	n := 0
+	for _, f := range []string{*changedVCS, *diffFile, *diffBase} {
+		if f != "" {
+			n++
+		}
+	}
+	switch {
+	case n > 1:
+		return nil, fmt.Errorf("-changed, -diff-file, and -diff-base are mutually exclusive")
+	case *diffFile != "":
+		return diffFileChanges(*diffFile), nil
+	case *diffBase != "":
+		return gitBaseChanges(*diffBase), nil
+	}
+	switch *changedVCS {
+	case "":
+		return nil, nil
+	case "git":
+		return gitChanges{}, nil
+	case "hg":
+		return hgChanges{}, nil
+	}
+	return nil, fmt.Errorf("unsupported -changed VCS %q (must be git or hg)", *changedVCS)
+}
+
+// gitChanges reports the working tree's changes relative to HEAD.
+type gitChanges struct{}
+
+func (gitChanges) Changes() (map[string][]returns.LineRange, error) {
+	root, err := command("git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	diff, err := command("git", "diff", "--no-color", "--no-ext-diff", "-U0", "HEAD", "--")
+	if err != nil {
+		return nil, err
+	}
+	return parseUnifiedDiff(diff, strings.TrimSpace(string(root)))
+}
+
+// gitBaseChanges reports the working tree's changes relative to the
+// commit at which the current branch forked from a ref (such as
+// origin/main), so that a branch is checked for the changes it makes
+// and not for those made since on the ref.
+type gitBaseChanges string
+
+func (ref gitBaseChanges) Changes() (map[string][]returns.LineRange, error) {
+	root, err := command("git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	base, err := command("git", "merge-base", string(ref), "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	diff, err := command("git", "diff", "--no-color", "--no-ext-diff", "-U0", strings.TrimSpace(string(base)), "--")
+	if err != nil {
+		return nil, err
+	}
+	return parseUnifiedDiff(diff, strings.TrimSpace(string(root)))
+}
+
+// hgChanges reports the working directory's changes relative to its
+// parent revision.
+type hgChanges struct{}
+
+func (hgChanges) Changes() (map[string][]returns.LineRange, error) {
+	root, err := command("hg", "root")
+	if err != nil {
+		return nil, err
+	}
+	diff, err := command("hg", "diff", "--git", "--unified", "0")
+	if err != nil {
+		return nil, err
+	}
+	return parseUnifiedDiff(diff, strings.TrimSpace(string(root)))
+}
+
+// diffFileChanges reads the changes from a unified diff file, such as
+// one produced by a patch-based review system. Paths in the diff are
+// relative to the current directory.
+type diffFileChanges string
+
+func (name diffFileChanges) Changes() (map[string][]returns.LineRange, error) {
+	diff, err := ioutil.ReadFile(string(name))
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		return nil, err
+	}
+	return parseUnifiedDiff(diff, dir)
+}
+
+// changedLines holds the changed lines of each changed file (keyed by
+// absolute path) when -changed or -diff-file is set, and nil otherwise.
+var changedLines map[string][]returns.LineRange
+
+// changedGoFiles returns the sorted names of the changed Go files.
+func changedGoFiles() []string {
+	var files []string
+	for name := range changedLines {
+		if strings.HasSuffix(name, ".go") {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// changedLinesOf returns the changed lines of filename and whether the
+// file changed at all.
+func changedLinesOf(filename string) ([]returns.LineRange, bool) {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	lines, ok := changedLines[filename]
+	return lines, ok
+}
+
+// mapLineRanges returns the ranges of lines of b, the result of changing
+// a (as goimports does), that correspond to lines, ranges of lines of
+// a. A range that starts or ends in lines that were replaced starts or
+// ends with their replacement.
+func mapLineRanges(a, b []byte, lines []returns.LineRange) []returns.LineRange {
+	type lineEdit struct{ start, end, n int } // lines [start, end) of a replaced by n lines
+	var edits []lineEdit
+	for _, e := range returns.LineEdits(a, b) {
+		start := bytes.Count(a[:e.Start], []byte("\n")) + 1
+		edits = append(edits, lineEdit{start, start + bytes.Count(a[e.Start:e.End], []byte("\n")), strings.Count(e.New, "\n")})
+	}
+	mapLine := func(line int, end bool) int {
+		shift := 0
+		for _, e := range edits {
+			switch {
+			case line < e.start:
+				return line + shift
+			case line >= e.end:
+				shift += e.n - (e.end - e.start)
+			case end && e.n > 0:
+				return e.start + shift + e.n - 1
+			default:
+				return e.start + shift
+			}
+		}
+		return line + shift
+	}
+	mapped := make([]returns.LineRange, len(lines))
+	for i, r := range lines {
+		mapped[i] = returns.LineRange{Start: mapLine(r.Start, false), End: mapLine(r.End, true)}
+	}
+	return mapped
+}
+
+func command(name string, args ...string) ([]byte, error) {
+	return commandInput(nil, name, args...)
+}
+
+// commandInput is like command, with stdin as the command's standard
+// input.
+func commandInput(stdin []byte, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// parseUnifiedDiff returns the line ranges added or changed in each new
+// file of a unified diff, keyed by absolute path (relative paths in the
+// diff are resolved against dir). The "a/" and "b/" prefixes written by
+// git are removed. Deleted files are omitted, and pure deletions mark
+// the line following them as changed.
+func parseUnifiedDiff(diff []byte, dir string) (map[string][]returns.LineRange, error) {
+	changes := map[string][]returns.LineRange{}
+	var file string // current file, or "" if deleted
+	s := bufio.NewScanner(bytes.NewReader(diff))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			name := strings.TrimPrefix(line, "+++ ")
+			if i := strings.IndexByte(name, '\t'); i >= 0 {
+				name = name[:i] // strip timestamp
+			}
+			if name == "/dev/null" {
+				file = ""
+				continue
+			}
+			name = strings.TrimPrefix(name, "b/")
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, filepath.FromSlash(name))
+			}
+			file = name
+			if _, ok := changes[file]; !ok {
+				changes[file] = []returns.LineRange{}
+			}
+		case strings.HasPrefix(line, "@@ ") && file != "":
+			// @@ -l,s +l,s @@
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("malformed hunk header %q", line)
+			}
+			start, count, err := parseHunkRange(fields[2][1:])
+			if err != nil {
+				return nil, fmt.Errorf("malformed hunk header %q: %s", line, err)
+			}
+			if count == 0 {
+				// Pure deletion after line start.
+				start, count = start+1, 1
+			}
+			changes[file] = append(changes[file], returns.LineRange{Start: start, End: start + count - 1})
+		}
+	}
+	return changes, s.Err()
+}
+
+// parseHunkRange parses "l,s" or "l" from a hunk header.
+func parseHunkRange(r string) (start, count int, err error) {
+	count = 1
+	if i := strings.IndexByte(r, ','); i >= 0 {
+		if count, err = strconv.Atoi(r[i+1:]); err != nil {
+			return 0, 0, err
+		}
+		r = r[:i]
+	}
+	start, err = strconv.Atoi(r)
+	return start, count, err
+}
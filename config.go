@@ -0,0 +1,1024 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+// configNames are the names of goreturns's config files, in order of
+// preference. A config file holds a JSON object whose keys are flag
+// names and whose values are the flags' defaults, such as
+//
+//	{"local": "github.com/myorg/", "fix": "+bare", "erronly": true}
+//
+// or the same in TOML (local = "github.com/myorg/") or YAML (local:
+// github.com/myorg/), of which only key-value pairs of strings,
+// booleans, numbers, and arrays of strings, and one level of tables,
+// are supported (see parseTOML and parseYAML, and the README for the
+// exact subsets). Flags may also be set in a "flags" table, and by the
+// names of flagAliases, but only those of configurable. Flags given on
+// the command line override them.
+var configNames = []string{".goreturns.json", ".goreturns.toml", "goreturns.toml", ".goreturns.yaml", ".goreturns.yml"}
+
+var (
+	configFile = flag.String("config", "", "read the defaults of flags from `file` (JSON, TOML, or YAML, by its extension) instead of from the project's or home directory's config files; \"off\" reads no config file")
+	noConfig   = flag.Bool("no-config", false, "read no config files and no GORETURNS_* environment variables, so that only the flags given apply (for hermetic builds)")
+	showConfig = flag.String("show-config", "", "print the config files that apply to the file or directory at `path` and the flags in effect there, instead of processing files")
+)
+
+var (
+	runConfig  string          // the config file that set the flags, if any
+	overridden map[string]bool // the flags set on the command line or by the environment, which config files don't change
+
+	dirOptionsMu    sync.Mutex
+	dirOptionsCache map[string]dirOptionsResult // by absolute directory
+)
+
+type dirOptionsResult struct {
+	opt   *returns.Options
+	err   error
+	stamp string // of the config files of the directory, for reloadConfig
+}
+
+// applyConfig sets the flags, which have been parsed from args, from
+// the config file of the project being processed and then from the
+// environment (see setEnvFlags), and then parses args again so that
+// they take precedence. The project's config file is the outermost one
+// found in the directory of the first path argument (or of
+// -stdin-filename, -show-config, or the current directory) or its
+// parents, up to the root of its module; if there is none, the user's
+// config file (see userConfig) is used, if it exists. Config files
+// below the project's override it for their directories (see
+// dirOptions). -config (or $GORETURNS_CONFIG) names the config file
+// explicitly, and then no others are read. -no-config (or
+// $GORETURNS_NO_CONFIG) reads neither config files nor the environment.
+func applyConfig(args []string) error {
+	overridden = commandLineFlags(args)
+	if v, ok := os.LookupEnv(envName("no-config")); ok && !overridden["no-config"] {
+		if err := setFlag("no-config", v); err != nil {
+			return fmt.Errorf("$%s: %s", envName("no-config"), err)
+		}
+	}
+	if *noConfig {
+		if overridden["config"] {
+			return errors.New("-no-config can't be combined with -config")
+		}
+		*configFile = "off"
+	}
+	if *configFile == "" {
+		*configFile = os.Getenv(envName("config"))
+	}
+	configArgs, configStamp = args, stampConfigs(runConfigFiles())
+	runConfig = ""
+	configExclude.dir, configExclude.globs = "", nil
+	dirOptionsMu.Lock()
+	dirOptionsCache = nil
+	dirOptionsMu.Unlock()
+
+	switch *configFile {
+	case "off":
+	case "":
+		if names := configFiles(absPath(configDir())); len(names) > 0 {
+			runConfig = names[0]
+		} else {
+			runConfig = userConfig()
+		}
+	default:
+		switch filepath.Ext(*configFile) {
+		case ".json", ".toml", ".yaml", ".yml":
+		default:
+			return fmt.Errorf("-config: %s isn't a .json, .toml, .yaml, or .yml file", *configFile)
+		}
+		runConfig = *configFile
+	}
+	if runConfig != "" {
+		values, err := readConfig(runConfig)
+		if err != nil {
+			return err
+		}
+		if v, ok := values["exclude"]; ok {
+			// Not the -exclude flag, whose globs are relative to the
+			// directories walked, but added to it.
+			if err := setConfigExclude(runConfig, v); err != nil {
+				return err
+			}
+			delete(values, "exclude")
+		}
+		if err := setFlags(runConfig, values); err != nil {
+			return err
+		}
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "goreturns: using config file %s\n", runConfig)
+		}
+	}
+	if !*noConfig {
+		if err := setEnvFlags(); err != nil {
+			return err
+		}
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	for _, name := range modeFlags {
+		if overridden[name] {
+			dropConfigModes()
+			break
+		}
+	}
+	return nil
+}
+
+// dropConfigModes resets the mode flags (see modeFlags) that weren't
+// set on the command line or by the environment.
+func dropConfigModes() {
+	for _, name := range modeFlags {
+		if !overridden[name] {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+		}
+	}
+}
+
+// readConfig reads the config file name.
+func readConfig(name string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	switch filepath.Ext(name) {
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err = d.Decode(&values); err == nil && d.More() {
+			err = fmt.Errorf("unexpected data after the object")
+		}
+	case ".toml":
+		values, err = parseTOML(data)
+	default:
+		values, err = parseYAML(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	// The flags section holds flags too, apart from the others.
+	if section, ok := values["flags"]; ok {
+		flags, ok := section.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: flags is a table of flag names and values", name)
+		}
+		delete(values, "flags")
+		for flagName, v := range flags {
+			if _, ok := values[flagName]; ok {
+				return nil, fmt.Errorf("%s: %s is set both in flags and outside it", name, flagName)
+			}
+			values[flagName] = v
+		}
+	}
+	for alias, flagName := range flagAliases {
+		if v, ok := values[alias]; ok {
+			if _, ok := values[flagName]; ok {
+				return nil, fmt.Errorf("%s: both %s and %s are set", name, alias, flagName)
+			}
+			values[flagName] = v
+			delete(values, alias)
+		}
+	}
+	return values, nil
+}
+
+// flagAliases are the longer names by which config files may also set
+// the flags whose names are single letters.
+var flagAliases = map[string]string{
+	"write":               "w",
+	"diff":                "d",
+	"list":                "l",
+	"remove-bare-returns": "b",
+	"all-errors":          "e",
+	"goimports":           "i",
+	"print-errors":        "p",
+	"simplify":            "s",
+}
+
+// modeFlags are the flags that choose what's done with the results. If
+// the command line (or the environment) sets any of them, those set by
+// the config file are dropped, so that, say, "write: true" in a config
+// file doesn't keep -check or -d from being used. They're dropped for
+// standard input too, which editors pipe through goreturns.
+var modeFlags = []string{"l", "w", "d", "n", "check", "lint", "interactive", "output"}
+
+// commandLineFlags returns the names of the flags set in args.
+// flag.Visit can't tell them from the flags set by config files, or in
+// the daemon, by earlier requests.
+func commandLineFlags(args []string) map[string]bool {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	flag.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		fs.Var(ignoredValue(ok && b.IsBoolFlag()), f.Name, "")
+	})
+	fs.Parse(args)
+	names := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { names[f.Name] = true })
+	return names
+}
+
+// An ignoredValue is a flag.Value that ignores what it's set to, and is
+// a boolean flag if it's true.
+type ignoredValue bool
+
+func (ignoredValue) String() string     { return "" }
+func (ignoredValue) Set(string) error   { return nil }
+func (v ignoredValue) IsBoolFlag() bool { return bool(v) }
+
+// dirOptions returns the options for the files in dir: options,
+// overridden by the config files of dir and its parents below the
+// project's config file (see applyConfig), outermost first. They may
+// set only the flags of bindOptionFlags, -fix, -errlast, and -ctxerr,
+// and not those set on the command line or by the environment; -fix's
+// +name/-name are relative to the fixers of the parent directories.
+func dirOptions(dir string) (*returns.Options, error) {
+	if *configFile != "" {
+		return options, nil // -config names the only config file
+	}
+	dir = absPath(dir)
+	dirOptionsMu.Lock()
+	defer dirOptionsMu.Unlock()
+	if r, ok := dirOptionsCache[dir]; ok {
+		return r.opt, r.err
+	}
+	stamp := stampConfigs(configFiles(dir))
+	opt, err := newDirOptions(dir)
+	if dirOptionsCache == nil {
+		dirOptionsCache = map[string]dirOptionsResult{}
+	}
+	dirOptionsCache[dir] = dirOptionsResult{opt, err, stamp}
+	return opt, err
+}
+
+func newDirOptions(dir string) (*returns.Options, error) {
+	names := configFiles(dir)
+	if len(names) < 2 {
+		return options, nil
+	}
+	// A project other than the first path's (see applyConfig) has its
+	// own outermost config file, which sets flags of the whole run and
+	// so is ignored.
+	var opt returns.Options
+	var fix string
+	var errLast, ctxErr bool
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	bindOptionFlags(fs, &opt)
+	fs.StringVar(&fix, "fix", "", "")
+	fs.BoolVar(&errLast, "errlast", false, "")
+	fs.BoolVar(&ctxErr, "ctxerr", false, "")
+	opt = *options
+	opt.Fixes = append([]string(nil), options.Fixes...)
+	for _, name := range names[1:] {
+		values, err := readConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		fix, errLast, ctxErr = "", false, false
+		for flagName, v := range values {
+			if overridden[flagName] {
+				continue
+			}
+			f := fs.Lookup(flagName)
+			if f == nil {
+				switch {
+				case flag.Lookup(flagName) == nil:
+					return nil, fmt.Errorf("%s: %s", name, unknownFlag(flagName))
+				case !configurable[flagName]:
+					return nil, fmt.Errorf("%s: %s", name, notConfigurable(flagName))
+				}
+				return nil, fmt.Errorf("%s: -%s applies to the whole run, so it can be set only in the project's config file, %s", name, flagName, names[0])
+			}
+			value, err := configString(f, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			if err := fs.Set(flagName, value); err != nil {
+				return nil, fmt.Errorf("%s: invalid value %q for -%s: %s", name, value, flagName, err)
+			}
+		}
+		if opt.Fixes, err = parseFixList(fix, opt.Fixes); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		if errLast {
+			opt.Fixes = addFix(opt.Fixes, "errlast")
+		}
+		if ctxErr {
+			opt.Fixes = addFix(opt.Fixes, "ctxerr")
+		}
+		if opt.RemoveBareReturns {
+			opt.Fixes = addFix(opt.Fixes, "bare")
+		}
+	}
+	return &opt, nil
+}
+
+// printConfig prints the config files that apply to path and the flags
+// in effect there that differ from their defaults, for -show-config.
+func printConfig(w io.Writer, path string) error {
+	dir := path
+	if fi, err := os.Stat(path); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		dir = filepath.Dir(path)
+	}
+	opt, err := dirOptions(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "config files:")
+	if runConfig != "" {
+		fmt.Fprintf(w, "\t%s\n", runConfig)
+	}
+	if *configFile == "" {
+		if names := configFiles(absPath(dir)); len(names) > 1 {
+			for _, name := range names[1:] {
+				fmt.Fprintf(w, "\t%s\n", name)
+			}
+		}
+	}
+
+	var dirOpt returns.Options
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	bindOptionFlags(fs, &dirOpt)
+	dirOpt = *opt
+	fmt.Fprintln(w, "flags:")
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "show-config" {
+			return
+		}
+		if df := fs.Lookup(f.Name); df != nil {
+			f = df
+		}
+		if f.Value.String() != f.DefValue {
+			fmt.Fprintf(w, "\t-%s=%s\n", f.Name, f.Value)
+		}
+	})
+	if len(configExclude.globs) > 0 {
+		fmt.Fprintf(w, "exclude (in %s): %s\n", configExclude.dir, strings.Join(configExclude.globs, ", "))
+	}
+	fmt.Fprintf(w, "fixers: %s\n", strings.Join(opt.Fixes, ", "))
+	return nil
+}
+
+// envNames are the names of the environment variables of the flags
+// whose names are single letters, after the options they set.
+var envNames = map[string]string{
+	"b": "GORETURNS_REMOVE_BARE_RETURNS",
+	"e": "GORETURNS_ALL_ERRORS",
+	"i": "GORETURNS_GOIMPORTS",
+	"p": "GORETURNS_PRINT_ERRORS",
+	"s": "GORETURNS_SIMPLIFY",
+}
+
+// envName returns the name of the environment variable that sets the
+// flag name: GORETURNS_ followed by the name in upper case, with dashes
+// as underscores (e.g., GORETURNS_STDIN_FILENAME), or for some flags
+// whose names are single letters, an entry of envNames.
+func envName(name string) string {
+	if env, ok := envNames[name]; ok {
+		return env
+	}
+	return "GORETURNS_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// setEnvFlags sets the flags whose environment variables are set, so
+// that containers can configure goreturns without config files.
+func setEnvFlags() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "no-config" {
+			return // see applyConfig
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && err == nil {
+			if err = setFlag(f.Name, value); err != nil {
+				err = fmt.Errorf("$%s: %s", envName(f.Name), err)
+			}
+			overridden[f.Name] = true
+		}
+	})
+	return err
+}
+
+// configurable are the flags that config files may set: those of how
+// files are fixed, formatted, and reported. The others name files to
+// write (such as -cpuprofile, -journal, -backup, and -cache) or read
+// instead of those processed, or apply only to a single invocation, so
+// they can be set only on the command line or in the environment, where
+// a config file checked into a repository can't set them.
+var configurable = map[string]bool{
+	"annotate": true, "b": true, "batch": true, "changed": true,
+	"check": true, "color": true, "count-only": true, "ctxerr": true,
+	"d": true, "diff-context": true, "e": true, "errlast": true,
+	"erronly": true, "fix": true, "format-only": true, "fsync": true,
+	"gitignore": true, "i": true, "import-sections": true, "importer": true,
+	"jobs": true, "l": true, "lint": true, "local": true, "n": true,
+	"nilnil": true, "org": true, "output": true, "p": true, "rate": true,
+	"returns-only": true, "s": true, "skipbad": true, "summary": true,
+	"syntaxonly": true, "tags": true, "timeout": true, "v": true,
+	"w": true, "walkall": true,
+}
+
+// notConfigurable returns the error for a config file's setting of the
+// flag name, which configurable doesn't hold.
+func notConfigurable(name string) error {
+	return fmt.Errorf("-%s can't be set in a config file, only on the command line or in the environment", name)
+}
+
+// setFlags sets the flags named by the keys of values, read from the
+// config file name.
+func setFlags(name string, values map[string]interface{}) error {
+	for flagName, v := range values {
+		f := flag.Lookup(flagName)
+		if f == nil {
+			return fmt.Errorf("%s: %s", name, unknownFlag(flagName))
+		}
+		if !configurable[flagName] {
+			return fmt.Errorf("%s: %s", name, notConfigurable(flagName))
+		}
+		value, err := configString(f, v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		if err := setFlag(flagName, value); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// listFlags are the flags that take comma-separated lists, which config
+// files may also give as arrays.
+var listFlags = map[string]bool{"exclude": true, "fix": true, "import-sections": true, "local": true, "org": true, "tags": true}
+
+// configString returns v, the value of f in a config file, as the
+// string to set f to. Boolean flags take booleans, flags of listFlags
+// strings or arrays of them, and other flags strings or numbers, so
+// that a quoted "false" is caught rather than taken as true, or a value
+// meant for another flag as text.
+func configString(f *flag.Flag, v interface{}) (string, error) {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	isBool := ok && b.IsBoolFlag()
+	switch v := v.(type) {
+	case bool:
+		if isBool {
+			return fmt.Sprint(v), nil
+		}
+		return "", fmt.Errorf("-%s takes a string, not the boolean %v", f.Name, v)
+	case string:
+		if !isBool {
+			return v, nil
+		}
+		return "", fmt.Errorf("-%s takes true or false, not the string %q", f.Name, v)
+	case json.Number:
+		if !isBool {
+			return string(v), nil
+		}
+		return "", fmt.Errorf("-%s takes true or false, not the number %v", f.Name, v)
+	case []interface{}:
+		if !listFlags[f.Name] {
+			return "", fmt.Errorf("-%s takes a single value, not an array", f.Name)
+		}
+		elems := make([]string, len(v))
+		for i, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return "", fmt.Errorf("-%s takes an array of strings", f.Name)
+			}
+			elems[i] = s
+		}
+		return strings.Join(elems, ","), nil
+	case map[string]interface{}:
+		return "", fmt.Errorf("-%s takes a single value, not a table", f.Name)
+	}
+	return "", fmt.Errorf("the value of %q isn't a string, boolean, or number", f.Name)
+}
+
+// unknownFlag returns the error for a config file's key that isn't the
+// name of a flag, suggesting the flag whose name (or environment
+// alias's, as in "removeBareReturns") is closest to it.
+func unknownFlag(key string) error {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(s))
+	}
+	// At most 2 edits away, and fewer for short keys.
+	best, bestDist := "", 3
+	if n := len(normalize(key))/3 + 1; n < bestDist {
+		bestDist = n
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		names := []string{f.Name}
+		for alias, name := range flagAliases {
+			if name == f.Name {
+				names = append(names, alias)
+			}
+		}
+		for _, name := range names {
+			if d := editDistance(normalize(key), normalize(name)); d < bestDist {
+				best, bestDist = f.Name, d
+			}
+		}
+	})
+	if best != "" {
+		return fmt.Errorf("no such flag -%s (did you mean %q?)", key, best)
+	}
+	return fmt.Errorf("no such flag -%s", key)
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = cur[j-1] + 1
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := prev[j-1] + cost; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// setFlag sets the flag name to value.
+func setFlag(name, value string) error {
+	if flag.Lookup(name) == nil {
+		return unknownFlag(name)
+	}
+	if err := flag.Set(name, value); err != nil {
+		return fmt.Errorf("invalid value %q for -%s: %s", value, name, err)
+	}
+	return nil
+}
+
+// configDir returns the directory in which to start looking for the
+// config file.
+func configDir() string {
+	path := *stdinName
+	if args := flag.Args(); len(args) > 0 {
+		path = args[0]
+	}
+	if *showConfig != "" {
+		path = *showConfig
+	}
+	if path == "" {
+		return "."
+	}
+	path = strings.TrimSuffix(filepath.ToSlash(path), "/...") // a package pattern
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return path
+	}
+	return filepath.Dir(path)
+}
+
+// configFiles returns the names of the config files in dir and its
+// parents, up to the root of its module, outermost first. dir is
+// absolute.
+func configFiles(dir string) []string {
+	var names []string
+	for {
+		if name := configIn(dir); name != "" {
+			names = append([]string{name}, names...)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			break // the root of the module
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return names
+}
+
+// userConfig returns the name of the user's config file, or "" if there
+// is none: config.json (or TOML or YAML) in the goreturns directory of
+// the user's config directory ($XDG_CONFIG_HOME, or ~/.config, on Linux),
+// or else ~/.goreturns.json (or TOML or YAML). Without a home directory,
+// as in minimal containers, there may be none.
+func userConfig() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		for _, ext := range []string{".json", ".toml", ".yaml", ".yml"} {
+			name := filepath.Join(dir, "goreturns", "config"+ext)
+			if _, err := os.Stat(name); err == nil {
+				return name
+			}
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return configIn(home)
+	}
+	return ""
+}
+
+// configIn returns the name of the config file in dir, or "" if there
+// is none.
+func configIn(dir string) string {
+	for _, name := range configNames {
+		name = filepath.Join(dir, name)
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// parseTOML parses a TOML config file of key = value lines, whose
+// values are strings, booleans, numbers, or arrays of strings (which
+// may span lines), and [tables] of them, which can't be nested.
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	table := values // the values of the current [table]
+	lines := strings.Split(string(data), "\n")
+	i := 0
+	next := func() (string, bool) { // the line after the ith, for arrays
+		if i+1 >= len(lines) {
+			return "", false
+		}
+		i++
+		return lines[i], true
+	}
+	for ; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			var rest string
+			if end >= 0 {
+				rest = strings.TrimSpace(line[end+1:])
+			}
+			if strings.HasPrefix(line, "[[") || end < 0 || rest != "" && rest[0] != '#' {
+				return nil, fmt.Errorf("line %d: expected [table]", i+1)
+			}
+			name, err := configKey(strings.TrimSpace(line[1:end]))
+			if err == nil && strings.Contains(name, ".") {
+				err = fmt.Errorf("nested tables aren't supported")
+			}
+			if _, ok := values[name]; ok && err == nil {
+				err = fmt.Errorf("duplicate key %s", name)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+			table = map[string]interface{}{}
+			values[name] = table
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key, err := configKey(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		keyLine := i
+		value, err := tomlValue(strings.TrimSpace(line[eq+1:]), next)
+		if _, ok := table[key]; ok && err == nil {
+			err = fmt.Errorf("duplicate key %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", keyLine+1, err)
+		}
+		table[key] = value
+	}
+	return values, nil
+}
+
+// tomlValue parses text, the value of a TOML line, which may be an
+// array of strings continued on the lines that next returns.
+func tomlValue(text string, next func() (string, bool)) (interface{}, error) {
+	var value interface{}
+	var rest string
+	var err error
+	if strings.HasPrefix(text, "[") {
+		value, rest, err = configArray(text, false, next)
+	} else {
+		var s string
+		if s, rest, err = configValue(text, false); err == nil {
+			value = typedValue(text, s)
+		}
+	}
+	if err == nil && rest != "" && rest[0] != '#' {
+		err = fmt.Errorf("unexpected %q after the value", rest)
+	}
+	return value, err
+}
+
+// parseYAML parses a YAML config file of "key: value" lines, whose
+// values are scalars, sequences of them (as "[a, b]", which may span
+// lines, or "- a" lines after "key:"), which are arrays of strings, or
+// mappings of them (as indented "key: value" lines after "key:"), which
+// can't be nested.
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	lines := strings.Split(string(data), "\n")
+	i := 0
+	next := func() (string, bool) { // the line after the ith, for sequences
+		if i+1 >= len(lines) {
+			return "", false
+		}
+		i++
+		return lines[i], true
+	}
+	for ; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t\r")
+		if isYAMLBlank(line) {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || line[0] == '-' {
+			return nil, fmt.Errorf("line %d: unexpected indented line or sequence item", i+1)
+		}
+		keyLine := i
+		key, value, err := yamlPair(line, next)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", keyLine+1, err)
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", keyLine+1, key)
+		}
+		if value == nil {
+			// A block of "- item" lines or of indented "key: value"
+			// lines.
+			var items []interface{}
+			var table map[string]interface{}
+		block:
+			for i+1 < len(lines) {
+				line := strings.TrimRight(lines[i+1], " \t\r")
+				if isYAMLBlank(line) {
+					i++
+					continue
+				}
+				trimmed := strings.TrimSpace(line)
+				switch {
+				case trimmed == "-" || strings.HasPrefix(trimmed, "- "):
+					i++
+					item, rest, err := configValue(strings.TrimSpace(trimmed[1:]), true)
+					if err == nil && rest != "" && rest[0] != '#' {
+						err = fmt.Errorf("unexpected %q after the value", rest)
+					}
+					if err != nil {
+						return nil, fmt.Errorf("line %d: %s", i+1, err)
+					}
+					items = append(items, item)
+				case line[0] == ' ' || line[0] == '\t':
+					i++
+					pairLine := i
+					k, v, err := yamlPair(trimmed, next)
+					if err == nil && v == nil {
+						err = fmt.Errorf("nested mappings are supported only one level deep")
+					}
+					if _, ok := table[k]; ok && err == nil {
+						err = fmt.Errorf("duplicate key %s", k)
+					}
+					if err != nil {
+						return nil, fmt.Errorf("line %d: %s", pairLine+1, err)
+					}
+					if table == nil {
+						table = map[string]interface{}{}
+					}
+					table[k] = v
+				default:
+					break block
+				}
+			}
+			switch {
+			case items != nil && table != nil:
+				return nil, fmt.Errorf("line %d: the value of %s mixes a sequence and a mapping", keyLine+1, key)
+			case items != nil:
+				value = items
+			case table != nil:
+				value = table
+			default:
+				return nil, fmt.Errorf("line %d: missing value", keyLine+1)
+			}
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// yamlPair parses a "key: value" line of a YAML config file, whose
+// value may be a sequence continued on the lines that next returns. The
+// value is nil if the line is only "key:".
+func yamlPair(line string, next func() (string, bool)) (key string, value interface{}, err error) {
+	colon := strings.Index(line, ": ")
+	if colon < 0 && strings.HasSuffix(line, ":") {
+		colon = len(line) - 1
+	}
+	if colon < 0 {
+		return "", nil, fmt.Errorf("expected key: value")
+	}
+	if key, err = configKey(line[:colon]); err != nil {
+		return "", nil, err
+	}
+	text := strings.TrimSpace(line[colon+1:])
+	var rest string
+	switch {
+	case text == "" || text[0] == '#':
+		return key, nil, nil
+	case text[0] == '[':
+		value, rest, err = configArray(text, true, next)
+	default:
+		var s string
+		s, rest, err = configValue(text, true)
+		value = typedValue(text, s)
+	}
+	if err == nil && rest != "" && rest[0] != '#' {
+		err = fmt.Errorf("unexpected %q after the value", rest)
+	}
+	return key, value, err
+}
+
+// isYAMLBlank reports whether a YAML line holds nothing, or only a
+// comment or the start of the document.
+func isYAMLBlank(line string) bool {
+	return line == "" || line == "---" || strings.HasPrefix(strings.TrimSpace(line), "#")
+}
+
+// configArray parses the array of strings at the start of s, as in
+// TOML's ["a", "b"] or YAML's [a, b], and returns it and the rest of
+// the line after it, without leading space. An array that isn't closed
+// on its line continues on the lines that next returns; comments and
+// blank lines between its values, and a comma after the last one, are
+// allowed.
+func configArray(s string, yaml bool, next func() (string, bool)) (values []interface{}, rest string, err error) {
+	values = []interface{}{}
+	s = s[1:]
+	// skip skips space and comments, and moves to the next line at the
+	// end of one.
+	skip := func() error {
+		for s = strings.TrimSpace(s); s == "" || s[0] == '#'; s = strings.TrimSpace(s) {
+			line, ok := next()
+			if !ok {
+				return fmt.Errorf("unterminated array")
+			}
+			s = line
+		}
+		return nil
+	}
+	for {
+		if err := skip(); err != nil {
+			return nil, "", err
+		}
+		if s[0] == ']' {
+			return values, strings.TrimSpace(s[1:]), nil
+		}
+		var value string
+		switch {
+		case s[0] == '"' || s[0] == '\'':
+			if value, s, err = configValue(s, yaml); err != nil {
+				return nil, "", err
+			}
+		case yaml:
+			// A plain string, which ends at a comma, the end of the
+			// array, or a comment at the end of the line.
+			end := strings.IndexAny(s, ",]")
+			if end < 0 {
+				end = len(s)
+			}
+			if i := strings.Index(s[:end], " #"); i >= 0 {
+				end = i
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		default:
+			return nil, "", fmt.Errorf("arrays may hold only strings")
+		}
+		values = append(values, value)
+		if err := skip(); err != nil {
+			return nil, "", err
+		}
+		switch s[0] {
+		case ',':
+			s = s[1:]
+		case ']':
+		default:
+			return nil, "", fmt.Errorf("expected , or ] after %q in the array", value)
+		}
+	}
+}
+
+// typedValue returns value, parsed from text by configValue, as a
+// boolean or (as a json.Number, which keeps its text) a number if it
+// wasn't quoted, as JSON config files' values are.
+func typedValue(text, value string) interface{} {
+	if text[0] == '"' || text[0] == '\'' {
+		return value
+	}
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return json.Number(value)
+	}
+	return value
+}
+
+// configKey returns the key of a TOML or YAML line, which may be quoted.
+func configKey(s string) (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("missing key")
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		key, rest, err := configValue(s, false)
+		if err != nil || rest != "" {
+			return "", fmt.Errorf("malformed key %s", s)
+		}
+		return key, nil
+	}
+	return s, nil
+}
+
+// configValue parses the value at the start of s, a quoted string or
+// (as text) a boolean or number, and returns it and the rest of s
+// after it, without leading space. YAML values may also be plain
+// strings, which end at a comment.
+func configValue(s string, yaml bool) (value, rest string, err error) {
+	switch {
+	case s == "":
+		return "", "", fmt.Errorf("missing value")
+	case s[0] == '"':
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return "", "", fmt.Errorf("unterminated string %s", s)
+		}
+		if value, err = strconv.Unquote(s[:end+1]); err != nil {
+			return "", "", fmt.Errorf("malformed string %s", s[:end+1])
+		}
+		return value, strings.TrimSpace(s[end+1:]), nil
+	case s[0] == '\'':
+		// TOML literal strings have no escapes; in YAML, '' is a quote.
+		var buf strings.Builder
+		for end := 1; end < len(s); end++ {
+			switch {
+			case s[end] != '\'':
+				buf.WriteByte(s[end])
+			case yaml && end+1 < len(s) && s[end+1] == '\'':
+				buf.WriteByte('\'')
+				end++
+			default:
+				return buf.String(), strings.TrimSpace(s[end+1:]), nil
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string %s", s)
+	}
+	if yaml {
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSpace(s), "", nil
+	}
+	// A boolean or number, which ends at whitespace or a comment.
+	end := strings.IndexAny(s, " \t#")
+	if end < 0 {
+		end = len(s)
+	}
+	value = s[:end]
+	if value != "true" && value != "false" {
+		if _, err := strconv.ParseFloat(strings.Replace(value, "_", "", -1), 64); err != nil {
+			return "", "", fmt.Errorf("unsupported value %s", value)
+		}
+		value = strings.Replace(value, "_", "", -1)
+	}
+	return value, strings.TrimSpace(s[end:]), nil
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+type configTest struct {
+	name string
+	in   string
+	want map[string]interface{}
+	err  string // a substring of the error, if one is expected
+}
+
+var tomlTests = []configTest{
+	{
+		name: "scalars",
+		in: `# A comment.
+local = "github.com/myorg/"
+b = true
+e = false
+jobs = 4
+timeout = 1_000
+`,
+		want: map[string]interface{}{"local": "github.com/myorg/", "b": true, "e": false, "jobs": json.Number("4"), "timeout": json.Number("1000")},
+	},
+	{
+		name: "strings",
+		in: `basic = "a \"quoted\" \\ # not a comment" # a comment
+literal = 'C:\path'
+quoted = "true"
+`,
+		want: map[string]interface{}{"basic": `a "quoted" \ # not a comment`, "literal": `C:\path`, "quoted": "true"},
+	},
+	{
+		name: "quoted keys",
+		in:   `"import-sections" = "std,local"` + "\n" + `'org' = "x"`,
+		want: map[string]interface{}{"import-sections": "std,local", "org": "x"},
+	},
+	{
+		name: "arrays",
+		in: `exclude = ["gen/**", 'x.go'] # generated
+empty = []
+`,
+		want: map[string]interface{}{"exclude": []interface{}{"gen/**", "x.go"}, "empty": []interface{}{}},
+	},
+	{
+		name: "multi-line arrays",
+		in: `fix = [
+  "zero",
+  "errlast", # a comment
+
+  # another
+]
+exclude = ["gen/**",
+  'x.go']
+b = true
+
+[flags]
+tags = [ "a", "b", ]
+`,
+		want: map[string]interface{}{
+			"fix":     []interface{}{"zero", "errlast"},
+			"exclude": []interface{}{"gen/**", "x.go"},
+			"b":       true,
+			"flags":   map[string]interface{}{"tags": []interface{}{"a", "b"}},
+		},
+	},
+	{
+		name: "tables",
+		in: `fix = "+bare"
+
+[flags] # how goreturns runs
+write = true
+tags = "integration"
+`,
+		want: map[string]interface{}{"fix": "+bare", "flags": map[string]interface{}{"write": true, "tags": "integration"}},
+	},
+	{
+		name: "keys in different tables",
+		in:   "w = true\n[flags]\nw = false\n",
+		want: map[string]interface{}{"w": true, "flags": map[string]interface{}{"w": false}},
+	},
+	{name: "bare string", in: "local = github.com/myorg/\n", err: "line 1: unsupported value github.com/myorg/"},
+	{name: "no value", in: "local =\n", err: "line 1: missing value"},
+	{name: "no equals", in: "local\n", err: "line 1: expected key = value"},
+	{name: "no key", in: `= "x"`, err: "line 1: missing key"},
+	{name: "malformed key", in: `"a"b = 1`, err: "line 1: malformed key"},
+	{name: "unterminated string", in: "\nlocal = \"x\n", err: "line 2: unterminated string"},
+	{name: "unterminated literal string", in: "local = 'x\n", err: "line 1: unterminated string"},
+	{name: "malformed string", in: `local = "\q"`, err: "line 1: malformed string"},
+	{name: "trailing data", in: `local = "x" "y"`, err: `line 1: unexpected "\"y\"" after the value`},
+	{name: "duplicate key", in: "b = true\nb = false\n", err: "line 2: duplicate key b"},
+	{name: "duplicate table", in: "[flags]\n[flags]\n", err: "line 2: duplicate key flags"},
+	{name: "table named like a key", in: "flags = 1\n[flags]\n", err: "line 2: duplicate key flags"},
+	{name: "nested table", in: "[a.b]\n", err: "line 1: nested tables aren't supported"},
+	{name: "array of tables", in: "[[a]]\n", err: "line 1: expected [table]"},
+	{name: "unterminated table", in: "[a\n", err: "line 1: expected [table]"},
+	{name: "table with trailing data", in: "[a] b\n", err: "line 1: expected [table]"},
+	{name: "array of numbers", in: "a = [1, 2]\n", err: "line 1: arrays may hold only strings"},
+	{name: "unterminated array", in: `a = ["x", `, err: "line 1: unterminated array"},
+	{name: "array without commas", in: `a = ["x" "y"]`, err: `line 1: expected , or ] after "x" in the array`},
+	{name: "unterminated multi-line array", in: "b = true\na = [\n  \"x\",\n\n", err: "line 2: unterminated array"},
+	{name: "multi-line array without commas", in: "a = [\n  \"x\"\n  \"y\"\n]\n", err: `line 1: expected , or ] after "x" in the array`},
+	{name: "number in a multi-line array", in: "a = [\n  \"x\",\n  1,\n]\n", err: "line 1: arrays may hold only strings"},
+	{name: "two commas", in: `a = ["x",,]`, err: "line 1: arrays may hold only strings"},
+}
+
+func TestParseTOML(t *testing.T) {
+	testConfigParser(t, parseTOML, tomlTests)
+}
+
+var yamlTests = []configTest{
+	{
+		name: "scalars",
+		in: `---
+# A comment.
+local: github.com/myorg/ # a comment
+b: true
+e: false
+jobs: 4
+fix: "+bare"
+tags: 'it''s'
+quoted: "true"
+`,
+		want: map[string]interface{}{"local": "github.com/myorg/", "b": true, "e": false, "jobs": json.Number("4"), "fix": "+bare", "tags": "it's", "quoted": "true"},
+	},
+	{
+		name: "plain string with a hash",
+		in:   "local: a#b\n",
+		want: map[string]interface{}{"local": "a#b"},
+	},
+	{
+		name: "quoted keys",
+		in:   `"import-sections": std,local` + "\n" + `'org': x`,
+		want: map[string]interface{}{"import-sections": "std,local", "org": "x"},
+	},
+	{
+		name: "flow sequences",
+		in:   "exclude: [gen/**, \"x.go\", 'y.go']\nempty: []\n",
+		want: map[string]interface{}{"exclude": []interface{}{"gen/**", "x.go", "y.go"}, "empty": []interface{}{}},
+	},
+	{
+		name: "multi-line flow sequences",
+		in: `exclude: [
+  gen/**,
+  "x.go", # a comment
+  y.go # another
+]
+flags:
+  tags: [a,
+    b]
+  w: true
+`,
+		want: map[string]interface{}{
+			"exclude": []interface{}{"gen/**", "x.go", "y.go"},
+			"flags":   map[string]interface{}{"tags": []interface{}{"a", "b"}, "w": true},
+		},
+	},
+	{
+		name: "block sequences",
+		in: `exclude:
+  - gen/**
+
+  # generated
+  - "x.go" # too
+- y.go
+b: true
+`,
+		want: map[string]interface{}{"exclude": []interface{}{"gen/**", "x.go", "y.go"}, "b": true},
+	},
+	{
+		name: "mappings",
+		in: `fix: none
+flags: # how goreturns runs
+  write: true
+  tags: integration
+  exclude: [a]
+`,
+		want: map[string]interface{}{"fix": "none", "flags": map[string]interface{}{"write": true, "tags": "integration", "exclude": []interface{}{"a"}}},
+	},
+	{name: "no colon", in: "local\n", err: "line 1: expected key: value"},
+	{name: "no space after colon", in: "local:x\n", err: "line 1: expected key: value"},
+	{name: "no key", in: ": x\n", err: "line 1: missing key"},
+	{name: "no value", in: "b: true\nexclude:\nfix: none\n", err: "line 2: missing value"},
+	{name: "indented line", in: "  b: true\n", err: "line 1: unexpected indented line or sequence item"},
+	{name: "stray item", in: "- x\n", err: "line 1: unexpected indented line or sequence item"},
+	{name: "duplicate key", in: "b: true\nb: false\n", err: "line 2: duplicate key b"},
+	{name: "duplicate key in a mapping", in: "flags:\n  w: true\n  w: false\n", err: "line 3: duplicate key w"},
+	{name: "nested mapping", in: "flags:\n  a:\n    b: c\n", err: "line 2: nested mappings are supported only one level deep"},
+	{name: "sequence and mapping", in: "flags:\n  - a\n  b: c\n", err: "line 1: the value of flags mixes a sequence and a mapping"},
+	{name: "unterminated string", in: "local: \"x\n", err: "line 1: unterminated string"},
+	{name: "trailing data", in: `local: "x" y`, err: `line 1: unexpected "y" after the value`},
+	{name: "trailing data after an item", in: "exclude:\n  - 'x' y\n", err: `line 2: unexpected "y" after the value`},
+	{name: "unterminated sequence", in: "exclude: [a, b\n", err: "line 1: unterminated array"},
+	{name: "unterminated multi-line sequence", in: "b: true\nflags:\n  tags: [a,\n    b\n", err: "line 3: unterminated array"},
+}
+
+func TestParseYAML(t *testing.T) {
+	testConfigParser(t, parseYAML, yamlTests)
+}
+
+func testConfigParser(t *testing.T, parse func([]byte) (map[string]interface{}, error), tests []configTest) {
+	for _, tt := range tests {
+		got, err := parse([]byte(tt.in))
+		switch {
+		case tt.err != "":
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !reflect.DeepEqual(got, tt.want):
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// writeConfig writes a config file named name, with contents data, in a
+// new temporary directory, and returns its path.
+func writeConfig(t *testing.T, name, data string) string {
+	dir, err := ioutil.TempDir("", "goreturns-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name = filepath.Join(dir, name)
+	if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReadConfig(t *testing.T) {
+	// The same config in each format, with aliases and a flags section.
+	files := map[string]string{
+		".goreturns.json": `{"local": "github.com/myorg/", "remove-bare-returns": true, "jobs": 4, "exclude": ["gen/**"], "flags": {"write": true}}`,
+		".goreturns.toml": `local = "github.com/myorg/"
+remove-bare-returns = true
+jobs = 4
+exclude = ["gen/**"]
+
+[flags]
+write = true
+`,
+		".goreturns.yaml": `local: github.com/myorg/
+remove-bare-returns: true
+jobs: 4
+exclude:
+  - gen/**
+flags:
+  write: true
+`,
+	}
+	want := map[string]interface{}{"local": "github.com/myorg/", "b": true, "jobs": json.Number("4"), "exclude": []interface{}{"gen/**"}, "w": true}
+	for base, data := range files {
+		name := writeConfig(t, base, data)
+		defer os.RemoveAll(filepath.Dir(name))
+		got, err := readConfig(name)
+		if err != nil {
+			t.Errorf("%s: %v", base, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, want %#v", base, got, want)
+		}
+	}
+
+	errs := map[string]string{
+		`{"local": "x"} {}`:                     "unexpected data after the object",
+		`{"flags": "x"}`:                        "flags is a table of flag names and values",
+		`{"w": true, "flags": {"w": true}}`:     "w is set both in flags and outside it",
+		`{"write": true, "w": false}`:           "both write and w are set",
+		`{"write": true, "flags": {"w": true}}`: "both write and w are set",
+	}
+	for data, want := range errs {
+		name := writeConfig(t, ".goreturns.json", data)
+		defer os.RemoveAll(filepath.Dir(name))
+		if _, err := readConfig(name); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want one containing %q", data, err, want)
+		}
+	}
+}
+
+// saveFlags returns a function that restores the values of the command
+// line flags. (resetState would also reset the testing package's flags.)
+func saveFlags() func() {
+	values := map[*flag.Flag]string{}
+	flag.VisitAll(func(f *flag.Flag) { values[f] = f.Value.String() })
+	return func() {
+		for f, v := range values {
+			if f.Value.String() != v {
+				f.Value.Set(v)
+			}
+		}
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	defer saveFlags()()
+	name := writeConfig(t, ".goreturns.toml", `local = ["github.com/myorg/", "github.com/other/"]
+fix = [
+  "zero",
+  "errlast",
+]
+b = true
+jobs = 4
+timeout = "1s"
+
+[flags]
+write = true
+`)
+	defer os.RemoveAll(filepath.Dir(name))
+	values, err := readConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(values, "exclude")
+	if err := setFlags(name, values); err != nil {
+		t.Fatal(err)
+	}
+	for flagName, want := range map[string]string{"local": "github.com/myorg/,github.com/other/", "fix": "zero,errlast", "b": "true", "jobs": "4", "timeout": "1s", "w": "true"} {
+		if got := flag.Lookup(flagName).Value.String(); got != want {
+			t.Errorf("-%s: got %q, want %q", flagName, got, want)
+		}
+	}
+
+	errs := []struct {
+		values map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"b": "false"}, `-b takes true or false, not the string "false"`},
+		{map[string]interface{}{"local": true}, "local"},
+		{map[string]interface{}{"exclude-all": true}, "no such flag -exclude-all"},
+		{map[string]interface{}{"config": "x.json"}, "-config can't be set in a config file"},
+		{map[string]interface{}{"no-config": true}, "-no-config can't be set in a config file"},
+		{map[string]interface{}{"show-config": "."}, "-show-config can't be set in a config file"},
+		{map[string]interface{}{"cpuprofile": "/tmp/x"}, "-cpuprofile can't be set in a config file, only on the command line or in the environment"},
+		{map[string]interface{}{"journal": "/tmp/x"}, "-journal can't be set in a config file"},
+		{map[string]interface{}{"backup": ".orig"}, "-backup can't be set in a config file"},
+		{map[string]interface{}{"cache": "/tmp/x"}, "-cache can't be set in a config file"},
+		{map[string]interface{}{"watch": true}, "-watch can't be set in a config file"},
+		{map[string]interface{}{"jobs": []interface{}{"4"}}, "-jobs takes a single value, not an array"},
+		{map[string]interface{}{"local": []interface{}{"a", true}}, "-local takes an array of strings"},
+		{map[string]interface{}{"jobs": json.Number("x")}, "jobs"},
+	}
+	for _, tt := range errs {
+		if err := setFlags(name, tt.values); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got error %v, want one containing %q", tt.values, err, tt.want)
+		}
+	}
+}
+
+// writeTree writes files, keyed by slash-separated names, in a new
+// temporary directory, and returns its name.
+func writeTree(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "goreturns-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// configure sets the flags and options as the goreturns command does
+// when run with args.
+func configure(t *testing.T, args ...string) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := setOptions(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirOptions(t *testing.T) {
+	defer saveFlags()()
+	defer func(opt returns.Options) {
+		*options = opt
+		runConfig, overridden, dirOptionsCache = "", nil, nil
+	}(*options)
+
+	root := writeTree(t, map[string]string{
+		"go.mod":          "module x\n",
+		".goreturns.json": `{"local": "x/", "erronly": true, "fix": "+bare", "w": true}`,
+		"a/.goreturns.toml": `fix = "-bare,+errlast"
+skipbad = true
+s = true
+`,
+		"a/b/.goreturns.yaml": "fix: +ctxerr\nannotate: zero\n",
+		"a/c/.goreturns.json": `{"w": false}`,
+		"a/d/.goreturns.json": `{"skipbd": true}`,
+		"a/f/.goreturns.json": `{"memprofile": "mem.out"}`,
+		"e/.goreturns.json":   `{"b": true, "fix": "zero"}`,
+	})
+	defer os.RemoveAll(root)
+	configure(t, "-s=false", root)
+
+	tests := []struct {
+		dir  string
+		want returns.Options
+	}{
+		{".", returns.Options{ErrorFuncsOnly: true, Fixes: []string{"zero", "bare"}}},
+		// -s is set on the command line, so a/.goreturns.toml can't
+		// change it, and -fix removes bare from its parent's fixers.
+		{"a", returns.Options{ErrorFuncsOnly: true, SkipBadDecls: true, Fixes: []string{"zero", "errlast"}}},
+		{"a/b", returns.Options{ErrorFuncsOnly: true, SkipBadDecls: true, ZeroValueComment: "zero", Fixes: []string{"zero", "errlast", "ctxerr"}}},
+		// -b adds bare after the fixers that -fix names.
+		{"e", returns.Options{ErrorFuncsOnly: true, RemoveBareReturns: true, Fixes: []string{"zero", "bare"}}},
+	}
+	for _, tt := range tests {
+		opt, err := dirOptions(filepath.Join(root, tt.dir))
+		if err != nil {
+			t.Errorf("%s: %v", tt.dir, err)
+			continue
+		}
+		got := returns.Options{
+			ErrorFuncsOnly:    opt.ErrorFuncsOnly,
+			SkipBadDecls:      opt.SkipBadDecls,
+			Simplify:          opt.Simplify,
+			RemoveBareReturns: opt.RemoveBareReturns,
+			ZeroValueComment:  opt.ZeroValueComment,
+			Fixes:             opt.Fixes,
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.dir, got, tt.want)
+		}
+	}
+
+	errs := map[string]string{
+		"a/c": "a/c/.goreturns.json: -w applies to the whole run, so it can be set only in the project's config file",
+		"a/d": "a/d/.goreturns.json: no such flag -skipbd",
+		"a/f": "a/f/.goreturns.json: -memprofile can't be set in a config file",
+	}
+	for dir, want := range errs {
+		if _, err := dirOptions(filepath.Join(root, dir)); err == nil || !strings.Contains(filepath.ToSlash(err.Error()), want) {
+			t.Errorf("%s: got error %v, want one containing %q", dir, err, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := printConfig(&buf, filepath.Join(root, "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(`config files:
+	ROOT/.goreturns.json
+	ROOT/a/.goreturns.toml
+	ROOT/a/b/.goreturns.yaml
+flags:
+	-annotate=zero
+	-erronly=true
+	-fix=+bare
+	-local=x/
+	-skipbad=true
+	-w=true
+fixers: zero, errlast, ctxerr
+`, "ROOT/", root+string(filepath.Separator), -1)
+	var got string
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if !strings.HasPrefix(line, "\t-test.") { // the testing package's flags
+			got += line
+		}
+	}
+	if got != filepath.FromSlash(want) {
+		t.Errorf("printConfig: got\n%s\nwant\n%s", got, want)
+	}
+}
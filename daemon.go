@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+var daemon = flag.Bool("daemon", false, "serve the goreturns invocations that read standard input (such as editors' save hooks) on a unix socket ($GORETURNS_SOCKET, or goreturns/daemon.sock in $XDG_RUNTIME_DIR or the user cache directory), keeping their dependencies' type information in memory between them; invocations use the daemon only if GORETURNS_USE_DAEMON=1")
+
+// daemonSocket returns the name of the daemon's unix socket. By default
+// it is in a directory of the user's own (see privateDir), so that
+// other users can't listen on it in the daemon's place.
+func daemonSocket() (string, error) {
+	if name := os.Getenv("GORETURNS_SOCKET"); name != "" {
+		return name, nil
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		var err error
+		if dir, err = os.UserCacheDir(); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "goreturns", "daemon.sock"), nil
+}
+
+// daemonEnvVars are the environment variables that a request passes
+// to the daemon, besides goreturns' own (GORETURNS_*): those that
+// affect how packages are loaded. Others, such as credentials, stay
+// out of the daemon, which runs with its own.
+var daemonEnvVars = map[string]bool{
+	"GOFLAGS":     true,
+	"GOOS":        true,
+	"GOARCH":      true,
+	"GOPATH":      true,
+	"GOROOT":      true,
+	"GO111MODULE": true,
+	"GOWORK":      true,
+	"CGO_ENABLED": true,
+}
+
+// isDaemonEnv reports whether kv, a "key=value" pair, is passed to the
+// daemon (see daemonEnvVars).
+func isDaemonEnv(kv string) bool {
+	key := kv
+	if i := strings.Index(kv, "="); i >= 0 {
+		key = kv[:i]
+	}
+	return daemonEnvVars[key] || strings.HasPrefix(key, "GORETURNS_")
+}
+
+// filterEnv returns the pairs of env for which keep returns true.
+func filterEnv(env []string, keep func(string) bool) []string {
+	var kept []string
+	for _, kv := range env {
+		if keep(kv) {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+// A daemonRequest is an invocation of goreturns sent to the daemon, as
+// JSON, which replies with a daemonResponse.
+type daemonRequest struct {
+	Args  []string `json:"args"` // command-line arguments, without the command name
+	Dir   string   `json:"dir"`  // working directory
+	Env   []string `json:"env"`
+	Stdin []byte   `json:"stdin"`
+}
+
+type daemonResponse struct {
+	Stdout   []byte `json:"stdout"`
+	Stderr   []byte `json:"stderr"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// proxyToDaemon runs this invocation of goreturns, with command-line
+// arguments args, in the daemon, if GORETURNS_USE_DAEMON=1 and one is
+// listening, and reports whether it did. (It isn't GORETURNS_DAEMON,
+// which sets -daemon.)
+func proxyToDaemon(args []string) bool {
+	if os.Getenv("GORETURNS_USE_DAEMON") != "1" || os.Getenv("GORETURNS_SOCKET") == "off" {
+		return false
+	}
+	name, err := daemonSocket()
+	if err != nil {
+		return false
+	}
+	// The buffer and the environment go only to a socket of the
+	// user's own.
+	if fi, err := os.Lstat(name); err != nil || !isOwnSocket(fi) {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", name, time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	req := daemonRequest{Args: args, Env: filterEnv(os.Environ(), isDaemonEnv)}
+	if req.Dir, err = os.Getwd(); err != nil {
+		report(err)
+		return true
+	}
+	if req.Stdin, err = ioutil.ReadAll(os.Stdin); err != nil {
+		report(err)
+		return true
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		report(fmt.Errorf("daemon: %v", err))
+		return true
+	}
+	var resp daemonResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		report(fmt.Errorf("daemon: %v", err))
+		return true
+	}
+	os.Stdout.Write(resp.Stdout)
+	os.Stderr.Write(resp.Stderr)
+	exitCode = resp.ExitCode
+	return true
+}
+
+// serveDaemon implements -daemon: it serves requests on the daemon's
+// socket, one at a time, until interrupted.
+func serveDaemon() {
+	if flag.NArg() > 0 {
+		report(errors.New("-daemon takes no path arguments"))
+		return
+	}
+	name, err := daemonSocket()
+	if err != nil {
+		report(err)
+		return
+	}
+	if os.Getenv("GORETURNS_SOCKET") == "" {
+		if err := privateDir(filepath.Dir(name)); err != nil {
+			report(err)
+			return
+		}
+	}
+	if conn, err := net.Dial("unix", name); err == nil {
+		conn.Close()
+		report(fmt.Errorf("a daemon is already listening on %s", name))
+		return
+	}
+	if fi, err := os.Lstat(name); err == nil {
+		if !isOwnSocket(fi) {
+			report(fmt.Errorf("%s is in the way, and isn't a socket of yours", name))
+			return
+		}
+		os.Remove(name) // left by a daemon that was killed
+	}
+	l, err := listenPrivate(name)
+	if err != nil {
+		report(err)
+		return
+	}
+	defer l.Close()
+	fmt.Fprintf(os.Stderr, "goreturns: listening on %s\n", name)
+
+	handleInterrupts()
+	go func() {
+		for !isInterrupted() {
+			time.Sleep(200 * time.Millisecond)
+		}
+		l.Close()
+	}()
+
+	// The flags that the daemon was started with are the defaults
+	// for requests.
+	base := os.Args[1:]
+	cache := returns.NewImportCache()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !isInterrupted() {
+				report(err)
+			}
+			return
+		}
+		serveDaemonConn(conn, base, cache)
+	}
+}
+
+func serveDaemonConn(conn net.Conn, base []string, cache *returns.ImportCache) {
+	defer conn.Close()
+	var req daemonRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+	resp, err := runRequest(req, base, cache)
+	if err != nil {
+		resp = daemonResponse{Stderr: []byte(fmt.Sprintf("goreturns: daemon: %v\n", err)), ExitCode: 2}
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// runRequest runs the invocation req in this process: in its working
+// directory and environment, with its standard input, and with the
+// global state reset.
+func runRequest(req daemonRequest, base []string, cache *returns.ImportCache) (resp daemonResponse, err error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return resp, err
+	}
+	env := os.Environ()
+	stdin, stdout, stderr := os.Stdin, os.Stdout, os.Stderr
+	var files []*os.File
+	defer func() {
+		os.Stdin, os.Stdout, os.Stderr = stdin, stdout, stderr
+		for _, f := range files {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		os.Chdir(cwd)
+		setEnv(env)
+	}()
+	// The request's variables replace the daemon's of the same kind.
+	reqEnv := append(filterEnv(env, func(kv string) bool { return !isDaemonEnv(kv) }), filterEnv(req.Env, isDaemonEnv)...)
+	for i := 0; i < 3; i++ {
+		f, err := ioutil.TempFile("", "goreturns-daemon")
+		if err != nil {
+			return resp, err
+		}
+		files = append(files, f)
+	}
+	if _, err := files[0].Write(req.Stdin); err != nil {
+		return resp, err
+	}
+	if _, err := files[0].Seek(0, 0); err != nil {
+		return resp, err
+	}
+	if err := os.Chdir(req.Dir); err != nil {
+		return resp, err
+	}
+	setEnv(reqEnv)
+	os.Stdin, os.Stdout, os.Stderr = files[0], files[1], files[2]
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Fprintf(os.Stderr, "goreturns: daemon: panic: %v\n", r)
+				exitCode = exitInternal
+			}
+		}()
+		resetState()
+		options.ImportCache = cache
+		args := append(append([]string(nil), base...), req.Args...)
+		if err := flag.CommandLine.Parse(args); err != nil {
+			report(err)
+			return
+		}
+		if err := applyConfig(args); err != nil {
+			report(err)
+			return
+		}
+		run(nil, flag.Args())
+	}()
+
+	resp.ExitCode = exitCode
+	if resp.Stdout, err = ioutil.ReadFile(files[1].Name()); err != nil {
+		return resp, err
+	}
+	resp.Stderr, err = ioutil.ReadFile(files[2].Name())
+	return resp, err
+}
+
+// resetState resets the flags to their defaults and the state that
+// processing files accumulates, for the daemon's next request.
+func resetState() {
+	*options = returns.Options{}
+	flag.VisitAll(func(f *flag.Flag) { f.Value.Set(f.DefValue) })
+	exitCode, changedFiles, fixedReturns = exitClean, 0, 0
+	changedLines, refactorFunc, txtarResults, stagedResults = nil, nil, nil, nil
+	stats, counts = runStats{}, runSummary{}
+	rdResults.Diagnostics = []rdDiagnostic{}
+}
+
+// setEnv replaces the environment with env ("key=value" pairs).
+func setEnv(env []string) {
+	os.Clearenv()
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			os.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+}
@@ -0,0 +1,43 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenPrivate listens on the unix socket name, which only the user
+// can connect to, from the moment it's created.
+func listenPrivate(name string) (net.Listener, error) {
+	mask := syscall.Umask(0077)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", name)
+}
+
+// isOwnSocket reports whether fi (from os.Lstat) is a socket owned by
+// the user.
+func isOwnSocket(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode()&os.ModeSocket != 0 && int(st.Uid) == os.Getuid()
+}
+
+// privateDir creates dir, if need be, and checks that only the user
+// can use it.
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Getuid() || fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s must be a directory of yours that only you can use (mode 0700)", dir)
+	}
+	return nil
+}
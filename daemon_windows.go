@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func listenPrivate(name string) (net.Listener, error) {
+	return nil, errors.New("-daemon isn't supported on Windows")
+}
+
+// isOwnSocket reports false: there's no daemon on Windows.
+func isOwnSocket(fi os.FileInfo) bool {
+	return false
+}
+
+func privateDir(dir string) error {
+	return errors.New("-daemon isn't supported on Windows")
+}
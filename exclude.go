@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	excludeGlobs = flag.String("exclude", "", "comma-separated `globs` of files and directories to skip when walking a directory (relative to it) or expanding package patterns (relative to the current directory); * matches within a path element and ** matches any number of them (e.g., \"gen/**,**/*_string.go\")")
+	gitIgnore    = flag.Bool("gitignore", true, "when walking a directory in a git repository, skip the untracked files and directories that git ignores (by .gitignore files, .git/info/exclude, and the global excludes file)")
+)
+
+// excludes returns the -exclude globs.
+func excludes() []string {
+	var globs []string
+	for _, g := range strings.Split(*excludeGlobs, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			globs = append(globs, filepath.ToSlash(g))
+		}
+	}
+	return globs
+}
+
+// isExcluded reports whether the file or directory at rel, a path
+// relative to the root of a walk, matches one of the -exclude globs.
+func isExcluded(rel string) bool {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	for _, g := range excludes() {
+		if matchGlob(strings.Split(g, "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// configExclude holds the exclude globs of the config file (see
+// applyConfig), which are relative to its directory, and apply to every
+// file processed, including those named on the command line.
+var configExclude struct {
+	dir   string
+	globs []string
+}
+
+// setConfigExclude sets configExclude from v, the value of "exclude" in
+// the config file name: an array of globs, or a string of
+// comma-separated ones.
+func setConfigExclude(name string, v interface{}) error {
+	var globs []string
+	switch v := v.(type) {
+	case string:
+		globs = strings.Split(v, ",")
+	case []interface{}:
+		for _, g := range v {
+			g, ok := g.(string)
+			if !ok {
+				return fmt.Errorf("%s: exclude holds globs, which are strings", name)
+			}
+			globs = append(globs, g)
+		}
+	default:
+		return fmt.Errorf("%s: exclude is an array of globs", name)
+	}
+	configExclude.dir = filepath.Dir(absPath(name))
+	for _, g := range globs {
+		if g = strings.TrimSpace(g); g != "" {
+			configExclude.globs = append(configExclude.globs, filepath.ToSlash(g))
+		}
+	}
+	return nil
+}
+
+// excludedByConfig reports whether the file or directory at path
+// matches one of the config file's exclude globs.
+func excludedByConfig(path string) bool {
+	if len(configExclude.globs) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(configExclude.dir, absPath(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	for _, g := range configExclude.globs {
+		if matchGlob(strings.Split(g, "/"), strings.Split(filepath.ToSlash(rel), "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// gitIgnored returns the untracked files and directories in the tree
+// rooted at dir that git ignores, as slash-separated paths relative to
+// dir, or nil if -gitignore is off or dir isn't in a git repository.
+func gitIgnored(dir string) map[string]bool {
+	if !*gitIgnore {
+		return nil
+	}
+	// With --directory, an ignored directory is listed instead of its
+	// files, with a trailing slash.
+	out, err := command("git", "-C", dir, "ls-files", "-z", "--others", "--ignored", "--exclude-standard", "--directory")
+	if err != nil {
+		return nil
+	}
+	ignored := map[string]bool{}
+	for _, name := range splitNul(out) {
+		ignored[strings.TrimSuffix(name, "/")] = true
+	}
+	return ignored
+}
+
+// matchGlob reports whether the path elements name match the glob
+// elements pattern, where a "**" element matches any number of path
+// elements and others are matched as by path.Match.
+func matchGlob(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlob(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/format"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+var (
+	fixList = flag.String("fix", "", "comma-separated `list` of fixers to run (or \"none\"), or +name/-name to enable/disable fixers relative to the defaults (see \"goreturns version -json\")")
+
+	// Shorthands for -fix=+errlast and -fix=+ctxerr.
+	fixErrLast = flag.Bool("errlast", false, "move error results to the last position (same as -fix=+errlast)")
+	fixCtxErr  = flag.Bool("ctxerr", false, "return ctx.Err() from naked returns in \"case <-ctx.Done():\" branches (same as -fix=+ctxerr)")
+
+	formatOnly  = flag.Bool("format-only", false, "don't fix returns; only run goimports (or with -i=false, gofmt) on files, as a drop-in replacement for goimports")
+	returnsOnly = flag.Bool("returns-only", false, "only fix returns, changing no other lines: don't run goimports, or reformat the rest of the file (for use with other formatters, such as gofumpt)")
+)
+
+// formatOnlySource returns the result of -format-only for src, the
+// contents of filename, which goimports has formatted if goimported is
+// set.
+func formatOnlySource(pkgDir, filename string, src []byte, opt *returns.Options, goimported bool) ([]byte, error) {
+	switch {
+	case opt.Simplify:
+		// Print the file without fixing it.
+		nopt := *opt
+		nopt.Fixes, nopt.RemoveBareReturns, nopt.SyntaxOnly = []string{}, false, true
+		return returns.Process(pkgDir, filename, src, &nopt)
+	case goimported:
+		return src, nil
+	}
+	return format.Source(src)
+}
+
+// useGoimports reports whether goimports runs on files before their
+// returns are fixed.
+func useGoimports() bool {
+	return *goimports && !*returnsOnly
+}
+
+// setFixes sets options.Fixes from the -fix flag and its shorthands.
+func setFixes() error {
+	fixes, err := parseFixList(*fixList, returns.DefaultFixes)
+	if err != nil {
+		return err
+	}
+	if *fixErrLast {
+		fixes = addFix(fixes, "errlast")
+	}
+	if *fixCtxErr {
+		fixes = addFix(fixes, "ctxerr")
+	}
+	if options.RemoveBareReturns {
+		fixes = addFix(fixes, "bare")
+	}
+	options.Fixes = fixes
+	options.KeepFormatting = *returnsOnly
+	return nil
+}
+
+// parseFixList parses the value of the -fix flag (see
+// returns.ParseFixes), relative to defaults.
+func parseFixList(list string, defaults []string) ([]string, error) {
+	fixes, err := returns.ParseFixes(list, defaults)
+	if err != nil {
+		return nil, fmt.Errorf("-fix: %s", err)
+	}
+	return fixes, nil
+}
+
+// enabledFix reports whether fixes includes name.
+func enabledFix(fixes []string, name string) bool {
+	for _, f := range fixes {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func addFix(fixes []string, name string) []string {
+	if enabledFix(fixes, name) {
+		return fixes
+	}
+	return append(fixes, name)
+}
@@ -2,4 +2,8 @@ module github.com/sqs/goreturns
 
 go 1.14
 
-require golang.org/x/tools v0.0.0-20201017001424-6003fad69a88
+require (
+	github.com/fsnotify/fsnotify v1.4.9
+	golang.org/x/mod v0.3.0
+	golang.org/x/tools v0.0.0-20201017001424-6003fad69a88
+)
@@ -6,6 +6,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	_ "go/importer"
@@ -13,50 +15,141 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"strings"
+	"time"
 
+	"golang.org/x/tools/go/buildutil"
 	"golang.org/x/tools/imports"
 
 	"github.com/sqs/goreturns/returns"
 )
 
+// The exit codes of goreturns.
+const (
+	exitClean    = 0 // nothing needed fixing (or the results were printed)
+	exitChanges  = 1 // files needed fixing (-l, -d, -check, -lint) or were fixed (-w)
+	exitError    = 2 // a file couldn't be read or parsed, the command line was invalid, or the run was interrupted (type errors aren't fatal: goreturns fixes some of them)
+	exitInternal = 3 // goreturns itself failed, as by panicking
+)
+
 var (
 	// main operation modes
-	list   = flag.Bool("l", false, "list files whose formatting differs from goreturns's")
+	list   = flag.Bool("l", false, "list files whose formatting differs from goreturns's, followed by a summary on stderr")
 	write  = flag.Bool("w", false, "write result to (source) file instead of stdout")
 	doDiff = flag.Bool("d", false, "display diffs instead of rewriting files")
+	dryRun = flag.Bool("n", false, "print each fix of a return, as file:line:col: what it does [the values it adds], instead of rewriting files")
+	check  = flag.Bool("check", false, "list files whose formatting differs from goreturns's without writing anything, and exit with status 1 if there are any (status 2 means an error)")
+	lint   = flag.Bool("lint", false, "report incomplete, bare, and missing returns (and other problems) as file:line:col findings instead of rewriting files; exit status 1 if any are found")
 	srcdir = flag.String("srcdir", "", "choose imports as if source code is from `dir`. When operating on a single file, dir may instead be the complete file name.")
 
 	goimports = flag.Bool("i", true, "run goimports on the file prior to processing")
+	modified  = flag.Bool("modified", false, "read an archive of modified files (such as unsaved editor buffers) from standard input and use them in place of the files on disk")
+	cacheDir  = flag.String("cache", "", "`dir` in which to cache the export data of dependencies typechecked from source (default: goreturns in the user cache directory; \"off\" disables the cache)")
+	buildTags = flag.String("tags", "", "comma- or space-separated `list` of additional build tags to consider satisfied when loading packages (as with \"go build -tags\")")
+	walkAll   = flag.Bool("walkall", false, "when walking directories, also process files in vendor and testdata directories and those whose names begin with \".\"")
+	countOnly = flag.Bool("count-only", false, "with -l, print only the number of files whose formatting differs")
+	timeout   = flag.Duration("timeout", 0, "give up loading and typechecking a file's package after `duration` and fix the file from its syntax alone (0 means no limit)")
+	stdinName = flag.String("stdin-filename", "", "when reading from standard input, treat it as the contents of the file `name`: find its package (and imports) from it, and use it in errors, diffs, and JSON output")
+	cursor    = flag.Int("cursor", -1, "when reading from standard input, print the byte `offset` in the output that corresponds to this offset in the input (as {\"cursor\":offset} on a line before the output, or with -output=json, in the result), so that editors can keep the caret in place")
 
 	options  = &returns.Options{}
-	exitCode = 0
+	exitCode = exitClean
+
+	// counted for the -l summary
+	changedFiles int
+	fixedReturns int
 )
 
 func init() {
-	flag.BoolVar(&options.PrintErrors, "p", false, "print non-fatal typechecking errors to stderr")
-	flag.BoolVar(&options.AllErrors, "e", false, "report all errors (not just the first 10 on different lines)")
-	flag.BoolVar(&options.RemoveBareReturns, "b", false, "remove bare returns")
+	bindOptionFlags(flag.CommandLine, options)
 	flag.StringVar(
 		&imports.LocalPrefix,
 		"local",
 		"",
-		"put imports beginning with this string after 3rd-party packages (see goimports)",
+		"put imports beginning with this string (or with one of these comma-separated strings) after 3rd-party packages (see goimports)",
 	)
 }
 
+// bindOptionFlags defines on fs the flags that set the fields of opt.
+// Config files in subdirectories may set them (see dirOptions).
+func bindOptionFlags(fs *flag.FlagSet, opt *returns.Options) {
+	fs.BoolVar(&opt.PrintErrors, "p", false, "print non-fatal typechecking errors to stderr")
+	fs.BoolVar(&opt.AllErrors, "e", false, "report all errors (not just the first 10 on different lines)")
+	fs.BoolVar(&opt.Simplify, "s", false, "simplify code (as gofmt -s does)")
+	fs.BoolVar(&opt.RemoveBareReturns, "b", false, "expand every bare return into an explicit return of the named results (same as -fix=+bare)")
+	fs.BoolVar(&opt.ReportNilNil, "nilnil", false, "with -lint, also report \"return nil, nil\" in functions whose last result is error")
+	fs.BoolVar(&opt.ErrorFuncsOnly, "erronly", false, "only complete returns in functions whose last result is error")
+	fs.BoolVar(&opt.SkipBadDecls, "skipbad", false, "leave top-level declarations with syntax errors (such as syntax newer than goreturns supports) as they are, and fix the rest of the file")
+	fs.BoolVar(&opt.SyntaxOnly, "syntaxonly", false, "don't load or typecheck packages; fix returns from the syntax alone (returns of calls and values of named types are left alone)")
+	fs.Var(importerFlag{&opt.ImportStrategy}, "importer", "`strategy` for importing dependencies when typechecking: auto (compiled export data, falling back to source), export, or source (default auto)")
+	fs.StringVar(&opt.ZeroValueComment, "annotate", "", "append a /* `text` */ comment after each inserted zero value")
+}
+
+// importerFlag is a flag.Value for a returns.ImportStrategy.
+type importerFlag struct{ s *returns.ImportStrategy }
+
+func (f importerFlag) String() string {
+	if f.s == nil {
+		return returns.ImportAuto.String()
+	}
+	return f.s.String()
+}
+
+func (f importerFlag) Set(name string) error {
+	s, err := returns.ParseImportStrategy(name)
+	if err != nil {
+		return err
+	}
+	*f.s = s
+	return nil
+}
+
+// setOptions sets the options that are derived from flags after they
+// are parsed.
+func setOptions() error {
+	options.BuildTags = strings.FieldsFunc(*buildTags, func(r rune) bool { return r == ',' || r == ' ' })
+	switch *cacheDir {
+	case "off":
+		options.CacheDir = ""
+	case "":
+		if dir, err := os.UserCacheDir(); err == nil {
+			options.CacheDir = filepath.Join(dir, "goreturns")
+		}
+	default:
+		options.CacheDir = *cacheDir
+	}
+	var err error
+	if colored, err = colorDiffs(); err != nil {
+		return err
+	}
+	if err := setImportSections(); err != nil {
+		return err
+	}
+	return setFixes()
+}
+
 func report(err error) {
 	scanner.PrintError(os.Stderr, err)
-	exitCode = 2
+	exitCode = exitError
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: goreturns [flags] [path ...]\n")
+	fmt.Fprintf(os.Stderr, "usage: goreturns [flags] [path or package pattern ...]\n")
+	fmt.Fprintf(os.Stderr, "       goreturns clean [dir ...]\n")
+	fmt.Fprintf(os.Stderr, "       goreturns install-hook [-fix] [-force] [-pre-commit-config]\n")
+	fmt.Fprintf(os.Stderr, "       goreturns lsp [flags]\n")
+	fmt.Fprintf(os.Stderr, "       goreturns pre-commit [-force] [-- flags]\n")
+	fmt.Fprintf(os.Stderr, "       goreturns resume journal\n")
+	fmt.Fprintf(os.Stderr, "       goreturns self-update [-check] [-timeout duration]\n")
+	fmt.Fprintf(os.Stderr, "       goreturns version [-json]\n")
+	fmt.Fprintf(os.Stderr, "       goreturns why [flags] file.go\n")
+	fmt.Fprintf(os.Stderr, "       goreturns -daemon [flags]\n")
 	flag.PrintDefaults()
-	os.Exit(2)
+	fmt.Fprintf(os.Stderr, "exit status: 0 if clean, 1 if files need fixing (-l, -d, -check, -lint) or were fixed (-w), 2 on errors (such as parse errors), 3 on internal errors\n")
+	os.Exit(exitError)
 }
 
 func isGoFile(f os.FileInfo) bool {
@@ -66,25 +159,197 @@ func isGoFile(f os.FileInfo) bool {
 }
 
 func processFile(pkgDir, filename string, in io.Reader, out io.Writer, stdin bool) error {
-	opt := options
+	if stdin && *stdinName != "" && excludedByConfig(filename) {
+		// Editors send excluded files too; give them back unchanged.
+		src, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		f := &pendingFile{pkgDir: pkgDir, filename: filename, opt: options, stdin: true, src: src, out: src, fixed: true}
+		return f.finish(out)
+	}
+	f, err := prepareFile(pkgDir, filename, in, stdin)
+	if f == nil {
+		return err
+	}
+	f.fix(nil)
+	return f.finish(out)
+}
+
+// processFiles processes files, all in the directory pkgDir. After
+// goimports has run on each, their packages are loaded and typechecked
+// once for all of them (see returns.LoadFiles), unless each file's
+// typechecking is limited by -timeout. The work is done concurrently
+// with that of other directories (see -jobs), but the results are
+// printed in order.
+func processFiles(pkgDir string, filenames []string) {
+	if len(configExclude.globs) > 0 {
+		var todo []string
+		for _, filename := range filenames {
+			if !excludedByConfig(filename) {
+				todo = append(todo, filename)
+			}
+		}
+		filenames = todo
+	}
+	if writer.journal != nil {
+		var todo []string
+		for _, filename := range filenames {
+			if !writer.journal.completed(filename) {
+				todo = append(todo, filename)
+			}
+		}
+		filenames = todo
+	}
+	queue.add(func() func() {
+		files, errs := fixFiles(pkgDir, filenames)
+		return func() {
+			for _, err := range errs {
+				report(err)
+			}
+			for _, f := range files {
+				if isInterrupted() {
+					return
+				}
+				if err := f.finish(os.Stdout); err != nil {
+					report(err)
+				}
+			}
+		}
+	})
+}
+
+// fixFiles prepares and fixes files (see processFiles), returning them
+// along with the errors that kept others from being prepared.
+func fixFiles(pkgDir string, filenames []string) (files []*pendingFile, errs []error) {
+	dirOpt, err := dirOptions(pkgDir)
+	if err != nil {
+		return nil, []error{err}
+	}
+	for _, filename := range filenames {
+		if isInterrupted() {
+			return files, errs
+		}
+		f, err := prepareFile(pkgDir, filename, nil, false)
+		if err != nil {
+			errs = append(errs, err)
+		} else if f != nil {
+			files = append(files, f)
+		}
+	}
+
+	var batch *returns.Batch
+	if len(files) > 1 && refactorFunc == nil && *timeout == 0 && !*lint && !*formatOnly {
+		names := make([]string, len(files))
+		srcs := make([][]byte, len(files))
+		for i, f := range files {
+			names[i], srcs[i] = f.filename, f.res
+		}
+		opt := traced(dirOpt, pkgDir)
+		if *printStats {
+			nopt := *opt
+			nopt.Timing = &returns.Timing{}
+			opt = &nopt
+			// The shared loading is recorded under the directory.
+			defer func(start time.Time) {
+				recordFileStats(pkgDir, 0, time.Since(start), opt.Timing)
+			}(time.Now())
+		}
+		batch = returns.LoadFiles(pkgDir, names, srcs, opt)
+	}
+
+	for _, f := range files {
+		if isInterrupted() {
+			return files, errs
+		}
+		f.fix(batch)
+	}
+	return files, errs
+}
+
+// A pendingFile is a file being processed: read and run through
+// goimports by prepareFile, then fixed by fix, and then written,
+// listed, or diffed by finish.
+type pendingFile struct {
+	pkgDir, filename string
+	src              []byte // as read
+	res              []byte // the result of processing so far
+	opt              *returns.Options
+	stdin            bool
+	start            time.Time
+	elapsed          time.Duration // time spent preparing the file
+	importsTime      time.Duration
+
+	diags []returns.Diagnostic // with -lint, the problems found
+
+	// Set by fix.
+	fixed        bool
+	out          []byte // the result of fixing res
+	err          error
+	decisions    []returns.Diagnostic // with -output=json or rdjson
+	fixedReturns int                  // with -l, the number of returns fixed
+}
+
+// prepareFile reads filename (from in, if it is non-nil) and runs
+// goimports on it, or with -lint, checks it. It returns nil if there's
+// nothing more to do: the file has no changed lines, or there was an
+// error.
+func prepareFile(pkgDir, filename string, in io.Reader, stdin bool) (f *pendingFile, err error) {
+	opt, err := dirOptions(pkgDir)
+	if err != nil {
+		return nil, err
+	}
 	if stdin {
-		nopt := *options
+		nopt := *opt
 		nopt.Fragment = true
 		opt = &nopt
+	} else if changedLines != nil {
+		lines, ok := changedLinesOf(filename)
+		if !ok {
+			return nil, nil // unchanged file
+		}
+		nopt := *opt
+		nopt.Lines = lines
+		opt = &nopt
 	}
+	f = &pendingFile{pkgDir: pkgDir, filename: filename, opt: opt, stdin: stdin, start: time.Now()}
+	if *printStats {
+		nopt := *opt
+		nopt.Timing = &returns.Timing{}
+		f.opt = &nopt
+		defer func(f0 *pendingFile) {
+			if f == nil {
+				// Otherwise, fix records the statistics.
+				recordFileStats(filename, f0.importsTime, time.Since(f0.start), f0.opt.Timing)
+			}
+		}(f)
+	}
+	f.opt = traced(f.opt, filename)
+	opt = f.opt
 
+	if data, ok := options.Overlay[absPath(filename)]; ok && in == nil {
+		in = bytes.NewReader(data)
+	}
 	if in == nil {
-		f, err := os.Open(filename)
+		fh, err := os.Open(filename)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer f.Close()
-		in = f
+		defer fh.Close()
+		in = fh
 	}
 
 	src, err := ioutil.ReadAll(in)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	f.src = src
+
+	if *lint {
+		if f.diags, err = returns.Check(pkgDir, filename, src, opt); err != nil {
+			return nil, err
+		}
+		return f, nil
 	}
 
 	var res = src // This holds the result of processing so far.
@@ -95,14 +360,14 @@ func processFile(pkgDir, filename string, in io.Reader, out io.Writer, stdin boo
 		// and then use it to override the target.
 		//
 		// See https://github.com/dominikh/go-mode.el/issues/146
-		f, err := os.Open(*srcdir)
+		fh, err := os.Open(*srcdir)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer f.Close()
-		stat, err := f.Stat()
+		defer fh.Close()
+		stat, err := fh.Stat()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if isGoFile(stat) {
 			target = *srcdir
@@ -114,65 +379,251 @@ func processFile(pkgDir, filename string, in io.Reader, out io.Writer, stdin boo
 		}
 	}
 
-	if *goimports {
+	if useGoimports() {
 		var err error
-		res, err = imports.Process(target, res, &imports.Options{
-			Fragment:  opt.Fragment,
-			AllErrors: opt.AllErrors,
-			Comments:  true,
-			TabIndent: true,
-			TabWidth:  8,
-		})
+		start := time.Now()
+		res, err = goimportsSource(target, res, opt)
+		f.importsTime = time.Since(start)
+		if _, ok := err.(scanner.ErrorList); ok && opt.SkipBadDecls {
+			// goimports can't process a file with syntax errors;
+			// let returns.Process skip the bad declarations.
+			res, err = src, nil
+		}
 		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(src, res) {
+			tracef(opt, "goimports: no changes")
+		} else {
+			tracef(opt, "goimports: changed imports or formatting")
+			if opt.Lines != nil {
+				// The changed lines are those of src, and goimports
+				// may have moved them.
+				nopt := *opt
+				nopt.Lines = mapLineRanges(src, res, opt.Lines)
+				f.opt = &nopt
+			}
+		}
+	}
+	f.res = res
+	f.elapsed = time.Since(f.start)
+	return f, nil
+}
+
+// importsOptions returns the goimports options for processing a file
+// with opt.
+func importsOptions(opt *returns.Options) *imports.Options {
+	return &imports.Options{
+		Fragment:  opt.Fragment,
+		AllErrors: opt.AllErrors,
+		Comments:  true,
+		TabIndent: true,
+		TabWidth:  8,
+	}
+}
+
+// fix fixes the returns in the file (using batch's type information if
+// batch is non-nil), recording the result in f.
+func (f *pendingFile) fix(batch *returns.Batch) {
+	if *printStats {
+		// Loading a batch isn't included in the total; processFiles
+		// records it separately.
+		defer func(start time.Time) {
+			recordFileStats(f.filename, f.importsTime, f.elapsed+time.Since(start), f.opt.Timing)
+		}(time.Now())
+	}
+	if *lint {
+		return
+	}
+	f.fixed = true
+	opt := f.opt
+	if jsonOutput() || *list || *summary != "" || *dryRun {
+		nopt := *opt
+		if jsonOutput() || *summary != "" || *dryRun {
+			nopt.Decisions = &f.decisions
+		}
+		if *list {
+			nopt.FixedReturns = &f.fixedReturns
+		}
+		opt = &nopt
+	}
+	switch {
+	case *formatOnly:
+		f.out, f.err = formatOnlySource(f.pkgDir, f.filename, f.res, opt, useGoimports())
+	case refactorFunc != nil:
+		f.out, f.err = refactor(f.pkgDir, f.filename, f.res, opt)
+	case batch != nil:
+		f.out, f.err = batch.Process(f.filename, opt)
+	case *timeout > 0:
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		f.out, f.err = returns.ProcessContext(ctx, f.pkgDir, f.filename, f.res, opt)
+		cancel()
+	default:
+		f.out, f.err = returns.Process(f.pkgDir, f.filename, f.res, opt)
+	}
+	switch {
+	case f.err != nil:
+		tracef(opt, "result: %s", f.err)
+	case bytes.Equal(f.src, f.out):
+		tracef(opt, "result: no changes")
+	case bytes.Equal(f.res, f.out):
+		tracef(opt, "result: changed by goimports only")
+	default:
+		tracef(opt, "result: changed")
+	}
+}
+
+// finish writes, lists, or diffs the result of fix (or with -lint,
+// prints the problems found).
+func (f *pendingFile) finish(out io.Writer) error {
+	if *lint {
+		for _, d := range f.diags {
+			fmt.Fprintln(out, d)
+		}
+		if len(f.diags) > 0 && exitCode == exitClean {
+			exitCode = exitChanges
+		}
+		return nil
+	}
+	if !f.fixed {
+		return nil // interrupted
+	}
+	filename, src, res := f.filename, f.src, f.out
+	if f.err != nil {
+		return f.err
+	}
+	fixedReturns += f.fixedReturns
+	newCursor := -1
+	if *cursor >= 0 && f.stdin {
+		if *cursor > len(src) {
+			return fmt.Errorf("-cursor %d is past the end of the input (%d bytes)", *cursor, len(src))
+		}
+		newCursor = returns.MapOffset(src, res, *cursor)
+	}
+	if jsonOutput() {
+		r := fileResult(filename, src, f.res, res, f.decisions)
+		if newCursor >= 0 {
+			r.Cursor = &newCursor
+		}
+		if *outputFormat == "rdjson" {
+			addRDJSON(r, src)
+		} else if err := writeJSON(out, r); err != nil {
 			return err
 		}
 	}
 
-	res, err = returns.Process(pkgDir, filename, res, opt)
-	if err != nil {
-		return err
+	if *interactive && !bytes.Equal(src, res) {
+		chosen, err := chooseEdits(out, filename, src, res)
+		if err != nil {
+			return err
+		}
+		res = chosen
+	}
+	if *summary != "" {
+		countFile(!bytes.Equal(src, res), f.decisions)
+	}
+	if *dryRun {
+		for _, d := range fileResult(filename, src, f.res, res, f.decisions).Diagnostics {
+			if !strings.HasPrefix(d.Message, "fixed: ") {
+				continue
+			}
+			fmt.Fprintf(out, "%s:%d:%d: %s", filename, d.Line, d.Column, strings.TrimPrefix(d.Message, "fixed: "))
+			if d.Added != "" {
+				fmt.Fprintf(out, " [%s]", d.Added)
+			}
+			fmt.Fprintln(out)
+		}
 	}
 
+	var err error
 	if !bytes.Equal(src, res) {
 		// formatting has changed
-		if *list {
+		changedFiles++
+		if *list && !*countOnly || *check {
 			fmt.Fprintln(out, filename)
 		}
 		if *write {
-			err = ioutil.WriteFile(filename, res, 0)
-			if err != nil {
+			if stagedResults != nil {
+				stagedResults[filename] = res
+			} else if err = writer.write(filename, res); err != nil {
 				return err
 			}
 		}
 		if *doDiff {
-			data, err := diff(src, res)
-			if err != nil {
-				return fmt.Errorf("computing diff: %s", err)
-			}
-			fmt.Printf("diff %s gofmt/%s\n", filename, filename)
-			out.Write(data)
+			out.Write(diff(filename, src, res))
+		}
+	} else if *write && !f.stdin {
+		if err := writer.skip(filename); err != nil {
+			return err
 		}
 	}
 
-	if !*list && !*write && !*doDiff {
-		_, err = out.Write(res)
+	if !*list && !*write && !*doDiff && !*check && !*dryRun && !jsonOutput() {
+		if txtarResults != nil {
+			txtarResults[filename] = res
+		} else {
+			if newCursor >= 0 {
+				fmt.Fprintf(out, "{\"cursor\":%d}\n", newCursor)
+			}
+			_, err = out.Write(res)
+		}
 	}
 
 	return err
 }
 
-func visitFile(path string, f os.FileInfo, err error) error {
-	if err == nil && isGoFile(f) {
-		err = processFile(filepath.Dir(path), path, nil, os.Stdout, false)
-	}
-	if err != nil {
-		report(err)
+// errInterrupted stops a directory walk when the process is interrupted.
+var errInterrupted = errors.New("interrupted")
+
+// walkDir processes the Go files in the tree rooted at path, a
+// directory at a time, skipping those excluded by -exclude and (unless
+// -walkall is set) those in vendor, testdata, and hidden directories.
+func walkDir(path string) {
+	var dirs []string
+	files := map[string][]string{}
+	root := path
+	ignored := gitIgnored(root)
+	filepath.Walk(path, func(path string, f os.FileInfo, err error) error {
+		if isInterrupted() {
+			return errInterrupted
+		}
+		if err != nil {
+			report(err)
+			return nil
+		}
+		if path == root {
+			// Walk the directory named on the command line, whatever
+			// its name.
+		} else if f.IsDir() && !*walkAll && isSkippedDir(f.Name()) {
+			return filepath.SkipDir
+		} else if rel, err := filepath.Rel(root, path); err == nil && (isExcluded(rel) || ignored[filepath.ToSlash(rel)] || excludedByConfig(path)) {
+			if f.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isGoFile(f) {
+			dir := filepath.Dir(path)
+			if files[dir] == nil {
+				dirs = append(dirs, dir)
+			}
+			files[dir] = append(files[dir], path)
+		}
+		return nil
+	})
+	for _, dir := range dirs {
+		if isInterrupted() {
+			return
+		}
+		processFiles(dir, files[dir])
 	}
-	return nil
 }
 
-func walkDir(path string) {
-	filepath.Walk(path, visitFile)
+// isSkippedDir reports whether directories named name are skipped by
+// default when walking: vendored code, test data, and hidden
+// directories (such as .git).
+func isSkippedDir(name string) bool {
+	return name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".")
 }
 
 func main() {
@@ -185,55 +636,422 @@ func main() {
 	os.Exit(exitCode)
 }
 
+// commands are the subcommands of goreturns, run as "goreturns cmd
+// [args]". Without a subcommand, goreturns processes files.
+var commands = map[string]func(args []string){
+	"clean":        cleanMain,
+	"install-hook": installHookMain,
+	"lsp":          lspMain,
+	"pre-commit":   preCommitMain,
+	"resume":       resumeMain,
+	"self-update":  selfUpdateMain,
+	"version":      versionMain,
+	"why":          whyMain,
+}
+
 func gofmtMain() {
+	defer func() {
+		if r := recover(); r != nil {
+			cleanupTempFiles()
+			fmt.Fprintf(os.Stderr, "goreturns: internal error: %v\n\n%s", r, debug.Stack())
+			exitCode = exitInternal
+		}
+	}()
+
 	flag.Usage = usage
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
+	if err := applyConfig(os.Args[1:]); err != nil {
+		report(err)
+		return
+	}
+	if *printVersion {
+		printVersionInfo(false)
+		return
+	}
+	err := startProfiling()
+	defer stopProfiling()
+	if err != nil {
+		report(err)
+		return
+	}
+	if *daemon {
+		serveDaemon()
+		return
+	}
+	if flag.NArg() == 0 && !*watch && proxyToDaemon(os.Args[1:]) {
+		return
+	}
+
+	var j *journal
+	if *journalTo != "" {
+		if !*write {
+			report(errors.New("-journal requires -w"))
+			return
+		}
+		var err error
+		j, err = createJournal(*journalTo, os.Args[1:])
+		if err != nil {
+			report(err)
+			return
+		}
+	}
+	run(j, flag.Args())
+}
+
+// writer writes rewritten files in -w mode.
+var writer *fileWriter
+
+// run processes the files, directories, and package patterns in paths
+// (or stdin), recording progress in j if it is non-nil.
+func run(j *journal, paths []string) {
+	if j != nil {
+		defer j.Close()
+	}
+	if err := setOptions(); err != nil {
+		report(err)
+		return
+	}
+	if *showConfig != "" {
+		if err := printConfig(os.Stdout, *showConfig); err != nil {
+			report(err)
+		}
+		return
+	}
+	if *check && (*write || *doDiff || *list) {
+		report(errors.New("-check can't be combined with -w, -d, or -l"))
+		return
+	}
+	if *dryRun && (*write || *doDiff || *list || *check || *lint || jsonOutput()) {
+		report(errors.New("-n can't be combined with -w, -d, -l, -check, -lint, -output=json, or -output=rdjson"))
+		return
+	}
+	if err := checkOutputFormat(); err != nil {
+		report(err)
+		return
+	}
+	if err := checkSummary(); err != nil {
+		report(err)
+		return
+	}
+	if *cursor >= 0 && (*write || *doDiff || *list || *check || *lint || *txtarMode || *outputFormat == "rdjson") {
+		report(errors.New("-cursor can't be combined with -w, -d, -l, -check, -lint, -txtar, or -output=rdjson"))
+		return
+	}
+	if *formatOnly && (*lint || refactoring() || *returnsOnly) {
+		report(errors.New("-format-only can't be combined with -lint, -add-result, -remove-result, or -returns-only"))
+		return
+	}
+	var err error
+	writer, err = newFileWriter(j)
+	if err != nil {
+		report(err)
+		return
+	}
+	handleInterrupts()
+	defer func() {
+		queue.wait()
+		if err := writer.flush(); err != nil {
+			report(err)
+		}
+		if *list && !isInterrupted() {
+			printListSummary()
+		}
+		if (*list || *doDiff || *check || *dryRun || *write) && changedFiles > 0 && exitCode == exitClean && !*watch {
+			exitCode = exitChanges
+		}
+		if *outputFormat == "rdjson" {
+			writeRDJSON()
+		}
+		if *printStats {
+			writeStats()
+		}
+		if *summary != "" {
+			writeSummary()
+		}
+		if isInterrupted() && !*watch { // interrupting is how -watch stops
+			fmt.Fprintln(os.Stderr, "goreturns: interrupted")
+			if j != nil {
+				fmt.Fprintf(os.Stderr, "goreturns: run \"goreturns resume %s\" to continue\n", j.f.Name())
+			}
+			exitCode = exitError
+		}
+	}()
+
+	if *txtarMode {
+		if *write || *modified || refactoring() || len(paths) > 0 {
+			report(errors.New("-txtar reads its files from standard input; it can't be combined with -w, -modified, -add-result, -remove-result, or path arguments"))
+			return
+		}
+		if err := processTxtar(os.Stdin, os.Stdout); err != nil {
+			report(err)
+		}
+		return
+	}
+
+	if err := checkInteractive(paths); err != nil {
+		report(err)
+		return
+	}
+
+	if *staged {
+		if err := checkStaged(paths); err != nil {
+			report(err)
+			return
+		}
+		if err := processStaged(); err != nil {
+			report(err)
+		}
+		return
+	}
 
-	if flag.NArg() == 0 {
-		if err := processFile("", "<standard input>", os.Stdin, os.Stdout, true); err != nil {
+	if refactoring() {
+		if *addResult != "" && *removeResult >= 0 {
+			report(errors.New("-add-result and -remove-result are mutually exclusive"))
+			return
+		}
+		if len(paths) == 0 {
+			report(errors.New("-add-result and -remove-result require a function argument (pkg.Func or pkg.Type.Method)"))
+			return
+		}
+		refactorFunc, err = parseFuncSpec(paths[0])
+		if err != nil {
 			report(err)
+			return
+		}
+		defer func() {
+			if !refactorFunc.found && !isInterrupted() {
+				report(fmt.Errorf("function %s not found", refactorFunc))
+			}
+		}()
+		paths = paths[1:]
+		if len(paths) == 0 {
+			paths = []string{"."}
+		}
+	}
+
+	if *modified {
+		if len(paths) == 0 {
+			report(errors.New("-modified requires file or directory arguments (standard input holds the archive)"))
+			return
 		}
+		if err := readModified(os.Stdin); err != nil {
+			report(err)
+			return
+		}
+	}
+
+	cs, err := newChangeSource()
+	if err != nil {
+		report(err)
 		return
 	}
+	if cs != nil {
+		if changedLines, err = cs.Changes(); err != nil {
+			report(err)
+			return
+		}
+		if len(paths) == 0 {
+			if paths = changedGoFiles(); len(paths) == 0 {
+				return
+			}
+		}
+	}
 
-	for i := 0; i < flag.NArg(); i++ {
-		path := flag.Arg(i)
+	if *watch {
+		if len(paths) == 0 {
+			paths = []string{"."}
+		}
+		if err := watchPaths(paths); err != nil {
+			report(err)
+		}
+		return
+	}
+
+	if len(paths) == 0 {
+		dropConfigModes()
+		if *write {
+			report(errors.New("can't use -w with standard input"))
+			return
+		}
+		filename, pkgDir := "<standard input>", ""
+		if *stdinName != "" {
+			filename, pkgDir = *stdinName, filepath.Dir(*stdinName)
+		}
+		if err := processFile(pkgDir, filename, os.Stdin, os.Stdout, true); err != nil {
+			report(err)
+		}
+		return
+	}
+	if *stdinName != "" {
+		report(errors.New("-stdin-filename can't be used with path arguments"))
+		return
+	}
+	if *cursor >= 0 {
+		report(errors.New("-cursor can't be used with path arguments"))
+		return
+	}
+
+	// Consecutive file arguments in the same directory are processed
+	// together.
+	var files []string
+	flush := func() {
+		if len(files) > 0 {
+			processFiles(filepath.Dir(files[0]), files)
+			files = nil
+		}
+	}
+	for _, path := range paths {
+		if isInterrupted() {
+			break
+		}
+		if isPattern(path) {
+			flush()
+			if err := processPattern(path); err != nil {
+				report(err)
+			}
+			continue
+		}
 		switch dir, err := os.Stat(path); {
+		case os.IsNotExist(err) && !strings.HasSuffix(path, ".go"):
+			// Perhaps an import path; if it isn't one either, the
+			// error is expandPattern's, which says so.
+			flush()
+			if err := processPattern(path); err != nil {
+				report(err)
+			}
 		case err != nil:
 			report(err)
 		case dir.IsDir():
+			flush()
 			walkDir(path)
 		default:
-			if err := processFile(filepath.Dir(path), path, nil, os.Stdout, false); err != nil {
-				report(err)
+			if len(files) > 0 && filepath.Dir(files[0]) != filepath.Dir(path) {
+				flush()
 			}
+			files = append(files, path)
 		}
 	}
+	flush()
 }
 
-func diff(b1, b2 []byte) (data []byte, err error) {
-	f1, err := ioutil.TempFile("", "gofmt")
-	if err != nil {
+// printListSummary prints the number of files listed by -l: alone on
+// stdout with -count-only, or else on stderr along with the number of
+// returns fixed in them.
+func printListSummary() {
+	if *countOnly {
+		fmt.Println(changedFiles)
 		return
 	}
-	defer os.Remove(f1.Name())
-	defer f1.Close()
+	verb := "would change"
+	if *write {
+		verb = "changed"
+	}
+	fmt.Fprintf(os.Stderr, "%s %s, %s fixed\n", plural(changedFiles, "file"), verb, plural(fixedReturns, "return"))
+}
 
-	f2, err := ioutil.TempFile("", "gofmt")
+// plural returns "n noun" or "n nouns", as appropriate.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// readModified reads an archive of modified files from r into
+// options.Overlay, keyed by absolute path. The archive format is the
+// one used by "goimports -modified" and guru: each file is its name, a
+// newline, its size in bytes as a decimal integer, a newline, and its
+// contents.
+func readModified(r io.Reader) error {
+	archive, err := buildutil.ParseOverlayArchive(r)
 	if err != nil {
-		return
+		return fmt.Errorf("reading -modified archive: %s", err)
 	}
-	defer os.Remove(f2.Name())
-	defer f2.Close()
+	options.Overlay = make(map[string][]byte, len(archive))
+	for name, data := range archive {
+		options.Overlay[absPath(name)] = data
+	}
+	return nil
+}
+
+func absPath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return filepath.Clean(name)
+}
+
+var (
+	diffContext = flag.Int("diff-context", 3, "with -d, show `n` lines of context around each change")
+	diffColor   = flag.String("color", "auto", "with -d, color diffs: auto (if standard output is a terminal), always, or never")
+
+	colored bool // whether diffs are colored, according to -color
+)
 
-	f1.Write(b1)
-	f2.Write(b2)
+// diff returns a unified diff of the changes to filename, from b1 to b2,
+// with -diff-context lines of context, as "diff -u" would print for
+// a/filename and b/filename.
+func diff(filename string, b1, b2 []byte) []byte {
+	name := strings.TrimPrefix(filepath.ToSlash(filename), "/")
+	d := returns.Diff("a/"+name, "b/"+name, b1, b2, *diffContext)
+	if colored {
+		d = colorize(d)
+	}
+	return d
+}
 
-	data, err = exec.Command("diff", "-u", f1.Name(), f2.Name()).CombinedOutput()
-	if len(data) > 0 {
-		// diff exits with a non-zero status when the files don't match.
-		// Ignore that failure as long as we get output.
-		err = nil
+// colorDiffs reports whether diffs should be colored, according to
+// -color. With "auto", they are if standard output is a terminal (and
+// NO_COLOR isn't set).
+func colorDiffs() (bool, error) {
+	switch *diffColor {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return false, nil
+		}
+		fi, err := os.Stdout.Stat()
+		return err == nil && fi.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, fmt.Errorf("invalid -color %q (want auto, always, or never)", *diffColor)
+}
+
+// colorize adds terminal colors to the lines of d, a unified diff of
+// one file: bold file names, cyan hunk headers, red removed lines, and
+// green added lines.
+func colorize(d []byte) []byte {
+	var buf bytes.Buffer
+	for i, line := range bytes.SplitAfter(d, []byte("\n")) {
+		var color string
+		switch {
+		case len(line) == 0:
+		case i < 2: // the "---" and "+++" lines
+			color = "\x1b[1m"
+		case line[0] == '@':
+			color = "\x1b[36m"
+		case line[0] == '-':
+			color = "\x1b[31m"
+		case line[0] == '+':
+			color = "\x1b[32m"
+		}
+		if color == "" {
+			buf.Write(line)
+			continue
+		}
+		text := bytes.TrimSuffix(line, []byte("\n"))
+		buf.WriteString(color)
+		buf.Write(text)
+		buf.WriteString("\x1b[0m")
+		buf.Write(line[len(text):])
 	}
-	return
+	return buf.Bytes()
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hookMarker identifies pre-commit hooks written by install-hook, which
+// it may overwrite.
+const hookMarker = `# Installed by "goreturns install-hook".`
+
+// preCommitConfig is the .pre-commit-config.yaml snippet printed by
+// "goreturns install-hook -pre-commit-config". The pre-commit framework
+// stashes unstaged changes and passes the staged files as arguments.
+const preCommitConfig = `- repo: local
+  hooks:
+    - id: goreturns
+      name: goreturns
+      entry: goreturns -check
+      language: system
+      types: [go]
+`
+
+// installHookMain implements "goreturns install-hook [-fix] [-force]
+// [-pre-commit-config]", which writes a git pre-commit hook that checks
+// the staged Go files (as "goreturns -staged -check" does) and fails
+// the commit if they need fixing, or with -fix, fixes and restages
+// them. With -pre-commit-config, it instead prints a snippet for the
+// .pre-commit-config.yaml of the pre-commit framework.
+func installHookMain(args []string) {
+	fs := flag.NewFlagSet("install-hook", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "fix and restage the staged files (as \"goreturns -staged -w\" does) instead of failing the commit")
+	force := fs.Bool("force", false, "replace an existing pre-commit hook that goreturns didn't install")
+	config := fs.Bool("pre-commit-config", false, "print a snippet for .pre-commit-config.yaml (see https://pre-commit.com) instead of installing a hook")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "usage: goreturns install-hook [-fix] [-force] [-pre-commit-config]\n")
+		os.Exit(exitError)
+	}
+	if *config {
+		if *fix {
+			report(fmt.Errorf("install-hook: -fix can't be combined with -pre-commit-config (the pre-commit framework restages nothing)"))
+			return
+		}
+		fmt.Print(preCommitConfig)
+		return
+	}
+	name, err := installHook(*fix, *force)
+	if err != nil {
+		report(err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "goreturns: installed %s\n", name)
+}
+
+// installHook writes the pre-commit hook of the git repository
+// containing the current directory and returns its name.
+func installHook(fix, force bool) (string, error) {
+	out, err := command("git", "rev-parse", "--git-path", "hooks/pre-commit")
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(string(out)) // respects core.hooksPath
+	if old, err := ioutil.ReadFile(name); err == nil && !bytes.Contains(old, []byte(hookMarker)) && !force {
+		return "", fmt.Errorf("install-hook: %s already exists (use -force to replace it)", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(name, []byte(hookScript(fix)), 0755); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the mode of an existing file, which may not be
+	// executable.
+	return name, os.Chmod(name, 0755)
+}
+
+// hookScript returns the text of the pre-commit hook.
+func hookScript(fix bool) string {
+	cmd, what := "exec goreturns -staged -check", `Fails the commit if the staged Go files need their returns fixed; run
+# "goreturns -staged -w" to fix and restage them.`
+	if fix {
+		// Status 1 means that files were fixed.
+		cmd, what = `goreturns -staged -w; [ $? -le 1 ]`, `Fixes the returns in the staged Go files and restages them.`
+	}
+	return fmt.Sprintf(`#!/bin/sh
+%s
+# %s
+if ! command -v goreturns >/dev/null 2>&1; then
+	echo "pre-commit: goreturns is not in PATH; skipping it" >&2
+	exit 0
+fi
+%s
+`, hookMarker, what, cmd)
+}
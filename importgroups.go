@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/imports"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+var (
+	importSections = flag.String("import-sections", "", "comma-separated `order` of the sections of import blocks, from std (the standard library), third-party, org (see -org), module (the packages of the file's module), and local (see -local); std and third-party are required, and imports go in the first listed of local, module, org that they belong to (default: goimports's grouping)")
+	orgPrefixes    = flag.String("org", "", "comma-separated `list` of import path prefixes of your organization's packages, for the org section of -import-sections")
+)
+
+// importSectionNames are the names of the sections of -import-sections,
+// in the order in which imports are assigned to them.
+var importSectionNames = []string{"local", "module", "org", "std", "third-party"}
+
+// sectionOrder holds the position of each section in -import-sections,
+// or is nil if imports are grouped as goimports groups them.
+var sectionOrder map[string]int
+
+// setImportSections sets sectionOrder from -import-sections.
+func setImportSections() error {
+	sectionOrder = nil
+	if *importSections == "" {
+		if *orgPrefixes != "" {
+			return errors.New("-org requires -import-sections with an org section")
+		}
+		return nil
+	}
+	order := map[string]int{}
+	for i, name := range strings.Split(*importSections, ",") {
+		name = strings.TrimSpace(name)
+		if !isImportSection(name) {
+			return fmt.Errorf("-import-sections: unknown section %q (known sections: %s)", name, strings.Join(importSectionNames, ", "))
+		}
+		if _, ok := order[name]; ok {
+			return fmt.Errorf("-import-sections: section %q is listed twice", name)
+		}
+		order[name] = i
+	}
+	if _, ok := order["std"]; !ok {
+		return errors.New("-import-sections must include std")
+	}
+	if _, ok := order["third-party"]; !ok {
+		return errors.New("-import-sections must include third-party")
+	}
+	if _, ok := order["org"]; !ok && *orgPrefixes != "" {
+		return errors.New("-org requires -import-sections with an org section")
+	}
+	sectionOrder = order
+	return nil
+}
+
+func isImportSection(name string) bool {
+	for _, s := range importSectionNames {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// goimportsSource runs goimports on src, the contents of filename, and
+// then groups the imports as -import-sections says.
+func goimportsSource(filename string, src []byte, opt *returns.Options) ([]byte, error) {
+	res, err := imports.Process(filename, src, importsOptions(opt))
+	if err != nil || sectionOrder == nil {
+		return res, err
+	}
+	return groupImports(filename, res), nil
+}
+
+// groupImports returns src, the contents of filename as printed by
+// goimports, with the imports of each parenthesized import declaration
+// regrouped into the sections of -import-sections. Declarations with
+// comments other than those of their imports, or with the cgo import
+// "C", are left as they are, as is src if it can't be parsed (as a
+// fragment can't).
+func groupImports(filename string, src []byte) []byte {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return src
+	}
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	var edits []returns.Edit
+	for _, decl := range file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT || !gd.Lparen.IsValid() {
+			continue
+		}
+		if text, ok := regroup(fset, file, gd, lines, filename); ok {
+			start := fset.Position(gd.Lparen).Offset + 1
+			end := fset.Position(gd.Rparen).Offset
+			// Replace the lines of the block, between the parens.
+			start += bytes.IndexByte(src[start:], '\n') + 1
+			end = bytes.LastIndexByte(src[:end], '\n') + 1
+			if start <= end {
+				edits = append(edits, returns.Edit{Start: start, End: end, New: text})
+			}
+		}
+	}
+	if len(edits) == 0 {
+		return src
+	}
+	out, err := format.Source(returns.ApplyEdits(src, edits))
+	if err != nil {
+		return src
+	}
+	return out
+}
+
+// regroup returns the lines of the import declaration gd, without its
+// parens, regrouped into sections. lines holds the lines of the file.
+func regroup(fset *token.FileSet, file *ast.File, gd *ast.GenDecl, lines [][]byte, filename string) (string, bool) {
+	type entry struct {
+		path, text string
+		section    int
+	}
+	var entries []entry
+	comments := 0 // comments of the imports
+	lastLine := fset.Position(gd.Lparen).Line
+	for _, spec := range gd.Specs {
+		is := spec.(*ast.ImportSpec)
+		path, err := strconv.Unquote(is.Path.Value)
+		if err != nil || path == "C" {
+			return "", false
+		}
+		first, last := fset.Position(is.Pos()).Line, fset.Position(is.End()).Line
+		if is.Doc != nil {
+			first = fset.Position(is.Doc.Pos()).Line
+			comments++
+		}
+		if is.Comment != nil {
+			last = fset.Position(is.Comment.End()).Line
+			comments++
+		}
+		if first <= lastLine {
+			return "", false // shares a line with the previous import
+		}
+		lastLine = last
+		entries = append(entries, entry{
+			path:    path,
+			text:    string(bytes.Join(lines[first-1:last], nil)),
+			section: sectionOrder[importSection(path, filename)],
+		})
+	}
+	for _, c := range file.Comments {
+		if gd.Lparen < c.Pos() && c.End() < gd.Rparen {
+			comments--
+		}
+	}
+	if comments != 0 {
+		return "", false // a comment that isn't an import's
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].section != entries[j].section {
+			return entries[i].section < entries[j].section
+		}
+		return entries[i].path < entries[j].path
+	})
+	var buf strings.Builder
+	for i, e := range entries {
+		if i > 0 && e.section != entries[i-1].section {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(e.text)
+	}
+	return buf.String(), true
+}
+
+// importSection returns the section of -import-sections of the import
+// of path in filename.
+func importSection(path, filename string) string {
+	if _, ok := sectionOrder["local"]; ok && hasImportPrefix(path, imports.LocalPrefix) {
+		return "local"
+	}
+	if _, ok := sectionOrder["module"]; ok {
+		if mod := modulePath(filepath.Dir(absPath(filename))); mod != "" && (path == mod || strings.HasPrefix(path, mod+"/")) {
+			return "module"
+		}
+	}
+	if _, ok := sectionOrder["org"]; ok && hasImportPrefix(path, *orgPrefixes) {
+		return "org"
+	}
+	if !strings.Contains(strings.Split(path, "/")[0], ".") {
+		return "std"
+	}
+	return "third-party"
+}
+
+// hasImportPrefix reports whether path begins with one of the
+// comma-separated prefixes, as goimports matches -local.
+func hasImportPrefix(path, prefixes string) bool {
+	if prefixes == "" {
+		return false
+	}
+	for _, p := range strings.Split(prefixes, ",") {
+		if p != "" && (strings.HasPrefix(path, p) || strings.TrimSuffix(p, "/") == path) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	modulesMu sync.Mutex
+	modules   = map[string]module{} // by directory
+)
+
+// A module is a module's root directory and path.
+type module struct{ root, path string }
+
+// modulePath returns the path of the module containing dir (from the
+// nearest go.mod file), or "" if there is none.
+func modulePath(dir string) string {
+	_, mod := moduleRoot(dir)
+	return mod
+}
+
+// moduleRoot returns the root directory and path of the module
+// containing dir (from the nearest go.mod file), or "", "" if there is
+// none.
+func moduleRoot(dir string) (root, mod string) {
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+	var m module
+	var dirs []string // the directories searched, which are in m
+	for {
+		if cached, ok := modules[dir]; ok {
+			m = cached
+			break
+		}
+		dirs = append(dirs, dir)
+		if data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+			if mod := modfile.ModulePath(data); mod != "" {
+				m = module{dir, mod}
+			}
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	for _, dir := range dirs {
+		modules[dir] = m
+	}
+	return m.root, m.path
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/imports"
+)
+
+var groupImportsTests = []struct {
+	name       string
+	sections   string // -import-sections
+	local, org string // -local and -org
+	in, out    string
+}{
+	{
+		name:     "sections in order",
+		sections: "std,third-party,module",
+		in: `package p
+
+import (
+	"example.com/mod/a"
+	"github.com/x/y"
+	"fmt"
+
+	"os"
+	"example.com/other"
+)
+`,
+		out: `package p
+
+import (
+	"fmt"
+	"os"
+
+	"example.com/other"
+	"github.com/x/y"
+
+	"example.com/mod/a"
+)
+`,
+	},
+	{
+		name:     "sections in another order",
+		sections: "module,third-party,std",
+		in: `package p
+
+import (
+	"fmt"
+	"github.com/x/y"
+	"example.com/mod/a"
+)
+`,
+		out: `package p
+
+import (
+	"example.com/mod/a"
+
+	"github.com/x/y"
+
+	"fmt"
+)
+`,
+	},
+	{
+		// Imports go in the first of local, module, and org that they
+		// belong to, wherever those are listed.
+		name:     "local, then module, then org",
+		sections: "std,third-party,org,module,local",
+		local:    "example.com/mod/internal/",
+		org:      "example.com/",
+		in: `package p
+
+import (
+	"example.com/mod/internal/x"
+	"example.com/mod/y"
+	"example.com/other"
+	"github.com/x/y"
+	"fmt"
+)
+`,
+		out: `package p
+
+import (
+	"fmt"
+
+	"github.com/x/y"
+
+	"example.com/other"
+
+	"example.com/mod/y"
+
+	"example.com/mod/internal/x"
+)
+`,
+	},
+	{
+		name:     "unlisted sections",
+		sections: "std,third-party,org",
+		local:    "example.com/mod/internal/",
+		org:      "example.com/",
+		in: `package p
+
+import (
+	"example.com/mod/internal/x"
+	"github.com/x/y"
+	"example.com/mod/y"
+	"fmt"
+)
+`,
+		out: `package p
+
+import (
+	"fmt"
+
+	"github.com/x/y"
+
+	"example.com/mod/internal/x"
+	"example.com/mod/y"
+)
+`,
+	},
+	{
+		name:     "several local prefixes",
+		sections: "std,third-party,local",
+		local:    "github.com/a/,github.com/b",
+		in: `package p
+
+import (
+	"github.com/a/x"
+	"github.com/b"
+	"github.com/b/c"
+	"github.com/c"
+	"github.com/ab"
+	"strings"
+)
+`,
+		out: `package p
+
+import (
+	"strings"
+
+	"github.com/ab"
+	"github.com/c"
+
+	"github.com/a/x"
+	"github.com/b"
+	"github.com/b/c"
+)
+`,
+	},
+	{
+		name:     "comments of imports",
+		sections: "std,third-party",
+		in: `package p
+
+import (
+	// y does things.
+	"github.com/x/y"
+	_ "embed" // for go:embed
+	z "github.com/x/z" // renamed
+)
+`,
+		out: `package p
+
+import (
+	_ "embed" // for go:embed
+
+	// y does things.
+	"github.com/x/y"
+	z "github.com/x/z" // renamed
+)
+`,
+	},
+	{
+		name:     "several declarations",
+		sections: "std,third-party",
+		in: `package p
+
+import (
+	"github.com/x/y"
+	"fmt"
+)
+
+import "github.com/x/z"
+
+import (
+	"github.com/x/w"
+	"os"
+)
+`,
+		out: `package p
+
+import (
+	"fmt"
+
+	"github.com/x/y"
+)
+
+import "github.com/x/z"
+
+import (
+	"os"
+
+	"github.com/x/w"
+)
+`,
+	},
+	{
+		name:     "a comment that isn't an import's",
+		sections: "std,third-party",
+		in: `package p
+
+import (
+	"github.com/x/y"
+	"fmt"
+
+	// More to come.
+)
+`,
+	},
+	{
+		name:     "cgo",
+		sections: "std,third-party",
+		in: `package p
+
+import (
+	"github.com/x/y"
+	"C"
+	"fmt"
+)
+`,
+	},
+	{
+		name:     "imports on one line",
+		sections: "std,third-party",
+		in: `package p
+
+import (
+	"github.com/x/y"; "fmt"
+)
+`,
+	},
+	{
+		name:     "a fragment",
+		sections: "std,third-party",
+		in: `import (
+	"github.com/x/y"
+	"fmt"
+)
+`,
+	},
+}
+
+func TestGroupImports(t *testing.T) {
+	defer saveFlags()()
+	defer func(prefix string) {
+		imports.LocalPrefix = prefix
+		sectionOrder = nil
+	}(imports.LocalPrefix)
+
+	dir := writeTree(t, map[string]string{"go.mod": "module example.com/mod\n"})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "p", "p.go")
+	for _, tt := range groupImportsTests {
+		*importSections, *orgPrefixes, imports.LocalPrefix = tt.sections, tt.org, tt.local
+		if err := setImportSections(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := tt.out
+		if want == "" {
+			want = tt.in // left as it is
+		}
+		if got := string(groupImports(filename, []byte(tt.in))); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+}
+
+func TestModulePath(t *testing.T) {
+	dir := writeTree(t, map[string]string{
+		"go.mod":        "module example.com/mod\n",
+		"a/b/x.go":      "package b\n",
+		"nested/go.mod": "// A nested module.\nmodule example.com/nested\n",
+		"nested/c/x.go": "package c\n",
+		"bad/go.mod":    "go 1.14\n",
+		"bad/d/x.go":    "package d\n",
+	})
+	defer os.RemoveAll(dir)
+	tests := map[string]string{
+		".":        "example.com/mod",
+		"a/b":      "example.com/mod",
+		"nested":   "example.com/nested",
+		"nested/c": "example.com/nested",
+		"bad/d":    "",
+	}
+	for name, want := range tests {
+		// Twice, the second time from modules.
+		for i := 0; i < 2; i++ {
+			if got := modulePath(filepath.Join(dir, filepath.FromSlash(name))); got != want {
+				t.Errorf("%s: got %q, want %q", name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+// -i already turns goimports on and off.
+var interactive = flag.Bool("interactive", false, "show each change to the files as a diff hunk and ask whether to make it (y/n/a/A/q, as \"git add -p\" does), then write the changes made")
+
+var (
+	answers   *bufio.Reader // the answers to -interactive's questions, from standard input
+	acceptAll bool          // whether "A" was answered
+	quit      bool          // whether "q" was answered (or standard input ended)
+)
+
+// checkInteractive reports an error if -interactive can't be combined
+// with the other flags or the arguments, and otherwise sets -w, with
+// which the changes chosen are written.
+func checkInteractive(paths []string) error {
+	if !*interactive {
+		return nil
+	}
+	if *list || *doDiff || *check || *lint || *dryRun || jsonOutput() || *watch || *txtarMode || *modified {
+		return errors.New("-interactive can't be combined with -l, -d, -check, -lint, -n, -output=json, -output=rdjson, -watch, -txtar, or -modified")
+	}
+	if len(paths) == 0 && !*staged {
+		return errors.New("-interactive requires file or directory arguments (standard input holds the answers)")
+	}
+	*write = true
+	answers = bufio.NewReader(os.Stdin)
+	return nil
+}
+
+// chooseEdits shows each change that turns src, the contents of
+// filename, into res as a diff hunk on out, and asks whether to make it.
+// It returns src with the changes chosen.
+func chooseEdits(out io.Writer, filename string, src, res []byte) ([]byte, error) {
+	var chosen []returns.Edit
+	acceptFile := false // whether "a" was answered
+	for i, e := range returns.LineEdits(src, res) {
+		if quit {
+			break
+		}
+		if !acceptAll && !acceptFile {
+			hunk := diff(filename, src, returns.ApplyEdits(src, []returns.Edit{e}))
+			if i > 0 {
+				// Print the file's names only before its first hunk.
+				hunk = hunk[bytes.IndexByte(hunk, '\n')+1:]
+				hunk = hunk[bytes.IndexByte(hunk, '\n')+1:]
+			}
+			out.Write(hunk)
+			answer, err := ask(out)
+			if err != nil {
+				return nil, err
+			}
+			switch answer {
+			case "n", "q":
+				continue
+			case "a":
+				acceptFile = true
+			case "A":
+				acceptAll = true
+			}
+		}
+		chosen = append(chosen, e)
+	}
+	return returns.ApplyEdits(src, chosen), nil
+}
+
+// ask asks whether to make a change, until it's answered y, n, a, A,
+// or q, and returns the answer. The end of standard input answers q.
+func ask(out io.Writer) (string, error) {
+	for {
+		fmt.Fprint(out, "Make this change [y,n,a,A,q,?]? ")
+		line, err := answers.ReadString('\n')
+		if err == io.EOF && line == "" {
+			fmt.Fprintln(out)
+			quit = true
+			return "q", nil
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		switch answer := strings.TrimSpace(line); answer {
+		case "y", "n", "a", "A":
+			return answer, nil
+		case "q":
+			quit = true
+			return answer, nil
+		}
+		fmt.Fprint(out, `y - make this change
+n - don't make this change
+a - make this change and the rest in this file
+A - make this change and the rest in all files
+q - quit; don't make this change or any of the rest
+`)
+	}
+}
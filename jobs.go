@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+var maxJobs = flag.Int("jobs", runtime.GOMAXPROCS(0), "process up to `n` directories concurrently (the output is printed in the same order regardless)")
+
+// A jobQueue runs jobs concurrently, up to the -jobs limit, and then
+// runs the functions they return to print their results, in the order
+// the jobs were added, on the goroutine that adds them. Jobs must not
+// print anything or change global state themselves.
+type jobQueue struct {
+	sem     chan struct{}
+	results []chan func() // of the jobs not yet printed, in order
+}
+
+var queue jobQueue
+
+// jobLimit returns the number of jobs to run at once. Refactorings run
+// one at a time, since they record whether they found the function, as
+// do the daemon's requests, which share an import cache.
+func jobLimit() int {
+	if refactoring() || options.ImportCache != nil || *maxJobs < 1 {
+		return 1
+	}
+	return *maxJobs
+}
+
+// add runs job and, once it and the jobs added before it are done, the
+// function it returns. It first prints the results of those earlier
+// jobs that are done.
+func (q *jobQueue) add(job func() func()) {
+	limit := jobLimit()
+	if limit == 1 {
+		q.wait()
+		job()()
+		return
+	}
+	if q.sem == nil {
+		q.sem = make(chan struct{}, limit)
+	}
+	// Don't hold on to too many results waiting for a slow job.
+	for len(q.results) >= 2*limit {
+		q.next()
+	}
+	done := make(chan func(), 1)
+	q.results = append(q.results, done)
+	q.sem <- struct{}{}
+	go func() {
+		defer func() { <-q.sem }()
+		defer func() {
+			if r := recover(); r != nil {
+				// Panic on the goroutine that adds the jobs instead,
+				// where gofmtMain recovers to report it.
+				stack := debug.Stack()
+				done <- func() { panic(fmt.Sprintf("%v\n\n%s", r, stack)) }
+			}
+		}()
+		done <- job()
+	}()
+	for len(q.results) > 0 && len(q.results[0]) > 0 {
+		q.next()
+	}
+}
+
+// next waits for the first job not yet printed and prints its results.
+func (q *jobQueue) next() {
+	print := <-q.results[0]
+	q.results = q.results[1:]
+	print()
+}
+
+// wait prints the results of all of the jobs, waiting for them as
+// needed.
+func (q *jobQueue) wait() {
+	for len(q.results) > 0 {
+		q.next()
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/token"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+// lspMain implements "goreturns lsp [flags]", a language server that
+// speaks the Language Server Protocol on standard input and output. It
+// offers document formatting (goimports, then fixing returns, as
+// goreturns does), range formatting (fixing the returns in the range),
+// and a quick fix for each return that can be fixed, so that editors
+// with an LSP client can use goreturns without a plugin of their own.
+// The flags are the usual goreturns flags.
+func lspMain(args []string) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		report(err)
+		return
+	}
+	if err := applyConfig(args); err != nil {
+		report(err)
+		return
+	}
+	if flag.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: goreturns lsp [flags]\n")
+		os.Exit(exitError)
+	}
+	if err := setOptions(); err != nil {
+		report(err)
+		return
+	}
+	// The server is long-running, like the daemon.
+	options.ImportCache = returns.NewImportCache()
+
+	s := &lspServer{in: bufio.NewReader(os.Stdin), out: os.Stdout, docs: map[string]*lspDocument{}}
+	if err := s.serve(); err != nil {
+		report(err)
+	}
+}
+
+// JSON-RPC error codes used by the server.
+const (
+	lspParseError     = -32700
+	lspInvalidRequest = -32600
+	lspMethodNotFound = -32601
+	lspInvalidParams  = -32602
+	lspNotInitialized = -32002
+	lspRequestFailed  = -32803
+)
+
+// lspTextDocumentFull is the TextDocumentSyncKind for clients sending
+// the whole document when it changes.
+const lspTextDocumentFull = 1
+
+// An lspError is the error of a failed request.
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *lspError) Error() string { return e.Message }
+
+// An lspMessage is a JSON-RPC request, notification (with no ID), or
+// response.
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`      // 0-based
+	Character int `json:"character"` // 0-based, in UTF-16 code units
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+// An lspCodeAction is a quick fix, which applies its edit.
+type lspCodeAction struct {
+	Title string `json:"title"`
+	Kind  string `json:"kind"`
+	Edit  struct {
+		Changes map[string][]lspTextEdit `json:"changes"` // by URI
+	} `json:"edit"`
+}
+
+type lspTextDocumentID struct {
+	URI string `json:"uri"`
+}
+
+// An lspDocument is a document that the client has opened.
+type lspDocument struct {
+	filename string
+	text     []byte
+}
+
+// An lspServer serves one client, handling its messages one at a time.
+type lspServer struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	initialized bool
+	shutdown    bool
+	docs        map[string]*lspDocument // by URI
+}
+
+// serve handles messages until the client sends "exit" (or closes the
+// connection).
+func (s *lspServer) serve() error {
+	for {
+		data, err := readLSPMessage(s.in)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var msg lspMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			if err := s.reply(nil, nil, &lspError{lspParseError, err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				exitCode = 1
+			}
+			return nil
+		}
+		if err := reloadConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "goreturns: lsp: reloading the config: %s\n", err)
+		}
+		result, err := s.handle(msg)
+		if msg.ID == nil {
+			// A notification, which has no reply.
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "goreturns: lsp: %s: %s\n", msg.Method, err)
+			}
+			continue
+		}
+		if err := s.reply(msg.ID, result, err); err != nil {
+			return err
+		}
+	}
+}
+
+// handle handles msg, returning the result to reply with if it is a
+// request.
+func (s *lspServer) handle(msg lspMessage) (interface{}, error) {
+	switch {
+	case msg.Method == "initialize":
+		s.initialized = true
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":                lspTextDocumentFull,
+				"documentFormattingProvider":      true,
+				"documentRangeFormattingProvider": true,
+				"codeActionProvider":              map[string][]string{"codeActionKinds": {"quickfix"}},
+			},
+			"serverInfo": map[string]string{"name": "goreturns", "version": moduleVersion()},
+		}, nil
+	case !s.initialized:
+		return nil, &lspError{lspNotInitialized, "the server is not initialized"}
+	case s.shutdown:
+		return nil, &lspError{lspInvalidRequest, "the server is shut down"}
+	}
+
+	switch msg.Method {
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := unmarshalParams(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		filename, err := uriFilename(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		s.docs[params.TextDocument.URI] = &lspDocument{filename: filename, text: []byte(params.TextDocument.Text)}
+		return nil, nil
+
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument   lspTextDocumentID `json:"textDocument"`
+			ContentChanges []struct {
+				Range *lspRange `json:"range"` // nil for the whole document
+				Text  string    `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := unmarshalParams(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range params.ContentChanges {
+			if c.Range == nil {
+				doc.text = []byte(c.Text)
+				continue
+			}
+			start, end := lspOffset(doc.text, c.Range.Start), lspOffset(doc.text, c.Range.End)
+			doc.text = returns.ApplyEdits(doc.text, []returns.Edit{{Start: start, End: end, New: c.Text}})
+		}
+		return nil, nil
+
+	case "textDocument/didClose":
+		var params struct {
+			TextDocument lspTextDocumentID `json:"textDocument"`
+		}
+		if err := unmarshalParams(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		delete(s.docs, params.TextDocument.URI)
+		return nil, nil
+
+	case "textDocument/formatting":
+		var params struct {
+			TextDocument lspTextDocumentID `json:"textDocument"`
+		}
+		if err := unmarshalParams(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.format(params.TextDocument, nil)
+
+	case "textDocument/rangeFormatting":
+		var params struct {
+			TextDocument lspTextDocumentID `json:"textDocument"`
+			Range        lspRange          `json:"range"`
+		}
+		if err := unmarshalParams(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		lines := rangeLines(params.Range)
+		return s.format(params.TextDocument, &lines)
+
+	case "textDocument/codeAction":
+		var params struct {
+			TextDocument lspTextDocumentID `json:"textDocument"`
+			Range        lspRange          `json:"range"`
+			Context      struct {
+				Only []string `json:"only"` // kinds of actions wanted, or nil for all
+			} `json:"context"`
+		}
+		if err := unmarshalParams(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		if !wantsQuickFixes(params.Context.Only) {
+			return []lspCodeAction{}, nil
+		}
+		return s.codeActions(params.TextDocument, rangeLines(params.Range))
+	}
+
+	if strings.HasPrefix(msg.Method, "$/") || msg.ID == nil {
+		return nil, nil // optional, or a notification the server doesn't need
+	}
+	return nil, &lspError{lspMethodNotFound, "method not supported: " + msg.Method}
+}
+
+// format returns the edits that format the document id as goreturns
+// would, or if lines is non-nil, that fix its returns that overlap
+// lines. Range formatting doesn't run goimports, which would change the
+// imports outside of the range.
+func (s *lspServer) format(id lspTextDocumentID, lines *returns.LineRange) ([]lspTextEdit, error) {
+	doc, err := s.document(id)
+	if err != nil {
+		return nil, err
+	}
+	opt := *options
+	opt.Overlay = s.overlay()
+	res := doc.text
+	if lines != nil {
+		opt.Lines = []returns.LineRange{*lines}
+	} else if useGoimports() {
+		if res, err = goimportsSource(doc.filename, res, &opt); err != nil {
+			return nil, &lspError{lspRequestFailed, err.Error()}
+		}
+	}
+	var out []byte
+	if *formatOnly {
+		out, err = formatOnlySource(filepath.Dir(doc.filename), doc.filename, res, &opt, lines == nil && useGoimports())
+	} else {
+		out, err = returns.Process(filepath.Dir(doc.filename), doc.filename, res, &opt)
+	}
+	if err != nil {
+		return nil, &lspError{lspRequestFailed, err.Error()}
+	}
+	return textEdits(doc.text, out, lines), nil
+}
+
+// codeActionFixers are the fixers whose fixes are offered as quick
+// fixes, whether or not they're enabled (see -fix). They fix one return
+// (or function) at a time.
+var codeActionFixers = map[string]string{
+	"zero":           "Fill in the return's missing values with zero values",
+	"bare":           "Expand the bare return",
+	"missing-return": "Add the missing return",
+}
+
+// codeActions returns a quick fix for each return of the document id
+// in lines that can be fixed, each of which makes only that fix (and
+// not goimports's changes, or gofmt's elsewhere).
+func (s *lspServer) codeActions(id lspTextDocumentID, lines returns.LineRange) ([]lspCodeAction, error) {
+	doc, err := s.document(id)
+	if err != nil {
+		return nil, err
+	}
+	if *formatOnly {
+		return []lspCodeAction{}, nil
+	}
+	opt := *options
+	opt.Overlay = s.overlay()
+	opt.RemoveBareReturns = false
+	opt.Fixes = nil
+	for name := range codeActionFixers {
+		opt.Fixes = append(opt.Fixes, name)
+	}
+	sort.Strings(opt.Fixes)
+	opt.Lines = []returns.LineRange{lines}
+	var decisions []returns.Diagnostic
+	opt.Decisions = &decisions
+	if _, err := returns.Process(filepath.Dir(doc.filename), doc.filename, doc.text, &opt); err != nil {
+		return nil, &lspError{lspRequestFailed, err.Error()}
+	}
+
+	actions := []lspCodeAction{}
+	for _, d := range decisions {
+		if !strings.HasPrefix(d.Message, "fixed: ") {
+			continue
+		}
+		// Make the fix on its own, and keep only the edit of its line,
+		// in case another return is fixed along with it.
+		line := returns.LineRange{Start: d.Pos.Line, End: d.Pos.Line}
+		opt.Fixes = []string{d.Category}
+		opt.Lines = []returns.LineRange{line}
+		opt.Decisions = nil
+		out, err := returns.Process(filepath.Dir(doc.filename), doc.filename, doc.text, &opt)
+		if err != nil {
+			return nil, &lspError{lspRequestFailed, err.Error()}
+		}
+		edits := textEdits(doc.text, out, &line)
+		if len(edits) == 0 {
+			continue
+		}
+		a := lspCodeAction{Title: codeActionTitle(d.Category, edits), Kind: "quickfix"}
+		a.Edit.Changes = map[string][]lspTextEdit{id.URI: edits}
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// codeActionTitle returns the title of fixer's quick fix that makes
+// edits: the fixer's title, followed by the return it adds or changes.
+func codeActionTitle(fixer string, edits []lspTextEdit) string {
+	title := codeActionFixers[fixer]
+	for _, e := range edits {
+		for _, line := range strings.Split(e.NewText, "\n") {
+			if line = strings.TrimSpace(line); strings.HasPrefix(line, "return") {
+				return title + ": " + line
+			}
+		}
+	}
+	return title
+}
+
+// wantsQuickFixes reports whether a client asking for code actions of
+// the kinds only wants quick fixes. Kinds are hierarchical, so
+// "quickfix" includes "quickfix.x"; an empty kind includes all.
+func wantsQuickFixes(only []string) bool {
+	if only == nil {
+		return true
+	}
+	for _, kind := range only {
+		if kind == "" || kind == "quickfix" {
+			return true
+		}
+	}
+	return false
+}
+
+// textEdits returns the edits that turn src into out, whole lines at a
+// time, or if lines is non-nil, those of them that overlap lines.
+func textEdits(src, out []byte, lines *returns.LineRange) []lspTextEdit {
+	edits := []lspTextEdit{}
+	for _, e := range returns.LineEdits(src, out) {
+		if lines != nil && !editInLines(src, e, *lines) {
+			continue
+		}
+		edits = append(edits, lspTextEdit{
+			Range:   lspRange{lspPositionOf(src, e.Start), lspPositionOf(src, e.End)},
+			NewText: e.New,
+		})
+	}
+	return edits
+}
+
+// document returns the open document id.
+func (s *lspServer) document(id lspTextDocumentID) (*lspDocument, error) {
+	doc, ok := s.docs[id.URI]
+	if !ok {
+		return nil, &lspError{lspInvalidParams, id.URI + " is not open"}
+	}
+	return doc, nil
+}
+
+// overlay returns the contents of the open documents, which may be
+// unsaved, to be used in place of the files on disk when typechecking.
+func (s *lspServer) overlay() map[string][]byte {
+	overlay := make(map[string][]byte, len(s.docs)+len(options.Overlay))
+	for name, data := range options.Overlay {
+		overlay[name] = data
+	}
+	for _, doc := range s.docs {
+		overlay[doc.filename] = doc.text
+	}
+	return overlay
+}
+
+// reply sends the response to the request with the given ID.
+func (s *lspServer) reply(id *json.RawMessage, result interface{}, err error) error {
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if err != nil {
+		lerr, ok := err.(*lspError)
+		if !ok {
+			lerr = &lspError{lspRequestFailed, err.Error()}
+		}
+		resp["error"] = lerr
+	} else {
+		resp["result"] = result
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+// readLSPMessage reads the content of the next message from r, which
+// is preceded by headers, as in HTTP.
+func readLSPMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line != "" {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("lsp: invalid header %q", line)
+		}
+		if strings.EqualFold(line[:i], "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil || length < 0 {
+				return nil, fmt.Errorf("lsp: invalid header %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("lsp: message has no Content-Length header")
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+func unmarshalParams(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &lspError{lspInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+// uriFilename returns the name of the file with the given file: URI.
+func uriFilename(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", &lspError{lspInvalidParams, err.Error()}
+	}
+	if u.Scheme != "file" {
+		return "", &lspError{lspInvalidParams, "not a file: URI: " + uri}
+	}
+	name := filepath.FromSlash(u.Path)
+	if len(name) >= 3 && name[0] == filepath.Separator && name[2] == ':' {
+		name = name[1:] // /C:/dir on Windows
+	}
+	return name, nil
+}
+
+// rangeLines returns the 1-based lines that r spans. A range that ends
+// at the start of a line doesn't include that line.
+func rangeLines(r lspRange) returns.LineRange {
+	lines := returns.LineRange{Start: r.Start.Line + 1, End: r.End.Line + 1}
+	if r.End.Character == 0 && r.End.Line > r.Start.Line {
+		lines.End--
+	}
+	return lines
+}
+
+// editInLines reports whether the lines of src that e replaces (or, if
+// e only inserts lines, the line it inserts them before) overlap lines.
+func editInLines(src []byte, e returns.Edit, lines returns.LineRange) bool {
+	start := 1 + bytes.Count(src[:e.Start], []byte("\n"))
+	end := bytes.Count(src[:e.End], []byte("\n")) // the last line replaced
+	if end < start {
+		end = start
+	}
+	return start <= lines.End && lines.Start <= end
+}
+
+// lspPositionOf returns the position of the byte offset off in src.
+func lspPositionOf(src []byte, off int) lspPosition {
+	line := bytes.Count(src[:off], []byte("\n"))
+	col := off - (bytes.LastIndexByte(src[:off], '\n') + 1) + 1
+	return lspPosition{
+		Line:      line,
+		Character: returns.UTF16Column(src, token.Position{Line: line + 1, Column: col}) - 1,
+	}
+}
+
+// lspOffset returns the byte offset in src of pos, clamped to the end
+// of its line (or of src).
+func lspOffset(src []byte, pos lspPosition) int {
+	off := 0
+	for line := 0; line < pos.Line; line++ {
+		i := bytes.IndexByte(src[off:], '\n')
+		if i < 0 {
+			return len(src)
+		}
+		off += i + 1
+	}
+	return off + returns.ByteColumn(src, pos.Line+1, pos.Character+1) - 1
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+var outputFormat = flag.String("output", "text", "output `format`: text (the fixed files, or as -d, -l, or -w say), json (a line per file with the edits that fix it, as byte ranges of the original, and why each return was or wasn't fixed), or rdjson (reviewdog's diagnostic format, with the fixes as suggestions)")
+
+// jsonOutputVersion is the version of the -output=json format, for
+// "goreturns version -json".
+const jsonOutputVersion = "1"
+
+// jsonOutput reports whether results are written as JSON (see
+// -output) instead of as text.
+func jsonOutput() bool {
+	return *outputFormat != "text"
+}
+
+// checkOutputFormat reports an error if -output is invalid, or can't
+// be combined with the other flags.
+func checkOutputFormat() error {
+	switch *outputFormat {
+	case "text":
+		return nil
+	case "json", "rdjson":
+		if *doDiff || *list || *check || *lint {
+			return fmt.Errorf("-output=%s can't be combined with -d, -l, -check, or -lint", *outputFormat)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid -output %q (want text, json, or rdjson)", *outputFormat)
+}
+
+// A jsonFile is the -output=json result for a file.
+type jsonFile struct {
+	File        string           `json:"file"`
+	Edits       []jsonEdit       `json:"edits"`            // in increasing order of offset, not overlapping
+	Diagnostics []jsonDiagnostic `json:"diagnostics"`      // why each return was or wasn't fixed
+	Cursor      *int             `json:"cursor,omitempty"` // with -cursor, the offset in the result
+}
+
+// A jsonEdit replaces the bytes [Start, End) of the original file with
+// New.
+type jsonEdit struct {
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	New   string `json:"new"`
+}
+
+type jsonDiagnostic struct {
+	Line        int    `json:"line"`        // in the original file
+	Column      int    `json:"column"`      // 1-based, in bytes
+	UTF16Column int    `json:"utf16Column"` // 1-based, in UTF-16 code units (as in LSP)
+	Fixer       string `json:"fixer"`
+	Message     string `json:"message"`         // "fixed: ..." or "skipped: ..."
+	Added       string `json:"added,omitempty"` // for fixes, the values added, as Go source
+}
+
+// writeJSON writes the -output=json result for a file (see
+// fileResult) to out.
+func writeJSON(out io.Writer, r jsonFile) error {
+	return json.NewEncoder(out).Encode(r)
+}
+
+// fileResult returns the result for filename, whose original contents
+// src were fixed to res. The positions of decisions are in imported,
+// the result of goimports that was then fixed; they are mapped back to
+// lines of src.
+func fileResult(filename string, src, imported, res []byte, decisions []returns.Diagnostic) jsonFile {
+	r := jsonFile{File: filename, Edits: []jsonEdit{}, Diagnostics: []jsonDiagnostic{}}
+	for _, e := range returns.LineEdits(src, res) {
+		r.Edits = append(r.Edits, jsonEdit{Start: e.Start, End: e.End, New: e.New})
+	}
+	importEdits := returns.LineEdits(src, imported)
+	for _, d := range decisions {
+		r.Diagnostics = append(r.Diagnostics, jsonDiagnostic{
+			Line:        srcLine(src, importEdits, d.Pos.Line),
+			Column:      d.Pos.Column,
+			UTF16Column: d.UTF16Col,
+			Fixer:       d.Category,
+			Message:     d.Message,
+			Added:       d.Added,
+		})
+	}
+	return r
+}
+
+// srcLine returns the line of src that corresponds to line of the
+// result of applying edits to src: for lines in the replacement text
+// of an edit, that's the first line the edit replaces.
+func srcLine(src []byte, edits []returns.Edit, line int) int {
+	shift := 0 // lines added (or, if negative, removed) by the edits so far
+	for _, e := range edits {
+		start := 1 + bytes.Count(src[:e.Start], []byte("\n"))
+		if line < start+shift {
+			break
+		}
+		if line < start+shift+strings.Count(e.New, "\n") {
+			return start
+		}
+		shift += strings.Count(e.New, "\n") - bytes.Count(src[e.Start:e.End], []byte("\n"))
+	}
+	return line - shift
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// isPattern reports whether the path argument arg is a package pattern
+// (such as "./..." or "example.com/m/...") rather than a file or
+// directory.
+func isPattern(arg string) bool {
+	return strings.Contains(arg, "...")
+}
+
+// expandPattern returns the Go files (including tests) of the packages
+// matching the package pattern or import path arg, as the go command
+// resolves it (so in module mode, "./..." is the packages of the
+// current module below the current directory, without vendor or
+// testdata directories), grouped by directory in the order the go
+// command lists them. Files excluded by -exclude are left out.
+func expandPattern(arg string) (dirs []string, files map[string][]string, err error) {
+	cfg := &packages.Config{Mode: packages.NeedName | packages.NeedFiles, Tests: true}
+	if len(options.BuildTags) > 0 {
+		cfg.BuildFlags = []string{"-tags=" + strings.Join(options.BuildTags, ",")}
+	}
+	pkgs, err := packages.Load(cfg, arg)
+	if err != nil {
+		return nil, nil, err
+	}
+	cwd, _ := os.Getwd()
+	files = map[string][]string{}
+	seen := map[string]bool{}
+	for _, p := range pkgs {
+		if strings.HasSuffix(p.ID, ".test") {
+			continue // a generated test main package
+		}
+		for _, name := range p.GoFiles {
+			if seen[name] {
+				continue // in both a package and its test variant
+			}
+			seen[name] = true
+			if rel, err := filepath.Rel(cwd, name); err == nil && !strings.HasPrefix(rel, "..") {
+				if isExcluded(rel) {
+					continue
+				}
+				name = rel
+			}
+			dir := filepath.Dir(name)
+			if files[dir] == nil {
+				dirs = append(dirs, dir)
+			}
+			files[dir] = append(files[dir], name)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, nil, fmt.Errorf("%s: matched no packages", arg)
+	}
+	return dirs, files, nil
+}
+
+// processPattern processes the Go files of the packages matching arg
+// (see expandPattern), a directory at a time.
+func processPattern(arg string) error {
+	dirs, files, err := expandPattern(arg)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if isInterrupted() {
+			return nil
+		}
+		processFiles(dir, files[dir])
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// preCommitMain implements "goreturns pre-commit [-force] [-- flags]",
+// which fixes the staged Go files of a git repository in place and
+// stages the fixes. It is meant to be run from a pre-commit hook.
+//
+// A file with unstaged changes is skipped with a warning unless -force
+// is given: restaging it would otherwise sweep unrelated working-tree
+// edits into the commit. Flags after "--" are goreturns flags.
+func preCommitMain(args []string) {
+	fs := flag.NewFlagSet("pre-commit", flag.ExitOnError)
+	force := fs.Bool("force", false, "also fix (and stage) files that have unstaged changes")
+	fs.Parse(args)
+	if err := flag.CommandLine.Parse(fs.Args()); err != nil {
+		report(err)
+		return
+	}
+	if err := applyConfig(fs.Args()); err != nil {
+		report(err)
+		return
+	}
+	if flag.NArg() > 0 {
+		report(fmt.Errorf("pre-commit: unexpected arguments %q", flag.Args()))
+		return
+	}
+
+	files, err := stagedGoFiles(*force)
+	if err != nil {
+		report(err)
+		return
+	}
+	if len(files) == 0 {
+		return
+	}
+	*write = true
+	run(nil, files)
+	if isInterrupted() {
+		return
+	}
+	if exitCode == exitChanges {
+		exitCode = exitClean // fixing files doesn't fail the commit
+	}
+	if _, err := command("git", append([]string{"add", "--"}, files...)...); err != nil {
+		report(err)
+	}
+}
+
+// stagedGoFiles returns the absolute paths of the Go files added or
+// modified in the git index. Files that also have unstaged changes are
+// omitted, with a warning, unless force is set.
+func stagedGoFiles(force bool) ([]string, error) {
+	root, err := command("git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	staged, err := command("git", "diff", "--cached", "--name-only", "--diff-filter=ACMR", "-z", "--", "*.go")
+	if err != nil {
+		return nil, err
+	}
+	unstaged, err := command("git", "diff", "--name-only", "-z")
+	if err != nil {
+		return nil, err
+	}
+	dirty := map[string]bool{}
+	for _, name := range splitNul(unstaged) {
+		dirty[name] = true
+	}
+
+	var files []string
+	for _, name := range splitNul(staged) {
+		if dirty[name] && !force {
+			fmt.Fprintf(os.Stderr, "goreturns: skipping %s: it has unstaged changes (stage or stash them, or use -force)\n", name)
+			continue
+		}
+		files = append(files, filepath.Join(strings.TrimSpace(string(root)), filepath.FromSlash(name)))
+	}
+	return files, nil
+}
+
+// splitNul splits the NUL-terminated names printed by git's -z option.
+func splitNul(b []byte) []string {
+	var names []string
+	for _, name := range bytes.Split(b, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names
+}
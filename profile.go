@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+)
+
+var (
+	cpuProfile = flag.String("cpuprofile", "", "write a CPU profile of the run to `file`")
+	memProfile = flag.String("memprofile", "", "write a heap profile to `file` at the end of the run")
+	traceTo    = flag.String("trace", "", "write an execution trace of the run to `file` (see \"go tool trace\")")
+)
+
+// stopProfiling stops the CPU profile and execution trace that
+// startProfiling started and writes the heap profile. It's called at the
+// end of the run, or by the interrupt handler before it exits; only the
+// first call has an effect.
+var stopProfiling = func() {}
+
+// startProfiling starts the CPU profile and execution trace requested
+// by flags, and sets stopProfiling.
+func startProfiling() error {
+	var stops []func()
+	var once sync.Once
+	stopProfiling = func() {
+		once.Do(func() {
+			for i := len(stops) - 1; i >= 0; i-- {
+				stops[i]()
+			}
+		})
+	}
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			closeProfile(f)
+		})
+	}
+	if *traceTo != "" {
+		f, err := os.Create(*traceTo)
+		if err != nil {
+			return err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return err
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			closeProfile(f)
+		})
+	}
+	if *memProfile != "" {
+		stops = append(stops, writeHeapProfile)
+	}
+	return nil
+}
+
+func writeHeapProfile() {
+	f, err := os.Create(*memProfile)
+	if err != nil {
+		report(err)
+		return
+	}
+	runtime.GC() // for up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		report(err)
+	}
+	closeProfile(f)
+}
+
+func closeProfile(f *os.File) {
+	if err := f.Close(); err != nil {
+		report(err)
+	}
+}
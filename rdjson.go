@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// An rdResult is reviewdog's diagnostic format, rdjson (see
+// https://github.com/reviewdog/reviewdog/tree/master/proto/rdf), which
+// -output=rdjson prints when done.
+type rdResult struct {
+	Source      rdSource       `json:"source"`
+	Severity    string         `json:"severity"`
+	Diagnostics []rdDiagnostic `json:"diagnostics"`
+}
+
+type rdSource struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type rdDiagnostic struct {
+	Message     string         `json:"message"`
+	Location    rdLocation     `json:"location"`
+	Code        *rdCode        `json:"code,omitempty"`
+	Suggestions []rdSuggestion `json:"suggestions"`
+}
+
+type rdLocation struct {
+	Path  string  `json:"path"`
+	Range rdRange `json:"range"`
+}
+
+type rdRange struct {
+	Start rdPosition `json:"start"`
+	End   rdPosition `json:"end"` // exclusive
+}
+
+type rdPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column"` // 1-based, in bytes
+}
+
+type rdCode struct {
+	Value string `json:"value"`
+}
+
+type rdSuggestion struct {
+	Range rdRange `json:"range"`
+	Text  string  `json:"text"`
+}
+
+var rdResults = rdResult{
+	Source:      rdSource{Name: "goreturns", URL: "https://github.com/sqs/goreturns"},
+	Severity:    "WARNING",
+	Diagnostics: []rdDiagnostic{},
+}
+
+// addRDJSON adds a diagnostic for each edit of r, the result for a file
+// whose original contents are src, suggesting the edit and saying
+// which returns it fixes.
+func addRDJSON(r jsonFile, src []byte) {
+	for _, e := range r.Edits {
+		e = wholeLines(src, e)
+		rng := rdRange{Start: rdPos(src, e.Start), End: rdPos(src, e.End)}
+
+		// The returns fixed in the lines the edit replaces.
+		var msgs, fixers []string
+		for _, d := range r.Diagnostics {
+			if d.Line >= rng.Start.Line && d.Line <= rng.End.Line && strings.HasPrefix(d.Message, "fixed: ") {
+				msgs = append(msgs, strings.TrimPrefix(d.Message, "fixed: "))
+				if len(fixers) == 0 || fixers[len(fixers)-1] != d.Fixer {
+					fixers = append(fixers, d.Fixer)
+				}
+			}
+		}
+		d := rdDiagnostic{
+			Message:     "goreturns would change these lines",
+			Location:    rdLocation{Path: r.File, Range: rng},
+			Suggestions: []rdSuggestion{{Range: rng, Text: e.New}},
+		}
+		if len(msgs) > 0 {
+			d.Message = "goreturns: " + strings.Join(msgs, "; ")
+		}
+		if len(fixers) == 1 {
+			d.Code = &rdCode{Value: fixers[0]}
+		}
+		rdResults.Diagnostics = append(rdResults.Diagnostics, d)
+	}
+}
+
+// wholeLines returns e, an edit of src, extended to replace at least
+// one line (instead of inserting text between lines), since review
+// comments are on lines.
+func wholeLines(src []byte, e jsonEdit) jsonEdit {
+	if e.Start != e.End {
+		return e
+	}
+	if e.End < len(src) {
+		next := e.End + bytes.IndexByte(src[e.End:], '\n') + 1
+		if next == e.End {
+			next = len(src)
+		}
+		e.New += string(src[e.End:next])
+		e.End = next
+	} else if e.Start > 0 {
+		prev := bytes.LastIndexByte(src[:e.Start-1], '\n') + 1
+		e.New = string(src[prev:e.Start]) + e.New
+		e.Start = prev
+	}
+	return e
+}
+
+// rdPos returns the position of the byte offset off in src.
+func rdPos(src []byte, off int) rdPosition {
+	lineStart := bytes.LastIndexByte(src[:off], '\n') + 1
+	return rdPosition{Line: 1 + bytes.Count(src[:off], []byte("\n")), Column: off - lineStart + 1}
+}
+
+// writeRDJSON prints the -output=rdjson result.
+func writeRDJSON() {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(rdResults); err != nil {
+		report(err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+var (
+	addResult    = flag.String("add-result", "", "append a result of type `T` to the function named by the first argument (pkg.Func or pkg.Type.Method) and complete its returns")
+	removeResult = flag.Int("remove-result", -1, "remove the result at `index` (from 0) from the function named by the first argument (pkg.Func or pkg.Type.Method), its returns, and its callers in the package")
+)
+
+// refactoring reports whether a signature refactoring was requested.
+func refactoring() bool {
+	return *addResult != "" || *removeResult >= 0
+}
+
+// A funcSpec names a function or method to refactor.
+type funcSpec struct {
+	pkg  string // package name, or import path if it has a slash
+	name string // "Func" or "Type.Method"
+
+	found bool // whether the function was found in any processed file
+}
+
+func (s *funcSpec) String() string { return s.pkg + "." + s.name }
+
+// parseFuncSpec parses "pkg.Func" or "pkg.Type.Method". The package may
+// be given by its import path ("example.com/pkg.Func").
+func parseFuncSpec(spec string) (*funcSpec, error) {
+	dir, last := "", spec
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		dir, last = spec[:i+1], spec[i+1:]
+	}
+	parts := strings.SplitN(last, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid function %q (want pkg.Func or pkg.Type.Method)", spec)
+	}
+	return &funcSpec{pkg: dir + parts[0], name: parts[1]}, nil
+}
+
+// matches reports whether src, the contents of filename in pkgDir, is
+// in s's package: whether its package clause names the package, or, if
+// s gives the package's import path, whether pkgDir is the package's
+// directory (and src isn't in its external test package).
+func (s *funcSpec) matches(pkgDir, filename string, src []byte) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), filename, src, parser.PackageClauseOnly)
+	if err != nil {
+		return false
+	}
+	if !strings.Contains(s.pkg, "/") {
+		return f.Name.Name == s.pkg
+	}
+	return !strings.HasSuffix(f.Name.Name, "_test") && importPath(pkgDir) == s.pkg
+}
+
+// importPath returns the import path of the package in dir, from the
+// nearest go.mod file, or else from its place in GOPATH, or "" if it
+// has neither.
+func importPath(dir string) string {
+	dir = absPath(dir)
+	if root, mod := moduleRoot(dir); mod != "" {
+		if rel, err := filepath.Rel(root, dir); err == nil {
+			return path.Join(mod, filepath.ToSlash(rel))
+		}
+	}
+	if pkg, err := build.ImportDir(dir, build.FindOnly); err == nil && pkg.ImportPath != "." {
+		return pkg.ImportPath
+	}
+	return ""
+}
+
+// refactorFunc is the function being refactored by -add-result or
+// -remove-result, or nil.
+var refactorFunc *funcSpec
+
+// refactor applies the requested signature refactoring to src if it
+// declares refactorFunc.
+func refactor(pkgDir, filename string, src []byte, opt *returns.Options) ([]byte, error) {
+	if !refactorFunc.matches(pkgDir, filename, src) {
+		return src, nil
+	}
+	var (
+		res   []byte
+		found bool
+		err   error
+	)
+	if *addResult != "" {
+		res, found, err = returns.AddResult(pkgDir, filename, src, refactorFunc.name, *addResult, opt)
+	} else {
+		res, found, err = returns.RemoveResult(pkgDir, filename, src, refactorFunc.name, *removeResult, opt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		refactorFunc.found = true
+	}
+	return res, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The state of the config files when they were last read, for
+// reloadConfig.
+var (
+	configArgs  []string // the arguments applyConfig parsed
+	configStamp string   // see stampConfigs
+)
+
+// runConfigFiles returns the names of the config files that may set the
+// flags of the run (see applyConfig): those that do, and those that
+// would if they were created or the others removed.
+func runConfigFiles() []string {
+	switch *configFile {
+	case "off":
+		return nil
+	case "":
+		return append(configFiles(absPath(configDir())), userConfig())
+	}
+	return []string{*configFile}
+}
+
+// stampConfigs returns a string that changes when one of the config
+// files names is created, removed, or modified.
+func stampConfigs(names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		if fi, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", name, fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	return b.String()
+}
+
+// reloadConfig reads the config files again if they've changed since
+// they were read, for the long-running modes (-watch and the language
+// server; the daemon reads them for each request): the flags are reset
+// to their defaults, and set from args, the config files, and the
+// environment again (see applyConfig). The options of directories whose
+// own config files changed (see dirOptions) are recomputed when next
+// needed. If reading them fails, it's tried again on the next call.
+func reloadConfig() error {
+	dirOptionsMu.Lock()
+	for dir, r := range dirOptionsCache {
+		if r.stamp != stampConfigs(configFiles(dir)) {
+			delete(dirOptionsCache, dir)
+		}
+	}
+	dirOptionsMu.Unlock()
+	if stampConfigs(runConfigFiles()) == configStamp {
+		return nil
+	}
+
+	args := configArgs
+	err := func() error {
+		flag.VisitAll(func(f *flag.Flag) { f.Value.Set(f.DefValue) })
+		if err := flag.CommandLine.Parse(args); err != nil {
+			return err
+		}
+		if err := applyConfig(args); err != nil {
+			return err
+		}
+		return setOptions()
+	}()
+	if err != nil {
+		configStamp = "" // to try again, until the config is fixed
+		return err
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "goreturns: reloaded the config files\n")
+	}
+	return nil
+}
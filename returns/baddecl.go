@@ -0,0 +1,100 @@
+package returns
+
+import (
+	"bytes"
+	"fmt"
+	"go/scanner"
+)
+
+// skipBadDecls replaces each top-level declaration of src that contains
+// one of the syntax errors in errs with a placeholder comment, so that
+// the rest of the file can be parsed and fixed. It returns the new
+// source and a function that puts the original declarations back in
+// the formatted output. ok is false if some error isn't inside a
+// top-level declaration (e.g., it's in the package clause).
+//
+// Declarations are found by their keyword at the start of a line, which
+// is how gofmt leaves them; this doesn't require parsing them.
+func skipBadDecls(src []byte, errs scanner.ErrorList) (out []byte, restore func([]byte) []byte, ok bool) {
+	type span struct{ start, end int }
+	var decls []span
+	for off := 0; off < len(src); {
+		line := src[off:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		}
+		if startsDecl(line) {
+			if n := len(decls); n > 0 {
+				decls[n-1].end = docStart(src, off)
+			}
+			decls = append(decls, span{off, len(src)})
+		}
+		off += len(line)
+	}
+
+	bad := map[int]bool{} // indexes of decls with errors
+	for _, err := range errs {
+		found := false
+		for i, d := range decls {
+			if d.start <= err.Pos.Offset && err.Pos.Offset < d.end {
+				bad[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, false
+		}
+	}
+
+	var buf bytes.Buffer
+	var markers, texts [][]byte
+	prev := 0
+	for i, d := range decls {
+		if !bad[i] {
+			continue
+		}
+		marker := []byte(fmt.Sprintf("//goreturns:skipped:%d", len(markers)))
+		markers = append(markers, marker)
+		texts = append(texts, bytes.TrimRight(src[d.start:d.end], " \t\n"))
+		buf.Write(src[prev:d.start])
+		buf.Write(marker)
+		// Keep the line numbers of the rest of the file.
+		buf.Write(bytes.Repeat([]byte("\n"), bytes.Count(src[d.start:d.end], []byte("\n"))))
+		prev = d.end
+	}
+	buf.Write(src[prev:])
+	restore = func(b []byte) []byte {
+		for i, marker := range markers {
+			b = bytes.Replace(b, marker, texts[i], 1)
+		}
+		return b
+	}
+	return buf.Bytes(), restore, true
+}
+
+// docStart returns the offset of the first of the comment lines that
+// immediately precede the line at offset off (or off, if there are
+// none), so that a declaration's doc comment stays with it.
+func docStart(src []byte, off int) int {
+	for off > 0 {
+		prev := bytes.LastIndexByte(src[:off-1], '\n') + 1
+		if !bytes.HasPrefix(src[prev:off], []byte("//")) {
+			break
+		}
+		off = prev
+	}
+	return off
+}
+
+// startsDecl reports whether line begins a top-level declaration.
+func startsDecl(line []byte) bool {
+	for _, kw := range []string{"func", "type", "var", "const", "import"} {
+		if bytes.HasPrefix(line, []byte(kw)) && len(line) > len(kw) {
+			switch line[len(kw)] {
+			case ' ', '\t', '(', '\n':
+				return true
+			}
+		}
+	}
+	return false
+}
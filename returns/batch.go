@@ -0,0 +1,306 @@
+package returns
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// A Batch is a set of files in one directory whose packages have been
+// loaded and typechecked together, so that each package is typechecked
+// once however many of its files are fixed. Fix each file with the
+// batch's Process method.
+type Batch struct {
+	pkgDir string
+	files  map[string]*batchFile // by absolute path
+}
+
+type batchFile struct {
+	src []byte       // as passed to LoadFiles
+	cf  *checkedFile // nil if the file must be processed on its own
+	err error        // error parsing the file
+}
+
+// LoadFiles parses the named files in pkgDir, whose contents are srcs,
+// and loads and typechecks their packages, seeing the files as given
+// rather than as they are on disk. A file and the in-package tests of
+// its package are checked together where possible, so that a directory
+// is typechecked at most twice (once more for its external tests).
+//
+// Files that can't be checked together with the others (e.g., those
+// excluded by build constraints, programs that each declare func main,
+// or all of them if the go command can't load the packages or
+// opt.SyntaxOnly is set) are
+// processed on their own, as by Process, when the batch's Process
+// method is called for them.
+func LoadFiles(pkgDir string, filenames []string, srcs [][]byte, opt *Options) *Batch {
+	if opt == nil {
+		opt = &Options{}
+	}
+	b := &Batch{pkgDir: pkgDir, files: map[string]*batchFile{}}
+	if opt.Errors != nil {
+		files := map[string][]byte{}
+		for i, filename := range filenames {
+			files[absPath(filename)] = srcs[i]
+		}
+		n := len(*opt.Errors)
+		defer func() { setColumns(*opt.Errors, n, files) }()
+	}
+	tm := opt.timing()
+	fset := token.NewFileSet()
+	ov := newOverlay(opt, "", nil)
+	goListOverlay := map[string][]byte{}
+	for name, data := range opt.Overlay {
+		goListOverlay[absPath(name)] = data
+	}
+
+	start := time.Now()
+	var abss []string // absolute paths of the parsed files, in order
+	hasTests, typed := false, false
+	for i, filename := range filenames {
+		abs := absPath(filename)
+		bf := &batchFile{src: srcs[i]}
+		b.files[abs] = bf
+		src := srcs[i]
+		file, adjust, err := parse(fset, filename, src, opt)
+		var restore func([]byte) []byte
+		if skipped, r, ok := skipBadSource(filename, src, err, opt); ok {
+			src, restore = skipped, r
+			file, adjust, err = parse(fset, filename, src, opt)
+		}
+		if err != nil {
+			bf.err = err
+			continue
+		}
+		bf.cf = &checkedFile{fset: fset, file: file, src: src, adjust: adjust, restore: restore}
+		ov[abs] = src
+		if importsChanged(abs, file) {
+			// "go list" must see the file's current imports.
+			goListOverlay[abs] = src
+		}
+		abss = append(abss, abs)
+		hasTests = hasTests || strings.HasSuffix(filename, "_test.go")
+		typed = typed || opt.reportsErrors() || needsTypes(file, opt)
+	}
+	tm.Parse += time.Since(start)
+	if len(abss) == 0 || opt.SyntaxOnly {
+		return b
+	}
+	if !typed {
+		opt.tracef("typecheck: skipped (no return needs type info to be fixed)")
+		return b
+	}
+
+	start = time.Now()
+	cfg := opt.packagesConfig(pkgDir)
+	cfg.Tests = hasTests
+	if len(goListOverlay) > 0 {
+		cfg.Overlay = goListOverlay
+	}
+	patterns := make([]string, len(abss))
+	for i, abs := range abss {
+		patterns[i] = "file=" + abs
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	tm.SiblingParse += time.Since(start)
+	if err != nil {
+		opt.tracef("load: go/packages: %s; processing the files one at a time", err)
+		b.unload(abss)
+		return b
+	}
+
+	for _, group := range groupByPackage(pkgs, abss) {
+		b.check(group.pkg, group.files, ov, opt)
+	}
+	return b
+}
+
+// A packageGroup is a package and the batch files that are checked as
+// part of it.
+type packageGroup struct {
+	pkg   *packages.Package
+	files []string // absolute paths
+}
+
+// groupByPackage assigns each of files to one of pkgs, preferring the
+// package that contains the most of the (remaining) files, so that a
+// package's files and its in-package tests are typechecked together as
+// the package's test variant. Files in none of pkgs are left out.
+func groupByPackage(pkgs []*packages.Package, files []string) []packageGroup {
+	contains := map[*packages.Package]map[string]bool{}
+	for _, pkg := range pkgs {
+		contains[pkg] = map[string]bool{}
+		for _, name := range pkg.CompiledGoFiles {
+			contains[pkg][name] = true
+		}
+	}
+	assigned := map[string]bool{}
+	var groups []packageGroup
+	for {
+		var best packageGroup
+		for _, pkg := range pkgs {
+			var g packageGroup
+			g.pkg = pkg
+			for _, abs := range files {
+				if !assigned[abs] && contains[pkg][abs] {
+					g.files = append(g.files, abs)
+				}
+			}
+			if len(g.files) > len(best.files) {
+				best = g
+			}
+		}
+		if len(best.files) == 0 {
+			return groups
+		}
+		for _, abs := range best.files {
+			assigned[abs] = true
+		}
+		groups = append(groups, best)
+	}
+}
+
+// check typechecks pkg, which contains the batch's files, once. If the
+// files are separate programs, they are instead unloaded to be
+// processed on their own.
+func (b *Batch) check(pkg *packages.Package, files []string, ov overlay, opt *Options) {
+	tm := opt.timing()
+	start := time.Now()
+	fset := b.files[files[0]].cf.fset
+	batched := map[string]*ast.File{}
+	var pkgFiles []*ast.File
+	for _, abs := range files {
+		batched[abs] = b.files[abs].cf.file
+		pkgFiles = append(pkgFiles, b.files[abs].cf.file)
+	}
+	var mains int
+	for _, name := range pkg.CompiledGoFiles {
+		if _, ok := batched[name]; ok {
+			continue
+		}
+		f, err := parseFile(fset, ov, name)
+		if err != nil {
+			if opt.PrintErrors {
+				fmt.Fprintf(opt.errOut(), "could not parse %q: %v\n", name, err)
+			}
+			opt.addError("parse", name, err)
+			continue
+		}
+		pkgFiles = append(pkgFiles, f)
+	}
+	for _, f := range pkgFiles {
+		if f.Name.Name == "main" && containsMainFunc(f) {
+			mains++
+		}
+	}
+	tm.SiblingParse += time.Since(start)
+	if mains > 1 {
+		// The directory is a collection of programs, one per file.
+		opt.tracef("load: several files in package %s declare func main; processing them one at a time", pkg.PkgPath)
+		b.unload(files)
+		return
+	}
+
+	opt.tracef("load: package %s (%s) with go/packages, for %s", pkg.Name, pkg.ID, plural(len(files), "file"))
+	opt.traceFiles(fset, pkgFiles[len(files):])
+	var imp types.Importer
+	if opt.targeted(true) {
+		imp = targetedImporter(fset, ov, pkg, pkgFiles, pkgFiles[:len(files)], opt)
+	} else {
+		imp = packageImporter(fset, ov, pkg, opt)
+	}
+	_, _, info, _ := checkFiles(fset, pkg.PkgPath, pkg.ID, pkgFiles[0], nil, pkgFiles, imp, opt)
+	for _, abs := range files {
+		b.files[abs].cf.info = info
+	}
+}
+
+// unload marks files to be processed on their own.
+func (b *Batch) unload(files []string) {
+	for _, abs := range files {
+		b.files[abs].cf = nil
+	}
+}
+
+// Process is like the package-level Process for filename, one of the
+// files the batch was loaded with, using the type information from
+// loading the batch. opt may set different fixer options (such as
+// Lines or Timing) from the options the batch was loaded with, but
+// should otherwise be the same.
+func (b *Batch) Process(filename string, opt *Options) ([]byte, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	bf, ok := b.files[absPath(filename)]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the batch", filename)
+	}
+	if hasPragmas(bf.src) {
+		// The batch was loaded with the options that the file
+		// overrides.
+		return Process(b.pkgDir, filename, bf.src, opt)
+	}
+	if bf.err != nil {
+		return nil, bf.err
+	}
+	if bf.cf == nil || bf.cf.info == nil && !opt.SyntaxOnly && needsTypes(bf.cf.file, opt) {
+		return Process(b.pkgDir, filename, bf.src, opt)
+	}
+	cf := bf.cf
+	bf.cf = nil // the syntax tree is about to be modified
+	return cf.fix(opt)
+}
+
+// ProcessPackage fixes the Go files in dir (those of its package, its
+// tests, and any excluded by build constraints, but not those whose
+// names begin with "." or "_"), loading and typechecking the package
+// once, as LoadFiles does. It returns the output of Process for each
+// file whose output differs from its contents, keyed by its path in
+// dir. Files are read through opt.Overlay and opt.BuildContext, if
+// set. If any file can't be processed, ProcessPackage returns the
+// first such error.
+func ProcessPackage(dir string, opt *Options) (map[string][]byte, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	ctxt := newOverlay(opt, "", nil).buildContext(opt.BuildContext, nil)
+	infos, err := ctxt.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	var srcs [][]byte
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			continue
+		}
+		filename := filepath.Join(dir, name)
+		src, err := readAll(ctxt.OpenFile(filename))
+		if err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+		srcs = append(srcs, src)
+	}
+
+	b := LoadFiles(dir, filenames, srcs, opt)
+	changed := map[string][]byte{}
+	for i, filename := range filenames {
+		out, err := b.Process(filename, opt)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(out, srcs[i]) {
+			changed[filename] = out
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,135 @@
+package returns
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadFiles(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/foo\n",
+		"a.go": `package foo
+
+import "errors"
+
+func Err() error { return errors.New("foo") }
+
+func A() (int, error) { return Err() }
+`,
+		"b.go": `package foo
+
+func B() (string, error) { return Err() }
+`,
+		"a_test.go": `package foo
+
+func helper() (bool, error) { return Err() }
+`,
+		"x_test.go": `package foo_test
+
+import "example.com/foo"
+
+func X() (int, error) { return foo.Err() }
+`,
+	})
+	defer os.RemoveAll(dir)
+	want := map[string]string{
+		"a.go": `package foo
+
+import "errors"
+
+func Err() error { return errors.New("foo") }
+
+func A() (int, error) { return 0, Err() }
+`,
+		"b.go": `package foo
+
+func B() (string, error) { return "", Err() }
+`,
+		"a_test.go": `package foo
+
+func helper() (bool, error) { return false, Err() }
+`,
+		"x_test.go": `package foo_test
+
+import "example.com/foo"
+
+func X() (int, error) { return 0, foo.Err() }
+`,
+	}
+
+	var filenames []string
+	var srcs [][]byte
+	for _, name := range []string{"a.go", "a_test.go", "b.go", "x_test.go"} {
+		filename := filepath.Join(dir, name)
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+		srcs = append(srcs, src)
+	}
+	var trace bytes.Buffer
+	opt := &Options{Trace: &trace}
+	b := LoadFiles(dir, filenames, srcs, opt)
+	for _, filename := range filenames {
+		buf, err := b.Process(filename, opt)
+		if err != nil {
+			t.Errorf("%s: %v", filename, err)
+			continue
+		}
+		if got, want := string(buf), want[filepath.Base(filename)]; got != want {
+			t.Errorf("%s: results diff\nGOT:\n%s\nWANT:\n%s\n", filename, got, want)
+		}
+	}
+
+	// The package and its in-package tests are typechecked together,
+	// and the external tests separately.
+	if n := strings.Count(trace.String(), "load: package"); n != 2 {
+		t.Errorf("got %d typechecks, want 2; trace:\n%s", n, &trace)
+	}
+}
+
+func TestProcessPackage(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/foo\n",
+		"a.go": `package foo
+
+func A() (int, error) { return Err() }
+`,
+		"b.go": `package foo
+
+func B() (int, error) { return 0, nil }
+`,
+		"_c.go": `package foo
+
+func C() (int, error) { return Err() }
+`,
+	})
+	defer os.RemoveAll(dir)
+	// d.go exists only in the overlay.
+	opt := &Options{Overlay: map[string][]byte{
+		filepath.Join(dir, "d.go"): []byte("package foo\n\nfunc Err() error { return nil }\n\nfunc D() (string, error) { return Err() }\n"),
+	}}
+	got, err := ProcessPackage(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"a.go": "package foo\n\nfunc A() (int, error) { return 0, Err() }\n",
+		"d.go": "package foo\n\nfunc Err() error { return nil }\n\nfunc D() (string, error) { return \"\", Err() }\n",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d changed files, want %d", len(got), len(want))
+	}
+	for name, w := range want {
+		if g, ok := got[filepath.Join(dir, name)]; !ok {
+			t.Errorf("%s: not changed", name)
+		} else if string(g) != w {
+			t.Errorf("%s: results diff\nGOT:\n%s\nWANT:\n%s\n", name, g, w)
+		}
+	}
+}
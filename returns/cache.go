@@ -0,0 +1,157 @@
+package returns
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"go/build"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/gcexportdata"
+	"golang.org/x/tools/go/packages"
+)
+
+// exportCacheVersion is part of every cache key. Change it when the
+// format of cache entries changes.
+const exportCacheVersion = "goreturns export cache v1"
+
+// An exportCache is an on-disk cache of the export data of packages
+// typechecked from source. Each entry is a file in dir named by the
+// package's key, which covers everything its export data depends on:
+// the package's own sources (identified by its module version, if any)
+// and, recursively, the keys of its dependencies.
+type exportCache struct {
+	dir  string
+	tags []string
+	keys map[*packages.Package]string // memoized keys
+	opt  *Options                     // for tracing
+}
+
+// key returns the cache key of p.
+func (c *exportCache) key(p *packages.Package, ov overlay) string {
+	if key, ok := c.keys[p]; ok {
+		return key
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s/%s tags=%s\npackage %s\n", exportCacheVersion, build.Default.GOOS, build.Default.GOARCH, strings.Join(c.tags, ","), p.PkgPath)
+	if m := p.Module; m != nil && m.Version != "" && m.Replace == nil {
+		// Versioned module contents are immutable.
+		fmt.Fprintf(h, "module %s@%s\n", m.Path, m.Version)
+	} else {
+		for _, name := range p.CompiledGoFiles {
+			if data, ok := ov[absPath(name)]; ok {
+				fmt.Fprintf(h, "file %s %x\n", name, sha256.Sum256(data))
+			} else if fi, err := os.Stat(name); err == nil {
+				fmt.Fprintf(h, "file %s %d %d\n", name, fi.Size(), fi.ModTime().UnixNano())
+			} else {
+				fmt.Fprintf(h, "file %s missing\n", name)
+			}
+		}
+	}
+	var imports []string
+	for path := range p.Imports {
+		imports = append(imports, path)
+	}
+	sort.Strings(imports)
+	for _, path := range imports {
+		fmt.Fprintf(h, "import %s %s\n", path, c.key(p.Imports[path], ov))
+	}
+	key := fmt.Sprintf("%x", h.Sum(nil))
+	c.keys[p] = key
+	return key
+}
+
+func (c *exportCache) file(key string) string {
+	return filepath.Join(c.dir, key[:2], key+"-export")
+}
+
+// readCache returns p's package from the export data cache, or nil if
+// it isn't cached (or the cache is disabled). p's dependencies are
+// imported first so that the cached package refers to the same
+// packages as the rest of the program.
+func (deps *exportDeps) readCache(p *packages.Package) *types.Package {
+	if deps.cache == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(deps.cache.file(deps.cache.key(p, deps.ov)))
+	if err != nil {
+		return nil
+	}
+	imports := map[string]*types.Package{}
+	var add func(pkg *types.Package)
+	add = func(pkg *types.Package) {
+		if pkg == nil || imports[pkg.Path()] != nil {
+			return
+		}
+		imports[pkg.Path()] = pkg
+		for _, imp := range pkg.Imports() {
+			add(imp)
+		}
+	}
+	imp := deps.importer(p)
+	for path := range p.Imports {
+		pkg, _ := imp.Import(path)
+		add(pkg)
+	}
+	tp, err := gcexportdata.Read(bytes.NewReader(data), deps.fset, imports, p.PkgPath)
+	if err != nil {
+		deps.cache.opt.tracef("cache: %s: %s", p.PkgPath, err)
+		return nil
+	}
+	deps.cache.opt.tracef("cache: %s: hit", p.PkgPath)
+	return tp
+}
+
+// writeCache stores the export data of tp, typechecked from p's
+// sources, in the cache. Failures are only traced: the cache is an
+// optimization.
+func (deps *exportDeps) writeCache(p *packages.Package, tp *types.Package) {
+	if deps.cache == nil || tp == nil {
+		return
+	}
+	if err := deps.cache.write(deps.cache.key(p, deps.ov), deps.fset, tp); err != nil {
+		deps.cache.opt.tracef("cache: %s: %s", p.PkgPath, err)
+	}
+}
+
+func (c *exportCache) write(key string, fset *token.FileSet, tp *types.Package) (err error) {
+	defer func() {
+		// The export data writer doesn't know every kind of type
+		// that go/types may produce.
+		if e := recover(); e != nil {
+			err = fmt.Errorf("writing export data: %v", e)
+		}
+	}()
+	var buf bytes.Buffer
+	if err := gcexportdata.Write(&buf, fset, tp); err != nil {
+		return err
+	}
+	name := c.file(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it into place, so that
+	// concurrent runs never read a partial entry.
+	f, err := ioutil.TempFile(filepath.Dir(name), key+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, &buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,245 @@
+package returns
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+// A Diagnostic is a problem found in a file by Check, or an error found
+// while loading its package (see Options.Errors).
+type Diagnostic struct {
+	Pos      token.Position // Pos.Column counts bytes
+	RuneCol  int            // Pos's 1-based column counted in runes (0 if Pos isn't in the file being processed)
+	UTF16Col int            // Pos's 1-based column counted in UTF-16 code units (as in LSP)
+	Category string         // short name of the check that produced it (e.g., "errlast"), or "parse", "load", or "typecheck"
+	Message  string
+	Severity Severity
+
+	Arity *Arity // for diagnostics about the number of values in a return
+
+	// NoTypeInfo is set on decisions (see Options.Decisions) to skip a
+	// return that type information would have let the fixer fix.
+	NoTypeInfo bool
+
+	// Added holds, for decisions to fix a return, the values that the
+	// fix added to it as Go source, such as "0, nil".
+	Added string
+}
+
+// Arity describes a return statement whose number of values differs
+// from its function's number of results.
+type Arity struct {
+	Want, Got int
+
+	// Drop lists the (0-based) indexes of the values that could be
+	// removed so that the remaining values match the results' types,
+	// if there are too many values and type info determines them.
+	Drop []int
+}
+
+// A Severity is how serious a Diagnostic is.
+type Severity int
+
+const (
+	Warning Severity = iota // the code may be wrong (as with all of Check's diagnostics), or the error doesn't prevent typechecking (e.g., an unused import)
+	Error                   // the code doesn't compile
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.Pos, d.Message)
+}
+
+// Check reports problems with the returns in the provided file (see
+// Process for the meaning of the arguments), without modifying it.
+func Check(pkgDir, filename string, src []byte, opt *Options) ([]Diagnostic, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	opt, err := applyPragmas(filename, src, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	cf, err := load(pkgDir, filename, src, opt, false)
+	if err != nil {
+		return nil, err
+	}
+	fset, file, typeInfo := cf.fset, cf.file, cf.info
+
+	var diags []Diagnostic
+	report := func(pos token.Pos, category, format string, args ...interface{}) {
+		p := fset.Position(pos)
+		diags = append(diags, Diagnostic{
+			Pos:      p,
+			RuneCol:  RuneColumn(src, p),
+			UTF16Col: UTF16Column(src, p),
+			Category: category,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	forEachFunc(file, func(name string, ftyp *ast.FuncType, body *ast.BlockStmt) {
+		if k, field := misplacedError(ftyp); field != nil {
+			report(field.Type.Pos(), "errlast", "error should be the last result of %s, not result %d", name, k)
+		}
+		if ftyp.Results == nil || len(ftyp.Results.List) == 0 || body == nil {
+			return
+		}
+		if !isTerminating(body) {
+			report(body.Rbrace, "missing-return", "missing return at end of %s", name)
+		}
+	})
+
+	returns := map[*ast.ReturnStmt]*ast.FuncType{}
+	ast.Walk(visitor{returns: returns}, file)
+	for _, ret := range sortedReturns(returns) {
+		ftyp := returns[ret]
+		if ftyp == nil || ftyp.Results == nil {
+			continue
+		}
+		numResults := 0
+		for _, f := range ftyp.Results.List {
+			numResults += fieldCount(f)
+		}
+		if opt.ReportNilNil && numResults >= 2 && len(ret.Results) == numResults && isNilNil(ftyp, ret) {
+			report(ret.Pos(), "nilnil", "returns nil value and nil error")
+		}
+		switch numRVs := len(ret.Results); {
+		case numRVs == 0 && len(ftyp.Results.List[0].Names) > 0:
+			report(ret.Pos(), "bare", "bare return")
+		case numRVs == 0:
+			report(ret.Pos(), "incomplete", "return has no values, want %d", numResults)
+		case numRVs < numResults:
+			if call, ok := ret.Results[0].(*ast.CallExpr); ok && numRVs == 1 && !funcHasSingleReturnVal(typeInfo, call) {
+				continue // might return multiple values
+			}
+			report(ret.Pos(), "incomplete", "return has %s, want %d", plural(numRVs, "value"), numResults)
+			diags[len(diags)-1].Arity = &Arity{Want: numResults, Got: numRVs}
+		case numRVs > numResults:
+			arity := &Arity{Want: numResults, Got: numRVs, Drop: valuesToDrop(ftyp, ret, typeInfo)}
+			msg := fmt.Sprintf("return has %s, want %d", plural(numRVs, "value"), numResults)
+			if len(arity.Drop) > 0 {
+				var drop []string
+				for _, i := range arity.Drop {
+					drop = append(drop, types.ExprString(ret.Results[i]))
+				}
+				msg += fmt.Sprintf(" (drop %s?)", strings.Join(drop, ", "))
+			}
+			report(ret.Pos(), "too-many", "%s", msg)
+			diags[len(diags)-1].Arity = arity
+		}
+	}
+	sort.SliceStable(diags, func(i, j int) bool {
+		pi, pj := diags[i].Pos, diags[j].Pos
+		return pi.Line < pj.Line || pi.Line == pj.Line && pi.Column < pj.Column
+	})
+	return diags, nil
+}
+
+// isNilNil reports whether ret, in a function with signature ftyp whose
+// last result is error, returns nil for all of its values.
+func isNilNil(ftyp *ast.FuncType, ret *ast.ReturnStmt) bool {
+	list := ftyp.Results.List
+	if !isErrorType(list[len(list)-1].Type) {
+		return false
+	}
+	for _, e := range ret.Results {
+		if id, ok := e.(*ast.Ident); !ok || id.Name != "nil" {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesToDrop returns the indexes of the values of ret that can be
+// dropped so that the rest are assignable, in order, to the results of
+// ftyp. It returns nil if type info is unavailable or no such choice
+// exists.
+func valuesToDrop(ftyp *ast.FuncType, ret *ast.ReturnStmt, typeInfo *types.Info) []int {
+	if typeInfo == nil {
+		return nil
+	}
+	var want []types.Type
+	for _, f := range ftyp.Results.List {
+		t := typeOf(typeInfo, f.Type)
+		if t == nil {
+			return nil
+		}
+		for i := 0; i < fieldCount(f); i++ {
+			want = append(want, t)
+		}
+	}
+	var drop []int
+	j := 0 // next result to match
+	for i, e := range ret.Results {
+		t := typeOf(typeInfo, e)
+		if t == nil {
+			return nil
+		}
+		// Keep the value if it matches the next result and enough
+		// values remain to match the rest.
+		if j < len(want) && types.AssignableTo(t, want[j]) && len(ret.Results)-i >= len(want)-j {
+			j++
+		} else {
+			drop = append(drop, i)
+		}
+	}
+	if j != len(want) {
+		return nil
+	}
+	return drop
+}
+
+// plural returns "n noun" or "n nouns", as appropriate.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// sortedReturns returns the keys of returns in source order.
+func sortedReturns(returns map[*ast.ReturnStmt]*ast.FuncType) []*ast.ReturnStmt {
+	rets := make([]*ast.ReturnStmt, 0, len(returns))
+	for ret := range returns {
+		rets = append(rets, ret)
+	}
+	sort.Slice(rets, func(i, j int) bool { return rets[i].Pos() < rets[j].Pos() })
+	return rets
+}
+
+// forEachFunc calls fn for each function declaration and function
+// literal in file. The name of a function literal is "func literal".
+func forEachFunc(file *ast.File, fn func(name string, ftyp *ast.FuncType, body *ast.BlockStmt)) {
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			fn(funcDeclName(n), n.Type, n.Body)
+		case *ast.FuncLit:
+			fn("func literal", n.Type, n.Body)
+		}
+		return true
+	})
+}
+
+// funcDeclName returns the name of fn as accepted by AddResult: "F" for
+// functions and "T.M" for methods.
+func funcDeclName(fn *ast.FuncDecl) string {
+	if fn.Recv != nil && len(fn.Recv.List) == 1 {
+		if recv := recvTypeName(fn.Recv.List[0].Type); recv != "" {
+			return recv + "." + fn.Name.Name
+		}
+	}
+	return fn.Name.Name
+}
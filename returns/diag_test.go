@@ -0,0 +1,105 @@
+package returns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	src := `package foo
+import "errors"
+func F() (error, int) { return nil, 0 }
+func G() (int, error) { return 0, nil }
+func H() (a int, err error, b string) { return }
+func I() (int, error) { return errors.New("x") }
+func J() (int, error) {
+	if true {
+		return
+	}
+	for {
+	}
+}
+func K() (int, error) {
+	switch {
+	case true:
+		return 0, nil
+	}
+}
+`
+	diags, err := Check("", "a.go", []byte(src), &Options{Fragment: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diags {
+		got = append(got, d.String())
+	}
+	want := []string{
+		"a.go:3:11: error should be the last result of F, not result 0",
+		"a.go:5:22: error should be the last result of H, not result 1",
+		"a.go:5:41: bare return",
+		"a.go:6:25: return has 1 value, want 2",
+		"a.go:9:3: return has no values, want 2",
+		"a.go:19:1: missing return at end of K",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got diagnostics %q, want %q", got, want)
+	}
+}
+
+func TestCheckNilNil(t *testing.T) {
+	src := `package foo
+func F() (*int, error) { return nil, nil }
+func G() (*int, error) { x := 1; return &x, nil }
+func H() (*int, *int) { return nil, nil }
+`
+	diags, err := Check("", "a.go", []byte(src), &Options{Fragment: true, ReportNilNil: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diags {
+		got = append(got, d.String())
+	}
+	want := []string{"a.go:2:26: returns nil value and nil error"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got diagnostics %q, want %q", got, want)
+	}
+}
+
+func TestCheckTooMany(t *testing.T) {
+	src := `package foo
+func F(s string) (int, error) { return 1, s, nil }
+func G() (int, error) { return 1, 2, 3 }
+`
+	diags, err := Check("", "a.go", []byte(src), &Options{Fragment: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Diagnostic{
+		{Message: "return has 3 values, want 2 (drop s?)", Arity: &Arity{Want: 2, Got: 3, Drop: []int{1}}},
+		{Message: "return has 3 values, want 2", Arity: &Arity{Want: 2, Got: 3}},
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d: %v", len(diags), len(want), diags)
+	}
+	for i, d := range diags {
+		if d.Category != "too-many" || d.Message != want[i].Message || !reflect.DeepEqual(d.Arity, want[i].Arity) {
+			t.Errorf("got diagnostic %q (arity %+v), want %q (arity %+v)", d.Message, d.Arity, want[i].Message, want[i].Arity)
+		}
+	}
+}
+
+func TestCheckMultibyte(t *testing.T) {
+	src := "package foo\nfunc Ĝ() (int, error) { /* 𝔼 */ return nil }\n"
+	diags, err := Check("", "a.go", []byte(src), &Options{Fragment: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 1 {
+		t.Fatalf("got %d diagnostics, want 1: %v", len(diags), diags)
+	}
+	if d := diags[0]; d.Pos.Column != 37 || d.RuneCol != 33 || d.UTF16Col != 34 {
+		t.Errorf("got columns %d (bytes), %d (runes), %d (UTF-16), want 37, 33, 34", d.Pos.Column, d.RuneCol, d.UTF16Col)
+	}
+}
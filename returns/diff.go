@@ -0,0 +1,100 @@
+package returns
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Diff returns a unified diff (as by "diff -u") that turns a, the
+// contents of the file oldName, into b, the contents of newName, with
+// context lines of unchanged context around each change. It returns nil
+// if a and b are the same.
+func Diff(oldName, newName string, a, b []byte, context int) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	alines, blines := splitLines(string(a)), splitLines(string(b))
+
+	// The lines of the edit script, each prefixed by ' ', '-', or '+'.
+	var script []string
+	ai, bi := 0, 0
+	for _, m := range append(matchLines(alines, blines), [2]int{len(alines), len(blines)}) {
+		for ; ai < m[0]; ai++ {
+			script = append(script, "-"+alines[ai])
+		}
+		for ; bi < m[1]; bi++ {
+			script = append(script, "+"+blines[bi])
+		}
+		if ai < len(alines) {
+			script = append(script, " "+alines[ai])
+		}
+		ai, bi = ai+1, bi+1
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+	aline, bline := 0, 0 // lines of a and b before script[i]
+	for i := 0; i < len(script); {
+		if script[i][0] == ' ' {
+			i, aline, bline = i+1, aline+1, bline+1
+			continue
+		}
+		// A hunk: the changes starting at script[i] and those that
+		// follow within 2*context unchanged lines, with context.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end, same := i, 0
+		for j := i; j < len(script) && same <= 2*context; j++ {
+			if script[j][0] == ' ' {
+				same++
+			} else {
+				end, same = j+1, 0
+			}
+		}
+		end += context
+		if end > len(script) {
+			end = len(script)
+		}
+		astart, bstart := aline-(i-start), bline-(i-start)
+		var acount, bcount int
+		for _, l := range script[start:end] {
+			if l[0] != '+' {
+				acount++
+			}
+			if l[0] != '-' {
+				bcount++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(astart, acount), hunkRange(bstart, bcount))
+		for _, l := range script[start:end] {
+			buf.WriteString(l)
+			if l[len(l)-1] != '\n' {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		for _, l := range script[i:end] {
+			if l[0] != '+' {
+				aline++
+			}
+			if l[0] != '-' {
+				bline++
+			}
+		}
+		i = end
+	}
+	return buf.Bytes()
+}
+
+// hunkRange formats the range of count lines after the first start
+// lines of a file for a hunk header, as "diff -u" does.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,30 @@
+package returns
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		context int
+		want    string
+	}{
+		{"a\nb\n", "a\nb\n", 3, ""},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "1\n2\n3\nfour\n5\n6\n7\n8\n9\nten\n", 1,
+			"--- a/f.go\n+++ b/f.go\n@@ -3,3 +3,3 @@\n 3\n-4\n+four\n 5\n@@ -9,2 +9,2 @@\n 9\n-10\n+ten\n",
+		},
+		{
+			// Changes within twice the context share a hunk.
+			"1\n2\n3\n4\n5\n", "one\n2\n3\nfour\n5\n", 1,
+			"--- a/f.go\n+++ b/f.go\n@@ -1,5 +1,5 @@\n-1\n+one\n 2\n 3\n-4\n+four\n 5\n",
+		},
+		{"", "a\n", 3, "--- a/f.go\n+++ b/f.go\n@@ -0,0 +1 @@\n+a\n"},
+		{"a\n", "", 3, "--- a/f.go\n+++ b/f.go\n@@ -1 +0,0 @@\n-a\n"},
+		{"a\nb", "a\nb\n", 3, "--- a/f.go\n+++ b/f.go\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n"},
+	}
+	for _, test := range tests {
+		if got := string(Diff("a/f.go", "b/f.go", []byte(test.a), []byte(test.b), test.context)); got != test.want {
+			t.Errorf("%q -> %q (context %d): got\n%s\nwant\n%s", test.a, test.b, test.context, got, test.want)
+		}
+	}
+}
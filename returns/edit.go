@@ -0,0 +1,341 @@
+package returns
+
+import (
+	"bytes"
+	"go/token"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// An Edit replaces the bytes src[Start:End] of a file's source with New.
+type Edit struct {
+	Start, End int // byte offsets in the original source
+	New        string
+}
+
+// ComputeFixes returns the edits that Process would make to the
+// provided file (see Process for the meaning of the arguments), as a
+// list of non-overlapping edits in increasing order of offset. Each
+// edit replaces whole lines. It is meant for editors and language
+// servers, which apply edits instead of replacing the whole file; use
+// RuneColumn and UTF16Column to convert the edits' positions, and
+// Check for the corresponding diagnostics.
+//
+// ComputeFixes, like the rest of the package, keeps no state between
+// calls, so it is safe to call concurrently.
+func ComputeFixes(pkgDir, filename string, src []byte, opt *Options) ([]Edit, error) {
+	out, err := Process(pkgDir, filename, src, opt)
+	if err != nil {
+		return nil, err
+	}
+	return LineEdits(src, out), nil
+}
+
+// ApplyEdits returns src with edits applied. The edits must not
+// overlap.
+func ApplyEdits(src []byte, edits []Edit) []byte {
+	sorted := append([]Edit(nil), edits...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	var buf bytes.Buffer
+	last := 0
+	for _, e := range sorted {
+		buf.Write(src[last:e.Start])
+		buf.WriteString(e.New)
+		last = e.End
+	}
+	buf.Write(src[last:])
+	return buf.Bytes()
+}
+
+// MapOffset returns the offset in b, the result of changing a (as by
+// processing it), that corresponds to offset in a, such as the position
+// of an editor's cursor. An offset in text that a change kept at the
+// start or end of a changed line stays with that text; an offset in text
+// that was replaced moves to the end of its replacement.
+func MapOffset(a, b []byte, offset int) int {
+	shift := 0 // bytes added (or, if negative, removed) by the edits so far
+	for _, e := range LineEdits(a, b) {
+		if offset < e.Start {
+			break
+		}
+		if offset < e.End {
+			old, new := string(a[e.Start:e.End]), e.New
+			p := 0 // length of their common prefix
+			for p < len(old) && p < len(new) && old[p] == new[p] {
+				p++
+			}
+			s := 0 // length of their common suffix, after the prefix
+			for s < len(old)-p && s < len(new)-p && old[len(old)-1-s] == new[len(new)-1-s] {
+				s++
+			}
+			switch {
+			case e.End-offset <= s:
+				return offset + shift + len(new) - len(old)
+			case offset-e.Start < p:
+				return offset + shift
+			}
+			return e.Start + shift + len(new) - s
+		}
+		shift += len(e.New) - (e.End - e.Start)
+	}
+	return offset + shift
+}
+
+// A TextEdit replaces the text of a file's source from Start up to End
+// with New.
+type TextEdit struct {
+	Start, End token.Position // with Offset, Line, and Column (counting bytes) in the source
+	New        string
+}
+
+// Edits returns the edits that fix the returns of the provided file
+// (see Process for the meaning of the arguments), in increasing order
+// of offset. Unlike ComputeFixes's, they change only the lines that the
+// fixers change (which are printed in gofmt style), leaving the rest of
+// the file's formatting as it is (as with Options.KeepFormatting), and
+// each spans only the words, spaces, and punctuation that change, such
+// as the values added to a return, rather than whole lines, so that
+// editors can apply them without disturbing the rest of the buffer (or
+// its markers and cursors). Use UTF16Column for LSP's positions.
+func Edits(pkgDir, filename string, src []byte, opt *Options) ([]TextEdit, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	o := *opt
+	o.KeepFormatting = true
+	out, err := Process(pkgDir, filename, src, &o)
+	if err != nil {
+		return nil, err
+	}
+	var edits []TextEdit
+	for _, e := range LineEdits(src, out) {
+		for _, e := range narrowEdit(src, e) {
+			edits = append(edits, TextEdit{Start: offsetPosition(filename, src, e.Start), End: offsetPosition(filename, src, e.End), New: e.New})
+		}
+	}
+	return edits, nil
+}
+
+// narrowEdit returns e, an edit of src that replaces whole lines, as
+// edits that replace only the words, spaces, and punctuation that
+// change.
+func narrowEdit(src []byte, e Edit) []Edit {
+	edits := tokenEdits(splitTokens(string(src[e.Start:e.End])), splitTokens(e.New))
+	for i := range edits {
+		edits[i].Start += e.Start
+		edits[i].End += e.Start
+	}
+	return edits
+}
+
+// splitTokens splits s into runs of letters, digits, and underscores,
+// runs of white space, and single other characters.
+func splitTokens(s string) []string {
+	class := func(r rune) int {
+		switch {
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			return 1
+		case unicode.IsSpace(r):
+			return 2
+		}
+		return 0
+	}
+	var tokens []string
+	for s != "" {
+		r, n := utf8.DecodeRuneInString(s)
+		if c := class(r); c != 0 {
+			for n < len(s) {
+				r, size := utf8.DecodeRuneInString(s[n:])
+				if class(r) != c {
+					break
+				}
+				n += size
+			}
+		}
+		tokens = append(tokens, s[:n])
+		s = s[n:]
+	}
+	return tokens
+}
+
+// offsetPosition returns the position of offset in src, the contents of
+// filename.
+func offsetPosition(filename string, src []byte, offset int) token.Position {
+	return token.Position{
+		Filename: filename,
+		Offset:   offset,
+		Line:     1 + bytes.Count(src[:offset], []byte("\n")),
+		Column:   offset - bytes.LastIndexByte(src[:offset], '\n'),
+	}
+}
+
+// LineEdits returns the edits that turn a into b (such as a file and
+// the result of processing it), replacing whole lines, in increasing
+// order of offset.
+func LineEdits(a, b []byte) []Edit {
+	return tokenEdits(splitLines(string(a)), splitLines(string(b)))
+}
+
+// tokenEdits returns the edits that turn the concatenation of a into
+// that of b, replacing whole elements of a (such as lines), in
+// increasing order of offset.
+func tokenEdits(a, b []string) []Edit {
+	aoff := make([]int, len(a)+1) // offset of each element of a
+	for i, t := range a {
+		aoff[i+1] = aoff[i] + len(t)
+	}
+
+	var edits []Edit
+	ai, bi := 0, 0 // next unmatched elements
+	for _, m := range append(matchLines(a, b), [2]int{len(a), len(b)}) {
+		if m[0] > ai || m[1] > bi {
+			edits = append(edits, Edit{Start: aoff[ai], End: aoff[m[0]], New: strings.Join(b[bi:m[1]], "")})
+		}
+		ai, bi = m[0]+1, m[1]+1
+	}
+	return edits
+}
+
+// keepFormatting returns src with the changes that turn formatted (src
+// as printed) into out (src as printed after fixing it). Where the
+// printing changed the lines around a change, and not just in place
+// (as by reindenting them), those lines are taken from formatted, so
+// that each change lands in the right place; the rest of src is left as
+// it is.
+func keepFormatting(src, formatted, out []byte) []byte {
+	a, f, o := splitLines(string(src)), splitLines(string(formatted)), splitLines(string(out))
+	fa := make([]int, len(f)) // index of the line of a matching each line of f, or -1
+	for i := range fa {
+		fa[i] = -1
+	}
+	for _, m := range matchLines(a, f) {
+		fa[m[1]] = m[0]
+	}
+
+	// A hunk replaces the lines f[fs:fe] with o[os:oe]. It is widened
+	// to the lines f[p+1:q] between the nearest lines of f that match
+	// lines of a, which are replaced in a.
+	type hunk struct{ fs, fe, os, oe, p, q int }
+	var hunks []hunk
+	fi, oi := 0, 0 // next unmatched lines
+	for _, m := range append(matchLines(f, o), [2]int{len(f), len(o)}) {
+		if m[0] > fi || m[1] > oi {
+			h := hunk{fs: fi, fe: m[0], os: oi, oe: m[1]}
+			if n := len(hunks); n > 0 && h.fs <= hunks[n-1].q {
+				// The widened hunks overlap; merge them.
+				h.fs, h.os = hunks[n-1].fs, hunks[n-1].os
+				hunks = hunks[:n-1]
+			}
+			for h.p = h.fs - 1; h.p >= 0 && fa[h.p] < 0; h.p-- {
+			}
+			for h.q = h.fe; h.q < len(f) && fa[h.q] < 0; h.q++ {
+			}
+			hunks = append(hunks, h)
+		}
+		fi, oi = m[0]+1, m[1]+1
+	}
+
+	var buf strings.Builder
+	ai := 0 // next line of a to copy
+	for _, h := range hunks {
+		start, end := 0, len(a) // the lines of a that h replaces
+		if h.p >= 0 {
+			start = fa[h.p] + 1
+		}
+		if h.q < len(f) {
+			end = fa[h.q]
+		}
+		before, after := f[h.p+1:h.fs], f[h.fe:h.q]
+		if end-start == h.q-h.p-1 {
+			// The lines of a were changed in place, so the lines
+			// around the change correspond.
+			before, after = a[start:start+len(before)], a[end-len(after):end]
+		}
+		buf.WriteString(strings.Join(a[ai:start], ""))
+		buf.WriteString(strings.Join(before, ""))
+		buf.WriteString(strings.Join(o[h.os:h.oe], ""))
+		buf.WriteString(strings.Join(after, ""))
+		ai = end
+	}
+	buf.WriteString(strings.Join(a[ai:], ""))
+	return []byte(buf.String())
+}
+
+// splitLines splits s into lines, each with its trailing newline (if
+// any).
+func splitLines(s string) []string {
+	var lines []string
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '\n') + 1
+		if i == 0 {
+			i = len(s)
+		}
+		lines = append(lines, s[:i])
+		s = s[i:]
+	}
+	return lines
+}
+
+// matchLines returns the index pairs of the lines of a and b in a
+// longest common subsequence, in increasing order. It uses Myers's
+// O(ND) diff algorithm, which is fast when a and b are similar.
+func matchLines(a, b []string) [][2]int {
+	n, m := len(a), len(b)
+	dmax := n + m
+	off := dmax + 1 // v is indexed by diagonal k in [-dmax-1, dmax+1]
+	v := make([]int, 2*dmax+3)
+	var trace [][]int // v before each round
+	d := 0
+Rounds:
+	for ; d <= dmax; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+				x = v[off+k+1] // down: insertion from b
+			} else {
+				x = v[off+k-1] + 1 // right: deletion from a
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break Rounds
+			}
+		}
+	}
+
+	// Walk back through the rounds, collecting the diagonal (matching)
+	// moves.
+	var matches [][2]int
+	x, y := n, m
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			matches = append(matches, [2]int{x, y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		matches = append(matches, [2]int{x, y})
+	}
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches
+}
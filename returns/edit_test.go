@@ -0,0 +1,153 @@
+package returns
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineEdits(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{"", ""},
+		{"", "a\n"},
+		{"a\n", ""},
+		{"a\nb\nc\n", "a\nb\nc\n"},
+		{"a\nb\nc\n", "a\nx\nc\n"},
+		{"a\nb\nc\n", "x\na\nb\nc\ny\n"},
+		{"a\nb\nc\nd\ne\n", "b\nc\nx\ne\n"},
+		{"a\nb", "a\nb\n"},
+		{"a\nb\na\nb\n", "b\na\nb\na\n"},
+	}
+	for _, test := range tests {
+		edits := LineEdits([]byte(test.a), []byte(test.b))
+		if got := string(ApplyEdits([]byte(test.a), edits)); got != test.b {
+			t.Errorf("%q -> %q: edits %+v give %q", test.a, test.b, edits, got)
+		}
+		if test.a == test.b && len(edits) != 0 {
+			t.Errorf("%q: got edits %+v for identical inputs", test.a, edits)
+		}
+	}
+}
+
+func TestMapOffset(t *testing.T) {
+	a := "package foo\n\nfunc F() (int, error) {\n\treturn errors.New(\"foo\")\n}\n\nvar x = 1\n"
+	b := "package foo\n\nimport \"errors\"\n\nfunc F() (int, error) {\n\treturn 0, errors.New(\"foo\")\n}\n\nvar x = 1\n"
+	tests := []struct {
+		before, after string // the text at the offset in a and in b
+	}{
+		{"package", "package"},
+		{"func F", "func F"},
+		{"return errors", "return 0, errors"},
+		{"errors.New", "errors.New"},
+		{"(\"foo\")", "(\"foo\")"},
+		{"var x", "var x"},
+	}
+	for _, test := range tests {
+		offset := strings.Index(a, test.before)
+		want := strings.Index(b, test.after)
+		if got := MapOffset([]byte(a), []byte(b), offset); got != want {
+			t.Errorf("offset of %q: got %d (at %q), want %d", test.before, got, b[got:], want)
+		}
+	}
+	if got, want := MapOffset([]byte(a), []byte(b), len(a)), len(b); got != want {
+		t.Errorf("offset at end: got %d, want %d", got, want)
+	}
+}
+
+func TestComputeFixes(t *testing.T) {
+	src := `package foo
+
+import "errors"
+
+func F() (int, error) { return errors.New("foo") }
+
+func G() error { return nil }
+
+func H() (string, error) {
+	return errors.New("foo")
+}
+`
+	edits, err := ComputeFixes("", "a.go", []byte(src), &Options{Fragment: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Edit{
+		{Start: 30, End: 81, New: "func F() (int, error) { return 0, errors.New(\"foo\") }\n"},
+		{Start: 140, End: 166, New: "\treturn \"\", errors.New(\"foo\")\n"},
+	}
+	if !reflect.DeepEqual(edits, want) {
+		t.Errorf("got edits %+v, want %+v", edits, want)
+	}
+}
+
+func TestEdits(t *testing.T) {
+	src := `package foo
+
+import "errors"
+
+func F() (int,error) { return errors.New("é") }
+
+func G() (s string, err error) {
+	return
+}
+
+func  H() (string, error) {
+	x := "é"
+	return errors.New(x)
+}
+`
+	edits, err := Edits("", "a.go", []byte(src), &Options{Fragment: true, Fixes: []string{"zero", "bare"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range edits {
+		got = append(got, fmt.Sprintf("%d:%d-%d:%d %q", e.Start.Line, e.Start.Column, e.End.Line, e.End.Column, e.New))
+		if string(src[e.Start.Offset:e.End.Offset]) != src[e.Start.Offset:e.End.Offset] {
+			t.Errorf("bad offsets %+v", e)
+		}
+	}
+	// The lines that change are printed in gofmt style, but no others.
+	want := []string{
+		`5:15-5:15 " "`,
+		`5:31-5:31 "0, "`,
+		`8:8-8:8 " s, err"`,
+		`13:9-13:9 "\"\", "`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got edits\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+
+	var lineEdits []Edit
+	for _, e := range edits {
+		lineEdits = append(lineEdits, Edit{Start: e.Start.Offset, End: e.End.Offset, New: e.New})
+	}
+	out, err := Process("", "a.go", []byte(src), &Options{Fragment: true, Fixes: []string{"zero", "bare"}, KeepFormatting: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(ApplyEdits([]byte(src), lineEdits)); got != string(out) {
+		t.Errorf("applying the edits got\n%s\nwant\n%s", got, out)
+	}
+}
+
+func ExampleComputeFixes() {
+	src := []byte(`package foo
+
+import "errors"
+
+func F() (int, string, error) {
+	return errors.New("é")
+}
+`)
+	edits, err := ComputeFixes("", "foo.go", src, nil)
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range edits {
+		fmt.Printf("replace %d:%d with %q\n", e.Start, e.End, strings.TrimSpace(e.New))
+	}
+	// Output:
+	// replace 62:87 with "return 0, \"\", errors.New(\"é\")"
+}
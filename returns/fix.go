@@ -5,15 +5,58 @@
 package returns
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
 	"go/printer"
 	"go/token"
 	"go/types"
+	"io"
 	"os"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
 )
 
-func fixReturns(fset *token.FileSet, f *ast.File, typeInfo *types.Info) error {
+// An IncompleteReturn is a return statement with fewer values than its
+// function has results, as found by IncompleteReturns.
+type IncompleteReturn struct {
+	Return *ast.ReturnStmt
+	Func   *ast.FuncType // the type of the function declaration or literal that Return is in
+
+	// Values are the zero values that the zero fixer would add before
+	// Return's values, or nil if it would leave Return alone, in which
+	// case Skip says why (e.g., "unknown zero value of T").
+	Values []ast.Expr
+	Skip   string
+}
+
+// IncompleteReturns returns the returns in f, a file parsed with fset,
+// that have fewer values than their functions have results (apart from
+// bare returns), in source order, with the zero values that FixReturns
+// would add to them, without modifying f. info, if non-nil, is the type
+// info of f's package (see FixReturns); opt's ErrorFuncsOnly and
+// Lines apply, and it may be nil. The values are
+// new syntax trees, which belong to the caller.
+func IncompleteReturns(fset *token.FileSet, f *ast.File, info *types.Info, opt *Options) []IncompleteReturn {
+	if opt == nil {
+		opt = &Options{}
+	}
+	returns := map[*ast.ReturnStmt]*ast.FuncType{}
+	ast.Walk(visitor{returns: returns}, f)
+	var incomplete []IncompleteReturn
+	for _, ret := range sortedReturns(returns) {
+		ftyp := returns[ret]
+		if ftyp == nil || ftyp.Results == nil || len(ret.Results) == 0 || len(ret.Results) >= len(resultTypes(ftyp)) {
+			continue
+		}
+		zvs, skip, _ := zeroValues(fset, ret, ftyp, info, opt)
+		incomplete = append(incomplete, IncompleteReturn{Return: ret, Func: ftyp, Values: zvs, Skip: skip})
+	}
+	return incomplete
+}
+
+func fixReturns(fset *token.FileSet, f *ast.File, typeInfo *types.Info, opt *Options) error {
 	// map of potentially incomplete return statements (that might
 	// need fixing) to the FuncType of the return's enclosing FuncDecl
 	// or FuncLit
@@ -24,54 +67,87 @@ func fixReturns(fset *token.FileSet, f *ast.File, typeInfo *types.Info) error {
 
 	//	printIncReturnsVerbose(fset, incReturns)
 
-IncReturnsLoop:
-	for ret, ftyp := range incReturns {
+	for _, ret := range sortedReturns(incReturns) {
+		ftyp := incReturns[ret]
 		if ftyp.Results == nil {
 			continue
 		}
-
-		numRVs := len(ret.Results)
-		if numRVs == len(ftyp.Results.List) {
-			// correct return arity
-			continue
+		pos := fset.Position(ret.Pos())
+		zvs, skip, untyped := zeroValues(fset, ret, ftyp, typeInfo, opt)
+		switch {
+		case untyped:
+			opt.skipUntypedf("zero", pos, "skipped: %s", skip)
+		case skip != "":
+			opt.decidef("zero", pos, "skipped: %s", skip)
+		case zvs != nil:
+			opt.fixedf("zero", pos, zvs, "fixed: added %s", plural(len(zvs), "zero value"))
+			ret.Results = append(zvs, ret.Results...)
 		}
+	}
 
-		if numRVs == 0 {
-			// skip naked returns (could be named return values)
-			continue
-		}
+	return nil
+}
 
-		if numRVs > len(ftyp.Results.List) {
-			// too many return values; preserve and ignore
-			continue
-		}
+// zeroValues returns the zero values that the zero fixer adds before
+// the values of ret, a return in a function of type ftyp, or else why
+// it leaves ret alone, and whether that's for lack of type info. It
+// returns neither if ret has the right number of values.
+func zeroValues(fset *token.FileSet, ret *ast.ReturnStmt, ftyp *ast.FuncType, typeInfo *types.Info, opt *Options) (zvs []ast.Expr, skip string, untyped bool) {
+	if !opt.inLines(fset, ret) {
+		return nil, "not on a selected line", false
+	}
+	if opt.ErrorFuncsOnly && !isErrorType(ftyp.Results.List[len(ftyp.Results.List)-1].Type) {
+		return nil, "function's last result isn't error", false
+	}
 
-		// skip if return value is a func call (whose multiple returns
-		// might be expanded)
-		if e, ok := ret.Results[0].(*ast.CallExpr); ok {
-			if !funcHasSingleReturnVal(typeInfo, e) {
-				continue
-			}
-		}
+	results := resultTypes(ftyp)
+	numRVs := len(ret.Results)
+	if numRVs == len(results) {
+		// correct return arity
+		return nil, "", false
+	}
 
-		// left-fill zero values
-		zvs := make([]ast.Expr, len(ftyp.Results.List)-numRVs)
-		for i, rt := range ftyp.Results.List[:len(zvs)] {
-			zv := newZeroValueNode(rt.Type)
-			if zv == nil {
-				// be conservative; if we can't determine the zero
-				// value, don't fill in anything
-				continue IncReturnsLoop
+	if numRVs == 0 {
+		// skip naked returns (could be named return values)
+		return nil, "naked return (see the bare fixer)", false
+	}
+
+	if numRVs > len(results) {
+		// too many return values; preserve and ignore
+		return nil, "too many values", false
+	}
+
+	// skip if return value is a func call (whose multiple returns
+	// might be expanded)
+	if e, ok := ret.Results[0].(*ast.CallExpr); ok {
+		if !funcHasSingleReturnVal(typeInfo, e) {
+			if typeOf(typeInfo, e) == nil {
+				return nil, "returns a call, and without its type it may return multiple values", true
 			}
-			zvs[i] = zv
+			return nil, "returns a call that returns multiple values", false
 		}
-		ret.Results = append(zvs, ret.Results...)
 	}
 
-	return nil
+	// left-fill zero values
+	zvs = make([]ast.Expr, len(results)-numRVs)
+	for i, rt := range results[:len(zvs)] {
+		zv := newZeroValueNode(rt)
+		if zv == nil {
+			// be conservative; if we can't determine the zero
+			// value, don't fill in anything
+			return nil, fmt.Sprintf("unknown zero value of %s", types.ExprString(rt)), false
+		}
+		opt.annotate(zv)
+		zvs[i] = zv
+	}
+	return zvs, "", false
 }
 
-func removeBareReturns(fset *token.FileSet, f *ast.File, typeInfo *types.Info) error {
+// removeBareReturns expands bare returns in functions with results
+// into returns of the named results. Blank (_) and unnamed results,
+// which a return can't refer to, get zero values instead; if any zero
+// value can't be determined, the return is left alone.
+func removeBareReturns(fset *token.FileSet, f *ast.File, typeInfo *types.Info, opt *Options) error {
 	// map of return statements to the FuncType of the return's enclosing
 	// FuncDecl or FuncLit
 	incReturns := map[*ast.ReturnStmt]*ast.FuncType{}
@@ -82,33 +158,589 @@ func removeBareReturns(fset *token.FileSet, f *ast.File, typeInfo *types.Info) e
 	//	printIncReturnsVerbose(fset, incReturns)
 
 IncReturnsLoop:
-	for ret, ftyp := range incReturns {
-		if ftyp.Results == nil {
+	for _, ret := range sortedReturns(incReturns) {
+		ftyp := incReturns[ret]
+		if ftyp.Results == nil || len(ftyp.Results.List) == 0 || len(ret.Results) != 0 {
 			continue
 		}
-
-		numRVs := len(ret.Results)
-		if numRVs == len(ftyp.Results.List) {
-			// correct return arity
+		pos := fset.Position(ret.Pos())
+		if !opt.inLines(fset, ret) {
+			opt.decidef("bare", pos, "skipped: not on a selected line")
 			continue
 		}
 
-		if numRVs == 0 && len(ftyp.Results.List) > 0 {
-			zvs := make([]ast.Expr, len(ftyp.Results.List))
-			for i, rt := range ftyp.Results.List {
-				if len(rt.Names) == 0 {
+		var rvs []ast.Expr
+		for _, rt := range ftyp.Results.List {
+			for i, n := 0, fieldCount(rt); i < n; i++ {
+				if len(rt.Names) > 0 && rt.Names[i].Name != "_" {
+					rvs = append(rvs, &ast.Ident{Name: rt.Names[i].Name})
+					continue
+				}
+				zv := zeroValueExpr(rt.Type, typeInfo)
+				if zv == nil {
+					if isType(typeInfo, rt.Type) {
+						opt.decidef("bare", pos, "skipped: unknown zero value of %s", types.ExprString(rt.Type))
+					} else {
+						opt.skipUntypedf("bare", pos, "skipped: unknown zero value of %s", types.ExprString(rt.Type))
+					}
 					continue IncReturnsLoop
 				}
-				zv := &ast.Ident{Name: rt.Names[0].Name}
-				zvs[i] = zv
+				opt.annotate(zv)
+				rvs = append(rvs, zv)
 			}
-			ret.Results = append(zvs, ret.Results...)
 		}
+		opt.fixedf("bare", pos, rvs, "fixed: expanded into a return of %s", plural(len(rvs), "value"))
+		ret.Results = rvs
+	}
+
+	return nil
+}
+
+// zeroValueExpr returns a new AST expr representing the zero value of
+// typ, a type expression in the file, using type info (if available)
+// for types whose zero value isn't evident from their syntax. It
+// returns nil if the zero value can't be determined.
+func zeroValueExpr(typ ast.Expr, typeInfo *types.Info) ast.Expr {
+	if zv := newZeroValueNode(typ); zv != nil {
+		return zv
+	}
+	if !isType(typeInfo, typ) {
+		return nil
+	}
+	zv := zeroValueOfType(typeInfo.Types[typ].Type, typ)
+	if lit, ok := zv.(*ast.CompositeLit); ok {
+		lit.Type = &ast.Ident{Name: types.ExprString(typ)}
+	}
+	return zv
+}
+
+// isType reports whether typeInfo (which may be nil) has the type that
+// the expression typ denotes.
+func isType(typeInfo *types.Info, typ ast.Expr) bool {
+	if typeInfo == nil {
+		return false
+	}
+	tv, ok := typeInfo.Types[typ]
+	return ok && tv.IsType() && tv.Type != types.Typ[types.Invalid]
+}
+
+// addMissingReturns adds a return statement at the end of functions
+// with results whose bodies don't end in a terminating statement. The
+// return is naked if the results are named, and returns zero values
+// otherwise.
+func addMissingReturns(fset *token.FileSet, f *ast.File, typeInfo *types.Info, opt *Options) error {
+	forEachFunc(f, func(name string, ftyp *ast.FuncType, body *ast.BlockStmt) {
+		if body == nil || ftyp.Results == nil || len(ftyp.Results.List) == 0 || isTerminating(body) || !opt.inLines(fset, body) {
+			return
+		}
+		ret := &ast.ReturnStmt{Return: body.Rbrace}
+		if len(ftyp.Results.List[0].Names) == 0 {
+			for _, rt := range ftyp.Results.List {
+				zv := newZeroValueNode(rt.Type)
+				if zv == nil {
+					opt.decidef("missing-return", fset.Position(body.Rbrace), "skipped: unknown zero value of %s", types.ExprString(rt.Type))
+					return
+				}
+				ret.Results = append(ret.Results, zv)
+			}
+		}
+		opt.fixedf("missing-return", fset.Position(body.Rbrace), ret.Results, "fixed: added a return at the end of %s", name)
+		body.List = append(body.List, ret)
+	})
+	return nil
+}
+
+// fillContextErrors completes naked returns (however deeply nested) in
+// select cases that receive from ctx.Done() and in the bodies of "if
+// ctx.Err() != nil" and "if err := ctx.Err(); err != nil" statements,
+// in functions with unnamed results that take a context.Context
+// parameter ctx and whose last result is error. The error result is
+// filled with ctx.Err() (instead of nil, and rather than err, which may
+// be shadowed) and the other results with zero values.
+func fillContextErrors(fset *token.FileSet, f *ast.File, typeInfo *types.Info, opt *Options) error {
+	fill := func(ftyp *ast.FuncType, body *ast.BlockStmt) {
+		if body == nil || ftyp.Results == nil || len(ftyp.Results.List) == 0 {
+			return
+		}
+		results := ftyp.Results.List
+		if len(results[0].Names) > 0 || !isErrorType(results[len(results)-1].Type) {
+			return
+		}
+		ctxParams := contextParams(ftyp)
+		if len(ctxParams) == 0 {
+			return
+		}
+		// fillReturns fills the naked returns in stmts.
+		fillReturns := func(stmts []ast.Stmt, ctx string) {
+			for _, ret := range nakedReturns(stmts) {
+				if !opt.inLines(fset, ret) {
+					continue
+				}
+				zvs := make([]ast.Expr, len(results))
+				for i, rt := range results[:len(results)-1] {
+					if zvs[i] = newZeroValueNode(rt.Type); zvs[i] == nil {
+						return
+					}
+				}
+				zvs[len(zvs)-1] = &ast.CallExpr{Fun: &ast.SelectorExpr{X: ast.NewIdent(ctx), Sel: ast.NewIdent("Err")}}
+				ret.Results = zvs
+			}
+		}
+		ast.Inspect(body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false // handled separately, with its own signature
+			case *ast.CommClause:
+				if ctx := doneContext(n.Comm); ctx != "" && ctxParams[ctx] {
+					fillReturns(n.Body, ctx)
+				}
+			case *ast.IfStmt:
+				if ctx := errCheckContext(n); ctx != "" && ctxParams[ctx] {
+					fillReturns(n.Body.List, ctx)
+				}
+			}
+			return true
+		})
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			fill(n.Type, n.Body)
+		case *ast.FuncLit:
+			fill(n.Type, n.Body)
+		}
+		return true
+	})
+	return nil
+}
+
+// returnDiscardedErrors returns errors that are discarded by assigning
+// them to _ from the last result of a call, in functions whose last
+// result is error. "v, _ := f()" becomes "v, err := f()" followed by
+// "if err != nil { return ..., err }", with zero values for the other
+// results, and "_ = f()" becomes "if err := f(); err != nil { ... }".
+// Whether the assignment declares err or assigns one already in scope
+// (with := or =) depends on what's in scope (see errAssignTok); it's
+// left alone if neither works. It requires type info.
+func returnDiscardedErrors(fset *token.FileSet, f *ast.File, typeInfo *types.Info, opt *Options) error {
+	if typeInfo == nil {
+		return nil
+	}
+	forEachFunc(f, func(_ string, ftyp *ast.FuncType, body *ast.BlockStmt) {
+		if body == nil || ftyp.Results == nil || len(ftyp.Results.List) == 0 {
+			return
+		}
+		results := resultTypes(ftyp)
+		if !isErrorType(results[len(results)-1]) {
+			return
+		}
+		returnErr := func() *ast.ReturnStmt {
+			ret := &ast.ReturnStmt{}
+			for _, typ := range results[:len(results)-1] {
+				zv := zeroValueExpr(typ, typeInfo)
+				if zv == nil {
+					return nil
+				}
+				opt.annotate(zv)
+				ret.Results = append(ret.Results, zv)
+			}
+			ret.Results = append(ret.Results, ast.NewIdent("err"))
+			return ret
+		}
+		declared := map[*types.Scope]bool{} // scopes in which err was declared by a rewrite
+		fix := func(list []ast.Stmt) []ast.Stmt {
+			var out []ast.Stmt
+			for _, stmt := range list {
+				as, ok := stmt.(*ast.AssignStmt)
+				if !ok || !discardsError(as, typeInfo) || !opt.inLines(fset, as) {
+					out = append(out, stmt)
+					continue
+				}
+				ret := returnErr()
+				if ret == nil {
+					out = append(out, stmt)
+					continue
+				}
+				tok := token.DEFINE
+				if len(as.Lhs) > 1 {
+					if tok, ok = errAssignTok(as, typeInfo, declared); !ok {
+						out = append(out, stmt)
+						continue
+					}
+				}
+				as.Lhs[len(as.Lhs)-1] = ast.NewIdent("err")
+				as.Tok = tok
+				check := &ast.IfStmt{
+					Cond: &ast.BinaryExpr{X: ast.NewIdent("err"), Op: token.NEQ, Y: ast.NewIdent("nil")},
+					Body: &ast.BlockStmt{List: []ast.Stmt{ret}},
+				}
+				if len(as.Lhs) == 1 {
+					check.Init = as
+					out = append(out, check)
+				} else {
+					out = append(out, as, check)
+				}
+			}
+			return out
+		}
+		ast.Inspect(body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false // handled separately, with its own signature
+			case *ast.BlockStmt:
+				n.List = fix(n.List)
+			case *ast.CaseClause:
+				n.Body = fix(n.Body)
+			case *ast.CommClause:
+				n.Body = fix(n.Body)
+			}
+			return true
+		})
+	})
+	return nil
+}
+
+// discardsError reports whether as assigns the error returned as the
+// last result of a call to _, in a form that returnDiscardedErrors can
+// rewrite ("v, _ := f()" or "_ = f()").
+func discardsError(as *ast.AssignStmt, typeInfo *types.Info) bool {
+	if len(as.Rhs) != 1 {
+		return false
+	}
+	if id, ok := as.Lhs[len(as.Lhs)-1].(*ast.Ident); !ok || id.Name != "_" {
+		return false
+	}
+	if as.Tok != token.DEFINE && as.Tok != token.ASSIGN {
+		return false
+	}
+	call, ok := as.Rhs[0].(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	t := typeOf(typeInfo, call)
+	if tuple, ok := t.(*types.Tuple); ok {
+		if tuple.Len() != len(as.Lhs) {
+			return false
+		}
+		t = tuple.At(tuple.Len() - 1).Type()
+	} else if len(as.Lhs) != 1 {
+		return false
+	}
+	return t != nil && types.Identical(t, types.Universe.Lookup("error").Type())
+}
+
+// errAssignTok returns the token with which as, which discards an
+// error (see discardsError), can assign it to err instead, going by the
+// err in scope: = or := (if as has it) assign an err of type error
+// declared in the same scope, or = one in an outer scope; otherwise :=
+// declares a new err, if it wouldn't redeclare any of as's other
+// variables in an outer scope, hide an outer err used later in the
+// scope, or clash with an err declared later in the scope. Scopes in
+// which earlier rewrites declared err are recorded in declared (as
+// typeInfo doesn't know about them). It reports false if there's no
+// such token.
+func errAssignTok(as *ast.AssignStmt, typeInfo *types.Info, declared map[*types.Scope]bool) (token.Token, bool) {
+	scope := scopeAt(typeInfo, as.Pos())
+	if scope == nil {
+		return 0, false
+	}
+	errScope, obj := scope.LookupParent("err", as.Pos())
+	for s := scope; s != nil && s != errScope; s = s.Parent() {
+		if declared[s] {
+			errScope, obj = s, types.NewVar(token.NoPos, nil, "err", types.Universe.Lookup("error").Type())
+			break
+		}
+	}
+	v, isVar := obj.(*types.Var)
+	isError := isVar && types.Identical(v.Type(), types.Universe.Lookup("error").Type())
+	switch {
+	case obj != nil && errScope == scope:
+		return as.Tok, isError
+	case isError && as.Tok == token.ASSIGN:
+		return token.ASSIGN, true
+	}
+	if obj != nil && usedAfter(obj, as.End(), scope.End(), typeInfo) || scope.Lookup("err") != nil {
+		return 0, false // err is used or declared later in the scope
+	}
+	if as.Tok == token.ASSIGN {
+		// := must assign the other variables, not declare them.
+		for _, lhs := range as.Lhs[:len(as.Lhs)-1] {
+			id, ok := lhs.(*ast.Ident)
+			if !ok {
+				return 0, false
+			}
+			if s, _ := scope.LookupParent(id.Name, as.Pos()); id.Name != "_" && s != scope {
+				return 0, false
+			}
+		}
+	}
+	declared[scope] = true
+	return token.DEFINE, true
+}
+
+// scopeAt returns the innermost scope at pos, or nil if typeInfo
+// doesn't say.
+func scopeAt(typeInfo *types.Info, pos token.Pos) *types.Scope {
+	for _, obj := range typeInfo.Defs {
+		if obj != nil && obj.Pkg() != nil {
+			return obj.Pkg().Scope().Innermost(pos)
+		}
+	}
+	return nil
+}
+
+// usedAfter reports whether obj is used between pos and end.
+func usedAfter(obj types.Object, pos, end token.Pos, typeInfo *types.Info) bool {
+	for id, o := range typeInfo.Uses {
+		if o == obj && id.Pos() > pos && id.Pos() < end {
+			return true
+		}
+	}
+	return false
+}
+
+func isErrorType(typ ast.Expr) bool {
+	id, ok := typ.(*ast.Ident)
+	return ok && id.Name == "error"
+}
+
+// contextParams returns the names of ftyp's parameters of type
+// context.Context.
+func contextParams(ftyp *ast.FuncType) map[string]bool {
+	names := map[string]bool{}
+	for _, p := range ftyp.Params.List {
+		sel, ok := p.Type.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Context" {
+			continue
+		}
+		if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "context" {
+			continue
+		}
+		for _, name := range p.Names {
+			names[name.Name] = true
+		}
+	}
+	return names
+}
+
+// doneContext returns the name of ctx if comm is a receive from
+// ctx.Done() (as in "case <-ctx.Done():"), or "" otherwise.
+func doneContext(comm ast.Stmt) string {
+	var x ast.Expr
+	switch s := comm.(type) {
+	case *ast.ExprStmt:
+		x = s.X
+	case *ast.AssignStmt:
+		if len(s.Rhs) == 1 {
+			x = s.Rhs[0]
+		}
+	}
+	recv, ok := x.(*ast.UnaryExpr)
+	if !ok || recv.Op != token.ARROW {
+		return ""
+	}
+	call, ok := recv.X.(*ast.CallExpr)
+	if !ok || len(call.Args) != 0 {
+		return ""
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Done" {
+		return ""
+	}
+	if id, ok := sel.X.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// errCheckContext returns the name of ctx if ifs checks ctx.Err(), as
+// in "if ctx.Err() != nil" or "if err := ctx.Err(); err != nil", or ""
+// otherwise.
+func errCheckContext(ifs *ast.IfStmt) string {
+	cond, ok := ifs.Cond.(*ast.BinaryExpr)
+	if !ok || cond.Op != token.NEQ {
+		return ""
+	}
+	x := cond.X
+	if id, ok := x.(*ast.Ident); ok && id.Name == "nil" {
+		x = cond.Y
+	} else if id, ok := cond.Y.(*ast.Ident); !ok || id.Name != "nil" {
+		return ""
+	}
+	if ifs.Init == nil {
+		return errContext(x)
+	}
+	as, ok := ifs.Init.(*ast.AssignStmt)
+	if !ok || as.Tok != token.DEFINE || len(as.Lhs) != 1 || len(as.Rhs) != 1 {
+		return ""
+	}
+	v, ok := as.Lhs[0].(*ast.Ident)
+	if id, isIdent := x.(*ast.Ident); !ok || !isIdent || id.Name != v.Name || v.Name == "_" {
+		return ""
+	}
+	return errContext(as.Rhs[0])
+}
+
+// errContext returns the name of ctx if e is a call of ctx.Err(), or ""
+// otherwise.
+func errContext(e ast.Expr) string {
+	call, ok := e.(*ast.CallExpr)
+	if !ok || len(call.Args) != 0 {
+		return ""
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Err" {
+		return ""
+	}
+	if id, ok := sel.X.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// nakedReturns returns the return statements with no results in stmts,
+// excluding those in nested func literals.
+func nakedReturns(stmts []ast.Stmt) []*ast.ReturnStmt {
+	var rets []*ast.ReturnStmt
+	for _, s := range stmts {
+		ast.Inspect(s, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.ReturnStmt:
+				if len(n.Results) == 0 {
+					rets = append(rets, n)
+				}
+			}
+			return true
+		})
+	}
+	return rets
+}
+
+// misplacedError returns the result field of ftyp with type error and
+// its result index, if it is not the last result. If ftyp has no error
+// result, more than one, or the error is last, it returns nil.
+func misplacedError(ftyp *ast.FuncType) (int, *ast.Field) {
+	if ftyp.Results == nil {
+		return 0, nil
+	}
+	var (
+		errField *ast.Field
+		errIndex int
+		n        int // number of results so far
+	)
+	for _, f := range ftyp.Results.List {
+		if isErrorType(f.Type) {
+			if errField != nil || len(f.Names) > 1 {
+				return 0, nil // multiple error results
+			}
+			errField, errIndex = f, n
+		}
+		n += fieldCount(f)
 	}
+	if errField == nil || errIndex == n-1 {
+		return 0, nil
+	}
+	return errIndex, errField
+}
+
+// moveErrorsLast moves error results that aren't in the last position
+// in function signatures to the end, reordering the values of the
+// functions' return statements and of the assignments in f from calls
+// to the functions to match.
+func moveErrorsLast(fset *token.FileSet, f *ast.File, typeInfo *types.Info, opt *Options) error {
+	type move struct {
+		name    string
+		from, n int // result index of the error, and number of results
+	}
+	var moves []move
+	forEachFunc(f, func(name string, ftyp *ast.FuncType, body *ast.BlockStmt) {
+		k, field := misplacedError(ftyp)
+		if field == nil || !opt.inLines(fset, ftyp) {
+			return
+		}
+		list := ftyp.Results.List
+		for i, f := range list {
+			if f == field {
+				list = append(list[:i:i], list[i+1:]...)
+				break
+			}
+		}
+		ftyp.Results.List = append(list, field)
+		n := 0
+		for _, f := range ftyp.Results.List {
+			n += fieldCount(f)
+		}
+
+		if body != nil {
+			returns := map[*ast.ReturnStmt]*ast.FuncType{}
+			ast.Walk(visitor{enclosing: ftyp, returns: returns}, body)
+			for ret, enclosing := range returns {
+				if enclosing == ftyp && len(ret.Results) == n {
+					ret.Results = moveLast(ret.Results, k)
+				}
+			}
+		}
+		if name != "func literal" {
+			moves = append(moves, move{name, k, n})
+		}
+	})
 
+	for _, m := range moves {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				if len(n.Rhs) == 1 && len(n.Lhs) == m.n {
+					if call, ok := n.Rhs[0].(*ast.CallExpr); ok && callsFunc(call, m.name, typeInfo) {
+						n.Lhs = moveLast(n.Lhs, m.from)
+					}
+				}
+			case *ast.ValueSpec:
+				if len(n.Values) == 1 && len(n.Names) == m.n {
+					if call, ok := n.Values[0].(*ast.CallExpr); ok && callsFunc(call, m.name, typeInfo) {
+						names := make([]ast.Expr, len(n.Names))
+						for i, id := range n.Names {
+							names[i] = id
+						}
+						for i, e := range moveLast(names, m.from) {
+							n.Names[i] = e.(*ast.Ident)
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
 	return nil
 }
 
+// fieldCount returns the number of parameters or results declared by f.
+func fieldCount(f *ast.Field) int {
+	if len(f.Names) == 0 {
+		return 1
+	}
+	return len(f.Names)
+}
+
+// resultTypes returns the type of each of ftyp's results, repeating
+// the type of grouped results ("a, b int").
+func resultTypes(ftyp *ast.FuncType) []ast.Expr {
+	var list []ast.Expr
+	for _, f := range ftyp.Results.List {
+		for i := 0; i < fieldCount(f); i++ {
+			list = append(list, f.Type)
+		}
+	}
+	return list
+}
+
+// moveLast returns a copy of list with its i'th element moved to the end.
+func moveLast(list []ast.Expr, i int) []ast.Expr {
+	moved := append(list[:i:i], list[i+1:]...)
+	return append(moved, list[i])
+}
+
 type visitor struct {
 	enclosing *ast.FuncType                     // innermost enclosing func
 	returns   map[*ast.ReturnStmt]*ast.FuncType // potentially incomplete returns
@@ -161,6 +793,94 @@ func newZeroValueNode(typ ast.Expr) ast.Expr {
 	return nil
 }
 
+// annotate marks zv, a zero value that a fixer inserted, to be printed
+// with opt.ZeroValueComment after it, if the file is to be printed.
+// The comment isn't added to the syntax tree: synthesized nodes have no
+// positions, so the printer can't place comments next to them.
+func (opt *Options) annotate(zv ast.Expr) {
+	if opt.annotated != nil {
+		opt.annotated[zv] = true
+	}
+}
+
+// An annotation is the text that replaces a node in a printed file.
+type annotation struct {
+	node        ast.Expr
+	placeholder string // an identifier that stands in for node when printing
+	text        string // node followed by its comment
+}
+
+// annotations returns the annotations of the nodes, commented with
+// text, in a file with source src.
+func annotations(src []byte, nodes map[ast.Expr]bool, text string) []annotation {
+	text = strings.Replace(text, "*/", "* /", -1)
+	var anns []annotation
+	for node := range nodes {
+		a := annotation{node: node, text: exprList([]ast.Expr{node}) + " /* " + text + " */"}
+		a.placeholder = fmt.Sprintf("zeroValue%d_", len(anns))
+		for bytes.Contains(src, []byte(a.placeholder)) {
+			a.placeholder = "_" + a.placeholder
+		}
+		// Print the placeholder as wide as the text, so that the
+		// printer lays out the file as it will be.
+		if n := len(a.text) - len(a.placeholder); n > 0 {
+			a.placeholder += strings.Repeat("_", n)
+		}
+		anns = append(anns, a)
+	}
+	return anns
+}
+
+// printAnnotated prints file like printer.Fprint, with the annotated
+// nodes followed by their comments. The nodes are replaced by
+// placeholders while printing, whose text is then replaced.
+func printAnnotated(w io.Writer, fset *token.FileSet, file *ast.File, anns []annotation) error {
+	if len(anns) == 0 {
+		return printer.Fprint(w, fset, file)
+	}
+	placeholders := map[ast.Node]ast.Expr{}
+	for _, a := range anns {
+		placeholders[a.node] = ast.NewIdent(a.placeholder)
+	}
+	replace := func(repl map[ast.Node]ast.Expr) {
+		astutil.Apply(file, nil, func(c *astutil.Cursor) bool {
+			if e, ok := repl[c.Node()]; ok {
+				c.Replace(e)
+			}
+			return true
+		})
+	}
+	replace(placeholders)
+	nodes := map[ast.Node]ast.Expr{}
+	for _, a := range anns {
+		nodes[placeholders[a.node]] = a.node
+	}
+	var buf bytes.Buffer
+	err := printer.Fprint(&buf, fset, file)
+	replace(nodes)
+	if err != nil {
+		return err
+	}
+	out := buf.Bytes()
+	for _, a := range anns {
+		out = bytes.Replace(out, []byte(a.placeholder), []byte(a.text), 1)
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// exprList returns the Go source of exprs, separated by commas.
+func exprList(exprs []ast.Expr) string {
+	var buf bytes.Buffer
+	for i, e := range exprs {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		printer.Fprint(&buf, token.NewFileSet(), e)
+	}
+	return buf.String()
+}
+
 func printIncReturns(fset *token.FileSet, v map[*ast.ReturnStmt]*ast.FuncType) {
 	for ret, ftyp := range v {
 		fmt.Print("FUNC TYPE: ")
@@ -5,9 +5,26 @@
 package returns
 
 import (
+	"bytes"
+	"context"
 	"flag"
-	_ "go/importer"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var only = flag.String("only", "", "If non-empty, the fix test to run")
@@ -15,6 +32,7 @@ var only = flag.String("only", "", "If non-empty, the fix test to run")
 var tests = []struct {
 	name    string
 	skip    bool
+	opt     *Options // if nil, defaults to fragment mode
 	in, out string
 }{
 	// No-op
@@ -54,6 +72,21 @@ func F() (int, error) { return errors.New("foo") }
 import "errors"
 
 func F() (int, error) { return 0, errors.New("foo") }
+`,
+	},
+	{
+		name: "preceding grouped",
+		in: `package foo
+import "os"
+func C() (a, b int, err error) { return os.ErrClosed }
+func D() (a, b int, err error) { return 1, 2, nil }
+`,
+		out: `package foo
+
+import "os"
+
+func C() (a, b int, err error) { return 0, 0, os.ErrClosed }
+func D() (a, b int, err error) { return 1, 2, nil }
 `,
 	},
 
@@ -427,25 +460,1738 @@ func outer() (string, error) {
 }
 `,
 	},
+
+	// Return ctx.Err() from naked returns in ctx.Done() branches.
+	{
+		name: "ctx.Err",
+		opt:  &Options{Fragment: true, Fixes: []string{"zero", "ctxerr"}},
+		in: `package foo
+import "context"
+func F(ctx context.Context, c chan int) (int, error) {
+	select {
+	case <-ctx.Done():
+		return
+	case v := <-c:
+		return v, nil
+	}
+}
+func G(ctx context.Context, c chan int) (v int, err error) {
+	select {
+	case <-ctx.Done():
+		return
+	}
+}
+func H(ctx context.Context, c chan int) (int, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			if len(c) > 0 {
+				for range c {
+					return
+				}
+			}
+			return
+		case v := <-c:
+			if v < 0 {
+				return
+			}
+		}
+	}
+}
+func I(ctx context.Context, c chan int) (int, error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if err := ctx.Err(); err != nil {
+		if len(c) > 0 {
+			return
+		}
+	}
+	if nil != ctx.Err() {
+		return
+	}
+	if ctx.Err() == nil {
+		return
+	}
+	return <-c, nil
 }
+`,
+		out: `package foo
 
-func TestFixReturns(t *testing.T) {
-	options := &Options{Fragment: true}
+import "context"
 
-	for _, tt := range tests {
-		if *only != "" && tt.name != *only {
-			continue
+func F(ctx context.Context, c chan int) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case v := <-c:
+		return v, nil
+	}
+}
+func G(ctx context.Context, c chan int) (v int, err error) {
+	select {
+	case <-ctx.Done():
+		return
+	}
+}
+func H(ctx context.Context, c chan int) (int, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			if len(c) > 0 {
+				for range c {
+					return 0, ctx.Err()
+				}
+			}
+			return 0, ctx.Err()
+		case v := <-c:
+			if v < 0 {
+				return
+			}
 		}
-		if tt.skip {
-			continue
+	}
+}
+func I(ctx context.Context, c chan int) (int, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err := ctx.Err(); err != nil {
+		if len(c) > 0 {
+			return 0, ctx.Err()
+		}
+	}
+	if nil != ctx.Err() {
+		return 0, ctx.Err()
+	}
+	if ctx.Err() == nil {
+		return
+	}
+	return <-c, nil
+}
+`,
+	},
+
+	// Move error results last, then fill zero values.
+	{
+		name: "errlast",
+		opt:  &Options{Fragment: true, Fixes: []string{"errlast", "zero"}},
+		in: `package foo
+import "errors"
+func F(x int) (error, int) {
+	if x < 0 {
+		return errors.New("negative")
+	}
+	return nil, x
+}
+func G() int {
+	err, x := F(1)
+	_ = err
+	return x
+}
+`,
+		out: `package foo
+
+import "errors"
+
+func F(x int) (int, error) {
+	if x < 0 {
+		return 0, errors.New("negative")
+	}
+	return x, nil
+}
+func G() int {
+	x, err := F(1)
+	_ = err
+	return x
+}
+`,
+	},
+
+	// Only fix returns on the given lines.
+	{
+		name: "lines",
+		opt:  &Options{Fragment: true, Lines: []LineRange{{Start: 4, End: 4}}},
+		in: `package foo
+import "errors"
+func F() (int, error) { return errors.New("foo") }
+func G() (int, error) { return errors.New("foo") }
+`,
+		out: `package foo
+
+import "errors"
+
+func F() (int, error) { return errors.New("foo") }
+func G() (int, error) { return 0, errors.New("foo") }
+`,
+	},
+
+	// Annotate inserted zero values with a comment.
+	{
+		name: "annotate",
+		opt:  &Options{Fragment: true, ZeroValueComment: "TODO: verify zero value"},
+		in: `package foo
+import "errors"
+func F() (int, string, error) { return errors.New("foo") }
+`,
+		out: `package foo
+
+import "errors"
+
+func F() (int, string, error) {
+	return 0 /* TODO: verify zero value */, "" /* TODO: verify zero value */, errors.New("foo")
+}
+`,
+	},
+
+	// Add missing returns at the end of functions.
+	{
+		name: "missing-return",
+		opt:  &Options{Fragment: true, Fixes: []string{"missing-return"}},
+		in: `package foo
+func F(x int) (int, error) {
+	if x > 0 {
+		return 1, nil
+	}
+}
+func G() (n int, err error) {
+	n = 1
+}
+func H() (int, error) {
+	for {
+	}
+}
+`,
+		out: `package foo
+
+func F(x int) (int, error) {
+	if x > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+func G() (n int, err error) {
+	n = 1
+	return
+}
+func H() (int, error) {
+	for {
+	}
+}
+`,
+	},
+
+	// Expand bare returns, with zero values for blank results.
+	{
+		name: "bare",
+		opt:  &Options{Fragment: true, Fixes: []string{"bare"}},
+		in: `package foo
+type T struct{ x int }
+func F() (a, b int, err error) { return }
+func G() (_ int, _ T, err error) { return }
+func H() (int, error) { return }
+`,
+		out: `package foo
+
+type T struct{ x int }
+
+func F() (a, b int, err error)   { return a, b, err }
+func G() (_ int, _ T, err error) { return 0, T{}, err }
+func H() (int, error)            { return 0, nil }
+`,
+	},
+
+	// Expand all bare returns, not just erroneous ones, including those
+	// in methods and function literals.
+	{
+		name: "bare everywhere",
+		opt:  &Options{Fragment: true, Fixes: []string{"bare"}},
+		in: `package foo
+type T struct{}
+func (T) M() (n int, err error) {
+	f := func() (s string) {
+		s = "x"
+		return
+	}
+	if n > 0 {
+		return
+	}
+	_ = f
+	return
+}
+func F() (n int) { return n }
+`,
+		out: `package foo
+
+type T struct{}
+
+func (T) M() (n int, err error) {
+	f := func() (s string) {
+		s = "x"
+		return s
+	}
+	if n > 0 {
+		return n, err
+	}
+	_ = f
+	return n, err
+}
+func F() (n int) { return n }
+`,
+	},
+
+	// Return errors instead of discarding them.
+	{
+		name: "errcheck",
+		opt:  &Options{Fragment: true, Fixes: []string{"errcheck"}},
+		in: `package foo
+import "os"
+type T struct{ x int }
+func F(name string) (T, int64, error) {
+	fi, _ := os.Stat(name)
+	_ = os.Remove(name)
+	switch {
+	case fi != nil:
+		f, _ := os.Open(name)
+		f.Close()
+	}
+	_ = func() int {
+		_ = os.Remove(name)
+		return 0
+	}
+	var n int
+	n, _ = 1, os.Remove(name)
+	return T{}, fi.Size() + int64(n), nil
+}
+`,
+		out: `package foo
+
+import "os"
+
+type T struct{ x int }
+
+func F(name string) (T, int64, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return T{}, 0, err
+	}
+	if err := os.Remove(name); err != nil {
+		return T{}, 0, err
+	}
+	switch {
+	case fi != nil:
+		f, err := os.Open(name)
+		if err != nil {
+			return T{}, 0, err
+		}
+		f.Close()
+	}
+	_ = func() int {
+		_ = os.Remove(name)
+		return 0
+	}
+	var n int
+	n, _ = 1, os.Remove(name)
+	return T{}, fi.Size() + int64(n), nil
+}
+`,
+	},
+
+	// Assign or declare err depending on what's in scope.
+	{
+		name: "errcheck err in scope",
+		opt:  &Options{Fragment: true, Fixes: []string{"errcheck"}},
+		in: `package foo
+import "os"
+func F(name string) (int, error) {
+	err := 1
+	fi, _ := os.Stat(name)
+	{
+		f, _ := os.Open(name)
+		f.Close()
+	}
+	return err, fi.Sys().(error)
+}
+func G(name string) (*os.File, error) {
+	var fi os.FileInfo
+	var err error
+	fi, _ = os.Stat(name)
+	var f *os.File
+	if fi != nil {
+		f, _ = os.Open(name)
+	}
+	return f, err
+}
+func H(name string) (*os.File, error) {
+	var f, g *os.File
+	f, _ = os.Open(name)
+	if f == nil {
+		f, _ = os.Open(name)
+	}
+	g, _ = os.Open(name)
+	return f, g.Close()
+}
+func I(name string) (*os.File, error) {
+	f, _ := os.Open(name)
+	var err error
+	return f, err
+}
+`,
+		out: `package foo
+
+import "os"
+
+func F(name string) (int, error) {
+	err := 1
+	fi, _ := os.Stat(name)
+	{
+		f, err := os.Open(name)
+		if err != nil {
+			return 0, err
 		}
-		buf, err := Process("", tt.name+".go", []byte(tt.in), options)
+		f.Close()
+	}
+	return err, fi.Sys().(error)
+}
+func G(name string) (*os.File, error) {
+	var fi os.FileInfo
+	var err error
+	fi, err = os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	var f *os.File
+	if fi != nil {
+		f, err = os.Open(name)
 		if err != nil {
-			t.Errorf("error on %q: %v", tt.name, err)
-			continue
+			return nil, err
 		}
-		if got := string(buf); got != tt.out {
-			t.Errorf("results diff on %q\nGOT:\n%s\nWANT:\n%s\n", tt.name, got, tt.out)
+	}
+	return f, err
+}
+func H(name string) (*os.File, error) {
+	var f, g *os.File
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		f, err = os.Open(name)
+		if err != nil {
+			return nil, err
 		}
 	}
+	g, err = os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, g.Close()
+}
+func I(name string) (*os.File, error) {
+	f, _ := os.Open(name)
+	var err error
+	return f, err
+}
+`,
+	},
+
+	// Only complete returns in functions that return an error.
+	{
+		name: "error funcs only",
+		opt:  &Options{Fragment: true, ErrorFuncsOnly: true},
+		in: `package foo
+import "errors"
+func F() (int, error) { return errors.New("foo") }
+func G() (int, string) { return "foo" }
+`,
+		out: `package foo
+
+import "errors"
+
+func F() (int, error)  { return 0, errors.New("foo") }
+func G() (int, string) { return "foo" }
+`,
+	},
+
+	// Leave declarations that don't parse alone, and fix the rest.
+	{
+		name: "skip bad decls",
+		opt:  &Options{Fragment: true, SkipBadDecls: true},
+		in: `package foo
+import "errors"
+func F() (int, error) { return errors.New("foo") }
+
+func G() (int, error) {
+	return 0, nil ~~~ syntax from the future
+}
+
+// H is fine.
+func H() (string, error) { return errors.New("foo") }
+`,
+		out: `package foo
+
+import "errors"
+
+func F() (int, error) { return 0, errors.New("foo") }
+
+func G() (int, error) {
+	return 0, nil ~~~ syntax from the future
+}
+
+// H is fine.
+func H() (string, error) { return "", errors.New("foo") }
+`,
+	},
+
+	// Fix function literals in test tables, keeping the table's
+	// alignment.
+	{
+		name: "test table closures",
+		in: `package foo
+import "errors"
+var err = errors.New("foo")
+var tests = []struct {
+	name string
+	run  func() (string, error)
+}{
+	{name: "a", run: func() (string, error) { return err }},        // fails
+	{name: "bb", run: func() (string, error) { return "ok", nil }}, // succeeds
+	{
+		name: "ccc",
+		run: func() (string, error) {
+			if true {
+				return errors.New("bar")
+			}
+			return "", nil
+		},
+	},
+}
+var byName = map[string]func() (int, error){
+	"x":   func() (int, error) { return err },
+	"yyy": func() (int, error) { return 1, nil },
+}
+`,
+		out: `package foo
+
+import "errors"
+
+var err = errors.New("foo")
+var tests = []struct {
+	name string
+	run  func() (string, error)
+}{
+	{name: "a", run: func() (string, error) { return "", err }},    // fails
+	{name: "bb", run: func() (string, error) { return "ok", nil }}, // succeeds
+	{
+		name: "ccc",
+		run: func() (string, error) {
+			if true {
+				return "", errors.New("bar")
+			}
+			return "", nil
+		},
+	},
+}
+var byName = map[string]func() (int, error){
+	"x":   func() (int, error) { return 0, err },
+	"yyy": func() (int, error) { return 1, nil },
+}
+`,
+	},
+
+	// Run no fixers.
+	{
+		name: "no fixes",
+		opt:  &Options{Fragment: true, Fixes: []string{}},
+		in: `package foo
+import "errors"
+func F() (int, error) { return errors.New("foo") }
+`,
+		out: `package foo
+
+import "errors"
+
+func F() (int, error) { return errors.New("foo") }
+`,
+	},
+
+	// Use the type info that's available when typechecking fails,
+	// but not the types of erroneous expressions.
+	{
+		name: "partial type info",
+		in: `package foo
+import "errors"
+func F() (int, error) { return errors.New("foo") }
+func G() (int, error) { return undefined() }
+func H() int { return undefined }
+`,
+		out: `package foo
+
+import "errors"
+
+func F() (int, error) { return 0, errors.New("foo") }
+func G() (int, error) { return undefined() }
+func H() int          { return undefined }
+`,
+	},
+}
+
+func TestFixReturns(t *testing.T) {
+	options := &Options{Fragment: true}
+
+	for _, tt := range tests {
+		if *only != "" && tt.name != *only {
+			continue
+		}
+		if tt.skip {
+			continue
+		}
+		opt := tt.opt
+		if opt == nil {
+			opt = options
+		}
+		buf, err := Process("", tt.name+".go", []byte(tt.in), opt)
+		if err != nil {
+			t.Errorf("error on %q: %v", tt.name, err)
+			continue
+		}
+		if got := string(buf); got != tt.out {
+			t.Errorf("results diff on %q\nGOT:\n%s\nWANT:\n%s\n", tt.name, got, tt.out)
+		}
+	}
+}
+
+// writePackage writes files (whose names may include subdirectories)
+// into a new temporary directory and returns its path.
+func writePackage(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "goreturns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFixReturnsTestPackages(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/foo\n",
+		"foo.go": "package foo\n",
+		"export_test.go": `package foo
+
+func Err() error { return nil }
+`,
+		"foo_test.go": `package foo_test
+
+import "example.com/foo"
+
+func F() (int, error) { return foo.Err() }
+`,
+		"internal_test.go": `package foo
+
+func G() (int, error) { return Err() }
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	for name, want := range map[string]string{
+		"foo_test.go": `package foo_test
+
+import "example.com/foo"
+
+func F() (int, error) { return 0, foo.Err() }
+`,
+		"internal_test.go": `package foo
+
+func G() (int, error) { return 0, Err() }
+`,
+	} {
+		filename := filepath.Join(dir, name)
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := Process(dir, filename, src, nil)
+		if err != nil {
+			t.Errorf("error on %q: %v", name, err)
+			continue
+		}
+		if got := string(buf); got != want {
+			t.Errorf("results diff on %q\nGOT:\n%s\nWANT:\n%s\n", name, got, want)
+		}
+	}
+}
+
+func TestFixReturnsOverlay(t *testing.T) {
+	// Neither the directory nor its files exist on disk.
+	dir := filepath.Join(os.TempDir(), "goreturns-overlay-does-not-exist")
+	filename := filepath.Join(dir, "a.go")
+	src := []byte(`package foo
+
+func F() (int, error) { return x() }
+`)
+	opt := &Options{Overlay: map[string][]byte{
+		filepath.Join(dir, "b.go"): []byte("package foo\n\nfunc x() error { return nil }\n"),
+	}}
+	buf, err := Process(dir, filename, src, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package foo
+
+func F() (int, error) { return 0, x() }
+`
+	if got := string(buf); got != want {
+		t.Errorf("results diff\nGOT:\n%s\nWANT:\n%s\n", got, want)
+	}
+}
+
+func TestFixReturnsBuildContextFileSystem(t *testing.T) {
+	// The package is served by the build context's file system hooks,
+	// and doesn't exist on disk.
+	dir := filepath.Join(os.TempDir(), "goreturns-fs-does-not-exist")
+	files := map[string]string{
+		filepath.Join(dir, "go.mod"): "module example.com/foo\n",
+		filepath.Join(dir, "b.go"):   "package foo\n\nfunc x() error { return nil }\n",
+	}
+	ctxt := build.Default
+	ctxt.IsDir = func(name string) bool { return name == dir }
+	ctxt.ReadDir = func(name string) ([]os.FileInfo, error) {
+		if name != dir {
+			return nil, os.ErrNotExist
+		}
+		var infos []os.FileInfo
+		for name, data := range files {
+			infos = append(infos, overlayFileInfo{filepath.Base(name), int64(len(data))})
+		}
+		return infos, nil
+	}
+	ctxt.OpenFile = func(name string) (io.ReadCloser, error) {
+		data, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(strings.NewReader(data)), nil
+	}
+	src := []byte(`package foo
+
+func F() (int, error) { return x() }
+`)
+	buf, err := Process(dir, filepath.Join(dir, "a.go"), src, &Options{BuildContext: &ctxt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package foo
+
+func F() (int, error) { return 0, x() }
+`
+	if got := string(buf); got != want {
+		t.Errorf("results diff\nGOT:\n%s\nWANT:\n%s\n", got, want)
+	}
+}
+
+func TestFixReturnsPrograms(t *testing.T) {
+	// Each program's return of a call needs type info to be fixed.
+	const prog = `package main
+
+func check() error { return nil }
+
+func run() (int, error) { return check() }
+
+func main() { run() }
+`
+	const want = `package main
+
+func check() error { return nil }
+
+func run() (int, error) { return 0, check() }
+
+func main() { run() }
+`
+	for _, files := range []map[string]string{
+		// A directory of programs, one per file.
+		{"a.go": prog, "b.go": prog},
+		// A program excluded from the package it sits beside.
+		{"foo.go": "package foo\n", "a.go": "//go:build ignore\n\n" + prog},
+	} {
+		dir := writePackage(t, files)
+		defer os.RemoveAll(dir)
+
+		filename := filepath.Join(dir, "a.go")
+		buf, err := Process(dir, filename, []byte(files["a.go"]), nil)
+		if err != nil {
+			t.Errorf("error on %v: %v", files, err)
+			continue
+		}
+		if got, want := string(buf), files["a.go"][:len(files["a.go"])-len(prog)]+want; got != want {
+			t.Errorf("results diff\nGOT:\n%s\nWANT:\n%s\n", got, want)
+		}
+	}
+}
+
+func TestFixReturnsTrace(t *testing.T) {
+	src := `package foo
+import "errors"
+func F() (int, error) { return errors.New("foo") }
+func G() (int, error) { return }
+`
+	var trace bytes.Buffer
+	if _, err := Process("", "a.go", []byte(src), &Options{Fragment: true, Trace: &trace}); err != nil {
+		t.Fatal(err)
+	}
+	want := `parse: ok
+load: no package directory; typechecking the file alone
+typecheck: ok (2 return arity errors, which may be fixable)
+fix: running fixers: zero
+zero: a.go:3:25: fixed: added 1 zero value
+zero: a.go:4:25: skipped: naked return (see the bare fixer)
+`
+	if got := trace.String(); got != want {
+		t.Errorf("got trace\n%s\nwant\n%s", got, want)
+	}
+
+	var logged bytes.Buffer
+	if _, err := Process("", "a.go", []byte(src), &Options{Fragment: true, Logger: log.New(&logged, "", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := logged.String(); got != want {
+		t.Errorf("got log\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFixReturnsSkipTypecheck(t *testing.T) {
+	// Only the bare fixer would need type info for G's naked return.
+	src := `package foo
+func F() (int, error) { return 0, nil }
+func G() (int, error) { return }
+`
+	var trace bytes.Buffer
+	buf, err := Process("", "a.go", []byte(src), &Options{Fragment: true, Trace: &trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package foo
+
+func F() (int, error) { return 0, nil }
+func G() (int, error) { return }
+`
+	if got := string(buf); got != want {
+		t.Errorf("results diff\nGOT:\n%s\nWANT:\n%s\n", got, want)
+	}
+	if !strings.Contains(trace.String(), "typecheck: skipped") {
+		t.Errorf("file was typechecked; trace:\n%s", &trace)
+	}
+
+	trace.Reset()
+	if _, err := Process("", "a.go", []byte(src), &Options{Fragment: true, Fixes: []string{"bare"}, Trace: &trace}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(trace.String(), "typecheck: skipped") {
+		t.Errorf("file wasn't typechecked for the bare fixer; trace:\n%s", &trace)
+	}
+}
+
+func TestFixReturnsStandaloneImports(t *testing.T) {
+	// Without type info for the imported package, the call might
+	// return multiple values, and the return wouldn't be fixed.
+	src := `package main
+
+import "golang.org/x/mod/module"
+
+func F() (int, error) { return module.CheckPath("x") }
+`
+	buf, err := Process("", "<standard input>", []byte(src), &Options{Fragment: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package main
+
+import "golang.org/x/mod/module"
+
+func F() (int, error) { return 0, module.CheckPath("x") }
+`
+	if got := string(buf); got != want {
+		t.Errorf("results diff\nGOT:\n%s\nWANT:\n%s\n", got, want)
+	}
+}
+
+func TestFixReturnsImportStrategies(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/foo\n",
+		"foo.go": `package foo
+
+import "errors"
+
+func Err() error { return errors.New("foo") }
+`,
+		"foo_test.go": `package foo_test
+
+import (
+	"strconv"
+
+	"example.com/foo"
+)
+
+func F() (int, error) { return foo.Err() }
+
+func G() (bool, error) { _, err := strconv.Atoi(""); return err }
+`,
+	})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "foo_test.go")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package foo_test
+
+import (
+	"strconv"
+
+	"example.com/foo"
+)
+
+func F() (int, error) { return 0, foo.Err() }
+
+func G() (bool, error) { _, err := strconv.Atoi(""); return false, err }
+`
+	for _, s := range []ImportStrategy{ImportAuto, ImportExport, ImportSource} {
+		buf, err := Process(dir, filename, src, &Options{ImportStrategy: s})
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if got := string(buf); got != want {
+			t.Errorf("%s: results diff\nGOT:\n%s\nWANT:\n%s\n", s, got, want)
+		}
+	}
+}
+
+func TestFixReturnsBuildTags(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/foo\n",
+		"foo.go": `package foo
+
+func F() (int, error) { return Err() }
+`,
+		"integration.go": `//go:build integration
+
+package foo
+
+import "errors"
+
+func Err() error { return errors.New("foo") }
+`,
+	})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "foo.go")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the tag, Err is undefined and the return is left alone.
+	tagged := `package foo
+
+func F() (int, error) { return 0, Err() }
+`
+	ctxt := build.Default
+	ctxt.BuildTags = []string{"integration"}
+	tests := map[string]struct {
+		opt  *Options
+		want string
+	}{
+		"untagged":      {&Options{}, string(src)},
+		"tagged":        {&Options{BuildTags: []string{"integration"}}, tagged},
+		"build context": {&Options{BuildContext: &ctxt}, tagged},
+		"env":           {&Options{Env: []string{"GOFLAGS=-tags=integration"}}, tagged},
+	}
+	for name, test := range tests {
+		buf, err := Process(dir, filename, src, test.opt)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got := string(buf); got != test.want {
+			t.Errorf("%s: results diff\nGOT:\n%s\nWANT:\n%s\n", name, got, test.want)
+		}
+	}
+}
+
+func TestFixReturnsExportCache(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/foo\n",
+		"foo.go": `package foo
+
+import "errors"
+
+func Err() error { return errors.New("foo") }
+`,
+		"bar/bar.go": `package bar
+
+import "example.com/foo"
+
+func F() (int, error) { return foo.Err() }
+`,
+	})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bar", "bar.go")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package bar
+
+import "example.com/foo"
+
+func F() (int, error) { return 0, foo.Err() }
+`
+	cacheDir := filepath.Join(dir, "cache")
+	for i, wantHit := range []bool{false, true} {
+		var trace bytes.Buffer
+		buf, err := Process(filepath.Dir(filename), filename, src, &Options{ImportStrategy: ImportSource, CacheDir: cacheDir, Trace: &trace})
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+		if got := string(buf); got != want {
+			t.Errorf("run %d: results diff\nGOT:\n%s\nWANT:\n%s\n", i, got, want)
+		}
+		if hit := strings.Contains(trace.String(), "cache: example.com/foo: hit"); hit != wantHit {
+			t.Errorf("run %d: got cache hit %v, want %v; trace:\n%s", i, hit, wantHit, &trace)
+		}
+	}
+}
+
+func TestFixReturnsImportCache(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/foo\n",
+		"foo.go": `package foo
+
+import "errors"
+
+func Err() error { return errors.New("foo") }
+`,
+		"bar/bar.go": `package bar
+
+import "example.com/foo"
+
+func F() (int, error) { return foo.Err() }
+`,
+	})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bar", "bar.go")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package bar
+
+import "example.com/foo"
+
+func F() (int, error) { return 0, foo.Err() }
+`
+	cache := NewImportCache()
+	for i, change := range []bool{false, false, true} {
+		if change {
+			// Change foo's export data.
+			if err := ioutil.WriteFile(filepath.Join(dir, "foo.go"), []byte("package foo\n\nfunc Err() error { return nil }\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var trace bytes.Buffer
+		buf, err := Process(filepath.Dir(filename), filename, src, &Options{ImportStrategy: ImportExport, ImportCache: cache, Trace: &trace})
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+		if got := string(buf); got != want {
+			t.Errorf("run %d: results diff\nGOT:\n%s\nWANT:\n%s\n", i, got, want)
+		}
+		if _, ok := cache.files["example.com/foo"]; !ok {
+			t.Errorf("run %d: example.com/foo isn't cached", i)
+		}
+		if emptied := strings.Contains(trace.String(), "emptying the import cache"); emptied != change {
+			t.Errorf("run %d: got cache emptied %v, want %v; trace:\n%s", i, emptied, change, &trace)
+		}
+	}
+}
+
+func TestFixReturnsSyntaxOnly(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"a.go": `package foo
+
+import "errors"
+
+func F() (*int, error) { return nil }
+
+func G() (int, error) { return errors.New("foo") }
+`,
+		"b.go": "package foo\n\nimport (\n",
+	})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "a.go")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without type info, the call's results are unknown, so G is left
+	// alone.
+	want := `package foo
+
+import "errors"
+
+func F() (*int, error) { return nil, nil }
+
+func G() (int, error) { return errors.New("foo") }
+`
+	// b.go's syntax error breaks the package, which used to be fatal.
+	for _, opt := range []*Options{{}, {SyntaxOnly: true}} {
+		buf, err := Process(dir, filename, src, opt)
+		if err != nil {
+			t.Errorf("SyntaxOnly=%v: %v", opt.SyntaxOnly, err)
+			continue
+		}
+		if got := string(buf); got != want {
+			t.Errorf("SyntaxOnly=%v: results diff\nGOT:\n%s\nWANT:\n%s\n", opt.SyntaxOnly, got, want)
+		}
+	}
+}
+
+// memImporter imports packages typechecked from in-memory sources,
+// falling back to the default importer.
+type memImporter map[string]*types.Package
+
+func (imp memImporter) Import(path string) (*types.Package, error) {
+	if pkg, ok := imp[path]; ok {
+		return pkg, nil
+	}
+	return importer.Default().Import(path)
+}
+
+func TestFixReturnsCustomImporter(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "mem.go", `package mem; func Err() error { return nil }`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := (&types.Config{}).Check("example.com/mem", fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := `package main
+
+import "example.com/mem"
+
+func F() (int, error) { return mem.Err() }
+`
+	opt := &Options{Fragment: true, Importer: memImporter{"example.com/mem": mem}}
+	buf, err := Process("", "<standard input>", []byte(src), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package main
+
+import "example.com/mem"
+
+func F() (int, error) { return 0, mem.Err() }
+`
+	if got := string(buf); got != want {
+		t.Errorf("results diff\nGOT:\n%s\nWANT:\n%s\n", got, want)
+	}
+}
+
+func TestFixReturnsWorkspace(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.work":  "go 1.18\n\nuse (\n\t./a\n\t./b\n)\n",
+		"a/go.mod": "module example.com/a\n\ngo 1.18\n",
+		"a/a.go": `package a
+
+import "example.com/b"
+
+func F() (int, error) { return b.Err() }
+`,
+		"b/go.mod": "module example.com/b\n\ngo 1.18\n",
+		"b/b.go": `package b
+
+import "errors"
+
+func Err() error { return errors.New("b") }
+`,
+	})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "a", "a.go")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package a
+
+import "example.com/b"
+
+func F() (int, error) { return 0, b.Err() }
+`
+	// example.com/b is only found through go.work, even if GOFLAGS
+	// has -mod=mod, which the go command rejects in workspace mode.
+	for _, env := range [][]string{nil, {"GOFLAGS=-mod=mod"}} {
+		buf, err := Process(filepath.Dir(filename), filename, src, &Options{Env: env})
+		if err != nil {
+			t.Errorf("env %q: %v", env, err)
+			continue
+		}
+		if got := string(buf); got != want {
+			t.Errorf("env %q: results diff\nGOT:\n%s\nWANT:\n%s\n", env, got, want)
+		}
+	}
+}
+
+func TestFixReturnsTargetedLoading(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/m\n",
+		"a.go": `package m
+
+import "errors"
+
+func F() (int, error) { return errors.New("a") }
+`,
+		"b.go": `package m
+
+import "net/http"
+
+func G() error { return http.ListenAndServe("", nil) }
+`,
+	})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "a.go")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace bytes.Buffer
+	buf, err := Process(dir, filename, src, &Options{Trace: &trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `package m
+
+import "errors"
+
+func F() (int, error) { return 0, errors.New("a") }
+`
+	if got := string(buf); got != want {
+		t.Errorf("results diff\nGOT:\n%s\nWANT:\n%s\n", got, want)
+	}
+	// net/http is only used in a body that isn't being fixed.
+	if !strings.Contains(trace.String(), "load: 1 of 2 imports used") {
+		t.Errorf("net/http was loaded; trace:\n%s", &trace)
+	}
+}
+
+func TestFixReturnsErrors(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/foo\n",
+		"a.go": `package foo
+
+import "errors"
+
+func F() (int, error) { /* é */ return errors.New("foo") }
+`,
+		"b.go": `package foo
+
+func G() int { return "x" }
+
+func H() { x := 1 }
+`,
+	})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "a.go")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errs []Diagnostic
+	if _, err := Process(dir, filename, src, &Options{Errors: &errs}); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		file, msg string
+		sev       Severity
+		runeCol   int
+	}{
+		{"a.go", "return values", Error, 40}, // 41 in bytes
+		{"b.go", `"x"`, Error, 0},
+		{"b.go", "x", Warning, 0},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d: %v", len(errs), len(want), errs)
+	}
+	for i, w := range want {
+		d := errs[i]
+		if filepath.Base(d.Pos.Filename) != w.file || !strings.Contains(d.Message, w.msg) || d.Severity != w.sev || d.RuneCol != w.runeCol || d.Category != "typecheck" {
+			t.Errorf("error %d: got %s (%s, %s, rune column %d), want one in %s containing %q (%s, rune column %d)", i, d, d.Category, d.Severity, d.RuneCol, w.file, w.msg, w.sev, w.runeCol)
+		}
+	}
+}
+
+func TestFixReturnsErrOut(t *testing.T) {
+	dir := writePackage(t, map[string]string{
+		"go.mod": "module example.com/foo\n",
+		"a.go":   "package foo\n\nfunc F() int { return \"x\" }\n",
+	})
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "a.go")
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := Process(dir, filename, src, &Options{PrintErrors: true, ErrOut: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, `a.go:3:23: cannot use "x"`) {
+		t.Errorf("got errors %q, want the typechecking error", got)
+	}
+}
+
+// A blockingImporter imports packages only once its context is done.
+type blockingImporter struct{ ctx context.Context }
+
+func (imp blockingImporter) Import(path string) (*types.Package, error) {
+	<-imp.ctx.Done()
+	return importer.Default().Import(path)
+}
+
+func TestProcessContext(t *testing.T) {
+	src := `package foo
+
+import "errors"
+
+func F() (*int, error) { return nil }
+
+func G() (int, error) { return errors.New("foo") }
+`
+	// Without type info, the call's results are unknown, so G is left
+	// alone.
+	want := `package foo
+
+import "errors"
+
+func F() (*int, error) { return nil, nil }
+
+func G() (int, error) { return errors.New("foo") }
+`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var trace bytes.Buffer
+	buf, err := ProcessContext(ctx, "", "a.go", []byte(src), &Options{Importer: blockingImporter{ctx}, Trace: &trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != want {
+		t.Errorf("results diff\nGOT:\n%s\nWANT:\n%s\n", got, want)
+	}
+	if !strings.Contains(trace.String(), "typecheck: canceled (context deadline exceeded)") {
+		t.Errorf("typechecking wasn't canceled; trace:\n%s", &trace)
+	}
+}
+
+func TestProcessContextCanceled(t *testing.T) {
+	src := `package foo
+
+import "errors"
+
+func G() (int, error) { return errors.New("foo") }
+`
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	buf, err := ProcessContext(ctx, "", "a.go", []byte(src), &Options{Importer: blockingImporter{ctx}})
+	if err != context.Canceled {
+		t.Errorf("got %q, %v; want error %v", buf, err, context.Canceled)
+	}
+}
+
+func TestFixReturnsFixedReturns(t *testing.T) {
+	src := `package foo
+
+import "errors"
+
+func F() (int, error) { return errors.New("foo") }
+
+func G() (s string, err error) {
+	if err != nil {
+		return
+	}
+	return "", nil
+}
+
+func H() (*int, error) {
+	for {
+	}
+}
+`
+	var n int
+	if _, err := Process("", "a.go", []byte(src), &Options{Fixes: []string{"zero", "bare", "missing-return"}, FixedReturns: &n}); err != nil {
+		t.Fatal(err)
+	}
+	// F's return and G's bare return; H doesn't need a return.
+	if n != 2 {
+		t.Errorf("got %d fixed returns, want 2", n)
+	}
+}
+
+func TestFixReturnsDecisions(t *testing.T) {
+	src := `package foo
+
+import "errors"
+
+func F() (int, error) { return errors.New("foo") }
+
+func G() (int, string, error) { return 1, 2, 3, errors.New("foo") }
+
+func H() (s string, err error) {
+	return
+}
+
+func I() (U, error) { return }
+`
+	var decisions []Diagnostic
+	if _, err := Process("", "a.go", []byte(src), &Options{Fixes: []string{"zero", "bare"}, Decisions: &decisions}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range decisions {
+		s := d.Category + ": " + d.String()
+		if d.NoTypeInfo {
+			s += " (no type info)"
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		"zero: a.go:5:25: fixed: added 1 zero value",
+		"zero: a.go:7:33: skipped: too many values",
+		"zero: a.go:10:2: skipped: naked return (see the bare fixer)",
+		"zero: a.go:13:23: skipped: naked return (see the bare fixer)",
+		"bare: a.go:10:2: fixed: expanded into a return of 2 values",
+		"bare: a.go:13:23: skipped: unknown zero value of U (no type info)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got decisions\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+	var added []string
+	for _, d := range decisions {
+		if d.Added != "" {
+			added = append(added, d.Added)
+		}
+	}
+	if want := []string{"0", "s, err"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("got added values %q, want %q", added, want)
+	}
+}
+
+func TestProcessResult(t *testing.T) {
+	src := `package foo
+
+import "errors"
+
+func F() (int, error) { return errors.New("foo") }
+
+func G() (s string, err error) {
+	return
+}
+
+func H() int { return undefined }
+`
+	res, err := ProcessResult("", "a.go", []byte(src), &Options{Fixes: []string{"zero", "bare"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Changed {
+		t.Error("got Changed false, want true")
+	}
+	var got []string
+	for _, f := range res.Fixes {
+		got = append(got, fmt.Sprintf("%s: %s: %s [%s]", f.Fixer, f.Pos, f.Message, f.Added))
+	}
+	want := []string{
+		"zero: a.go:5:25: added 1 zero value [0]",
+		"bare: a.go:8:2: expanded into a return of 2 values [s, err]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got fixes\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+	// The errors of the source, including those the fixes fixed.
+	var diags []string
+	for _, d := range res.Diagnostics {
+		diags = append(diags, d.Pos.String()+": "+strings.SplitN(d.Message, "\n", 2)[0])
+	}
+	if want := []string{"a.go:5:32: not enough return values", "a.go:11:23: undefined: undefined"}; !reflect.DeepEqual(diags, want) {
+		t.Errorf("got diagnostics %q, want %q", diags, want)
+	}
+
+	res, err = ProcessResult("", "a.go", res.Output, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Changed || len(res.Fixes) != 0 {
+		t.Errorf("processing the output again: got Changed %v and fixes %v, want none", res.Changed, res.Fixes)
+	}
+}
+
+func TestFixReturnsInPlace(t *testing.T) {
+	src := `package foo
+
+type T struct{}
+
+func (T) err() error { return nil }
+
+func F(t T) (int, error) { return t.err() }
+`
+	for _, typed := range []bool{true, false} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "a.go", src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info *types.Info
+		if typed {
+			info = &types.Info{Types: map[ast.Expr]types.TypeAndValue{}, Defs: map[*ast.Ident]types.Object{}, Uses: map[*ast.Ident]types.Object{}}
+			if _, err := (&types.Config{}).Check("foo", fset, []*ast.File{f}, info); err == nil {
+				t.Fatal("typechecking succeeded, want an arity error")
+			}
+		}
+		changed, err := FixReturns(fset, f, info, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without type info, t.err() might return both values.
+		if changed != typed {
+			t.Errorf("typed %v: got changed %v, want %v", typed, changed, typed)
+		}
+		var buf bytes.Buffer
+		if err := format.Node(&buf, fset, f); err != nil {
+			t.Fatal(err)
+		}
+		want := "return t.err() }"
+		if typed {
+			want = "return 0, t.err() }"
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("typed %v: got\n%s\nwant it to contain %q", typed, buf.String(), want)
+		}
+	}
+
+	// Moving an error result last changes the signature.
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "a.go", `package foo; func G() (error, string) { panic("") }`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := FixReturns(fset, f, nil, &Options{Fixes: []string{"errlast"}}); err != nil || !changed {
+		t.Errorf("errlast: got %v, %v, want true, nil", changed, err)
+	}
+}
+
+func TestIncompleteReturns(t *testing.T) {
+	src := `package foo
+
+type T struct{}
+
+func (T) err() error { return nil }
+
+func F(err error) (int, string, error) { return err }
+
+func G(t T) (int, error) { return t.err() }
+
+func H() (T, error) { return nil }
+
+func I() (n int, err error) { return }
+
+func J() (int, error) { return 0, nil }
+
+func K() (a, b int, err error) { return err }
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "a.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before bytes.Buffer
+	if err := format.Node(&before, fset, f); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range IncompleteReturns(fset, f, nil, nil) {
+		got = append(got, fmt.Sprintf("%s: %s [%s] %s", fset.Position(r.Return.Pos()), types.ExprString(r.Func), exprList(r.Values), r.Skip))
+	}
+	want := []string{
+		"a.go:7:42: func(err error) (int, string, error) [0, \"\"] ",
+		"a.go:9:28: func(t T) (int, error) [] returns a call, and without its type it may return multiple values",
+		"a.go:11:23: func() (T, error) [] unknown zero value of T",
+		"a.go:17:34: func() (a, b int, err error) [0, 0] ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n\t%s\nwant\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+	var after bytes.Buffer
+	if err := format.Node(&after, fset, f); err != nil {
+		t.Fatal(err)
+	}
+	if after.String() != before.String() {
+		t.Errorf("IncompleteReturns modified the file:\n%s", after.String())
+	}
+}
+
+func TestFixReturnsZeroValueComment(t *testing.T) {
+	src := `package foo
+
+func F(err error) (int, string, error) { return err }
+`
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "a.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := &Options{ZeroValueComment: "TODO"}
+	var values []ast.Expr
+	for _, r := range IncompleteReturns(fset, f, nil, opt) {
+		values = append(values, r.Values...)
+	}
+	if got, want := exprList(values), `0, ""`; got != want {
+		t.Errorf("IncompleteReturns: got values %s, want %s", got, want)
+	}
+	if _, err := FixReturns(fset, f, nil, opt); err != nil {
+		t.Fatal(err)
+	}
+	// The syntax tree holds only real identifiers, not the comments.
+	ast.Inspect(f, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && !token.IsIdentifier(id.Name) {
+			t.Errorf("invalid identifier %q in the syntax tree", id.Name)
+		}
+		return true
+	})
+	out, err := Process("", "a.go", []byte(src), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `return 0 /* TODO */, "" /* TODO */, err`; !strings.Contains(string(out), want) {
+		t.Errorf("Process: got\n%s\nwant it to contain %s", out, want)
+	}
+}
+
+func TestFixReturnsKeepFormatting(t *testing.T) {
+	src := `package foo
+
+import "errors"
+
+func F() (int, error) {
+	x := map[string]int{
+		"a": 1,
+		"bb":   2,
+	}
+	_ = x
+	if true { return errors.New("foo") }
+	return   errors.New("bar")
+}
+
+func G() (string, error) {
+  _ = 1
+  return errors.New("baz")
+}
+`
+	want := `package foo
+
+import "errors"
+
+func F() (int, error) {
+	x := map[string]int{
+		"a": 1,
+		"bb":   2,
+	}
+	_ = x
+	if true {
+		return 0, errors.New("foo")
+	}
+	return 0, errors.New("bar")
+}
+
+func G() (string, error) {
+  _ = 1
+	return "", errors.New("baz")
+}
+`
+	out, err := Process("", "a.go", []byte(src), &Options{KeepFormatting: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+
+	// Nothing to fix: the file is left as it is.
+	unformatted := "package foo\n\nfunc  F() error { return nil }\n"
+	if out, err := Process("", "a.go", []byte(unformatted), &Options{KeepFormatting: true}); err != nil || string(out) != unformatted {
+		t.Errorf("got %q, %v; want the file unchanged", out, err)
+	}
+}
+
+func TestFixReturnsSimplify(t *testing.T) {
+	src := `package foo
+
+import "errors"
+
+type T struct{ x int }
+
+var (
+	_ = []T{T{1}, T{2}}
+	_ = []*T{&T{1}}
+	_ = map[T]T{T{1}: T{2}}
+)
+
+const ()
+
+func F(s []int) (int, error) {
+	for _ = range s {
+	}
+	for i, _ := range s {
+		_ = s[i:len(s)]
+	}
+	return errors.New("foo")
+}
+`
+	want := `package foo
+
+import "errors"
+
+type T struct{ x int }
+
+var (
+	_ = []T{{1}, {2}}
+	_ = []*T{{1}}
+	_ = map[T]T{{1}: {2}}
+)
+
+func F(s []int) (int, error) {
+	for range s {
+	}
+	for i := range s {
+		_ = s[i:]
+	}
+	return 0, errors.New("foo")
+}
+`
+	out, err := Process("", "a.go", []byte(src), &Options{Simplify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
 }
@@ -0,0 +1,295 @@
+package returns
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// A fixer is a named rule that rewrites the returns of a file.
+type fixer struct {
+	name string
+	doc  string
+	fix  func(fset *token.FileSet, f *ast.File, typeInfo *types.Info, opt *Options) error
+
+	// needsTypes is a cheap syntactic check of whether the fixer
+	// might use type info to fix f. It may report false positives,
+	// but not false negatives. If it is nil, the fixer never uses
+	// type info.
+	needsTypes func(f *ast.File) bool
+}
+
+// fixers are the available fixers, in the order they run.
+var fixers = []fixer{
+	{"errlast", "move error results to the last position (in signatures, returns, and calls in the same file)", moveErrorsLast, hasMisplacedErrors},
+	{"zero", "add zero values for missing leading return values", fixReturns, hasIncompleteReturns},
+	{"ctxerr", `return ctx.Err() from naked returns in "case <-ctx.Done():" branches and "if ctx.Err() != nil" blocks`, fillContextErrors, nil},
+	{"errcheck", "return errors assigned to _ from calls, instead of discarding them", returnDiscardedErrors, hasDiscardedResults},
+	{"bare", "expand every bare return into an explicit return of the named results", removeBareReturns, hasNakedReturns},
+	{"missing-return", "add a return of zero values at the end of functions that lack one", addMissingReturns, nil},
+}
+
+// DefaultFixes are the fixers run when Options.Fixes is nil.
+var DefaultFixes = []string{"zero"}
+
+// Fixers returns the names and descriptions of the available fixers, in
+// the order they run.
+func Fixers() (names, docs []string) {
+	for _, f := range fixers {
+		names = append(names, f.name)
+		docs = append(docs, f.doc)
+	}
+	return names, docs
+}
+
+// ParseFixes parses a comma-separated list of fixers, as given to the
+// goreturns command's -fix flag. If every element of the list is
+// prefixed with + or -, the named fixers are added to or removed from
+// base; otherwise the list names exactly the fixers to run, or is
+// "none". An empty list returns a copy of base.
+func ParseFixes(list string, base []string) ([]string, error) {
+	switch list {
+	case "":
+		return append([]string(nil), base...), nil
+	case "none":
+		return []string{}, nil
+	}
+	elems := strings.Split(list, ",")
+	relative := 0
+	for _, e := range elems {
+		if strings.HasPrefix(e, "+") || strings.HasPrefix(e, "-") {
+			relative++
+		}
+	}
+	if relative != 0 && relative != len(elems) {
+		return nil, fmt.Errorf("can't mix +name/-name with plain fixer names in %q", list)
+	}
+
+	fixes := []string{} // not nil, which would mean the defaults
+	if relative != 0 {
+		fixes = append(fixes, base...)
+	}
+	for _, e := range elems {
+		name := strings.TrimLeft(e, "+-")
+		if !isFixer(name) {
+			names, _ := Fixers()
+			return nil, fmt.Errorf("unknown fixer %q (known fixers: %s)", name, strings.Join(names, ", "))
+		}
+		i := fixIndex(fixes, name)
+		switch {
+		case strings.HasPrefix(e, "-") && i >= 0:
+			fixes = append(fixes[:i], fixes[i+1:]...)
+		case !strings.HasPrefix(e, "-") && i < 0:
+			fixes = append(fixes, name)
+		}
+	}
+	return fixes, nil
+}
+
+// fixIndex returns the index of name in fixes, or -1.
+func fixIndex(fixes []string, name string) int {
+	for i, f := range fixes {
+		if f == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// enabledFixes returns the set of fixers to run.
+func (opt *Options) enabledFixes() (map[string]bool, error) {
+	fixes := opt.Fixes
+	if fixes == nil {
+		fixes = DefaultFixes
+	}
+	enabled := map[string]bool{}
+	for _, name := range fixes {
+		if !isFixer(name) {
+			return nil, fmt.Errorf("unknown fixer %q", name)
+		}
+		enabled[name] = true
+	}
+	if opt.RemoveBareReturns {
+		enabled["bare"] = true
+	}
+	return enabled, nil
+}
+
+func isFixer(name string) bool {
+	for _, f := range fixers {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FixReturns runs the fixers that opt enables on f, a file parsed with
+// fset (with comments, if f is to be printed), modifying its syntax
+// tree in place, so that tools that have already parsed and
+// typechecked their files, such as linters and code generators, needn't
+// print and reparse them. info, if non-nil, is the type info of f's
+// package, with at least its Types, Defs, and Uses; if it is nil, the
+// returns are fixed from the syntax alone (as with Options.SyntaxOnly).
+// If opt is nil the defaults are used.
+//
+// Only the fixers' options apply: f is neither printed nor simplified,
+// and its //goreturns:options comments are ignored. FixReturns reports
+// whether it changed f.
+func FixReturns(fset *token.FileSet, f *ast.File, info *types.Info, opt *Options) (changed bool, err error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	before, misplaced := returnResults(f), misplacedErrors(f)
+	if err := runFixers(fset, f, info, opt); err != nil {
+		return false, err
+	}
+	return changedReturns(before, returnResults(f)) > 0 || misplacedErrors(f) != misplaced, nil
+}
+
+// misplacedErrors returns the number of functions in f with error
+// results that aren't last.
+func misplacedErrors(f *ast.File) int {
+	n := 0
+	forEachFunc(f, func(_ string, ftyp *ast.FuncType, _ *ast.BlockStmt) {
+		if _, field := misplacedError(ftyp); field != nil {
+			n++
+		}
+	})
+	return n
+}
+
+// runFixers runs the enabled fixers on f.
+func runFixers(fset *token.FileSet, f *ast.File, typeInfo *types.Info, opt *Options) error {
+	enabled, err := opt.enabledFixes()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, fx := range fixers {
+		if enabled[fx.name] {
+			names = append(names, fx.name)
+		}
+	}
+	opt.tracef("fix: running fixers: %s", strings.Join(names, ", "))
+	var before map[*ast.ReturnStmt][]ast.Expr
+	if opt.FixedReturns != nil {
+		before = returnResults(f)
+	}
+	for _, fx := range fixers {
+		if enabled[fx.name] {
+			if err := fx.fix(fset, f, typeInfo, opt); err != nil {
+				return err
+			}
+		}
+	}
+	if opt.FixedReturns != nil {
+		*opt.FixedReturns += changedReturns(before, returnResults(f))
+	}
+	return nil
+}
+
+// returnResults returns the results of each return statement in f.
+func returnResults(f *ast.File) map[*ast.ReturnStmt][]ast.Expr {
+	results := map[*ast.ReturnStmt][]ast.Expr{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if ret, ok := n.(*ast.ReturnStmt); ok {
+			results[ret] = append([]ast.Expr(nil), ret.Results...)
+		}
+		return true
+	})
+	return results
+}
+
+// changedReturns returns the number of return statements in after (see
+// returnResults) that are new or have different results than before.
+func changedReturns(before, after map[*ast.ReturnStmt][]ast.Expr) int {
+	n := 0
+	for ret, results := range after {
+		old, ok := before[ret]
+		if !ok || len(old) != len(results) {
+			n++
+			continue
+		}
+		for i := range old {
+			if old[i] != results[i] {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// needsTypes reports whether any of the enabled fixers might use type
+// info to fix f. If not, loading and typechecking f's package can be
+// skipped.
+func needsTypes(f *ast.File, opt *Options) bool {
+	enabled, err := opt.enabledFixes()
+	if err != nil {
+		return true // runFixers reports the error
+	}
+	for _, fx := range fixers {
+		if enabled[fx.name] && fx.needsTypes != nil && fx.needsTypes(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIncompleteReturns reports whether f has non-naked returns whose
+// number of values differs from the number of results of their
+// functions.
+func hasIncompleteReturns(f *ast.File) bool {
+	returns := map[*ast.ReturnStmt]*ast.FuncType{}
+	ast.Walk(visitor{returns: returns}, f)
+	for ret, ftyp := range returns {
+		if ftyp == nil || ftyp.Results == nil || len(ret.Results) == 0 {
+			continue
+		}
+		if len(ret.Results) != len(resultTypes(ftyp)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNakedReturns reports whether f has naked returns in functions with
+// results.
+func hasNakedReturns(f *ast.File) bool {
+	returns := map[*ast.ReturnStmt]*ast.FuncType{}
+	ast.Walk(visitor{returns: returns}, f)
+	for ret, ftyp := range returns {
+		if ftyp != nil && ftyp.Results != nil && len(ftyp.Results.List) > 0 && len(ret.Results) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMisplacedErrors reports whether f has functions with error results
+// that aren't last.
+func hasMisplacedErrors(f *ast.File) bool {
+	return misplacedErrors(f) > 0
+}
+
+// hasDiscardedResults reports whether f assigns a result of a call to
+// the blank identifier.
+func hasDiscardedResults(f *ast.File) bool {
+	found := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		if as, ok := n.(*ast.AssignStmt); ok && len(as.Rhs) == 1 {
+			if _, ok := as.Rhs[0].(*ast.CallExpr); ok {
+				for _, lhs := range as.Lhs {
+					if id, ok := lhs.(*ast.Ident); ok && id.Name == "_" {
+						found = true
+					}
+				}
+			}
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,90 @@
+package returns
+
+import (
+	"fmt"
+	"go/importer"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// An ImportCache keeps the dependencies that are imported from their
+// compiled export data in memory between calls that share it (see
+// Options.ImportCache), so that a long-running process reads each one
+// once while it's unchanged. Packages typechecked from source aren't
+// kept (but see Options.CacheDir).
+//
+// The cached packages form one consistent set: when a call's
+// dependencies have different export data than the cached packages
+// with the same paths (because they changed, or belong to another
+// module's build), the cache is emptied. Calls sharing an ImportCache
+// must not run concurrently.
+type ImportCache struct {
+	mu    sync.Mutex
+	gc    types.Importer               // keeps the packages it imports
+	files map[string]string            // package path -> export file of the cached package
+	pkgs  map[string]*packages.Package // the current call's dependencies, by package path
+}
+
+// NewImportCache returns an empty ImportCache.
+func NewImportCache() *ImportCache {
+	c := &ImportCache{}
+	c.reset()
+	return c
+}
+
+func (c *ImportCache) reset() {
+	c.files = map[string]string{}
+	c.gc = importer.ForCompiler(token.NewFileSet(), "gc", func(path string) (io.ReadCloser, error) {
+		p, ok := c.pkgs[path]
+		if !ok || p.ExportFile == "" {
+			return nil, fmt.Errorf("no export data for %s", path)
+		}
+		return os.Open(p.ExportFile)
+	})
+}
+
+// importer returns an importer that imports the packages in pkgs (by
+// package path) from their export data through c.
+func (c *ImportCache) importer(pkgs map[string]*packages.Package, opt *Options) types.Importer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, file := range c.files {
+		if p, ok := pkgs[path]; ok && p.ExportFile != file {
+			opt.tracef("import: export data of %s changed; emptying the import cache", path)
+			c.reset()
+			break
+		}
+	}
+	return cacheImporter{c, pkgs}
+}
+
+type cacheImporter struct {
+	c    *ImportCache
+	pkgs map[string]*packages.Package
+}
+
+func (imp cacheImporter) Import(path string) (*types.Package, error) {
+	c := imp.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pkgs = imp.pkgs
+	tp, err := c.gc.Import(path)
+	if err != nil {
+		return nil, err
+	}
+	// The export data may include the parts of the package's
+	// dependencies that it uses, which are kept too.
+	if p, ok := imp.pkgs[path]; ok {
+		packages.Visit([]*packages.Package{p}, nil, func(q *packages.Package) {
+			if _, ok := c.files[q.PkgPath]; !ok {
+				c.files[q.PkgPath] = q.ExportFile
+			}
+		})
+	}
+	return tp, nil
+}
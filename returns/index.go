@@ -15,15 +15,32 @@ func funcHasSingleReturnVal(typeInfo *types.Info, e *ast.CallExpr) bool {
 		}
 	}
 
-	if typeInfo != nil {
-		// look up in type info
-		typ := typeInfo.TypeOf(e)
-		if _, ok := typ.(*types.Tuple); ok {
-			return false
-		}
-		return true
+	// look up in type info
+	typ := typeOf(typeInfo, e)
+	if _, ok := typ.(*types.Tuple); ok || typ == nil {
+		// multiple values, or (conservatively) unknown
+		return false
 	}
+	return true
+}
 
-	// conservatively return false if we don't have type info
-	return false
+// typeOf returns the type of e according to typeInfo, or nil if it is
+// unknown: there's no type info, or it's partial (because typechecking
+// failed) and e's type couldn't be determined.
+func typeOf(typeInfo *types.Info, e ast.Expr) types.Type {
+	if typeInfo == nil {
+		return nil
+	}
+	t := typeInfo.TypeOf(e)
+	if t == nil || t == types.Typ[types.Invalid] {
+		return nil
+	}
+	if tuple, ok := t.(*types.Tuple); ok {
+		for i := 0; i < tuple.Len(); i++ {
+			if tuple.At(i).Type() == types.Typ[types.Invalid] {
+				return nil
+			}
+		}
+	}
+	return t
 }
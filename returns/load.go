@@ -0,0 +1,367 @@
+package returns
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// loadPackage finds the package in pkgDir that contains file (parsed
+// from src, the contents of filename) with go/packages (that is, "go
+// list"), which honors module mode, vendoring, and GOFLAGS. It returns
+// the package's files (file first), its import path, and an importer
+// that reads its dependencies' export data from the build cache.
+//
+// If lazy is set, only the dependencies that the fixers might need
+// type info from are imported (see targetedImporter).
+//
+// ok is false if the package can't be loaded this way (e.g., there's no
+// go command, the directory exists only in the overlay, or the file is
+// excluded from the package), in which case the caller should load it
+// with go/build.
+func loadPackage(fset *token.FileSet, pkgDir, filename string, file *ast.File, src []byte, opt *Options, lazy bool) (pkgFiles []*ast.File, importPath string, imp types.Importer, ok bool) {
+	tm := opt.timing()
+	start := time.Now()
+	defer func() { tm.SiblingParse += time.Since(start) }()
+
+	abs := absPath(filename)
+	ov := newOverlay(opt, filename, src)
+	cfg := opt.packagesConfig(pkgDir)
+	cfg.Tests = strings.HasSuffix(filename, "_test.go")
+	if len(opt.Overlay) > 0 || importsChanged(abs, file) {
+		// "go list" must see the file's current imports (which
+		// goimports may have just added).
+		cfg.Overlay = ov
+	}
+	pkgs, err := packages.Load(cfg, "file="+abs)
+	if err != nil {
+		opt.tracef("load: go/packages: %s; falling back to go/build", err)
+		return nil, "", nil, false
+	}
+	pkg := packageWithFile(pkgs, abs)
+	if pkg == nil {
+		opt.tracef("load: go/packages found no package containing the file; falling back to go/build")
+		return nil, "", nil, false
+	}
+
+	pkgFiles = []*ast.File{file}
+	for _, name := range pkg.CompiledGoFiles {
+		if name == abs {
+			continue
+		}
+		f, err := parseFile(fset, ov, name)
+		if err != nil {
+			if opt.PrintErrors {
+				fmt.Fprintf(opt.errOut(), "could not parse %q: %v\n", name, err)
+			}
+			opt.addError("parse", name, err)
+			continue
+		}
+		pkgFiles = append(pkgFiles, f)
+	}
+	if redeclaresMain(file, pkgFiles[1:]) {
+		opt.tracef("load: another file in the directory also declares func main; falling back to go/build")
+		return nil, "", nil, false
+	}
+	opt.tracef("load: package %s (%s) with go/packages, with %d other files", pkg.Name, pkg.PkgPath, len(pkgFiles)-1)
+	opt.traceFiles(fset, pkgFiles[1:])
+	if opt.targeted(lazy) {
+		return pkgFiles, pkg.PkgPath, targetedImporter(fset, ov, pkg, pkgFiles, pkgFiles[:1], opt), true
+	}
+	return pkgFiles, pkg.PkgPath, packageImporter(fset, ov, pkg, opt), true
+}
+
+// targeted reports whether a package being fixed should only have the
+// dependencies imported that the fixers might need type info from: if
+// lazy is set and there's no reason to typecheck all of the package
+// (opt.reportsErrors) or nothing to gain (opt.Importer).
+func (opt *Options) targeted(lazy bool) bool {
+	return lazy && !opt.reportsErrors() && opt.Importer == nil
+}
+
+// standaloneImporter returns an importer for the imports of file, which
+// isn't loaded as part of a package (e.g., it was read from stdin). If
+// file imports non-standard packages, they are found by "go list" in
+// the current directory, so that a file piped from an editor sees the
+// current module's dependencies.
+func standaloneImporter(fset *token.FileSet, file *ast.File, opt *Options) types.Importer {
+	if opt.Importer != nil {
+		return opt.Importer
+	}
+	var paths []string
+	nonStd := false
+	for _, imp := range file.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil || path == "C" || path == "unsafe" {
+			continue
+		}
+		paths = append(paths, path)
+		if first := strings.SplitN(path, "/", 2)[0]; strings.Contains(first, ".") {
+			nonStd = true
+		}
+	}
+	if !nonStd {
+		return opt.defaultImporter(fset)
+	}
+
+	cfg := opt.packagesConfig("")
+	pkgs, err := packages.Load(cfg, paths...)
+	if err != nil {
+		opt.tracef("load: go/packages: %s; only standard library imports will be found", err)
+		return opt.defaultImporter(fset)
+	}
+	// The importer takes the imports of a package; make one that
+	// imports everything the file does.
+	root := &packages.Package{Imports: map[string]*packages.Package{}}
+	for _, p := range pkgs {
+		root.Imports[p.PkgPath] = p
+	}
+	opt.tracef("load: found the file's imports with go/packages")
+	return newExportImporter(fset, nil, root, opt)
+}
+
+// loadMode returns the go/packages load mode for finding a package and
+// its dependencies. Export data is only needed if it will be used.
+func (opt *Options) loadMode() packages.LoadMode {
+	mode := packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports
+	if opt.Importer != nil {
+		// Dependencies are the caller's business.
+		return mode
+	}
+	mode |= packages.NeedDeps
+	if opt.ImportStrategy != ImportSource {
+		mode |= packages.NeedExportsFile
+	}
+	if opt.CacheDir != "" {
+		mode |= packages.NeedModule
+	}
+	return mode
+}
+
+// packagesConfig returns the configuration for loading packages with
+// go/packages from dir (or, if it is empty, the build context's working
+// directory).
+func (opt *Options) packagesConfig(dir string) *packages.Config {
+	cfg := &packages.Config{Context: opt.context(), Mode: opt.loadMode(), Dir: dir, Env: opt.env()}
+	tags := opt.BuildTags
+	if c := opt.BuildContext; c != nil {
+		tags = append(append([]string(nil), c.BuildTags...), tags...)
+		if dir == "" {
+			cfg.Dir = c.Dir
+		}
+	}
+	if len(tags) > 0 {
+		cfg.BuildFlags = []string{"-tags=" + strings.Join(tags, ",")}
+	}
+	cfg.Env = workspaceEnv(cfg.Dir, cfg.Env, opt)
+	return cfg
+}
+
+// env returns the environment for the go command: the process's
+// environment with the settings of opt.BuildContext and then opt.Env
+// applied, or nil (meaning the process's) if there are none.
+func (opt *Options) env() []string {
+	if opt.BuildContext == nil && opt.Env == nil {
+		return nil
+	}
+	env := os.Environ()
+	if c := opt.BuildContext; c != nil {
+		for _, kv := range [][2]string{{"GOOS", c.GOOS}, {"GOARCH", c.GOARCH}, {"GOROOT", c.GOROOT}, {"GOPATH", c.GOPATH}} {
+			if kv[1] != "" {
+				env = append(env, kv[0]+"="+kv[1])
+			}
+		}
+		if c.CgoEnabled {
+			env = append(env, "CGO_ENABLED=1")
+		} else {
+			env = append(env, "CGO_ENABLED=0")
+		}
+	}
+	// Later settings take precedence.
+	return append(env, opt.Env...)
+}
+
+// defaultImporter returns an importer for packages that weren't found
+// by go/packages, which (for export data) only finds standard library
+// packages in module mode.
+func (opt *Options) defaultImporter(fset *token.FileSet) types.Importer {
+	if opt.Importer != nil {
+		return opt.Importer
+	}
+	switch opt.ImportStrategy {
+	case ImportExport:
+		return importer.Default()
+	case ImportSource:
+		return importer.ForCompiler(fset, "source", nil)
+	}
+	return fallbackImporter{importer.Default(), importer.ForCompiler(fset, "source", nil)}
+}
+
+// A fallbackImporter imports packages with its second importer if its
+// first one fails.
+type fallbackImporter [2]types.Importer
+
+func (imp fallbackImporter) Import(path string) (*types.Package, error) {
+	pkg, err := imp[0].Import(path)
+	if err != nil {
+		if pkg, err2 := imp[1].Import(path); err2 == nil {
+			return pkg, nil
+		}
+	}
+	return pkg, err
+}
+
+// packageWithFile returns the package in pkgs whose files include
+// filename, or nil if there is none.
+func packageWithFile(pkgs []*packages.Package, filename string) *packages.Package {
+	for _, pkg := range pkgs {
+		for _, name := range pkg.CompiledGoFiles {
+			if name == filename {
+				return pkg
+			}
+		}
+	}
+	return nil
+}
+
+// importsChanged reports whether file imports different packages than
+// the file on disk named filename (or the file doesn't exist on disk).
+func importsChanged(filename string, file *ast.File) bool {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return true
+	}
+	disk, err := parser.ParseFile(token.NewFileSet(), filename, src, parser.ImportsOnly)
+	if err != nil || len(disk.Imports) != len(file.Imports) {
+		return true
+	}
+	paths := map[string]bool{}
+	for _, imp := range disk.Imports {
+		paths[imp.Path.Value] = true
+	}
+	for _, imp := range file.Imports {
+		if !paths[imp.Path.Value] {
+			return true
+		}
+	}
+	return false
+}
+
+// packageImporter returns an importer for the dependencies of pkg:
+// opt.Importer, if set, or one that follows opt.ImportStrategy.
+func packageImporter(fset *token.FileSet, ov overlay, pkg *packages.Package, opt *Options) types.Importer {
+	if opt.Importer != nil {
+		return opt.Importer
+	}
+	return newExportImporter(fset, ov, pkg, opt)
+}
+
+// An exportImporter imports the dependencies of a package loaded by
+// go/packages according to an ImportStrategy: from their export data,
+// or from source (ignoring errors). With ImportAuto, packages are
+// typechecked from source if their export data is unavailable or
+// unreadable, as when the package under test has an incomplete return
+// in a _test.go file, and so doesn't compile.
+type exportImporter struct {
+	*exportDeps
+	paths map[string]string // import path in the importing package's files -> package path
+}
+
+// exportDeps holds the dependencies shared by the importers for a
+// package and its dependencies.
+type exportDeps struct {
+	strategy ImportStrategy
+	gc       types.Importer
+	fset     *token.FileSet
+	ov       overlay
+	pkgs     map[string]*packages.Package // package path -> package
+	checked  map[string]*types.Package    // packages typechecked from source (or read from the cache)
+	cache    *exportCache                 // nil if caching is disabled
+}
+
+// newExportImporter returns an importer for the dependencies of pkg.
+// Only pkg's own dependency graph is consulted, so that a test variant
+// of a package (which has the same package path as the package) is
+// found where the test imports it.
+func newExportImporter(fset *token.FileSet, ov overlay, pkg *packages.Package, opt *Options) *exportImporter {
+	deps := &exportDeps{strategy: opt.ImportStrategy, fset: fset, ov: ov, pkgs: map[string]*packages.Package{}, checked: map[string]*types.Package{}}
+	if opt.CacheDir != "" {
+		deps.cache = &exportCache{dir: opt.CacheDir, tags: opt.BuildTags, keys: map[*packages.Package]string{}, opt: opt}
+	}
+	packages.Visit([]*packages.Package{pkg}, nil, func(p *packages.Package) {
+		if p != pkg {
+			deps.pkgs[p.PkgPath] = p
+		}
+	})
+	if opt.ImportCache != nil {
+		deps.gc = opt.ImportCache.importer(deps.pkgs, opt)
+		return deps.importer(pkg)
+	}
+	deps.gc = importer.ForCompiler(fset, "gc", func(path string) (io.ReadCloser, error) {
+		p, ok := deps.pkgs[path]
+		if !ok || p.ExportFile == "" {
+			return nil, fmt.Errorf("no export data for %s", path)
+		}
+		return os.Open(p.ExportFile)
+	})
+	return deps.importer(pkg)
+}
+
+// importer returns an importer for the imports of pkg.
+func (deps *exportDeps) importer(pkg *packages.Package) *exportImporter {
+	paths := map[string]string{}
+	for path, p := range pkg.Imports {
+		paths[path] = p.PkgPath
+	}
+	return &exportImporter{exportDeps: deps, paths: paths}
+}
+
+func (imp *exportImporter) Import(path string) (*types.Package, error) {
+	if pkgPath, ok := imp.paths[path]; ok {
+		path = pkgPath // e.g., a vendored package
+	}
+	p, ok := imp.pkgs[path]
+	if !ok || len(p.CompiledGoFiles) == 0 || imp.strategy == ImportExport {
+		return imp.gc.Import(path)
+	}
+	if imp.strategy == ImportSource || p.ExportFile == "" {
+		return imp.checkSource(p)
+	}
+	if pkg, err := imp.gc.Import(path); err == nil {
+		return pkg, nil
+	}
+	return imp.checkSource(p)
+}
+
+// checkSource typechecks p from source, ignoring errors.
+func (deps *exportDeps) checkSource(p *packages.Package) (*types.Package, error) {
+	if tp, ok := deps.checked[p.PkgPath]; ok {
+		return tp, nil
+	}
+	if tp := deps.readCache(p); tp != nil {
+		deps.checked[p.PkgPath] = tp
+		return tp, nil
+	}
+	var files []*ast.File
+	for _, name := range p.CompiledGoFiles {
+		if f, err := parseFile(deps.fset, deps.ov, name); err == nil {
+			files = append(files, f)
+		}
+	}
+	cfg := types.Config{Error: func(error) {}, Importer: deps.importer(p)}
+	tp, _ := cfg.Check(p.PkgPath, deps.fset, files, nil)
+	deps.checked[p.PkgPath] = tp
+	deps.writeCache(p, tp)
+	return tp, nil
+}
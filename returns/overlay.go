@@ -0,0 +1,146 @@
+package returns
+
+import (
+	"bytes"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// overlay is a view of the filesystem in which some files' contents
+// are replaced by (or supplemented with) in-memory contents. Files in
+// the overlay need not exist on disk.
+type overlay map[string][]byte
+
+// newOverlay returns an overlay containing opt.Overlay plus the file
+// being processed (whose contents may differ from, or be absent on,
+// disk). Keys are made absolute so that lookups don't depend on how the
+// caller spelled the path.
+func newOverlay(opt *Options, filename string, src []byte) overlay {
+	o := overlay{}
+	for name, data := range opt.Overlay {
+		o[absPath(name)] = data
+	}
+	if filename != "" {
+		o[absPath(filename)] = src
+	}
+	return o
+}
+
+func absPath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return filepath.Clean(name)
+}
+
+// buildContext returns a copy of base (or build.Default, if base is
+// nil) that consults the overlay before the filesystem (or base's file
+// system hooks) and satisfies the additional build tags.
+func (o overlay) buildContext(base *build.Context, tags []string) *build.Context {
+	if base == nil {
+		base = &build.Default
+	}
+	ctxt := *base
+	ctxt.BuildTags = append(append([]string(nil), ctxt.BuildTags...), tags...)
+	ctxt.IsDir = func(dir string) bool {
+		if base.IsDir != nil {
+			if base.IsDir(dir) {
+				return true
+			}
+		} else if fi, err := os.Stat(dir); err == nil {
+			return fi.IsDir()
+		}
+		// A directory that exists only in the overlay.
+		dir = absPath(dir)
+		for name := range o {
+			if filepath.Dir(name) == dir {
+				return true
+			}
+		}
+		return false
+	}
+	ctxt.ReadDir = func(dir string) ([]os.FileInfo, error) {
+		return o.readDir(dir, base.ReadDir)
+	}
+	ctxt.OpenFile = func(name string) (io.ReadCloser, error) {
+		if data, ok := o[absPath(name)]; ok {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+		if base.OpenFile != nil {
+			return base.OpenFile(name)
+		}
+		return os.Open(name)
+	}
+	return &ctxt
+}
+
+// readDir lists dir on disk (with read, if it is non-nil) merged with
+// the overlay's files in dir. A missing directory is not an error if
+// the overlay has files in it.
+func (o overlay) readDir(dir string, read func(string) ([]os.FileInfo, error)) ([]os.FileInfo, error) {
+	if read == nil {
+		read = ioutil.ReadDir
+	}
+	infos, err := read(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	seen := map[string]int{}
+	for i, fi := range infos {
+		seen[fi.Name()] = i
+	}
+	abs := absPath(dir)
+	found := err == nil
+	for name, data := range o {
+		if filepath.Dir(name) != abs {
+			continue
+		}
+		found = true
+		fi := overlayFileInfo{name: filepath.Base(name), size: int64(len(data))}
+		if i, ok := seen[fi.name]; ok {
+			infos[i] = fi
+		} else {
+			infos = append(infos, fi)
+		}
+	}
+	if !found {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// readFile returns the contents of name from the overlay, or from disk
+// if it is not overlaid.
+func (o overlay) readFile(name string) ([]byte, error) {
+	if data, ok := o[absPath(name)]; ok {
+		return data, nil
+	}
+	return ioutil.ReadFile(name)
+}
+
+// readAll reads and closes the file that was opened with err.
+func readAll(f io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+type overlayFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi overlayFileInfo) Name() string       { return fi.name }
+func (fi overlayFileInfo) Size() int64        { return fi.size }
+func (fi overlayFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi overlayFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi overlayFileInfo) IsDir() bool        { return false }
+func (fi overlayFileInfo) Sys() interface{}   { return nil }
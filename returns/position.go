@@ -0,0 +1,74 @@
+package returns
+
+import (
+	"bytes"
+	"go/token"
+	"unicode/utf8"
+)
+
+// The Column of a token.Position is a 1-based byte offset within the
+// line. Editors count columns in runes, and LSP clients count them in
+// UTF-16 code units; the counts differ on lines with non-ASCII text.
+// These helpers convert between them, given the file's source.
+
+// RuneColumn returns the 1-based column of pos in src, counted in runes.
+func RuneColumn(src []byte, pos token.Position) int {
+	return utf8.RuneCount(linePrefix(src, pos)) + 1
+}
+
+// UTF16Column returns the 1-based column of pos in src, counted in
+// UTF-16 code units.
+func UTF16Column(src []byte, pos token.Position) int {
+	n := 1
+	for _, r := range string(linePrefix(src, pos)) {
+		n += utf16Len(r)
+	}
+	return n
+}
+
+// ByteColumn returns the 1-based byte column in src of the 1-based
+// UTF-16 column col16 on the given line. A column past the end of the
+// line is clamped to the end of the line.
+func ByteColumn(src []byte, line, col16 int) int {
+	text := lineText(src, line)
+	n := 1 // UTF-16 column of the rune at text[i:]
+	for i, r := range string(text) {
+		if n >= col16 {
+			return i + 1
+		}
+		n += utf16Len(r)
+	}
+	return len(text) + 1
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 && r <= utf8.MaxRune {
+		return 2 // surrogate pair
+	}
+	return 1
+}
+
+// linePrefix returns the text of pos's line in src that precedes pos.
+func linePrefix(src []byte, pos token.Position) []byte {
+	text := lineText(src, pos.Line)
+	if col := pos.Column - 1; col >= 0 && col < len(text) {
+		return text[:col]
+	}
+	return text
+}
+
+// lineText returns the text of the 1-based line in src, without its
+// newline.
+func lineText(src []byte, line int) []byte {
+	for ; line > 1; line-- {
+		i := bytes.IndexByte(src, '\n')
+		if i < 0 {
+			return nil
+		}
+		src = src[i+1:]
+	}
+	if i := bytes.IndexByte(src, '\n'); i >= 0 {
+		src = src[:i]
+	}
+	return src
+}
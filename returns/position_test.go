@@ -0,0 +1,32 @@
+package returns
+
+import (
+	"go/token"
+	"testing"
+)
+
+func TestColumns(t *testing.T) {
+	src := []byte("x := 1\ns := \"é𝔼\" + y\n")
+	tests := []struct {
+		col               int // byte column on line 2
+		runeCol, utf16Col int
+	}{
+		{col: 1, runeCol: 1, utf16Col: 1},
+		{col: 7, runeCol: 7, utf16Col: 7},    // é
+		{col: 9, runeCol: 8, utf16Col: 8},    // 𝔼
+		{col: 13, runeCol: 9, utf16Col: 10},  // closing quote
+		{col: 17, runeCol: 13, utf16Col: 14}, // y
+	}
+	for _, test := range tests {
+		pos := token.Position{Line: 2, Column: test.col}
+		if got := RuneColumn(src, pos); got != test.runeCol {
+			t.Errorf("RuneColumn(%d) = %d, want %d", test.col, got, test.runeCol)
+		}
+		if got := UTF16Column(src, pos); got != test.utf16Col {
+			t.Errorf("UTF16Column(%d) = %d, want %d", test.col, got, test.utf16Col)
+		}
+		if got := ByteColumn(src, 2, test.utf16Col); got != test.col {
+			t.Errorf("ByteColumn(%d) = %d, want %d", test.utf16Col, got, test.col)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package returns
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pragmaPrefix begins the comments by which a file overrides its
+// options (see applyPragmas).
+const pragmaPrefix = "//goreturns:options"
+
+// pragmaOptions are the options that a file may override, by the names
+// of their fields in lower camel case, with the functions that set
+// them from the pragmas' values. Fixes is normalized first (see
+// applyPragmas), so that RemoveBareReturns is only "bare" in Fixes.
+var pragmaOptions = map[string]func(opt *Options, value string) error{
+	"fixes": func(opt *Options, value string) (err error) {
+		opt.Fixes, err = ParseFixes(value, opt.Fixes)
+		return err
+	},
+	"removeBareReturns": func(opt *Options, value string) error {
+		b, err := parsePragmaBool(value)
+		if err == nil {
+			list := "-bare"
+			if b {
+				list = "+bare"
+			}
+			opt.Fixes, err = ParseFixes(list, opt.Fixes)
+		}
+		return err
+	},
+	"errorFuncsOnly": pragmaBool(func(opt *Options) *bool { return &opt.ErrorFuncsOnly }),
+	"reportNilNil":   pragmaBool(func(opt *Options) *bool { return &opt.ReportNilNil }),
+	"skipBadDecls":   pragmaBool(func(opt *Options) *bool { return &opt.SkipBadDecls }),
+	"syntaxOnly":     pragmaBool(func(opt *Options) *bool { return &opt.SyntaxOnly }),
+	"simplify":       pragmaBool(func(opt *Options) *bool { return &opt.Simplify }),
+	"keepFormatting": pragmaBool(func(opt *Options) *bool { return &opt.KeepFormatting }),
+	"zeroValueComment": func(opt *Options, value string) error {
+		opt.ZeroValueComment = value
+		return nil
+	},
+}
+
+func pragmaBool(field func(*Options) *bool) func(*Options, string) error {
+	return func(opt *Options, value string) error {
+		b, err := parsePragmaBool(value)
+		*field(opt) = b
+		return err
+	}
+}
+
+func parsePragmaBool(value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q isn't true or false", value)
+}
+
+// hasPragmas reports whether src's header holds a //goreturns:options
+// comment.
+func hasPragmas(src []byte) bool {
+	return len(pragmaLines(src)) > 0
+}
+
+// applyPragmas returns opt with the overrides of the //goreturns:options
+// comments in the header of src, the contents of filename (the comments
+// before its package clause, or for a fragment, before its first line
+// of code), such as
+//
+//	//goreturns:options removeBareReturns=false fixes=-zero
+//
+// so that files such as vendored or generated ones kept in the tree
+// can be left alone, or fixed differently. A value may be quoted, as a
+// Go string. fixes is a list of fixers as for ParseFixes, relative to
+// those opt enables. It returns opt itself if there are no pragmas.
+func applyPragmas(filename string, src []byte, opt *Options) (*Options, error) {
+	lines := pragmaLines(src)
+	if len(lines) == 0 {
+		return opt, nil
+	}
+	o := *opt
+	enabled, err := opt.enabledFixes()
+	if err != nil {
+		return nil, err
+	}
+	o.Fixes, o.RemoveBareReturns = nil, false
+	for _, fx := range fixers {
+		if enabled[fx.name] {
+			o.Fixes = append(o.Fixes, fx.name)
+		}
+	}
+	if o.Fixes == nil {
+		o.Fixes = []string{} // not the defaults
+	}
+	for _, l := range lines {
+		fields, err := pragmaFields(l.text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %s", filename, l.line, pragmaPrefix, err)
+		}
+		for _, f := range fields {
+			set, ok := pragmaOptions[f[0]]
+			if !ok {
+				var names []string
+				for name := range pragmaOptions {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				return nil, fmt.Errorf("%s:%d: %s: unknown option %q (options: %s)", filename, l.line, pragmaPrefix, f[0], strings.Join(names, ", "))
+			}
+			if err := set(&o, f[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %s: %s", filename, l.line, pragmaPrefix, f[0], err)
+			}
+		}
+	}
+	o.tracef("pragma: options overridden by the file's %s comments", pragmaPrefix)
+	return &o, nil
+}
+
+// A pragmaLine is the text after pragmaPrefix of a line of a file.
+type pragmaLine struct {
+	line int
+	text string
+}
+
+// pragmaLines returns the pragmas in the header of src (see
+// applyPragmas).
+func pragmaLines(src []byte) []pragmaLine {
+	if !bytes.Contains(src, []byte(pragmaPrefix)) {
+		return nil
+	}
+	var pragmas []pragmaLine
+	inComment := false // in a /* */ comment
+	for i, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case inComment:
+			inComment = !strings.Contains(line, "*/")
+		case strings.HasPrefix(line, "/*"):
+			inComment = !strings.Contains(line[2:], "*/")
+		case line == pragmaPrefix || strings.HasPrefix(line, pragmaPrefix+" ") || strings.HasPrefix(line, pragmaPrefix+"\t"):
+			pragmas = append(pragmas, pragmaLine{i + 1, line[len(pragmaPrefix):]})
+		case line == "" || strings.HasPrefix(line, "//"):
+		default:
+			return pragmas // the package clause, or code
+		}
+	}
+	return pragmas
+}
+
+// pragmaFields splits the text of a pragma into its name=value pairs.
+func pragmaFields(text string) ([][2]string, error) {
+	var fields [][2]string
+	for text = strings.TrimSpace(text); text != ""; text = strings.TrimSpace(text) {
+		eq := strings.IndexByte(text, '=')
+		if eq <= 0 || strings.ContainsAny(text[:eq], " \t") {
+			return nil, fmt.Errorf("expected name=value, not %q", strings.Fields(text)[0])
+		}
+		name, value := text[:eq], text[eq+1:]
+		if strings.HasPrefix(value, `"`) {
+			end := 1
+			for ; end < len(value) && value[end] != '"'; end++ {
+				if value[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(value) {
+				return nil, fmt.Errorf("unterminated string in %s", name)
+			}
+			s, err := strconv.Unquote(value[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed string in %s", name)
+			}
+			fields = append(fields, [2]string{name, s})
+			text = value[end+1:]
+			continue
+		}
+		end := strings.IndexAny(value, " \t")
+		if end < 0 {
+			end = len(value)
+		}
+		fields = append(fields, [2]string{name, value[:end]})
+		text = value[end:]
+	}
+	return fields, nil
+}
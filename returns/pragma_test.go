@@ -0,0 +1,73 @@
+package returns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPragmas(t *testing.T) {
+	tests := []struct {
+		src, want string
+		opt       Options
+	}{
+		{
+			src: `//goreturns:options fixes=none
+package foo
+import "errors"
+func F() (int, error) { return errors.New("x") }
+`,
+			want: "return errors.New(\"x\")",
+		},
+		{
+			src: `// Copyright 2020 Someone Else.
+
+/* Derived from a
+third-party file. */
+//goreturns:options zeroValueComment="TODO fill in" removeBareReturns=false
+package foo
+import "errors"
+func F() (n int, err error) { return errors.New("x") }
+func G() (n int, err error) { return }
+`,
+			opt:  Options{RemoveBareReturns: true},
+			want: "return 0 /* TODO fill in */, errors.New(\"x\") }\nfunc G() (n int, err error) { return }",
+		},
+		{
+			// Only the header's pragmas count.
+			src: `package foo
+//goreturns:options fixes=none
+import "errors"
+func F() (int, error) { return errors.New("x") }
+`,
+			want: "return 0, errors.New(\"x\")",
+		},
+	}
+	for i, test := range tests {
+		test.opt.Fragment = true
+		out, err := Process("", "a.go", []byte(test.src), &test.opt)
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+		if !strings.Contains(strings.Replace(string(out), "\t", "", -1), test.want) {
+			t.Errorf("%d: got\n%s\nwant it to contain %q", i, out, test.want)
+		}
+	}
+}
+
+func TestPragmaErrors(t *testing.T) {
+	tests := map[string]string{
+		"//goreturns:options removeBareReturn=false": `a.go:1: //goreturns:options: unknown option "removeBareReturn"`,
+		"//goreturns:options simplify=yes":           `a.go:1: //goreturns:options: simplify: "yes" isn't true or false`,
+		"//goreturns:options fixes=+nope":            `a.go:1: //goreturns:options: fixes: unknown fixer "nope"`,
+		"//goreturns:options zeroValueComment=\"x":   `a.go:1: //goreturns:options: unterminated string in zeroValueComment`,
+		"//goreturns:options simplify":               `a.go:1: //goreturns:options: expected name=value, not "simplify"`,
+	}
+	for pragma, want := range tests {
+		src := pragma + "\npackage foo\n"
+		_, err := Process("", "a.go", []byte(src), &Options{Fragment: true})
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %s", pragma, err, want)
+		}
+	}
+}
@@ -0,0 +1,604 @@
+package returns
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path"
+	"strconv"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// AddResult appends a result of type typ (a Go type expression, such
+// as "error" or "*bytes.Buffer") to the signature of the function named
+// name in the provided file, and completes every return statement in
+// the function's body with the new result's zero value. The name is
+// either a function name ("F") or a method name qualified by its
+// receiver type ("T.M"). If the function's results are named, the new
+// result is named too, so existing naked returns remain valid. The
+// packages that typ refers to are imported if the file doesn't import
+// them already; each must be imported by another file of the package,
+// or be in the standard library.
+//
+// Calls to the function in the provided file that assign its results
+// ("v, err := f()", "var v, err = f()") get a blank identifier for the
+// new result, so AddResult should be run on every file of the package.
+// Calls in other contexts (such as "return f()", "g(f())", or
+// "var v T = f()") are left alone, and may need fixing by hand.
+//
+// It reports whether the function was found; if not, out is src
+// formatted but with its calls updated.
+func AddResult(pkgDir, filename string, src []byte, name, typ string, opt *Options) (out []byte, found bool, err error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	typExpr, err := parser.ParseExpr(typ)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid result type %q: %s", typ, err)
+	}
+
+	cf, err := load(pkgDir, filename, src, opt, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	numResults := -1 // the function's original number of results, if known
+	if fn := findFunc(cf.file, name); fn != nil {
+		found = true
+		if numResults, err = addResult(fn, typExpr, cf.info); err != nil {
+			return nil, false, err
+		}
+		if err := addTypeImports(cf.fset, cf.file, typExpr, cf.info); err != nil {
+			return nil, false, err
+		}
+	}
+	addResultToCalls(cf.file, name, numResults, cf.info)
+
+	out, err = cf.print()
+	return out, found, err
+}
+
+// addResult adds a result of type typ to fn and its returns, and
+// returns fn's original number of results.
+func addResult(fn *ast.FuncDecl, typ ast.Expr, typeInfo *types.Info) (int, error) {
+	zv := zeroValue(fn, typ, typeInfo)
+	if zv == nil {
+		return 0, fmt.Errorf("can't determine the zero value of %s", types.ExprString(typ))
+	}
+
+	ftyp := fn.Type
+	if ftyp.Results == nil {
+		ftyp.Results = &ast.FieldList{}
+	}
+	named := len(ftyp.Results.List) > 0 && len(ftyp.Results.List[0].Names) > 0
+	// Synthesized nodes are printed from their names, so that typ's
+	// positions (from a different FileSet) don't confuse the printer.
+	field := &ast.Field{Type: &ast.Ident{Name: types.ExprString(typ)}}
+	if named {
+		field.Names = []*ast.Ident{{Name: resultName(ftyp, typ)}}
+	}
+	numResults := 0
+	for _, f := range ftyp.Results.List {
+		numResults += fieldCount(f)
+	}
+	ftyp.Results.List = append(ftyp.Results.List, field)
+	if fn.Body == nil {
+		return numResults, nil
+	}
+
+	returns := map[*ast.ReturnStmt]*ast.FuncType{}
+	ast.Walk(visitor{enclosing: ftyp, returns: returns}, fn.Body)
+	for ret, enclosing := range returns {
+		if enclosing != ftyp {
+			continue // return from a nested func literal
+		}
+		if len(ret.Results) == 0 && named {
+			continue // the new named result is implicitly returned
+		}
+		if len(ret.Results) == 1 && numResults > 1 {
+			// A call that returns multiple values can't be
+			// extended; leave it for the user to fix.
+			if _, ok := ret.Results[0].(*ast.CallExpr); ok {
+				continue
+			}
+		}
+		ret.Results = append(ret.Results, zeroValue(fn, typ, typeInfo))
+	}
+
+	if numResults == 0 && !isTerminating(fn.Body) {
+		fn.Body.List = append(fn.Body.List, &ast.ReturnStmt{
+			Return:  fn.Body.Rbrace,
+			Results: []ast.Expr{zeroValue(fn, typ, typeInfo)},
+		})
+	}
+	return numResults, nil
+}
+
+// addTypeImports adds imports to file of the packages that typ refers
+// to and that file doesn't import, which must be imported by another
+// file of the package (as type info says) or be in the standard
+// library.
+func addTypeImports(fset *token.FileSet, file *ast.File, typ ast.Expr, typeInfo *types.Info) error {
+	var err error
+	ast.Inspect(typ, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok || err != nil {
+			return err == nil
+		}
+		id, ok := sel.X.(*ast.Ident)
+		if !ok || importsName(file, id.Name, typeInfo) {
+			return true
+		}
+		path := packagePath(id.Name, typeInfo)
+		if path == "" {
+			err = fmt.Errorf("can't find the package %s of %s to import; import it in the file first", id.Name, types.ExprString(typ))
+			return false
+		}
+		astutil.AddImport(fset, file, path)
+		return false
+	})
+	return err
+}
+
+// importsName reports whether file imports a package as name.
+func importsName(file *ast.File, name string, typeInfo *types.Info) bool {
+	for _, imp := range file.Imports {
+		if imp.Name != nil {
+			if imp.Name.Name == name {
+				return true
+			}
+			continue
+		}
+		if typeInfo != nil {
+			if pkgName, ok := typeInfo.Implicits[imp].(*types.PkgName); ok {
+				if pkgName.Imported().Name() == name {
+					return true
+				}
+				continue
+			}
+		}
+		if p, err := strconv.Unquote(imp.Path.Value); err == nil && path.Base(p) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// packagePath returns the import path of the package named name that
+// another file of the package imports (as type info says), or of the
+// standard library package name, or "" if there is neither.
+func packagePath(name string, typeInfo *types.Info) string {
+	if typeInfo != nil {
+		for _, obj := range typeInfo.Defs {
+			if obj == nil || obj.Pkg() == nil {
+				continue
+			}
+			for _, p := range obj.Pkg().Imports() {
+				if p.Name() == name {
+					return p.Path()
+				}
+			}
+			break // every object is in the same package
+		}
+	}
+	if p, err := build.Import(name, "", build.FindOnly); err == nil && p.Goroot {
+		return name
+	}
+	return ""
+}
+
+// addResultToCalls rewrites the assignments in file from calls to the
+// function named name to assign the new result to the blank identifier.
+// Only assignments of the function's original number of results
+// (numResults, if known, or else as type info says) are rewritten.
+func addResultToCalls(file *ast.File, name string, numResults int, typeInfo *types.Info) {
+	// oldArity returns the number of results that call returned
+	// before the new one was added, or -1 if it's unknown.
+	oldArity := func(e ast.Expr) int {
+		call, ok := e.(*ast.CallExpr)
+		if !ok || !callsFunc(call, name, typeInfo) {
+			return -1
+		}
+		if numResults >= 0 {
+			return numResults
+		}
+		if typeInfo != nil {
+			if tuple, ok := typeInfo.TypeOf(call).(*types.Tuple); ok {
+				return tuple.Len()
+			} else if typeInfo.TypeOf(call) != nil {
+				return 1
+			}
+		}
+		return -1
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if (n.Tok == token.DEFINE || n.Tok == token.ASSIGN) && len(n.Rhs) == 1 && len(n.Lhs) == oldArity(n.Rhs[0]) {
+				n.Lhs = append(n.Lhs, &ast.Ident{Name: "_"})
+			}
+		case *ast.ValueSpec:
+			// With a type, the blank would have to be of that type.
+			if n.Type == nil && len(n.Values) == 1 && len(n.Names) == oldArity(n.Values[0]) {
+				n.Names = append(n.Names, &ast.Ident{Name: "_"})
+			}
+		}
+		return true
+	})
+}
+
+// findFunc returns the top-level function or method declaration in file
+// named name ("F" or "T.M"), or nil if there is none.
+func findFunc(file *ast.File, name string) *ast.FuncDecl {
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		if funcDeclName(fn) == name {
+			return fn
+		}
+	}
+	return nil
+}
+
+// recvTypeName returns the name of the base type of a method receiver.
+func recvTypeName(e ast.Expr) string {
+	for {
+		switch t := e.(type) {
+		case *ast.Ident:
+			return t.Name
+		case *ast.StarExpr:
+			e = t.X
+		case *ast.ParenExpr:
+			e = t.X
+		case *ast.IndexExpr:
+			e = t.X
+		default:
+			return ""
+		}
+	}
+}
+
+// resultName returns a name for a new result of type typ that doesn't
+// conflict with ftyp's other parameter and result names.
+func resultName(ftyp *ast.FuncType, typ ast.Expr) string {
+	used := map[string]bool{}
+	for _, list := range []*ast.FieldList{ftyp.Params, ftyp.Results} {
+		if list == nil {
+			continue
+		}
+		for _, f := range list.List {
+			for _, id := range f.Names {
+				used[id.Name] = true
+			}
+		}
+	}
+	base := "result"
+	if id, ok := typ.(*ast.Ident); ok && id.Name == "error" {
+		base = "err"
+	}
+	name := base
+	for i := 2; used[name]; i++ {
+		name = base + strconv.Itoa(i)
+	}
+	return name
+}
+
+// zeroValue returns a new AST expr representing the zero value of typ
+// as written in fn, using type info (if available) for types whose zero
+// value isn't evident from their syntax. It returns nil if the zero
+// value can't be determined.
+func zeroValue(fn *ast.FuncDecl, typ ast.Expr, typeInfo *types.Info) ast.Expr {
+	zv := newZeroValueNode(typ)
+	if zv == nil {
+		zv = zeroValueFromTypeInfo(fn, typ, typeInfo)
+	}
+	if lit, ok := zv.(*ast.CompositeLit); ok {
+		lit.Type = &ast.Ident{Name: types.ExprString(typ)}
+	}
+	return zv
+}
+
+func zeroValueFromTypeInfo(fn *ast.FuncDecl, typ ast.Expr, typeInfo *types.Info) ast.Expr {
+	if typeInfo == nil {
+		return nil
+	}
+	obj := typeInfo.Defs[fn.Name]
+	if obj == nil || obj.Pkg() == nil {
+		return nil
+	}
+	tv, err := types.Eval(token.NewFileSet(), obj.Pkg(), token.NoPos, types.ExprString(typ))
+	if err != nil || !tv.IsType() {
+		return nil
+	}
+	return zeroValueOfType(tv.Type, typ)
+}
+
+// zeroValueOfType returns an AST expr representing the zero value of t,
+// which is spelled as typ in the source.
+func zeroValueOfType(t types.Type, typ ast.Expr) ast.Expr {
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsBoolean != 0:
+			return &ast.Ident{Name: "false"}
+		case u.Info()&types.IsString != 0:
+			return &ast.BasicLit{Kind: token.STRING, Value: `""`}
+		case u.Info()&types.IsNumeric != 0:
+			return &ast.BasicLit{Kind: token.INT, Value: "0"}
+		case u.Kind() == types.UnsafePointer:
+			return &ast.Ident{Name: "nil"}
+		}
+	case *types.Pointer, *types.Slice, *types.Map, *types.Chan, *types.Signature, *types.Interface:
+		return &ast.Ident{Name: "nil"}
+	case *types.Struct, *types.Array:
+		return &ast.CompositeLit{Type: typ}
+	}
+	return nil
+}
+
+// RemoveResult removes the result at index i (counting from 0) from the
+// signature of the function named name (see AddResult) and drops the
+// corresponding value from every return statement in the function's
+// body. If the result was named and the body refers to it, it becomes
+// a local variable so that the references remain valid.
+//
+// Calls to the function in the provided file that assign its results
+// ("v, err := f()", "var v, err = f()") are rewritten to drop the
+// removed position too, so RemoveResult should be run on every file of
+// the package. A variable that such a call declared for the removed
+// result is declared on its own instead (as "var v T", with its zero
+// value) if it is used elsewhere and its type is known. Calls in other
+// contexts (such as "return f()") are left alone.
+//
+// It reports whether the function's declaration was found in the file.
+func RemoveResult(pkgDir, filename string, src []byte, name string, i int, opt *Options) (out []byte, found bool, err error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+
+	cf, err := load(pkgDir, filename, src, opt, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	numResults := -1 // the function's original number of results, if known
+	var typ ast.Expr // the removed result's type, if known
+	if fn := findFunc(cf.file, name); fn != nil {
+		found = true
+		if numResults, typ, err = removeResult(fn, i); err != nil {
+			return nil, false, err
+		}
+	}
+	removeResultFromCalls(cf.file, name, i, numResults, typ, cf.info)
+
+	out, err = cf.print()
+	return out, found, err
+}
+
+// removeResult removes the i'th result from fn and its returns and
+// returns fn's original number of results and the result's type.
+func removeResult(fn *ast.FuncDecl, i int) (int, ast.Expr, error) {
+	ftyp := fn.Type
+	var fields []*ast.Field // one per result, with at most one name
+	if ftyp.Results != nil {
+		for _, f := range ftyp.Results.List {
+			if len(f.Names) == 0 {
+				fields = append(fields, f)
+			}
+			for _, name := range f.Names {
+				fields = append(fields, &ast.Field{Names: []*ast.Ident{name}, Type: f.Type})
+			}
+		}
+	}
+	if i < 0 || i >= len(fields) {
+		return 0, nil, fmt.Errorf("%s has %d results; can't remove result %d", fn.Name.Name, len(fields), i)
+	}
+
+	removed := fields[i]
+	fields = append(fields[:i:i], fields[i+1:]...)
+	if len(fields) == 0 {
+		ftyp.Results = nil
+	} else {
+		ftyp.Results.List = fields
+	}
+	if fn.Body == nil {
+		return len(fields) + 1, removed.Type, nil
+	}
+
+	returns := map[*ast.ReturnStmt]*ast.FuncType{}
+	ast.Walk(visitor{enclosing: ftyp, returns: returns}, fn.Body)
+	for ret, enclosing := range returns {
+		if enclosing != ftyp || len(ret.Results) != len(fields)+1 {
+			continue // nested func literal, naked return, or multi-value call
+		}
+		ret.Results = append(ret.Results[:i:i], ret.Results[i+1:]...)
+	}
+
+	if len(removed.Names) > 0 && removed.Names[0].Name != "_" && isReferenced(fn.Body, removed.Names[0]) {
+		// Keep the named result as a local variable.
+		fn.Body.List = append([]ast.Stmt{varDecl(removed.Names[0].Name, removed.Type)}, fn.Body.List...)
+	}
+	return len(fields) + 1, removed.Type, nil
+}
+
+// isReferenced reports whether an identifier in n other than id refers
+// to the object that id declares, as resolved by the parser.
+func isReferenced(n ast.Node, id *ast.Ident) bool {
+	if id.Obj == nil {
+		return true // conservatively
+	}
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		if x, ok := n.(*ast.Ident); ok && x != id && x.Obj == id.Obj {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// varDecl returns the statement "var name typ".
+func varDecl(name string, typ ast.Expr) ast.Stmt {
+	return &ast.DeclStmt{Decl: &ast.GenDecl{
+		Tok:   token.VAR,
+		Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{ast.NewIdent(name)}, Type: &ast.Ident{Name: types.ExprString(typ)}}},
+	}}
+}
+
+// removeResultFromCalls rewrites the assignments in file from calls to
+// the function named name to drop the i'th result, whose type is typ
+// (or if typ is nil, as type info says). If numResults is known (not
+// -1), only assignments of that many values are rewritten. Variables
+// that the assignments declared for the result and that are used
+// elsewhere are declared before them instead.
+func removeResultFromCalls(file *ast.File, name string, i, numResults int, typ ast.Expr, typeInfo *types.Info) {
+	isCall := func(e ast.Expr) bool {
+		call, ok := e.(*ast.CallExpr)
+		return ok && callsFunc(call, name, typeInfo)
+	}
+	arityOK := func(n int) bool {
+		return n > i && (numResults == -1 || n == numResults)
+	}
+
+	// keep returns the declaration of the variable that id, the
+	// removed result's variable in an assignment, declares, or nil if
+	// it needn't (or can't) be kept.
+	keep := func(id *ast.Ident) ast.Stmt {
+		if id.Name == "_" || !isReferenced(file, id) {
+			return nil
+		}
+		t := typ
+		if t == nil {
+			if typeInfo == nil || typeInfo.Defs[id] == nil {
+				return nil
+			}
+			obj := typeInfo.Defs[id]
+			t = &ast.Ident{Name: types.TypeString(obj.Type(), func(p *types.Package) string {
+				if p == obj.Pkg() {
+					return ""
+				}
+				return p.Name()
+			})}
+		}
+		return varDecl(id.Name, t)
+	}
+
+	var rewrite func(list []ast.Stmt) []ast.Stmt
+	rewrite = func(list []ast.Stmt) []ast.Stmt {
+		var out []ast.Stmt
+		for _, s := range list {
+			switch s := s.(type) {
+			case *ast.AssignStmt:
+				if len(s.Rhs) != 1 || !isCall(s.Rhs[0]) || !arityOK(len(s.Lhs)) {
+					break
+				}
+				if id, ok := s.Lhs[i].(*ast.Ident); ok && s.Tok == token.DEFINE && (typeInfo == nil || typeInfo.Defs[id] != nil) {
+					if decl := keep(id); decl != nil {
+						out = append(out, decl)
+					}
+				}
+				s.Lhs = append(s.Lhs[:i:i], s.Lhs[i+1:]...)
+				if len(s.Lhs) == 0 {
+					out = append(out, &ast.ExprStmt{X: s.Rhs[0]})
+					continue
+				}
+				if s.Tok == token.DEFINE && !definesNewVar(s.Lhs, typeInfo) {
+					s.Tok = token.ASSIGN
+				}
+			case *ast.DeclStmt:
+				gen, ok := s.Decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.VAR {
+					break
+				}
+				var specs []ast.Spec
+				for _, spec := range gen.Specs {
+					vs := spec.(*ast.ValueSpec)
+					if len(vs.Values) != 1 || !isCall(vs.Values[0]) || !arityOK(len(vs.Names)) {
+						specs = append(specs, vs)
+						continue
+					}
+					if decl := keep(vs.Names[i]); decl != nil {
+						out = append(out, decl)
+					}
+					vs.Names = append(vs.Names[:i:i], vs.Names[i+1:]...)
+					if len(vs.Names) == 0 {
+						out = append(out, &ast.ExprStmt{X: vs.Values[0]})
+						continue
+					}
+					specs = append(specs, vs)
+				}
+				if len(specs) == 0 {
+					continue
+				}
+				gen.Specs = specs
+			}
+			out = append(out, s)
+		}
+		return out
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			n.List = rewrite(n.List)
+		case *ast.CaseClause:
+			n.Body = rewrite(n.Body)
+		case *ast.CommClause:
+			n.Body = rewrite(n.Body)
+		}
+		return true
+	})
+}
+
+// callsFunc reports whether call calls the function or method named
+// name ("F" or "T.M") in the current package. Without type info, only
+// unqualified calls to functions are recognized.
+func callsFunc(call *ast.CallExpr, name string, typeInfo *types.Info) bool {
+	var id *ast.Ident
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		id = fun
+	case *ast.SelectorExpr:
+		id = fun.Sel
+	default:
+		return false
+	}
+	if typeInfo == nil {
+		return call.Fun == id && id.Name == name
+	}
+	fn, ok := typeInfo.Uses[id].(*types.Func)
+	if !ok {
+		return false
+	}
+	sig := fn.Type().(*types.Signature)
+	if sig.Recv() == nil {
+		return fn.Name() == name && call.Fun == id
+	}
+	recv := sig.Recv().Type()
+	if ptr, ok := recv.(*types.Pointer); ok {
+		recv = ptr.Elem()
+	}
+	named, ok := recv.(*types.Named)
+	return ok && named.Obj().Name()+"."+fn.Name() == name
+}
+
+// definesNewVar reports whether any of the identifiers on the left-hand
+// side of a := assignment declares a new variable. Without type info,
+// it assumes that any non-blank identifier might.
+func definesNewVar(lhs []ast.Expr, typeInfo *types.Info) bool {
+	for _, e := range lhs {
+		id, ok := e.(*ast.Ident)
+		if !ok || id.Name == "_" {
+			continue
+		}
+		if typeInfo == nil || typeInfo.Defs[id] != nil {
+			return true
+		}
+	}
+	return false
+}
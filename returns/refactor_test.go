@@ -0,0 +1,337 @@
+package returns
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+)
+
+var addResultTests = []struct {
+	name     string
+	fn, typ  string
+	in, out  string
+	notFound bool
+}{
+	{
+		name: "no results",
+		fn:   "F",
+		typ:  "error",
+		in: `package foo
+func F(x int) {
+	if x > 0 {
+		return
+	}
+	println(x)
+}
+`,
+		out: `package foo
+
+func F(x int) error {
+	if x > 0 {
+		return nil
+	}
+	println(x)
+	return nil
+}
+`,
+	},
+	{
+		name: "existing results",
+		fn:   "F",
+		typ:  "*int",
+		in: `package foo
+func F() (int, string) {
+	_ = func() int { return 1 }
+	return 1, "a"
+}
+`,
+		out: `package foo
+
+func F() (int, string, *int) {
+	_ = func() int { return 1 }
+	return 1, "a", nil
+}
+`,
+	},
+	{
+		name: "named results",
+		fn:   "T.M",
+		typ:  "error",
+		in: `package foo
+type T struct{}
+func (t *T) M() (err int) {
+	err = 1
+	return
+}
+`,
+		out: `package foo
+
+type T struct{}
+
+func (t *T) M() (err int, err2 error) {
+	err = 1
+	return
+}
+`,
+	},
+	{
+		name: "struct type from type info",
+		fn:   "F",
+		typ:  "S",
+		in: `package foo
+type S struct{ x int }
+func F() int { return 1 }
+`,
+		out: `package foo
+
+type S struct{ x int }
+
+func F() (int, S) { return 1, S{} }
+`,
+	},
+	{
+		name: "import result type",
+		fn:   "F",
+		typ:  "*bytes.Buffer",
+		in: `package foo
+import "fmt"
+func F() error { return fmt.Errorf("x") }
+`,
+		out: `package foo
+
+import (
+	"bytes"
+	"fmt"
+)
+
+func F() (error, *bytes.Buffer) { return fmt.Errorf("x"), nil }
+`,
+	},
+	{
+		name: "grouped results and callers",
+		fn:   "F",
+		typ:  "error",
+		in: `package foo
+func F() (a, b int) { return 1, 2 }
+func G() {
+	x, y := F()
+	x, y = F()
+	var v, w = F()
+	_, _, _, _ = x, y, v, w
+}
+`,
+		out: `package foo
+
+func F() (a, b int, err error) { return 1, 2, nil }
+func G() {
+	x, y, _ := F()
+	x, y, _ = F()
+	var v, w, _ = F()
+	_, _, _, _ = x, y, v, w
+}
+`,
+	},
+	{
+		name:     "not found",
+		fn:       "G",
+		typ:      "error",
+		in:       "package foo\n",
+		out:      "package foo\n",
+		notFound: true,
+	},
+}
+
+func TestAddResult(t *testing.T) {
+	for _, tt := range addResultTests {
+		buf, found, err := AddResult("", tt.name+".go", []byte(tt.in), tt.fn, tt.typ, &Options{Fragment: true})
+		if err != nil {
+			t.Errorf("error on %q: %v", tt.name, err)
+			continue
+		}
+		if found == tt.notFound {
+			t.Errorf("%q: got found %v, want %v", tt.name, found, !tt.notFound)
+		}
+		if got := string(buf); got != tt.out {
+			t.Errorf("results diff on %q\nGOT:\n%s\nWANT:\n%s\n", tt.name, got, tt.out)
+		}
+		// The result must compile.
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, tt.name+".go", buf, 0)
+		if err != nil {
+			t.Errorf("%q: %v", tt.name, err)
+			continue
+		}
+		conf := &types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+		if _, err := conf.Check("foo", fset, []*ast.File{f}, nil); err != nil {
+			t.Errorf("%q: result doesn't typecheck: %v", tt.name, err)
+		}
+	}
+}
+
+var removeResultTests = []struct {
+	name    string
+	fn      string
+	i       int
+	in, out string
+}{
+	{
+		name: "returns and callers",
+		fn:   "F",
+		i:    0,
+		in: `package foo
+func F() (int, error) {
+	if true {
+		return 1, nil
+	}
+	return 2, nil
+}
+func G() error {
+	_, err := F()
+	var w, err2 = F()
+	_, _ = w, err2
+	return err
+}
+`,
+		out: `package foo
+
+func F() error {
+	if true {
+		return nil
+	}
+	return nil
+}
+func G() error {
+	err := F()
+	var w int
+	var err2 = F()
+	_, _ = w, err2
+	return err
+}
+`,
+	},
+	{
+		name: "named result",
+		fn:   "T.M",
+		i:    1,
+		in: `package foo
+type T struct{}
+func (T) M() (n int, err error) {
+	n = 1
+	return
+}
+func G(t T) {
+	n, _ := t.M()
+	_ = n
+}
+`,
+		out: `package foo
+
+type T struct{}
+
+func (T) M() (n int) {
+	n = 1
+	return
+}
+func G(t T) {
+	n := t.M()
+	_ = n
+}
+`,
+	},
+	{
+		name: "referenced named result",
+		fn:   "F",
+		i:    0,
+		in: `package foo
+func g() error { return nil }
+func F() (err error, n int) {
+	if err = g(); err != nil {
+		return
+	}
+	return nil, 1
+}
+`,
+		out: `package foo
+
+func g() error { return nil }
+func F() (n int) {
+	var err error
+	if err = g(); err != nil {
+		return
+	}
+	return 1
+}
+`,
+	},
+	{
+		name: "unused and grouped variables",
+		fn:   "F",
+		i:    1,
+		in: `package foo
+type T struct{ x int }
+func F() (int, T, error) { return 0, T{}, nil }
+func G() error {
+	n, t, err := F()
+	_ = n
+	var (
+		a       = 1
+		m, u, e = F()
+	)
+	_, _, _ = a, m, u.x
+	if err != nil {
+		return err
+	}
+	return e
+}
+`,
+		out: `package foo
+
+type T struct{ x int }
+
+func F() (int, error) { return 0, nil }
+func G() error {
+	n, err := F()
+	_ = n
+	var u T
+	var (
+		a    = 1
+		m, e = F()
+	)
+	_, _, _ = a, m, u.x
+	if err != nil {
+		return err
+	}
+	return e
+}
+`,
+	},
+}
+
+func TestRemoveResult(t *testing.T) {
+	for _, tt := range removeResultTests {
+		buf, found, err := RemoveResult("", tt.name+".go", []byte(tt.in), tt.fn, tt.i, &Options{Fragment: true})
+		if err != nil {
+			t.Errorf("error on %q: %v", tt.name, err)
+			continue
+		}
+		if !found {
+			t.Errorf("%q: function not found", tt.name)
+		}
+		if got := string(buf); got != tt.out {
+			t.Errorf("results diff on %q\nGOT:\n%s\nWANT:\n%s\n", tt.name, got, tt.out)
+		}
+		// The result must compile.
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, tt.name+".go", buf, 0)
+		if err != nil {
+			t.Errorf("%q: %v", tt.name, err)
+			continue
+		}
+		if _, err := (&types.Config{}).Check("foo", fset, []*ast.File{f}, nil); err != nil {
+			t.Errorf("%q: result doesn't typecheck: %v", tt.name, err)
+		}
+	}
+}
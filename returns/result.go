@@ -0,0 +1,60 @@
+package returns
+
+import (
+	"bytes"
+	"go/token"
+	"strings"
+)
+
+// A Result is the result of ProcessResult.
+type Result struct {
+	Output  []byte // the file, as Process returns it
+	Changed bool   // whether Output differs from the source
+
+	// Fixes lists the changes that the fixers made, in the order they
+	// were made.
+	Fixes []Fix
+
+	// Diagnostics lists the non-fatal errors found while parsing and
+	// typechecking the file's package (see Options.Errors).
+	Diagnostics []Diagnostic
+}
+
+// A Fix is a change that a fixer made to a return (or to a function, as
+// for errlast and missing-return).
+type Fix struct {
+	Fixer   string         // the name of the fixer (see Fixers)
+	Pos     token.Position // of the return or function in the source; Pos.Column counts bytes
+	Message string         // what the fixer did, such as "added 1 zero value"
+	Added   string         // the values added to the return as Go source, if any, such as "0, nil"
+}
+
+// ProcessResult is like Process, but also reports what changed, so that
+// callers needn't compare the output with the source themselves. As
+// with Options.Errors, the file is always typechecked. opt's Decisions
+// and Errors, if set, also receive the decisions and errors.
+func ProcessResult(pkgDir, filename string, src []byte, opt *Options) (*Result, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	var decisions, errs []Diagnostic
+	o := *opt
+	o.Decisions, o.Errors = &decisions, &errs
+	out, err := Process(pkgDir, filename, src, &o)
+	if opt.Decisions != nil {
+		*opt.Decisions = append(*opt.Decisions, decisions...)
+	}
+	if opt.Errors != nil {
+		*opt.Errors = append(*opt.Errors, errs...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Output: out, Changed: !bytes.Equal(src, out), Diagnostics: errs}
+	for _, d := range decisions {
+		if msg := strings.TrimPrefix(d.Message, "fixed: "); msg != d.Message {
+			res.Fixes = append(res.Fixes, Fix{Fixer: d.Category, Pos: d.Pos, Message: msg, Added: d.Added})
+		}
+	}
+	return res, nil
+}
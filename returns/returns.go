@@ -5,124 +5,710 @@
 // Package returns implements a Go pretty-printer (like package "go/format")
 // that also adds zero-value return values as necessary to incomplete return
 // statements.
+//
+// Editors and language servers can use ComputeFixes, which returns the
+// changes as edits, and Check, which reports the problems it would fix
+// as diagnostics, instead of Process. Tools that process many files of
+// a package can use LoadFiles (or ProcessPackage, for all of a
+// directory's files) to typecheck the package only once, and those
+// that have already parsed and typechecked their files can fix the
+// syntax trees themselves with FixReturns, or find the incomplete
+// returns in them with IncompleteReturns.
 package returns
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/build"
 	"go/format"
-	"go/importer"
 	"go/parser"
-	"go/printer"
+	"go/scanner"
 	"go/token"
 	"go/types"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/modfile"
 )
 
 // Options specifies options for processing files.
 type Options struct {
 	Fragment bool // Accept fragment of a source file (no package statement)
 
-	PrintErrors bool // Print non-fatal typechecking errors to stderr (interferes with some tools that use gofmt/goimports and expect them to only print code or diffs to stdout + stderr)
+	PrintErrors bool // Print non-fatal typechecking errors to ErrOut (interferes with some tools that use gofmt/goimports and expect them to only print code or diffs to stdout + stderr)
+
+	// ErrOut, if set, is where PrintErrors prints the errors, instead
+	// of os.Stderr, e.g., so that a server can log them with the request
+	// they belong to.
+	ErrOut io.Writer
 
 	AllErrors bool // Report all errors (not just the first 10 on different lines)
 
-	RemoveBareReturns bool // Remove bare returns
+	// Fixes lists the names of the fixers to run (see Fixers). If nil,
+	// DefaultFixes are run.
+	Fixes []string
+
+	RemoveBareReturns bool // Remove bare returns (deprecated: add "bare" to Fixes instead)
+
+	ReportNilNil bool // Check reports "return nil, nil" in functions whose last result is error
+
+	ErrorFuncsOnly bool // Only complete returns in functions whose last result is error
+
+	// SkipBadDecls makes top-level declarations that fail to parse
+	// (e.g., because they use syntax newer than goreturns supports) be
+	// left as they are while the rest of the file is processed, instead
+	// of failing.
+	SkipBadDecls bool
+
+	// SyntaxOnly skips loading and typechecking the file's package,
+	// as happens anyway when the package can't be loaded. Returns are
+	// then fixed from the syntax alone, so returns of calls and values
+	// of named types are left alone.
+	SyntaxOnly bool
+
+	// ZeroValueComment, if set, is appended as a /* ZeroValueComment */
+	// comment to each inserted zero value when the file is printed. The
+	// syntax trees of FixReturns and IncompleteReturns, which aren't
+	// printed, don't get the comments.
+	ZeroValueComment string
+
+	// Simplify applies gofmt -s's simplifications to the file when it
+	// is printed.
+	Simplify bool
+
+	// KeepFormatting leaves the formatting of the file as it is,
+	// changing only the lines that the fixers change (which are
+	// printed in gofmt style), instead of printing the whole file in
+	// gofmt style.
+	KeepFormatting bool
+
+	// Lines, if non-nil, restricts fixes to the return statements (and,
+	// for signature changes, the function types) that overlap these line
+	// ranges of the file. It is used to fix only changed code.
+	Lines []LineRange
+
+	// Timing, if non-nil, accumulates the time spent in each phase of
+	// processing.
+	Timing *Timing
+
+	// FixedReturns, if non-nil, accumulates the number of return
+	// statements that the fixers added or changed.
+	FixedReturns *int
+
+	// Errors, if non-nil, accumulates the non-fatal errors found while
+	// parsing and typechecking the file's package (those PrintErrors
+	// prints, but all of them), so that the caller can decide how to
+	// surface them. The file is then always typechecked.
+	Errors *[]Diagnostic
+
+	// Decisions, if non-nil, accumulates a diagnostic for each return
+	// that a fixer fixed or considered and left alone, whose Category
+	// is the fixer and whose Message begins with "fixed: " or
+	// "skipped: " and says why. Trace also includes these.
+	Decisions *[]Diagnostic
+
+	// Trace, if non-nil, receives a line-by-line account of the
+	// decisions made while processing the file (how it was parsed and
+	// typechecked, and why each return was or wasn't fixed).
+	Trace io.Writer
+
+	// Logger, if set, also receives each line of Trace (without its
+	// newline), so that embedders can route it into their own logging.
+	Logger Logger
+
+	// BuildContext, if set, is the build context (GOOS, GOARCH, GOROOT,
+	// GOPATH, cgo, build tags, and working directory) in which to find
+	// the package's files, instead of build.Default. Its settings are
+	// passed on to the go command, and its file system hooks, if any,
+	// are used when listing and reading the package's files (and
+	// finding its go.mod) without it, so that a package can be served
+	// from a virtual file system that the go command can't see.
+	BuildContext *build.Context
+
+	// Env, if set, holds additional environment variables (such as
+	// GOFLAGS or GOPRIVATE) for the go command, as "key=value" pairs
+	// that override the process's environment and BuildContext.
+	Env []string
+
+	// BuildTags are additional build tags to satisfy when selecting
+	// the files of the package (as with "go build -tags").
+	BuildTags []string
+
+	// ImportStrategy selects how the file's dependencies are imported
+	// for typechecking.
+	ImportStrategy ImportStrategy
+
+	// Importer, if set, imports the file's dependencies instead (and
+	// ImportStrategy is ignored), e.g., to resolve packages that exist
+	// only in memory. The go command is still used to find the other
+	// files of the file's package.
+	Importer types.Importer
+
+	// ImportCache, if set, keeps the dependencies imported from their
+	// export data in memory for later calls that share it, as in a
+	// long-running process.
+	ImportCache *ImportCache
+
+	// CacheDir, if set, is a directory in which to cache the export
+	// data of dependencies that are typechecked from source (see
+	// ImportStrategy), so that later runs can reuse it. Entries are
+	// keyed by the package's module version (or, outside versioned
+	// modules, its files) and the build configuration.
+	CacheDir string
+
+	// Overlay maps file names to contents that replace (or stand in
+	// for missing) files on disk when loading the other files of the
+	// package, e.g., unsaved editor buffers or generated previews, so
+	// that the file is typechecked against them. The names may be
+	// relative to the working directory. The file being processed is
+	// always read from src, even if it's in Overlay.
+	Overlay map[string][]byte
+
+	ctx context.Context // set by ProcessContext
+
+	annotated map[ast.Expr]bool // zero values to print with ZeroValueComment, set by checkedFile.fix
+}
+
+// A Logger logs lines of the account given by Options.Trace. A
+// *log.Logger is one.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// tracef writes a line to opt.Trace and opt.Logger, if set.
+func (opt *Options) tracef(format string, args ...interface{}) {
+	if opt.Trace != nil {
+		fmt.Fprintf(opt.Trace, format+"\n", args...)
+	}
+	if opt.Logger != nil {
+		opt.Logger.Printf(format, args...)
+	}
+}
+
+// traceFiles traces the names of the other files of the package that
+// were parsed to typecheck the file with.
+func (opt *Options) traceFiles(fset *token.FileSet, files []*ast.File) {
+	if opt.Trace == nil && opt.Logger == nil || len(files) == 0 {
+		return
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = filepath.Base(fset.File(f.Pos()).Name())
+	}
+	opt.tracef("load: parsed %s", strings.Join(names, ", "))
+}
+
+// decidef records the decision of fixer about the return at pos (see
+// Decisions) and traces it.
+func (opt *Options) decidef(fixer string, pos token.Position, format string, args ...interface{}) {
+	opt.decide(Diagnostic{Pos: pos, Category: fixer, Message: fmt.Sprintf(format, args...)})
+}
+
+// fixedf is like decidef, for a return to which fixer added values.
+func (opt *Options) fixedf(fixer string, pos token.Position, values []ast.Expr, format string, args ...interface{}) {
+	opt.decide(Diagnostic{Pos: pos, Category: fixer, Message: fmt.Sprintf(format, args...), Added: exprList(values)})
+}
+
+// skipUntypedf is like decidef, for a return that fixer skipped for
+// lack of type information.
+func (opt *Options) skipUntypedf(fixer string, pos token.Position, format string, args ...interface{}) {
+	opt.decide(Diagnostic{Pos: pos, Category: fixer, Message: fmt.Sprintf(format, args...), NoTypeInfo: true})
+}
+
+func (opt *Options) decide(d Diagnostic) {
+	opt.tracef("%s: %s: %s", d.Category, d.Pos, d.Message)
+	if opt.Decisions != nil {
+		*opt.Decisions = append(*opt.Decisions, d)
+	}
+}
+
+// errOut returns the writer to which PrintErrors prints.
+func (opt *Options) errOut() io.Writer {
+	if opt.ErrOut == nil {
+		return os.Stderr
+	}
+	return opt.ErrOut
+}
+
+// context returns the context in which the file is being processed.
+func (opt *Options) context() context.Context {
+	if opt.ctx == nil {
+		return context.Background()
+	}
+	return opt.ctx
+}
+
+// reportsErrors reports whether the non-fatal errors found while
+// loading a package are wanted (and so it must be fully typechecked).
+func (opt *Options) reportsErrors() bool {
+	return opt.PrintErrors || opt.Errors != nil
+}
+
+// addError adds err, found while doing category ("parse", "load", or
+// "typecheck") for filename, to opt.Errors, if set.
+func (opt *Options) addError(category, filename string, err error) {
+	if opt.Errors == nil {
+		return
+	}
+	add := func(pos token.Position, msg string, sev Severity) {
+		*opt.Errors = append(*opt.Errors, Diagnostic{Pos: pos, Category: category, Message: msg, Severity: sev})
+	}
+	switch err := err.(type) {
+	case types.Error:
+		sev := Error
+		if err.Soft {
+			sev = Warning
+		}
+		add(err.Fset.Position(err.Pos), err.Msg, sev)
+	case scanner.ErrorList:
+		for _, e := range err {
+			add(e.Pos, e.Msg, Error)
+		}
+	case *scanner.Error:
+		add(err.Pos, err.Msg, Error)
+	default:
+		add(token.Position{Filename: filename}, err.Error(), Error)
+	}
+}
+
+// An ImportStrategy is a way of getting the type information of a
+// file's dependencies.
+type ImportStrategy int
+
+const (
+	// ImportAuto reads the dependencies' compiled export data, and
+	// typechecks them from source if it's unavailable (e.g., in a
+	// fresh checkout, when cross-compiling, or when they don't
+	// compile).
+	ImportAuto ImportStrategy = iota
+
+	// ImportExport only reads compiled export data.
+	ImportExport
+
+	// ImportSource typechecks the dependencies from source, which is
+	// slower but doesn't require them to have been compiled.
+	ImportSource
+)
+
+var importStrategyNames = []string{"auto", "export", "source"}
+
+func (s ImportStrategy) String() string {
+	if s < 0 || int(s) >= len(importStrategyNames) {
+		return fmt.Sprintf("ImportStrategy(%d)", int(s))
+	}
+	return importStrategyNames[s]
+}
+
+// ParseImportStrategy returns the ImportStrategy named name ("auto",
+// "export", or "source").
+func ParseImportStrategy(name string) (ImportStrategy, error) {
+	for i, n := range importStrategyNames {
+		if n == name {
+			return ImportStrategy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown import strategy %q (must be auto, export, or source)", name)
+}
+
+// A LineRange is an inclusive range of 1-based line numbers.
+type LineRange struct {
+	Start, End int
+}
+
+// inLines reports whether node overlaps opt.Lines (or opt.Lines is nil).
+func (opt *Options) inLines(fset *token.FileSet, node ast.Node) bool {
+	if opt.Lines == nil {
+		return true
+	}
+	start, end := fset.Position(node.Pos()).Line, fset.Position(node.End()).Line
+	for _, r := range opt.Lines {
+		if start <= r.End && r.Start <= end {
+			return true
+		}
+	}
+	return false
+}
+
+// A Timing records the time spent in each phase of processing a file.
+type Timing struct {
+	Parse        time.Duration // parsing the file
+	SiblingParse time.Duration // loading and parsing the package's other files
+	Typecheck    time.Duration
+	Fix          time.Duration // running the fixers
+	Print        time.Duration // printing and formatting the result
+}
+
+// timing returns opt.Timing, or a Timing to be discarded if it is nil.
+func (opt *Options) timing() *Timing {
+	if opt.Timing != nil {
+		return opt.Timing
+	}
+	return &Timing{}
 }
 
 // Process formats and adjusts returns for the provided file in a
 // package in pkgDir. If pkgDir is empty, the file is treated as a
 // standalone fragment (opt.Fragment should be true). If opt is nil
 // the defaults are used.
+//
+// The file is parsed and typechecked once; the enabled fixers then run
+// in turn on the same syntax tree and type info, and the result is
+// printed once.
+//
+// Comments in the file's header (before its package clause) such as
+//
+//	//goreturns:options removeBareReturns=false fixes=-zero
+//
+// override opt for the file. They may set fixes (as for ParseFixes,
+// relative to the fixers opt enables), removeBareReturns,
+// errorFuncsOnly, reportNilNil, skipBadDecls, syntaxOnly, simplify,
+// keepFormatting, and zeroValueComment (whose value may be a quoted Go
+// string).
 func Process(pkgDir, filename string, src []byte, opt *Options) ([]byte, error) {
+	return ProcessContext(context.Background(), pkgDir, filename, src, opt)
+}
+
+// ProcessContext is like Process, but gives up on loading, parsing,
+// and typechecking the file's package when ctx's deadline passes, and
+// then fixes the file from its syntax alone (as with
+// Options.SyntaxOnly), so that, for example, an editor can bound the
+// time it spends fixing a file on save. If ctx is canceled instead,
+// ProcessContext gives up on the file and returns ctx.Err(), for
+// servers whose clients no longer want the result.
+func ProcessContext(ctx context.Context, pkgDir, filename string, src []byte, opt *Options) ([]byte, error) {
 	if opt == nil {
 		opt = &Options{}
 	}
-
-	fileSet := token.NewFileSet()
-	file, adjust, typeInfo, err := parseAndCheck(fileSet, pkgDir, filename, src, opt)
+	if ctx.Err() == context.Canceled {
+		return nil, ctx.Err()
+	}
+	o := *opt
+	o.ctx = ctx
+	opt, err := applyPragmas(filename, src, &o)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := fixReturns(fileSet, file, typeInfo); err != nil {
+	cf, err := load(pkgDir, filename, src, opt, true)
+	if err != nil {
 		return nil, err
 	}
+	if ctx.Err() == context.Canceled {
+		return nil, ctx.Err()
+	}
+	return cf.fix(opt)
+}
 
-	if opt.RemoveBareReturns {
-		if err := removeBareReturns(fileSet, file, typeInfo); err != nil {
+// fix runs the enabled fixers on the file and prints the result.
+func (cf *checkedFile) fix(opt *Options) ([]byte, error) {
+	if opt.Decisions != nil {
+		n, filename := len(*opt.Decisions), cf.fset.File(cf.file.Pos()).Name()
+		defer func() { setColumns(*opt.Decisions, n, map[string][]byte{absPath(filename): cf.src}) }()
+	}
+	tm := opt.timing()
+	var formatted []byte // with KeepFormatting, the file as printed before fixing
+	if opt.KeepFormatting {
+		start := time.Now()
+		var err error
+		formatted, err = cf.print()
+		tm.Print += time.Since(start)
+		if err != nil {
 			return nil, err
 		}
 	}
+	start := time.Now()
+	if opt.ZeroValueComment != "" {
+		o := *opt
+		o.annotated = map[ast.Expr]bool{}
+		opt = &o
+	}
+	if err := runFixers(cf.fset, cf.file, cf.info, opt); err != nil {
+		return nil, err
+	}
+	if opt.Simplify {
+		simplify(cf.file)
+	}
+	tm.Fix += time.Since(start)
 
-	var buf bytes.Buffer
-	err = printer.Fprint(&buf, fileSet, file)
+	start = time.Now()
+	defer func() { tm.Print += time.Since(start) }()
+	cf.annotations = annotations(cf.src, opt.annotated, opt.ZeroValueComment)
+	out, err := cf.print()
+	if err != nil || !opt.KeepFormatting {
+		return out, err
+	}
+	src := cf.src
+	if cf.restore != nil {
+		src = cf.restore(src)
+	}
+	return keepFormatting(src, formatted, out), nil
+}
+
+// A checkedFile is a file that has been parsed and typechecked, along
+// with what's needed to print it after its syntax tree is modified.
+type checkedFile struct {
+	fset   *token.FileSet
+	file   *ast.File
+	info   *types.Info // nil if typechecking failed
+	src    []byte
+	adjust func(orig, src []byte) []byte // non-nil if src was a fragment
+
+	// restore, if non-nil, puts back the declarations that were
+	// skipped because of syntax errors (see Options.SkipBadDecls).
+	restore func([]byte) []byte
+
+	annotations []annotation // comments to add to the nodes when printing
+}
+
+// load parses and typechecks the provided file (see Process for the
+// meaning of the arguments). If lazy is set, typechecking is skipped
+// if none of the enabled fixers would use the type info.
+func load(pkgDir, filename string, src []byte, opt *Options, lazy bool) (*checkedFile, error) {
+	if opt.Errors != nil {
+		n := len(*opt.Errors)
+		defer func() { setColumns(*opt.Errors, n, map[string][]byte{absPath(filename): src}) }()
+	}
+	fset := token.NewFileSet()
+	file, adjust, info, err := parseAndCheck(fset, pkgDir, filename, src, opt, lazy)
+	var restore func([]byte) []byte
+	if skipped, r, ok := skipBadSource(filename, src, err, opt); ok {
+		fset = token.NewFileSet()
+		src, restore = skipped, r
+		file, adjust, info, err = parseAndCheck(fset, pkgDir, filename, src, opt, lazy)
+	}
+	if err == errCanceled {
+		// The typechecker may still be reading the syntax tree, so
+		// fix a fresh one.
+		fset = token.NewFileSet()
+		file, adjust, err = parse(fset, filename, src, opt)
+		info = nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	out := buf.Bytes()
-	if adjust != nil {
-		out = adjust(src, out)
+	return &checkedFile{fset: fset, file: file, info: info, src: src, adjust: adjust, restore: restore}, nil
+}
+
+// setColumns sets the rune and UTF-16 columns of diags[start:] that
+// are in one of files (by absolute path).
+func setColumns(diags []Diagnostic, start int, files map[string][]byte) {
+	for i := start; i < len(diags); i++ {
+		d := &diags[i]
+		if src, ok := files[absPath(d.Pos.Filename)]; ok && d.Pos.Line > 0 {
+			d.RuneCol, d.UTF16Col = RuneColumn(src, d.Pos), UTF16Column(src, d.Pos)
+		}
 	}
+}
 
-	out, err = format.Source(out)
-	if err != nil {
+// skipBadSource returns src with its declarations that have syntax
+// errors set aside (see Options.SkipBadDecls), and a function to put
+// them back in the output, if err (from parsing src) can be handled
+// that way.
+func skipBadSource(filename string, src []byte, err error, opt *Options) ([]byte, func([]byte) []byte, bool) {
+	if _, ok := err.(scanner.ErrorList); !ok || !opt.SkipBadDecls || !hasPackageClause(src) {
+		return nil, nil, false
+	}
+	// Find all of the syntax errors, not just the first few.
+	_, perr := parser.ParseFile(token.NewFileSet(), filename, src, parser.AllErrors)
+	errs, _ := perr.(scanner.ErrorList)
+	skipped, restore, ok := skipBadDecls(src, errs)
+	if !ok || len(errs) == 0 {
+		return nil, nil, false
+	}
+	if opt.PrintErrors {
+		scanner.PrintError(opt.errOut(), errs)
+	}
+	opt.addError("parse", filename, errs)
+	opt.tracef("parse: leaving declarations with syntax errors as they are")
+	return skipped, restore, true
+}
+
+// hasPackageClause reports whether src begins with a package clause
+// (and so isn't a fragment).
+func hasPackageClause(src []byte) bool {
+	_, err := parser.ParseFile(token.NewFileSet(), "", src, parser.PackageClauseOnly)
+	return err == nil
+}
+
+// print prints and formats the file, undoing the wrapping of a fragment.
+func (cf *checkedFile) print() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := printAnnotated(&buf, cf.fset, cf.file, cf.annotations); err != nil {
 		return nil, err
 	}
-	return out, nil
+	out := buf.Bytes()
+	if cf.adjust != nil {
+		out = cf.adjust(cf.src, out)
+	}
+	out, err := format.Source(out)
+	if err == nil && cf.restore != nil {
+		out = cf.restore(out)
+	}
+	return out, err
 }
 
-func parseAndCheck(fset *token.FileSet, pkgDir, filename string, src []byte, opt *Options) (*ast.File, func(orig, src []byte) []byte, *types.Info, error) {
+func parseAndCheck(fset *token.FileSet, pkgDir, filename string, src []byte, opt *Options, lazy bool) (*ast.File, func(orig, src []byte) []byte, *types.Info, error) {
 	var pkgFiles []*ast.File // all package files
 
+	tm := opt.timing()
+	start := time.Now()
 	// Parse the named file using `parse`, which handles fragments and reads from the src byte array.
 	file, adjust, err := parse(fset, filename, src, opt)
+	tm.Parse += time.Since(start)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 	pkgFiles = append(pkgFiles, file)
 
+	if opt.SyntaxOnly {
+		opt.tracef("typecheck: skipped (syntax-only mode); returns of calls and values of named types can't be fixed")
+		return file, adjust, nil, nil
+	}
+	if lazy && !opt.reportsErrors() && !needsTypes(file, opt) {
+		opt.tracef("typecheck: skipped (no return needs type info to be fixed)")
+		return file, adjust, nil, nil
+	}
+
 	var importPath string
+	imp := opt.defaultImporter(fset)
 	if pkgDir != "" {
-		// Parse other package files by reading from the filesystem.
-		buildPkg, err := build.ImportDir(pkgDir, 0)
-		if err != nil {
-			// TODO(sqs): support parser-only mode (that doesn't require
-			// files passed to goreturns to be part of a valid package)
-			return nil, nil, nil, err
+		if pkgFiles, importPath, imp, ok := loadPackage(fset, pkgDir, filename, file, src, opt, lazy); ok {
+			return checkFiles(fset, importPath, filename, file, adjust, pkgFiles, imp, opt)
+		}
+		if err := opt.context().Err(); err != nil {
+			opt.tracef("typecheck: skipped (%v); returns of calls and values of named types can't be fixed", err)
+			return file, adjust, nil, nil
+		}
+
+		// Otherwise, find the package with go/build and parse its
+		// other files by reading from the filesystem (or the overlay,
+		// for files that aren't saved to disk, or BuildContext's file
+		// system hooks).
+		start := time.Now()
+		ctxt := newOverlay(opt, filename, src).buildContext(opt.BuildContext, opt.BuildTags)
+		buildPkg, err := ctxt.ImportDir(pkgDir, 0)
+		switch err.(type) {
+		case nil:
+		case *build.MultiplePackageError, *build.NoGoError:
+			// The directory has no single package that the file
+			// belongs to (e.g., it holds standalone programs excluded
+			// from the build by "ignore" tags).
+			opt.tracef("load: %s; typechecking the file alone", err)
+			buildPkg = nil
+		default:
+			// The package is broken (e.g., a sibling file has a
+			// syntax error); fix the file from its syntax alone.
+			if opt.PrintErrors {
+				fmt.Fprintf(opt.errOut(), "%s: loading package failed (continuing without type info): %s\n", filename, err)
+			}
+			opt.addError("load", filename, err)
+			opt.tracef("load: %s", err)
+			opt.tracef("typecheck: skipped; returns of calls and values of named types can't be fixed")
+			tm.SiblingParse += time.Since(start)
+			return file, adjust, nil, nil
+		}
+		if buildPkg == nil || isIgnored(buildPkg, filename) {
+			// Typecheck the file on its own.
+			if buildPkg != nil {
+				opt.tracef("load: file is excluded from package %s by build constraints; typechecking it alone", buildPkg.Name)
+			}
+			tm.SiblingParse += time.Since(start)
+			return checkFiles(fset, file.Name.Name, filename, file, adjust, []*ast.File{file}, imp, opt)
 		}
 		importPath = buildPkg.ImportPath
-		for _, files := range [...][]string{buildPkg.GoFiles, buildPkg.CgoFiles} {
-			for _, file := range files {
-				if file == filepath.Base(filename) {
-					// already parsed this file above
-					continue
-				}
-				f, err := parser.ParseFile(fset, filepath.Join(pkgDir, file), nil, 0)
-				if err != nil {
-					if opt.PrintErrors {
-						fmt.Fprintf(os.Stderr, "could not parse %q: %v\n", file, err)
-					}
-					continue
-				}
-				pkgFiles = append(pkgFiles, f)
+		if importPath == "." {
+			importPath = dirImportPath(ctxt, pkgDir)
+		}
+
+		isTest := strings.HasSuffix(filename, "_test.go")
+		siblings := [][]string{buildPkg.GoFiles, buildPkg.CgoFiles}
+		switch {
+		case isTest && file.Name.Name == buildPkg.Name+"_test":
+			// External test package: typecheck it against the test
+			// variant of the package under test, which includes the
+			// identifiers exported by the in-package _test.go files.
+			testFiles := parseFiles(fset, ctxt, pkgDir, [][]string{buildPkg.GoFiles, buildPkg.CgoFiles, buildPkg.TestGoFiles}, "", opt)
+			tm.SiblingParse += time.Since(start)
+			start = time.Now()
+			testCfg := types.Config{Error: func(error) {}, Importer: imp}
+			if testPkg, _ := testCfg.Check(importPath, fset, testFiles, nil); testPkg != nil {
+				imp = testImporter{Importer: imp, path: importPath, pkg: testPkg}
 			}
+			tm.Typecheck += time.Since(start)
+			start = time.Now()
+			importPath += "_test"
+			siblings = [][]string{buildPkg.XTestGoFiles}
+		case isTest:
+			siblings = append(siblings, buildPkg.TestGoFiles)
+		}
+		siblingFiles := parseFiles(fset, ctxt, pkgDir, siblings, filepath.Base(filename), opt)
+		tm.SiblingParse += time.Since(start)
+		if redeclaresMain(file, siblingFiles) {
+			// The directory is a collection of programs, one per file
+			// (e.g., "go run"-style scripts); typecheck the file on its
+			// own.
+			opt.tracef("load: another file in the directory also declares func main; typechecking the file alone")
+			return checkFiles(fset, "main", filename, file, adjust, []*ast.File{file}, imp, opt)
 		}
+		pkgFiles = append(pkgFiles, siblingFiles...)
+		opt.tracef("load: package %s (%s) in %s, with %d other files", buildPkg.Name, importPath, pkgDir, len(siblingFiles))
+		opt.traceFiles(fset, siblingFiles)
+	} else {
+		opt.tracef("load: no package directory; typechecking the file alone")
+		imp = standaloneImporter(fset, file, opt)
 	}
 
-	var nerrs int
+	return checkFiles(fset, importPath, filename, file, adjust, pkgFiles, imp, opt)
+}
+
+// errCanceled is returned by checkFiles if the context is done before
+// typechecking finishes.
+var errCanceled = errors.New("typechecking canceled")
+
+// checkFiles typechecks pkgFiles, the files of the package with the
+// given import path, of which file (parsed from filename) is the one
+// being processed. If typechecking fails for reasons other than the
+// arity of returns, the partial type info is returned.
+//
+// If opt's context is done first, checkFiles returns errCanceled
+// without waiting for the typechecker, which goes on reading pkgFiles
+// until it notices.
+func checkFiles(fset *token.FileSet, importPath, filename string, file *ast.File, adjust func(orig, src []byte) []byte, pkgFiles []*ast.File, imp types.Importer, opt *Options) (*ast.File, func(orig, src []byte) []byte, *types.Info, error) {
+	tm := opt.timing()
+	ctx := opt.context()
+	var (
+		mu       sync.Mutex // guards the error count and opt.Errors against an abandoned typechecker
+		canceled bool
+	)
+	var nerrs, narity int
 	cfg := types.Config{
 		Error: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if canceled {
+				return
+			}
 			if opt.PrintErrors && (opt.AllErrors || nerrs == 0) {
-				fmt.Fprintln(os.Stderr, err)
+				fmt.Fprintln(opt.errOut(), err)
+			}
+			opt.addError("typecheck", filename, err)
+			if terr, ok := err.(types.Error); ok && isReturnCountError(terr) {
+				narity++
 			}
 			nerrs++
 		},
-		Importer: importer.Default(),
+		Importer: imp,
+	}
+	if ctx.Done() != nil {
+		cfg.Importer = contextImporter{ctx, imp}
 	}
 
 	info := &types.Info{
@@ -130,21 +716,183 @@ func parseAndCheck(fset *token.FileSet, pkgDir, filename string, src []byte, opt
 		Uses:  map[*ast.Ident]types.Object{},
 		Defs:  map[*ast.Ident]types.Object{},
 	}
-	if _, err := cfg.Check(importPath, fset, pkgFiles, info); err != nil {
-		if terr, ok := err.(types.Error); ok && strings.HasPrefix(terr.Msg, "wrong number of return values") {
-			// ignore "wrong number of return values" errors
-		} else {
-			if opt.PrintErrors {
-				fmt.Fprintf(os.Stderr, "%s: typechecking failed (continuing without type info)\n", filename)
-			}
-			// proceed but without type info
-			return file, adjust, nil, nil
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		_, err := cfg.Check(importPath, fset, pkgFiles, info)
+		done <- err
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		mu.Lock()
+		canceled = true
+		mu.Unlock()
+		tm.Typecheck += time.Since(start)
+		if opt.PrintErrors {
+			fmt.Fprintf(opt.errOut(), "%s: typechecking canceled (continuing without type info): %v\n", filename, ctx.Err())
+		}
+		opt.tracef("typecheck: canceled (%v); returns of calls and values of named types can't be fixed", ctx.Err())
+		return nil, nil, nil, errCanceled
+	}
+	tm.Typecheck += time.Since(start)
+	if nerrs > narity {
+		// Keep the type info that was recorded despite the errors;
+		// expressions whose types couldn't be determined are missing
+		// from it (or have invalid types), and the fixers treat them
+		// as unknown.
+		if opt.PrintErrors {
+			fmt.Fprintf(opt.errOut(), "%s: typechecking failed (continuing with partial type info)\n", filename)
 		}
+		opt.tracef("typecheck: failed: %s", err)
+		opt.tracef("typecheck: continuing with partial type info (%s); returns involving the errors can't be fixed", plural(narity, "return arity error"))
+		return file, adjust, info, nil
 	}
 
+	opt.tracef("typecheck: ok (%s, which may be fixable)", plural(narity, "return arity error"))
 	return file, adjust, info, nil
 }
 
+// A contextImporter fails to import packages once its context is done,
+// so that an abandoned typechecker finishes sooner.
+type contextImporter struct {
+	ctx context.Context
+	imp types.Importer
+}
+
+func (imp contextImporter) Import(path string) (*types.Package, error) {
+	if err := imp.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return imp.imp.Import(path)
+}
+
+// isIgnored reports whether filename is excluded from buildPkg by build
+// constraints, as with a "//go:build ignore" program kept alongside a
+// package.
+func isIgnored(buildPkg *build.Package, filename string) bool {
+	base := filepath.Base(filename)
+	for _, name := range buildPkg.IgnoredGoFiles {
+		if name == base {
+			return true
+		}
+	}
+	return false
+}
+
+// redeclaresMain reports whether file and one of its siblings both
+// declare func main.
+func redeclaresMain(file *ast.File, siblings []*ast.File) bool {
+	if file.Name.Name != "main" || !containsMainFunc(file) {
+		return false
+	}
+	for _, f := range siblings {
+		if containsMainFunc(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFiles parses the named files in pkgDir (as read by ctxt),
+// skipping the file named skip (which the caller has already parsed).
+// Files that fail to parse are omitted.
+func parseFiles(fset *token.FileSet, ctxt *build.Context, pkgDir string, names [][]string, skip string, opt *Options) []*ast.File {
+	var files []*ast.File
+	for _, list := range names {
+		for _, name := range list {
+			if opt.context().Err() != nil {
+				return files // checkFiles gives up at once
+			}
+			if name == skip {
+				continue
+			}
+			filename := filepath.Join(pkgDir, name)
+			src, err := readAll(ctxt.OpenFile(filename))
+			var f *ast.File
+			if err == nil {
+				f, err = parser.ParseFile(fset, filename, src, 0)
+			}
+			if err != nil {
+				if opt.PrintErrors {
+					fmt.Fprintf(opt.errOut(), "could not parse %q: %v\n", name, err)
+				}
+				opt.addError("parse", filename, err)
+				continue
+			}
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func parseFile(fset *token.FileSet, ov overlay, filename string) (*ast.File, error) {
+	src, err := ov.readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parser.ParseFile(fset, filename, src, 0)
+}
+
+// isReturnCountError reports whether err is the typechecker's complaint
+// about a return statement's arity, which is exactly what goreturns
+// fixes. Older Go versions say "wrong number of return values"; newer
+// ones say "not enough" or "too many".
+func isReturnCountError(err types.Error) bool {
+	for _, prefix := range []string{"wrong number of return values", "not enough return values", "too many return values"} {
+		if strings.HasPrefix(err.Msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// testImporter resolves the package under test to its test variant (the
+// package including its in-package _test.go files) so that external test
+// packages see identifiers exported only for tests.
+type testImporter struct {
+	types.Importer
+	path string
+	pkg  *types.Package
+}
+
+func (t testImporter) Import(path string) (*types.Package, error) {
+	if path == t.path {
+		return t.pkg, nil
+	}
+	return t.Importer.Import(path)
+}
+
+// dirImportPath returns the import path of the package in dir, derived
+// from the nearest enclosing go.mod (as read by ctxt). It returns "." if
+// dir is not inside a module.
+func dirImportPath(ctxt *build.Context, dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "."
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if data, err := readAll(ctxt.OpenFile(filepath.Join(d, "go.mod"))); err == nil {
+			modPath := modfile.ModulePath(data)
+			if modPath == "" {
+				return "."
+			}
+			rel, err := filepath.Rel(d, dir)
+			if err != nil {
+				return "."
+			}
+			if rel == "." {
+				return modPath
+			}
+			return path.Join(modPath, filepath.ToSlash(rel))
+		}
+		if filepath.Dir(d) == d {
+			return "."
+		}
+	}
+}
+
 // parse parses src, which was read from filename,
 // as a Go source file or statement list.
 func parse(fset *token.FileSet, filename string, src []byte, opt *Options) (*ast.File, func(orig, src []byte) []byte, error) {
@@ -156,12 +904,14 @@ func parse(fset *token.FileSet, filename string, src []byte, opt *Options) (*ast
 	// Try as whole source file.
 	file, err := parser.ParseFile(fset, filename, src, parserMode)
 	if err == nil {
+		opt.tracef("parse: ok")
 		return file, nil, nil
 	}
 	// If the error is that the source file didn't begin with a
 	// package line and we accept fragmented input, fall through to
 	// try as a source fragment.  Stop and return on any other error.
 	if !opt.Fragment || !strings.Contains(err.Error(), "expected 'package'") {
+		opt.tracef("parse: %s", err)
 		return nil, nil, err
 	}
 
@@ -175,8 +925,10 @@ func parse(fset *token.FileSet, filename string, src []byte, opt *Options) (*ast
 		// If a main function exists, we will assume this is a main
 		// package and leave the file.
 		if containsMainFunc(file) {
+			opt.tracef("parse: ok, as declarations of package main")
 			return file, nil, nil
 		}
+		opt.tracef("parse: ok, as a list of declarations")
 
 		adjust := func(orig, src []byte) []byte {
 			// Remove the package clause.
@@ -190,6 +942,7 @@ func parse(fset *token.FileSet, filename string, src []byte, opt *Options) (*ast
 	// declaration, fall through to try as a statement list.
 	// Stop and return on any other error.
 	if !strings.Contains(err.Error(), "expected declaration") {
+		opt.tracef("parse: %s", err)
 		return nil, nil, err
 	}
 
@@ -201,6 +954,7 @@ func parse(fset *token.FileSet, filename string, src []byte, opt *Options) (*ast
 	fsrc := append(append([]byte("package p; func _() {"), src...), '}')
 	file, err = parser.ParseFile(fset, filename, fsrc, parserMode)
 	if err == nil {
+		opt.tracef("parse: ok, as a list of statements")
 		adjust := func(orig, src []byte) []byte {
 			// Remove the wrapping.
 			// Gofmt has turned the ; into a \n\n.
@@ -215,6 +969,7 @@ func parse(fset *token.FileSet, filename string, src []byte, opt *Options) (*ast
 	}
 
 	// Failed, and out of options.
+	opt.tracef("parse: %s", err)
 	return nil, nil, err
 }
 
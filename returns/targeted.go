@@ -0,0 +1,111 @@
+package returns
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// targetedImporter returns an importer for the dependencies of pkg
+// that only imports those the fixers might need type info from when
+// fixing targets (some of pkgFiles): the others are replaced by empty
+// packages, so that they aren't read or typechecked from source, and
+// the code using them (which isn't being fixed) just has no type info.
+func targetedImporter(fset *token.FileSet, ov overlay, pkg *packages.Package, pkgFiles, targets []*ast.File, opt *Options) types.Importer {
+	used := usedImports(pkg, pkgFiles, targets, opt)
+	stubs := map[string]*types.Package{}
+	for path, p := range pkg.Imports {
+		if !used[path] {
+			stubs[path] = types.NewPackage(p.PkgPath, p.Name)
+			stubs[path].MarkComplete()
+		}
+	}
+	opt.tracef("load: %d of %s used by the returns to fix", len(pkg.Imports)-len(stubs), plural(len(pkg.Imports), "import"))
+	return stubImporter{packageImporter(fset, ov, pkg, opt), stubs}
+}
+
+// A stubImporter imports the packages in its map (by import path) as
+// they are, and others with its importer.
+type stubImporter struct {
+	imp   types.Importer
+	stubs map[string]*types.Package
+}
+
+func (imp stubImporter) Import(path string) (*types.Package, error) {
+	if p, ok := imp.stubs[path]; ok {
+		return p, nil
+	}
+	return imp.imp.Import(path)
+}
+
+// usedImports returns the set of import paths (as written in the files)
+// of pkg that the fixers might need type info from when fixing targets:
+// those referenced by pkgFiles outside of function bodies, which
+// declare the package's types and signatures, and by the bodies of the
+// functions in targets that needsTypes flags. (moveErrorsLast updates
+// calls anywhere in a file, so all of its bodies count if it has
+// misplaced errors.)
+func usedImports(pkg *packages.Package, pkgFiles, targets []*ast.File, opt *Options) map[string]bool {
+	isTarget := map[*ast.File]bool{}
+	for _, f := range targets {
+		isTarget[f] = true
+	}
+	enabled, _ := opt.enabledFixes()
+	used := map[string]bool{}
+	for _, f := range pkgFiles {
+		names := map[string]string{} // name in f -> import path
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			var name string
+			switch {
+			case spec.Name != nil:
+				name = spec.Name.Name
+			case pkg.Imports[path] != nil:
+				name = pkg.Imports[path].Name
+			}
+			if name == "" || name == "." {
+				used[path] = true // can't tell where it's used
+				continue
+			}
+			names[name] = path
+		}
+		allBodies := isTarget[f] && enabled["errlast"] && hasMisplacedErrors(f)
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil {
+				markImports(decl, names, used)
+				continue
+			}
+			if isTarget[f] && (allBodies || needsTypes(&ast.File{Name: f.Name, Decls: []ast.Decl{fn}}, opt)) {
+				markImports(fn, names, used)
+				continue
+			}
+			if fn.Recv != nil {
+				markImports(fn.Recv, names, used)
+			}
+			markImports(fn.Type, names, used)
+		}
+	}
+	return used
+}
+
+// markImports adds to used the paths of the imports (by name in names)
+// that node refers to.
+func markImports(node ast.Node, names map[string]string, used map[string]bool) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && id.Obj == nil {
+				if path, ok := names[id.Name]; ok {
+					used[path] = true
+				}
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,122 @@
+package returns
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// isTerminating reports whether s is a terminating statement, as
+// defined by "Terminating statements" in the Go spec. Calls to panic
+// are recognized syntactically (a shadowed panic isn't detected).
+func isTerminating(s ast.Stmt) bool {
+	return isTerminatingLabeled(s, "")
+}
+
+func isTerminatingLabeled(s ast.Stmt, label string) bool {
+	switch s := s.(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.BranchStmt:
+		return s.Tok == token.GOTO || s.Tok == token.FALLTHROUGH
+	case *ast.ExprStmt:
+		if call, ok := s.X.(*ast.CallExpr); ok {
+			if id, ok := call.Fun.(*ast.Ident); ok && id.Name == "panic" {
+				return true
+			}
+		}
+	case *ast.BlockStmt:
+		return isTerminatingList(s.List)
+	case *ast.IfStmt:
+		return s.Else != nil && isTerminating(s.Body) && isTerminating(s.Else)
+	case *ast.ForStmt:
+		return s.Cond == nil && !hasBreak(s.Body, label)
+	case *ast.LabeledStmt:
+		return isTerminatingLabeled(s.Stmt, s.Label.Name)
+	case *ast.SwitchStmt:
+		return clausesTerminate(s.Body, label, true)
+	case *ast.TypeSwitchStmt:
+		return clausesTerminate(s.Body, label, true)
+	case *ast.SelectStmt:
+		return clausesTerminate(s.Body, label, false)
+	}
+	return false
+}
+
+func isTerminatingList(list []ast.Stmt) bool {
+	// Trailing empty statements are permitted.
+	for len(list) > 0 {
+		if _, ok := list[len(list)-1].(*ast.EmptyStmt); !ok {
+			break
+		}
+		list = list[:len(list)-1]
+	}
+	return len(list) > 0 && isTerminating(list[len(list)-1])
+}
+
+// clausesTerminate reports whether the switch or select statement with
+// the given body is terminating: there are no breaks referring to it,
+// every clause's statement list is terminating, and (for switches) there
+// is a default case.
+func clausesTerminate(body *ast.BlockStmt, label string, needDefault bool) bool {
+	hasDefault := false
+	for _, s := range body.List {
+		var list []ast.Stmt
+		switch c := s.(type) {
+		case *ast.CaseClause:
+			list = c.Body
+			hasDefault = hasDefault || c.List == nil
+		case *ast.CommClause:
+			list = c.Body
+		}
+		if !isTerminatingList(list) || hasBreakList(list, label) {
+			return false
+		}
+	}
+	return hasDefault || !needDefault
+}
+
+// hasBreak reports whether body contains a break statement referring to
+// the enclosing statement (the one labeled label, if label is not "").
+func hasBreak(body *ast.BlockStmt, label string) bool {
+	return hasBreakList(body.List, label)
+}
+
+func hasBreakList(list []ast.Stmt, label string) bool {
+	found := false
+	for _, s := range list {
+		ast.Inspect(s, func(n ast.Node) bool {
+			if found {
+				return false
+			}
+			switch n := n.(type) {
+			case *ast.BranchStmt:
+				if n.Tok == token.BREAK && (n.Label == nil || n.Label.Name == label) {
+					found = true
+				}
+			case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+				// Unlabeled breaks inside refer to the nested statement.
+				if label != "" {
+					found = hasLabeledBreak(n, label)
+				}
+				return false
+			case *ast.FuncLit:
+				return false
+			}
+			return true
+		})
+	}
+	return found
+}
+
+// hasLabeledBreak reports whether n contains "break label".
+func hasLabeledBreak(n ast.Node, label string) bool {
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		if b, ok := n.(*ast.BranchStmt); ok && b.Tok == token.BREAK && b.Label != nil && b.Label.Name == label {
+			found = true
+		}
+		_, isLit := n.(*ast.FuncLit)
+		return !found && !isLit
+	})
+	return found
+}
@@ -0,0 +1,79 @@
+package returns
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// workspaceEnv returns the environment (nil meaning the process's) for
+// running the go command in dir, adjusted if dir is in a go.work
+// workspace: the go command refuses to load packages in workspace mode
+// if GOFLAGS has -mod=mod (as is commonly set for single-module work),
+// so the flag is removed.
+func workspaceEnv(dir string, env []string, opt *Options) []string {
+	work := goWork(dir, env)
+	if work == "" {
+		return env
+	}
+	cmd := exec.Command("go", "env", "GOFLAGS")
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		return env
+	}
+	var flags []string
+	removed := false
+	for _, flag := range strings.Fields(string(out)) {
+		if flag == "-mod=mod" || flag == "--mod=mod" {
+			removed = true
+			continue
+		}
+		flags = append(flags, flag)
+	}
+	if !removed {
+		return env
+	}
+	opt.tracef("load: in workspace %s; ignoring -mod=mod in GOFLAGS", work)
+	if env == nil {
+		env = os.Environ()
+	}
+	return append(env, "GOFLAGS="+strings.Join(flags, " "))
+}
+
+// goWork returns the go.work file that the go command uses in dir (or
+// the current directory, if dir is empty): $GOWORK, or else the first
+// go.work in dir or its parents. It returns "" if there is none or
+// workspace mode is off.
+func goWork(dir string, env []string) string {
+	if env == nil {
+		env = os.Environ()
+	}
+	gowork := ""
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "GOWORK=") {
+			gowork = strings.TrimPrefix(kv, "GOWORK=") // the last setting wins
+		}
+	}
+	switch gowork {
+	case "off":
+		return ""
+	case "":
+	default:
+		return gowork
+	}
+	dir = absPath(dir)
+	for {
+		name := filepath.Join(dir, "go.work")
+		if fi, err := os.Stat(name); err == nil && !fi.IsDir() {
+			return name
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+)
+
+// selfUpdateMain implements "goreturns self-update", which replaces the
+// running binary with the latest release built for this platform.
+//
+// Releases are expected to have an asset named goreturns_GOOS_GOARCH
+// (plus ".exe" on Windows) and a checksums.txt asset in the format
+// written by sha256sum. The download is verified against the checksum
+// before it replaces the current executable. The checksum comes from
+// the same release, so it catches corrupted downloads, not tampered
+// releases; there's no signature to check.
+func selfUpdateMain(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	checkOnly := fs.Bool("check", false, "only report whether a newer release is available")
+	releaseURL := fs.String("url", "https://api.github.com/repos/sqs/goreturns/releases/latest", "GitHub API `url` of the release to install")
+	timeout := fs.Duration("timeout", 5*time.Minute, "give up on each download after `duration`")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: goreturns self-update [-check] [-timeout duration] [-url url]\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "The download is only checked against the release's checksums.txt, which\n")
+		fmt.Fprintf(os.Stderr, "catches corruption but not a tampered release: no signature is verified.\n")
+	}
+	fs.Parse(args)
+	httpClient.Timeout = *timeout
+
+	rel, err := fetchRelease(*releaseURL)
+	if err != nil {
+		report(err)
+		return
+	}
+	if !semver.IsValid(rel.TagName) {
+		report(fmt.Errorf("self-update: the release's tag %q isn't a semantic version", rel.TagName))
+		return
+	}
+	// A development build, whose version is "(devel)", is replaced by
+	// any release.
+	current := moduleVersion()
+	if semver.IsValid(current) {
+		switch c := semver.Compare(current, rel.TagName); {
+		case c == 0:
+			fmt.Printf("goreturns %s is up to date\n", current)
+			return
+		case c > 0:
+			fmt.Printf("goreturns %s is newer than the latest release, %s; not downgrading\n", current, rel.TagName)
+			return
+		}
+	}
+	if *checkOnly {
+		fmt.Printf("goreturns %s is available (current version: %s)\n", rel.TagName, current)
+		return
+	}
+
+	if err := selfUpdate(rel); err != nil {
+		report(fmt.Errorf("self-update: %s", err))
+		return
+	}
+	fmt.Printf("updated goreturns %s -> %s\n", current, rel.TagName)
+}
+
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *release) assetURL(name string) (string, error) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, nil
+		}
+	}
+	return "", fmt.Errorf("release %s has no asset %q", r.TagName, name)
+}
+
+func fetchRelease(url string) (*release, error) {
+	data, err := download(url)
+	if err != nil {
+		return nil, err
+	}
+	var rel release
+	if err := json.Unmarshal(data, &rel); err != nil {
+		return nil, fmt.Errorf("decoding release from %s: %s", url, err)
+	}
+	return &rel, nil
+}
+
+func selfUpdate(rel *release) error {
+	name := fmt.Sprintf("goreturns_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	binURL, err := rel.assetURL(name)
+	if err != nil {
+		return err
+	}
+	sumsURL, err := rel.assetURL("checksums.txt")
+	if err != nil {
+		return err
+	}
+
+	sums, err := download(sumsURL)
+	if err != nil {
+		return err
+	}
+	want, err := findChecksum(sums, name)
+	if err != nil {
+		return err
+	}
+	bin, err := download(binURL)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(bin)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", name, got, want)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	return replaceExecutable(exe, bin)
+}
+
+// findChecksum returns the hex SHA-256 checksum of name listed in sums
+// (in sha256sum's output format).
+func findChecksum(sums []byte, name string) (string, error) {
+	s := bufio.NewScanner(bytes.NewReader(sums))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// replaceExecutable atomically replaces the file exe with data, by
+// writing data to a temporary file in the same directory and renaming
+// it over exe.
+func replaceExecutable(exe string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(exe), ".goreturns-update")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op after a successful rename
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// A running executable can't be replaced on Windows, but it
+		// can be renamed out of the way.
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, exe)
+}
+
+// httpClient is the client of the downloads, whose timeout is set by
+// self-update's -timeout flag.
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+func download(url string) ([]byte, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 256<<20))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var staged = flag.Bool("staged", false, "fix the Go files staged in git as they are in the index (which may differ from the working tree), and with -w, stage the results (writing them to the working tree too, for files without unstaged changes)")
+
+// A stagedFile is a Go file staged in the git index.
+type stagedFile struct {
+	name  string // relative to the root of the repository, with slashes
+	path  string // absolute
+	mode  string // as in the index, e.g. "100644"
+	dirty bool   // whether the working tree's version differs from the index's
+}
+
+// stagedResults holds the results of fixing the staged files with -w,
+// by absolute path, to be written to the index instead of to the files.
+var stagedResults map[string][]byte
+
+// processStaged fixes the staged Go files as they are in the index,
+// with the index's versions overlaid on the files on disk (see
+// returns.Options.Overlay) so that the packages are typechecked as
+// they'll be committed. With -w, each changed file is staged through
+// the index, so that unstaged changes to it stay unstaged, and written
+// to the working tree as well if the working tree's version is the
+// index's.
+func processStaged() error {
+	root, files, err := indexGoFiles()
+	if err != nil {
+		return err
+	}
+	if options.Overlay == nil {
+		options.Overlay = make(map[string][]byte, len(files))
+	}
+	var dirs []string
+	byDir := map[string][]string{}
+	for _, f := range files {
+		data, err := command("git", "-C", root, "cat-file", "blob", ":"+f.name)
+		if err != nil {
+			return err
+		}
+		options.Overlay[f.path] = data
+		dir := filepath.Dir(f.path)
+		if byDir[dir] == nil {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], f.path)
+	}
+
+	if *write {
+		stagedResults = map[string][]byte{}
+	}
+	for _, dir := range dirs {
+		if isInterrupted() {
+			return nil
+		}
+		processFiles(dir, byDir[dir])
+	}
+	queue.wait()
+	for _, f := range files {
+		res, ok := stagedResults[f.path]
+		if !ok {
+			continue
+		}
+		hash, err := commandInput(res, "git", "-C", root, "hash-object", "-w", "--no-filters", "--stdin")
+		if err != nil {
+			return err
+		}
+		cacheinfo := fmt.Sprintf("%s,%s,%s", f.mode, bytes.TrimSpace(hash), f.name)
+		if _, err := command("git", "-C", root, "update-index", "--cacheinfo", cacheinfo); err != nil {
+			return err
+		}
+		if !f.dirty {
+			if err := writer.write(f.path, res); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexGoFiles returns the root of the git repository containing the
+// current directory and the Go files added or modified in its index.
+func indexGoFiles() (string, []stagedFile, error) {
+	out, err := command("git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", nil, err
+	}
+	root := strings.TrimSpace(string(out))
+	names, err := command("git", "-C", root, "diff", "--cached", "--name-only", "--diff-filter=ACMR", "-z", "--", "*.go")
+	if err != nil {
+		return "", nil, err
+	}
+	if len(names) == 0 {
+		return root, nil, nil
+	}
+	unstaged, err := command("git", "-C", root, "diff", "--name-only", "-z")
+	if err != nil {
+		return "", nil, err
+	}
+	dirty := map[string]bool{}
+	for _, name := range splitNul(unstaged) {
+		dirty[name] = true
+	}
+	// "mode hash stage\tname" for each file
+	entries, err := command("git", append([]string{"--literal-pathspecs", "-C", root, "ls-files", "--stage", "-z", "--"}, splitNul(names)...)...)
+	if err != nil {
+		return "", nil, err
+	}
+	var files []stagedFile
+	for _, e := range splitNul(entries) {
+		i := strings.IndexByte(e, '\t')
+		if i < 0 || len(strings.Fields(e[:i])) != 3 {
+			return "", nil, fmt.Errorf("git ls-files: unexpected output %q", e)
+		}
+		name := e[i+1:]
+		files = append(files, stagedFile{
+			name:  name,
+			path:  filepath.Join(root, filepath.FromSlash(name)),
+			mode:  strings.Fields(e)[0],
+			dirty: dirty[name],
+		})
+	}
+	return root, files, nil
+}
+
+// checkStaged reports an error if -staged can't be combined with the
+// other flags or the arguments.
+func checkStaged(paths []string) error {
+	if *modified || *watch || *txtarMode || refactoring() || *changedVCS != "" || *diffFile != "" || *diffBase != "" || *journalTo != "" || len(paths) > 0 {
+		return errors.New("-staged finds its files in the git index; it can't be combined with -modified, -watch, -txtar, -add-result, -remove-result, -changed, -diff-file, -diff-base, -journal, or path arguments")
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+var (
+	printStats = flag.Bool("stats", false, "when done, print statistics (including per-file, per-phase timings) as JSON to stderr")
+	summary    = flag.String("summary", "", "when done, print to stderr, in `format` text or json, the number of files scanned and changed, of returns fixed by each fixer, and of returns skipped for lack of type information")
+)
+
+// runStats are the statistics printed by -stats.
+type runStats struct {
+	Files []fileStats `json:"files"`
+	Total phaseTimes  `json:"total"`
+}
+
+type fileStats struct {
+	File  string     `json:"file"`
+	Times phaseTimes `json:"times"`
+}
+
+// phaseTimes are the times spent in each phase of processing, in
+// milliseconds.
+type phaseTimes struct {
+	Imports      float64 `json:"importsMs"`
+	Parse        float64 `json:"parseMs"`
+	SiblingParse float64 `json:"siblingParseMs"`
+	Typecheck    float64 `json:"typecheckMs"`
+	Fix          float64 `json:"fixMs"`
+	Print        float64 `json:"printMs"`
+	Total        float64 `json:"totalMs"`
+}
+
+func (t *phaseTimes) add(u phaseTimes) {
+	t.Imports += u.Imports
+	t.Parse += u.Parse
+	t.SiblingParse += u.SiblingParse
+	t.Typecheck += u.Typecheck
+	t.Fix += u.Fix
+	t.Print += u.Print
+	t.Total += u.Total
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+var (
+	stats   runStats
+	statsMu sync.Mutex // guards stats, which are recorded concurrently (see -jobs)
+)
+
+// recordFileStats records the statistics for processing filename.
+func recordFileStats(filename string, imports, total time.Duration, tm *returns.Timing) {
+	t := phaseTimes{
+		Imports:      ms(imports),
+		Parse:        ms(tm.Parse),
+		SiblingParse: ms(tm.SiblingParse),
+		Typecheck:    ms(tm.Typecheck),
+		Fix:          ms(tm.Fix),
+		Print:        ms(tm.Print),
+		Total:        ms(total),
+	}
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats.Files = append(stats.Files, fileStats{File: filename, Times: t})
+	stats.Total.add(t)
+}
+
+func writeStats() {
+	enc := json.NewEncoder(os.Stderr)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(stats); err != nil {
+		report(err)
+	}
+}
+
+// runSummary holds the counts printed by -summary.
+type runSummary struct {
+	FilesScanned      int `json:"filesScanned"`
+	FilesChanged      int `json:"filesChanged"`
+	ZeroFilled        int `json:"returnsZeroFilled"`
+	BareExpanded      int `json:"bareReturnsExpanded"`
+	MissingReturns    int `json:"missingReturnsAdded"`
+	SkippedNoTypeInfo int `json:"skippedForLackOfTypeInfo"`
+}
+
+var counts runSummary // recorded by finish, which runs for one file at a time
+
+func checkSummary() error {
+	switch *summary {
+	case "":
+		return nil
+	case "text", "json":
+		if *lint {
+			return errors.New("-summary can't be combined with -lint")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid -summary %q (want text or json)", *summary)
+}
+
+// countFile adds a file, which fixing changed or not, and the decisions
+// made in fixing it to counts.
+func countFile(changed bool, decisions []returns.Diagnostic) {
+	counts.FilesScanned++
+	if changed {
+		counts.FilesChanged++
+	}
+	for _, d := range decisions {
+		switch {
+		case d.NoTypeInfo:
+			counts.SkippedNoTypeInfo++
+		case !strings.HasPrefix(d.Message, "fixed: "):
+		case d.Category == "zero":
+			counts.ZeroFilled++
+		case d.Category == "bare":
+			counts.BareExpanded++
+		case d.Category == "missing-return":
+			counts.MissingReturns++
+		}
+	}
+}
+
+func writeSummary() {
+	if *summary == "json" {
+		if err := json.NewEncoder(os.Stderr).Encode(counts); err != nil {
+			report(err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s scanned, %d changed\n", plural(counts.FilesScanned, "file"), counts.FilesChanged)
+	fmt.Fprintf(os.Stderr, "%s zero-filled, %s expanded, %s added\n", plural(counts.ZeroFilled, "return"), plural(counts.BareExpanded, "bare return"), plural(counts.MissingReturns, "missing return"))
+	fmt.Fprintf(os.Stderr, "%s skipped for lack of type information\n", plural(counts.SkippedNoTypeInfo, "return"))
+}
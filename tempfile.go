@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Temporary files created while rewriting a file are named
+// tempPrefix+base+tempSuffix and live next to the file, so that the
+// final rename is atomic. The name is deterministic so that "goreturns
+// clean" can find files left behind by a crash.
+const (
+	tempPrefix = ".goreturns-"
+	tempSuffix = ".tmp"
+)
+
+// tempFiles is the set of temporary files that currently exist and
+// must be removed if goreturns is killed or panics.
+var tempFiles = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+// tempFileFor returns the name of the temporary file used when
+// rewriting filename.
+func tempFileFor(filename string) string {
+	return filepath.Join(filepath.Dir(filename), tempPrefix+filepath.Base(filename)+tempSuffix)
+}
+
+func isTempFile(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, tempPrefix) && strings.HasSuffix(base, tempSuffix)
+}
+
+// createTemp creates (or truncates) the temporary file name and
+// registers it for cleanup.
+func createTemp(name string, perm os.FileMode) (*os.File, error) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	tempFiles.m[name] = true
+	return f, nil
+}
+
+// forgetTemp unregisters the temporary file name, removing it unless it
+// was renamed into place.
+func forgetTemp(name string, remove bool) {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	if remove {
+		os.Remove(name)
+	}
+	delete(tempFiles.m, name)
+}
+
+// cleanupTempFiles removes all registered temporary files.
+func cleanupTempFiles() {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+	for name := range tempFiles.m {
+		os.Remove(name)
+		delete(tempFiles.m, name)
+	}
+}
+
+// cleanMain implements "goreturns clean [dir ...]", which removes
+// temporary files left behind by goreturns processes that crashed.
+func cleanMain(args []string) {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	for _, dir := range args {
+		err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				report(err)
+				return nil
+			}
+			if fi.Mode().IsRegular() && isTempFile(path) {
+				if err := os.Remove(path); err != nil {
+					report(err)
+				} else {
+					fmt.Println("removed", path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			report(err)
+		}
+	}
+}
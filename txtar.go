@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/txtar"
+)
+
+var txtarMode = flag.Bool("txtar", false, "read a txtar archive from standard input, fix its Go files as if they were at their paths (relative to the current directory, or in a module of their own if the archive has a go.mod) with the archive's other files beside them, and write an archive of the results to standard output")
+
+// txtarResults holds the results of processing the Go files of the
+// -txtar archive, by name.
+var txtarResults map[string][]byte
+
+// processTxtar processes the Go files in the txtar archive read from in,
+// a directory at a time, with all of the archive's files overlaid on
+// the files on disk (see returns.Options.Overlay) so that they're
+// typechecked together. An archive that is a module of its own (see
+// isModule) is instead extracted to a temporary directory, so that its
+// packages can import each other. Unless another flag says what to
+// print, it writes the archive to out with the Go files replaced by the
+// results.
+func processTxtar(in io.Reader, out io.Writer) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	ar := txtar.Parse(data)
+	if isModule(ar) {
+		// The go command only finds modules on disk.
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir, err := extractTxtar(ar)
+		defer os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+		defer os.Chdir(cwd)
+	} else {
+		if options.Overlay == nil {
+			options.Overlay = make(map[string][]byte, len(ar.Files))
+		}
+		for _, f := range ar.Files {
+			options.Overlay[absPath(f.Name)] = f.Data
+		}
+	}
+
+	var dirs []string
+	files := map[string][]string{}
+	for _, f := range ar.Files {
+		if !strings.HasSuffix(f.Name, ".go") {
+			continue
+		}
+		dir := filepath.Dir(f.Name)
+		if files[dir] == nil {
+			dirs = append(dirs, dir)
+		}
+		files[dir] = append(files[dir], f.Name)
+	}
+
+	txtarResults = map[string][]byte{}
+	for _, dir := range dirs {
+		if isInterrupted() {
+			return nil
+		}
+		processFiles(dir, files[dir])
+	}
+	queue.wait()
+	if *list || *doDiff || *check || jsonOutput() {
+		return nil // already printed
+	}
+	for i, f := range ar.Files {
+		if res, ok := txtarResults[f.Name]; ok {
+			ar.Files[i].Data = res
+		}
+	}
+	_, err = out.Write(txtar.Format(ar))
+	return err
+}
+
+// isModule reports whether ar has a go.mod file at its root.
+func isModule(ar *txtar.Archive) bool {
+	for _, f := range ar.Files {
+		if filepath.Clean(f.Name) == "go.mod" {
+			return true
+		}
+	}
+	return false
+}
+
+// extractTxtar writes the files of ar to a new temporary directory and
+// returns its name.
+func extractTxtar(ar *txtar.Archive) (string, error) {
+	dir, err := ioutil.TempDir("", "goreturns-txtar")
+	if err != nil {
+		return "", err
+	}
+	for _, f := range ar.Files {
+		name := filepath.Clean(filepath.FromSlash(f.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return dir, fmt.Errorf("-txtar: file %s is outside of the archive's module", f.Name)
+		}
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return dir, err
+		}
+		if err := ioutil.WriteFile(name, f.Data, 0644); err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
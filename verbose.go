@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+var verbose = flag.Bool("v", false, "log to stderr how each file is processed: which of its package's files were parsed, whether type information was available, and why each return was or wasn't fixed")
+
+// A traceWriter writes the -v log of a file (or of loading a directory's
+// packages) to stderr, prefixing each line with the name. Lines are
+// written whole, so those of files processed concurrently (see -jobs)
+// don't mix.
+type traceWriter struct{ name string }
+
+var traceMu sync.Mutex
+
+func (w traceWriter) Write(p []byte) (int, error) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) > 0 {
+			fmt.Fprintf(os.Stderr, "%s: %s", w.name, line)
+		}
+	}
+	return len(p), nil
+}
+
+// traced returns opt, or with -v, a copy of opt that logs to a
+// traceWriter for name.
+func traced(opt *returns.Options, name string) *returns.Options {
+	if !*verbose {
+		return opt
+	}
+	nopt := *opt
+	nopt.Trace = traceWriter{name}
+	return &nopt
+}
+
+// tracef logs to the -v log of opt, if any.
+func tracef(opt *returns.Options, format string, args ...interface{}) {
+	if opt.Trace != nil {
+		fmt.Fprintf(opt.Trace, format+"\n", args...)
+	}
+}
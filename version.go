@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/build"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+var printVersion = flag.Bool("version", false, "print goreturns's version, the revision it was built from, and the Go toolchain that built it, and exit (\"goreturns version -json\" also lists the supported features)")
+
+// versionInfo describes this build of goreturns and its capabilities,
+// for editor plugins and CI to check before relying on newer features.
+type versionInfo struct {
+	Version      string            `json:"version"`                // module version, or "(devel)"
+	Revision     string            `json:"revision,omitempty"`     // VCS revision goreturns was built from, if known
+	RevisionTime string            `json:"revisionTime,omitempty"` // time of the revision, in RFC 3339 format
+	Modified     bool              `json:"modified,omitempty"`     // whether the working tree had uncommitted changes
+	GoVersion    string            `json:"goVersion"`              // Go toolchain that built goreturns
+	LangVersion  string            `json:"langVersion"`            // newest Go language version goreturns can parse
+	Rules        []ruleInfo        `json:"rules"`                  // return-fixing rules, in the order they run
+	Protocols    map[string]string `json:"protocols"`              // versions of the file formats and protocols goreturns speaks
+	Flags        []string          `json:"flags"`                  // names of the supported command-line flags, sorted
+}
+
+type ruleInfo struct {
+	Name    string `json:"name"`    // name accepted by -fix
+	Doc     string `json:"doc"`     // what the rule does
+	Enabled bool   `json:"enabled"` // whether the rule is enabled by default
+}
+
+func getVersionInfo() versionInfo {
+	v := versionInfo{
+		Version:   moduleVersion(),
+		GoVersion: runtime.Version(),
+		Protocols: map[string]string{
+			"journal": journalHeader,
+			"json":    jsonOutputVersion,
+		},
+	}
+	names, docs := returns.Fixers()
+	for i, name := range names {
+		v.Rules = append(v.Rules, ruleInfo{
+			Name:    name,
+			Doc:     docs[i],
+			Enabled: enabledFix(returns.DefaultFixes, name),
+		})
+	}
+	if tags := build.Default.ReleaseTags; len(tags) > 0 {
+		v.LangVersion = tags[len(tags)-1]
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		v.Revision, v.RevisionTime, v.Modified = vcsInfo(bi)
+	}
+	flag.VisitAll(func(f *flag.Flag) { v.Flags = append(v.Flags, f.Name) })
+	return v
+}
+
+// moduleVersion returns the version of the goreturns module that was
+// built, or "(devel)".
+func moduleVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "(devel)"
+}
+
+// versionMain implements "goreturns version [-json]".
+func versionMain(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print version and feature information as JSON")
+	fs.Parse(args)
+	printVersionInfo(*asJSON)
+}
+
+// printVersionInfo prints the version information to standard output,
+// as JSON if asJSON is set.
+func printVersionInfo(asJSON bool) {
+	v := getVersionInfo()
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(v); err != nil {
+			report(err)
+		}
+		return
+	}
+	fmt.Printf("goreturns %s (built with %s, supports Go language %s)\n", v.Version, v.GoVersion, v.LangVersion)
+	if v.Revision != "" {
+		modified := ""
+		if v.Modified {
+			modified = ", with uncommitted changes"
+		}
+		fmt.Printf("revision %s (%s%s)\n", v.Revision, v.RevisionTime, modified)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var watch = flag.Bool("watch", false, "watch the directories (and files) given as arguments, and process Go files as they change, until interrupted; requires -w, -l, -d, or -lint")
+
+// watchSettle is how long to wait for more changes after a file
+// changes, so that a save that takes several writes (or a checkout that
+// changes many files) is processed once.
+const watchSettle = 100 * time.Millisecond
+
+// watchPaths processes the Go files in paths (directories, walked as
+// by walkDir, or files) whenever they change, until interrupted. The
+// changed files are processed a directory at a time, so that each
+// package is loaded once per change; the export data cache (see -cache)
+// keeps the dependencies' type information between changes.
+func watchPaths(paths []string) error {
+	if !*write && !*list && !*doDiff && !*lint {
+		return errors.New("-watch requires -w, -l, -d, or -lint")
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	files := map[string]bool{}   // files given as arguments, watched in their directories
+	roots := map[string]string{} // the root of the tree of each directory watched in one
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			files[filepath.Clean(path)] = true
+			if err := w.Add(filepath.Dir(path)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := watchTree(w, roots, path, path); err != nil {
+			return err
+		}
+	}
+
+	// wrote holds the contents last written to each file, so that
+	// the change made by -w isn't processed again.
+	wrote := map[string][]byte{}
+	changed := map[string]bool{}
+	var settle <-chan time.Time
+	tick := time.NewTicker(200 * time.Millisecond) // to notice interrupts
+	defer tick.Stop()
+	for {
+		select {
+		case ev := <-w.Events:
+			name := filepath.Clean(ev.Name)
+			if ev.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(name); err == nil && fi.IsDir() && len(files) == 0 {
+					if root, ok := roots[filepath.Dir(name)]; ok {
+						if err := watchTree(w, roots, root, name); err != nil {
+							report(err)
+						}
+					}
+					continue
+				}
+			}
+			if ev.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 || !strings.HasSuffix(name, ".go") || strings.HasPrefix(filepath.Base(name), ".") {
+				continue
+			}
+			if len(files) > 0 && !files[name] {
+				continue
+			}
+			if excludedByConfig(name) {
+				continue
+			}
+			if root, ok := roots[filepath.Dir(name)]; ok {
+				if rel, err := filepath.Rel(root, name); err == nil && isExcluded(rel) {
+					continue
+				}
+			}
+			changed[name] = true
+			settle = time.After(watchSettle)
+		case err := <-w.Errors:
+			report(err)
+		case <-settle:
+			dropIgnored(changed, roots)
+			processChanged(changed, wrote)
+			changed = map[string]bool{}
+		case <-tick.C:
+			if isInterrupted() {
+				return nil
+			}
+		}
+	}
+}
+
+// watchTree adds the directories in the tree rooted at dir, which is
+// root or a directory in its tree, to w, skipping those that walkDir
+// skips when walking root, and records their root in roots.
+func watchTree(w *fsnotify.Watcher, roots map[string]string, root, dir string) error {
+	ignored := gitIgnored(root)
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return err
+		}
+		if path != root {
+			if isSkippedDir(fi.Name()) && !*walkAll || excludedByConfig(path) {
+				return filepath.SkipDir
+			}
+			if rel, err := filepath.Rel(root, path); err == nil && (isExcluded(rel) || ignored[filepath.ToSlash(rel)]) {
+				return filepath.SkipDir
+			}
+		}
+		roots[path] = root
+		return w.Add(path)
+	})
+}
+
+// dropIgnored removes from changed the files that git ignores (see
+// gitIgnored) in the trees of roots, as walkDir skips them. git is asked
+// again each time, for files created since the trees were first walked.
+func dropIgnored(changed map[string]bool, roots map[string]string) {
+	ignored := map[string]map[string]bool{} // by root
+	for name := range changed {
+		root, ok := roots[filepath.Dir(name)]
+		if !ok {
+			continue
+		}
+		if _, ok := ignored[root]; !ok {
+			ignored[root] = gitIgnored(root)
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			continue
+		}
+		// An ignored directory is listed instead of its files.
+		for rel = filepath.ToSlash(rel); rel != "."; rel = path.Dir(rel) {
+			if ignored[root][rel] {
+				delete(changed, name)
+				break
+			}
+		}
+	}
+}
+
+// processChanged processes the changed files that still exist and
+// aren't as goreturns last wrote them, a directory at a time, and
+// records what -w writes in wrote. The config files are read again
+// first if they've changed.
+func processChanged(changed map[string]bool, wrote map[string][]byte) {
+	if err := reloadConfig(); err != nil {
+		report(err)
+		return
+	}
+	byDir := map[string][]string{}
+	for name := range changed {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue // removed (or renamed) since
+		}
+		if last, ok := wrote[name]; ok && string(last) == string(data) {
+			continue
+		}
+		byDir[filepath.Dir(name)] = append(byDir[filepath.Dir(name)], name)
+	}
+	var dirs []string
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		sort.Strings(byDir[dir])
+		processFiles(dir, byDir[dir])
+	}
+	queue.wait()
+	if err := writer.flush(); err != nil {
+		report(err)
+	}
+	if *write {
+		for _, dir := range dirs {
+			for _, name := range byDir[dir] {
+				if data, err := ioutil.ReadFile(name); err == nil {
+					wrote[name] = data
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sqs/goreturns/returns"
+)
+
+// whyMain implements "goreturns why [flags] file.go", which runs the
+// usual processing of the file (with the given goreturns flags) without
+// writing anything and prints a trace of the decisions made, to explain
+// why the file was or wasn't changed.
+func whyMain(args []string) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		report(err)
+		return
+	}
+	if err := applyConfig(args); err != nil {
+		report(err)
+		return
+	}
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: goreturns why [flags] file.go\n")
+		os.Exit(exitError)
+	}
+	if err := setOptions(); err != nil {
+		report(err)
+		return
+	}
+	filename := flag.Arg(0)
+	if err := why(filepath.Dir(filename), filename); err != nil {
+		fmt.Printf("error: %s\n", err)
+		exitCode = exitError
+	}
+}
+
+func why(pkgDir, filename string) error {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	opt := *options
+	opt.Trace = os.Stdout
+
+	res := src
+	if useGoimports() {
+		if res, err = goimportsSource(filename, res, &opt); err != nil {
+			return fmt.Errorf("goimports: %s", err)
+		}
+		if bytes.Equal(src, res) {
+			fmt.Println("goimports: no changes")
+		} else {
+			fmt.Println("goimports: changed imports or formatting")
+		}
+	}
+
+	out, err := returns.Process(pkgDir, filename, res, &opt)
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.Equal(src, out):
+		fmt.Println("result: no changes")
+	case bytes.Equal(res, out):
+		fmt.Println("result: changed by goimports only")
+	default:
+		fmt.Println("result: changed (run with -d to see the diff)")
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	batchSize = flag.Int("batch", 1, "with -w, buffer up to `n` rewritten files in memory and write them together")
+	fsync     = flag.String("fsync", "never", "with -w, when to fsync rewritten files: never, batch (after each batch), or always (after each file)")
+	writeRate = flag.Float64("rate", 0, "with -w, write at most `n` files per second (0 means unlimited)")
+	journalTo = flag.String("journal", "", "with -w, record completed files in `file` so that an interrupted run can be continued with \"goreturns resume file\"")
+	backup    = flag.String("backup", "", "with -w, save the original of each rewritten file alongside it, named with `suffix` appended (e.g., \".orig\")")
+)
+
+// interrupted is set (to 1) when the process receives SIGINT or SIGTERM.
+// Processing stops at the next file boundary so that pending writes can
+// be flushed and the journal left consistent.
+var interrupted int32
+
+// handleInterrupts sets interrupted when the process is interrupted.
+// Only the first call has an effect.
+func handleInterrupts() {
+	interruptsOnce.Do(notifyInterrupts)
+}
+
+var interruptsOnce sync.Once
+
+func notifyInterrupts() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		atomic.StoreInt32(&interrupted, 1)
+		// A second signal exits immediately, after removing any
+		// temporary files and writing the profiles.
+		<-c
+		cleanupTempFiles()
+		stopProfiling()
+		os.Exit(exitError)
+	}()
+}
+
+func isInterrupted() bool {
+	return atomic.LoadInt32(&interrupted) != 0
+}
+
+// A fileWriter writes rewritten files back to disk. Writes are buffered
+// in batches, throttled to the configured rate, synced according to the
+// fsync policy, and recorded in the journal (if any) once durable.
+type fileWriter struct {
+	batchSize int
+	fsync     string
+	throttle  <-chan time.Time // nil if unlimited
+	journal   *journal         // nil if not journaling
+	backup    string           // suffix of the originals' backups, or "" for none
+
+	pending []pendingWrite
+	done    []string // completed files not yet recorded in the journal
+}
+
+type pendingWrite struct {
+	filename string
+	data     []byte
+}
+
+func newFileWriter(j *journal) (*fileWriter, error) {
+	switch *fsync {
+	case "never", "batch", "always":
+	default:
+		return nil, fmt.Errorf("invalid -fsync value %q (must be never, batch, or always)", *fsync)
+	}
+	w := &fileWriter{batchSize: *batchSize, fsync: *fsync, journal: j, backup: *backup}
+	if w.batchSize < 1 {
+		w.batchSize = 1
+	}
+	if *writeRate > 0 {
+		w.throttle = time.NewTicker(time.Duration(float64(time.Second) / *writeRate)).C
+	}
+	return w, nil
+}
+
+// write queues data to be written to filename.
+func (w *fileWriter) write(filename string, data []byte) error {
+	w.pending = append(w.pending, pendingWrite{filename, data})
+	w.done = append(w.done, filename)
+	if len(w.pending) >= w.batchSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// skip records that filename was processed and needs no write.
+func (w *fileWriter) skip(filename string) error {
+	w.done = append(w.done, filename)
+	if len(w.pending) == 0 {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush writes all pending files and records them in the journal. Each
+// file (the target of a symlink, rather than the link) is written to a
+// temporary file that is then renamed over the original, so an
+// interrupted write never leaves a truncated file, unless renaming would
+// break its other hard links or lose its owner; then it's written in
+// place.
+func (w *fileWriter) flush() error {
+	targets := make([]string, len(w.pending)) // the files written, with symlinks resolved
+	temps := make([]string, len(w.pending))   // temporary files, or "" to write in place
+	defer func() {
+		for _, tmp := range temps {
+			if tmp != "" {
+				forgetTemp(tmp, true) // no-op after a successful rename
+			}
+		}
+	}()
+	for i, p := range w.pending {
+		if w.throttle != nil {
+			<-w.throttle
+		}
+		target, err := filepath.EvalSymlinks(p.filename)
+		if err != nil {
+			return err
+		}
+		targets[i] = target
+		if temps[i], err = writeTemp(target, p.data, w.fsync == "always"); err != nil {
+			return err
+		}
+	}
+	if w.fsync == "batch" {
+		for _, tmp := range temps {
+			if tmp == "" {
+				continue // synced when written
+			}
+			if err := syncFile(tmp); err != nil {
+				return err
+			}
+		}
+	}
+	for i, p := range w.pending {
+		if w.backup != "" {
+			if err := backupFile(targets[i], p.filename+w.backup, temps[i] == ""); err != nil {
+				return err
+			}
+		}
+		var err error
+		if temps[i] == "" {
+			err = writeInPlace(targets[i], p.data, w.fsync != "never")
+		} else {
+			err = os.Rename(temps[i], targets[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.pending = w.pending[:0]
+
+	if w.journal != nil {
+		for _, filename := range w.done {
+			if err := w.journal.record(filename); err != nil {
+				return err
+			}
+		}
+		if err := w.journal.sync(); err != nil {
+			return err
+		}
+	}
+	w.done = w.done[:0]
+	return nil
+}
+
+// writeTemp writes data to the temporary file for filename, with
+// filename's permissions and owner, and returns the temporary file's
+// name. It returns "" if filename should be written in place instead:
+// if it has other hard links, or its owner can't be kept.
+func writeTemp(filename string, data []byte, sync bool) (string, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	if hardLinks(fi) > 1 {
+		return "", nil
+	}
+	tmp := tempFileFor(filename)
+	f, err := createTemp(tmp, fi.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	if !keepOwner(f, fi) {
+		f.Close()
+		forgetTemp(tmp, true)
+		return "", nil
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return tmp, err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return tmp, err
+		}
+	}
+	// Honor the original mode even if the umask masked it (and after
+	// the chown, which may clear the setuid and setgid bits).
+	if err := f.Chmod(fi.Mode().Perm()); err != nil {
+		f.Close()
+		return tmp, err
+	}
+	return tmp, f.Close()
+}
+
+// writeInPlace overwrites filename with data, syncing it if sync is
+// set.
+func writeInPlace(filename string, data []byte, sync bool) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// backupFile saves the contents of filename as backup, by linking it
+// unless inPlace is set (because filename is to be written in place) or
+// it can't be linked.
+func backupFile(filename, backup string, inPlace bool) error {
+	if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !inPlace && os.Link(filename, backup) == nil {
+		return nil
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(backup, data, fi.Mode().Perm())
+}
+
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+const journalHeader = "goreturns journal v1"
+
+// A journal records the files completed by a run of goreturns -w, so
+// that an interrupted run can be resumed without reprocessing them.
+//
+// The journal is a text file. The first line is journalHeader, the
+// second is "args " followed by the JSON-encoded command-line
+// arguments, and each following line is "done " followed by the path
+// of a completed file. A trailing partial line (from a crash while
+// appending) is ignored.
+type journal struct {
+	f    *os.File
+	done map[string]bool
+}
+
+// createJournal creates (or truncates) the journal file name for a run
+// with the given command-line arguments.
+func createJournal(name string, args []string) (*journal, error) {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{f: f, done: map[string]bool{}}
+	if _, err := fmt.Fprintf(f, "%s\nargs %s\n", journalHeader, argsJSON); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, j.sync()
+}
+
+// openJournal opens an existing journal for appending and returns it
+// along with the command-line arguments of the run that created it.
+func openJournal(name string) (*journal, []string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Ignore a partial last line.
+	if i := strings.LastIndexByte(string(data), '\n'); i >= 0 {
+		data = data[:i+1]
+	}
+	s := bufio.NewScanner(strings.NewReader(string(data)))
+	s.Buffer(nil, 1<<20)
+	if !s.Scan() || s.Text() != journalHeader {
+		return nil, nil, fmt.Errorf("%s: not a goreturns journal", name)
+	}
+	if !s.Scan() || !strings.HasPrefix(s.Text(), "args ") {
+		return nil, nil, fmt.Errorf("%s: missing args line", name)
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(s.Text(), "args ")), &args); err != nil {
+		return nil, nil, fmt.Errorf("%s: invalid args line: %s", name, err)
+	}
+	done := map[string]bool{}
+	for s.Scan() {
+		if filename := strings.TrimPrefix(s.Text(), "done "); filename != s.Text() {
+			done[filename] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// Truncate any partial last line before appending.
+	if err := os.Truncate(name, int64(len(data))); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &journal{f: f, done: done}, args, nil
+}
+
+// completed reports whether filename was recorded as done.
+func (j *journal) completed(filename string) bool {
+	return j.done[journalKey(filename)]
+}
+
+func (j *journal) record(filename string) error {
+	filename = journalKey(filename)
+	j.done[filename] = true
+	_, err := fmt.Fprintf(j.f, "done %s\n", filename)
+	return err
+}
+
+func (j *journal) sync() error {
+	if *fsync == "never" {
+		return nil
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+func journalKey(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filename
+}
+
+// resumeMain implements "goreturns resume journal", which reruns the
+// command recorded in the journal, skipping files it already completed.
+func resumeMain(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: goreturns resume journal\n")
+		os.Exit(exitError)
+	}
+	j, origArgs, err := openJournal(args[0])
+	if err != nil {
+		report(err)
+		return
+	}
+	if err := flag.CommandLine.Parse(origArgs); err != nil {
+		report(err)
+		return
+	}
+	if err := applyConfig(origArgs); err != nil {
+		report(err)
+		return
+	}
+	if !*write {
+		report(errors.New("journal was not recorded by a -w run"))
+		return
+	}
+	run(j, flag.Args())
+}
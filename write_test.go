@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileWriterLinks(t *testing.T) {
+	dir := writeTree(t, map[string]string{"a.go": "old a", "b.go": "old b"})
+	defer os.RemoveAll(dir)
+	name := func(base string) string { return filepath.Join(dir, base) }
+	if err := os.Symlink("a.go", name("link.go")); err != nil {
+		t.Skip(err) // e.g., without the privilege on Windows
+	}
+	if err := os.Link(name("b.go"), name("hard.go")); err != nil {
+		t.Skip(err)
+	}
+
+	w := &fileWriter{fsync: "never", backup: ".orig"}
+	w.pending = []pendingWrite{{name("link.go"), []byte("new a")}, {name("b.go"), []byte("new b")}}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Lstat(name("link.go")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("link.go is no longer a symlink (%v)", err)
+	}
+	for base, want := range map[string]string{
+		"a.go":         "new a", // through the symlink
+		"b.go":         "new b",
+		"hard.go":      "new b", // the same file as b.go
+		"link.go.orig": "old a",
+		"b.go.orig":    "old b",
+	} {
+		if data, err := ioutil.ReadFile(name(base)); err != nil {
+			t.Error(err)
+		} else if string(data) != want {
+			t.Errorf("%s: got %q, want %q", base, data, want)
+		}
+	}
+	if names, _ := filepath.Glob(name(tempPrefix + "*")); len(names) > 0 {
+		t.Errorf("temporary files left behind: %v", names)
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+func hardLinks(fi os.FileInfo) uint64 { return 1 }
+
+// keepOwner does nothing on Windows, where a new file inherits its
+// directory's permissions rather than having a mode and owner.
+func keepOwner(f *os.File, fi os.FileInfo) bool { return true }